@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIError is an error that is reported to API clients. Code identifies the
+// error for programs and does not change; Message is meant for people.
+type APIError struct {
+	Status  int                   `json:"-"`
+	Code    string                `json:"code"`
+	Message string                `json:"message"`
+	Fields  map[string]FieldError `json:"fields,omitempty"`
+}
+
+// FieldError describes what is wrong with one request parameter.
+type FieldError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiErrors holds the errors declared with newAPIError by their code.
+var apiErrors = make(map[string]*APIError)
+
+// newAPIError declares an error. It is only called to initialize package
+// variables, which keeps the codes unique.
+func newAPIError(status int, code, message string) *APIError {
+	if _, ok := apiErrors[code]; ok {
+		panic("duplicate API error code " + code)
+	}
+
+	err := &APIError{Status: status, Code: code, Message: message}
+	apiErrors[code] = err
+	return err
+}
+
+// withMessage returns a copy of the error with a more specific message.
+func (e *APIError) withMessage(message string) *APIError {
+	err := *e
+	err.Message = message
+	return &err
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// General API errors, for when nothing more specific applies
+var (
+	ErrBadRequest          = newAPIError(http.StatusBadRequest, "bad_request", "Bad request")
+	ErrInvalidJSON         = newAPIError(http.StatusBadRequest, "invalid_json", "Invalid JSON body")
+	ErrForbidden           = newAPIError(http.StatusForbidden, "forbidden", "Forbidden")
+	ErrInvalidCredentials  = newAPIError(http.StatusForbidden, "invalid_credentials", "Invalid email or password")
+	ErrNotFound            = newAPIError(http.StatusNotFound, "not_found", "Not found")
+	ErrMethodNotAllowed    = newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	ErrInternalServerError = newAPIError(http.StatusInternalServerError, "internal_error", "Internal server error")
+)
+
+// Errors for things that do not exist
+var (
+	ErrUserNotFound         = newAPIError(http.StatusNotFound, "user_not_found", "User not found")
+	ErrHoopNotFound         = newAPIError(http.StatusNotFound, "hoop_not_found", "Hoop not found")
+	ErrStoryNotFound        = newAPIError(http.StatusNotFound, "story_not_found", "Story not found")
+	ErrCommentNotFound      = newAPIError(http.StatusNotFound, "comment_not_found", "Comment not found")
+	ErrNotificationNotFound = newAPIError(http.StatusNotFound, "notification_not_found", "Notification not found")
+	ErrDeviceNotFound       = newAPIError(http.StatusNotFound, "device_not_found", "Device not found")
+	ErrJobNotFound          = newAPIError(http.StatusNotFound, "job_not_found", "Job not found")
+)
+
+// Errors for request parameters, reported with invalidField
+var (
+	ErrRequired     = newAPIError(http.StatusBadRequest, "required", "Required")
+	ErrInvalidValue = newAPIError(http.StatusBadRequest, "invalid", "Invalid value")
+	ErrTooShort     = newAPIError(http.StatusBadRequest, "too_short", "Too short")
+	ErrTooLong      = newAPIError(http.StatusBadRequest, "too_long", "Too long")
+	ErrOutOfRange   = newAPIError(http.StatusBadRequest, "out_of_range", "Out of range")
+	ErrReplyTooDeep = newAPIError(http.StatusBadRequest, "reply_too_deep", "Reply too deep")
+)
+
+// fieldErrors collects what is wrong with each request parameter, so that
+// all of them can be reported at once.
+type fieldErrors map[string]*APIError
+
+func (errs fieldErrors) add(field string, err *APIError) {
+	if _, ok := errs[field]; !ok {
+		errs[field] = err
+	}
+}
+
+// err returns the error reporting the fields, or nil if there are none.
+func (errs fieldErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(errs))
+	fields := make(map[string]FieldError, len(errs))
+	for name, err := range errs {
+		names = append(names, name)
+		fields[name] = FieldError{Code: err.Code, Message: err.Message}
+	}
+	sort.Strings(names)
+
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    "invalid_fields",
+		Message: "Invalid " + strings.Join(names, ", "),
+		Fields:  fields,
+	}
+}
+
+// invalidField returns the error for a single bad request parameter.
+func invalidField(field string, err *APIError) error {
+	return fieldErrors{field: err}.err()
+}
+
+type errorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+type dataResponse struct {
+	Data interface{} `json:"data"`
+}
+
+// writeError responds with the error. Errors that are not API errors are
+// logged and reported as internal errors, except for sql.ErrNoRows, which
+// means that what was asked for does not exist.
+func writeError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		if err == sql.ErrNoRows {
+			apiErr = ErrNotFound
+		} else {
+			log.Println(err)
+			apiErr = ErrInternalServerError
+		}
+	}
+
+	writeJSON(w, apiErr.Status, errorResponse{Error: apiErr})
+}
+
+// writeData responds with v as the data of the envelope.
+func writeData(w http.ResponseWriter, v interface{}) {
+	writeJSON(w, http.StatusOK, dataResponse{Data: v})
+}
+
+// writeOK responds to a request that succeeded with nothing to return.
+func writeOK(w http.ResponseWriter) {
+	writeData(w, nil)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -5,7 +5,17 @@ import (
 	"net/http"
 )
 
+// loggedIn resolves the user from an Authorization bearer token if one is
+// sent, and from the session cookie otherwise.
 func loggedIn(w http.ResponseWriter, r *http.Request, fetchUser bool) (bool, *User) {
+	if token, ok := bearerToken(r); ok {
+		userID, err := parseAccessToken(token)
+		if err != nil {
+			return false, nil
+		}
+		return userLoggedIn(userID, fetchUser)
+	}
+
 	session, err := ss.Get(r, "pinoyHoopsSession")
 	if err != nil {
 		log.Println(err)
@@ -15,7 +25,13 @@ func loggedIn(w http.ResponseWriter, r *http.Request, fetchUser bool) (bool, *Us
 	val := session.Values["userID"]
 	if userID, ok := val.(int64); !ok {
 		return false, nil
-	} else if exists, user := userExists(&User{ID: userID}, fetchUser); !exists {
+	} else {
+		return userLoggedIn(userID, fetchUser)
+	}
+}
+
+func userLoggedIn(userID int64, fetchUser bool) (bool, *User) {
+	if exists, user := store.Users.UserExists(&User{ID: userID}, fetchUser); !exists {
 		return false, nil
 	} else {
 		return true, user
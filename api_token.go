@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token lifetimes
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidToken = newAPIError(http.StatusForbidden, "invalid_token", "Invalid token")
+	ErrExpiredToken = newAPIError(http.StatusForbidden, "token_expired", "Token expired")
+)
+
+// Access tokens are HS256 JSON Web Tokens. The header never changes so it
+// is encoded once.
+var accessTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var accessTokenKey []byte
+
+type accessTokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// setAccessTokenKey sets the access token signing key. If secret is empty a
+// random key is used, so tokens do not survive a restart and are not
+// accepted by other server instances.
+func setAccessTokenKey(secret string) error {
+	if secret != "" {
+		accessTokenKey = []byte(secret)
+		return nil
+	}
+
+	accessTokenKey = make([]byte, 32)
+	_, err := rand.Read(accessTokenKey)
+	return err
+}
+
+func signAccessToken(userID int64, now time.Time) (string, error) {
+	claims, err := json.Marshal(accessTokenClaims{
+		Subject:   strconv.FormatInt(userID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := accessTokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + accessTokenSignature(payload), nil
+}
+
+func accessTokenSignature(payload string) string {
+	mac := hmac.New(sha256.New, accessTokenKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseAccessToken verifies the token and returns the user ID it was issued to.
+func parseAccessToken(token string) (int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != accessTokenHeader {
+		return 0, ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(accessTokenSignature(parts[0]+"."+parts[1]))) {
+		return 0, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	var claims accessTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return 0, ErrExpiredToken
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+
+	return userID, nil
+}
+
+// bearerToken returns the token from the Authorization header, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// hashRefreshToken returns the form refresh tokens are stored in, so that a
+// leaked table cannot be used to mint access tokens.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates a new access token and refresh token pair for the user.
+func issueTokens(userID int64) (*tokenResponse, error) {
+	now := time.Now()
+
+	accessToken, err := signAccessToken(userID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(b)
+
+	if err := store.Tokens.InsertRefreshToken(userID, hashRefreshToken(refreshToken), now.Add(RefreshTokenTTL)); err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(AccessTokenTTL / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// refreshTokens exchanges a refresh token for a new token pair. The old
+// refresh token is revoked so each one can only be used once.
+func refreshTokens(refreshToken string) (*tokenResponse, error) {
+	tokenHash := hashRefreshToken(refreshToken)
+
+	token, err := store.Tokens.GetRefreshToken(tokenHash)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	} else if !token.valid() {
+		return nil, ErrExpiredToken
+	}
+
+	if revoked, err := store.Tokens.RevokeRefreshToken(tokenHash); err != nil {
+		return nil, err
+	} else if !revoked {
+		return nil, ErrInvalidToken
+	}
+
+	return issueTokens(token.UserID)
+}
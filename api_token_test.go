@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	server := newTestServer(t)
+	user := newTestClient(t, server).signup("Juan")
+
+	app := newTestClient(t, server)
+	app.fails("POST", "/api/token", params{"grant_type": "password", "email": "juan@example.com", "password": "wrong password"}, http.StatusForbidden)
+	app.fails("POST", "/api/token", params{"grant_type": "client_credentials"}, http.StatusBadRequest)
+
+	var tokens tokenResponse
+	app.ok("POST", "/api/token", params{"grant_type": "password", "email": "juan@example.com", "password": "password"}, &tokens)
+	if tokens.TokenType != "Bearer" || tokens.ExpiresIn != int64(AccessTokenTTL/time.Second) || tokens.RefreshToken == "" {
+		t.Errorf("got tokens %+v", tokens)
+	}
+
+	// The access token logs the app in without a session
+	app.token = tokens.AccessToken
+	var me User
+	app.ok("GET", "/api/login", nil, &me)
+	if me.ID != user.ID {
+		t.Errorf("logged in as user %d, want %d", me.ID, user.ID)
+	}
+
+	// Refresh tokens are used once, and replaced by a new pair
+	var refreshed tokenResponse
+	app.ok("POST", "/api/token", params{"grant_type": "refresh_token", "refresh_token": tokens.RefreshToken}, &refreshed)
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+	app.fails("POST", "/api/token", params{"grant_type": "refresh_token", "refresh_token": tokens.RefreshToken}, http.StatusForbidden)
+
+	app.token = refreshed.AccessToken
+	app.ok("GET", "/api/login", nil, &me)
+
+	// Revoked refresh tokens are refused
+	app.ok("DELETE", "/api/token", params{"refresh_token": refreshed.RefreshToken}, nil)
+	app.fails("POST", "/api/token", params{"grant_type": "refresh_token", "refresh_token": refreshed.RefreshToken}, http.StatusForbidden)
+	app.fails("POST", "/api/token", params{"grant_type": "refresh_token", "refresh_token": "not a token"}, http.StatusForbidden)
+}
+
+func TestBearerTokenInvalid(t *testing.T) {
+	server := newTestServer(t)
+
+	// A bearer token is used instead of the session, even when it is invalid
+	c := newTestClient(t, server)
+	user := c.signup("Juan")
+
+	expired, err := signAccessToken(user.ID, time.Now().Add(-AccessTokenTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := signAccessToken(user.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := valid[:len(valid)-2] + "xx"
+
+	for _, token := range []string{expired, forged, "not a token"} {
+		c.token = token
+		c.fails("GET", "/api/login", nil, http.StatusForbidden)
+	}
+
+	// Tokens signed with another key are refused
+	c.token = valid
+	c.ok("GET", "/api/login", nil, nil)
+	if err := setAccessTokenKey("another secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.fails("GET", "/api/login", nil, http.StatusForbidden)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Patterns of the ids in v2 routes, named as the parameters they bind
+const (
+	userIDVar         = "{user_id:[0-9]+}"
+	hoopIDVar         = "{hoop_id:[0-9]+}"
+	storyIDVar        = "{story_id:[0-9]+}"
+	commentIDVar      = "{comment_id:[0-9]+}"
+	notificationIDVar = "{notification_id:[0-9]+}"
+	jobIDVar          = "{job_id:[0-9]+}"
+	tileVars          = "{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{format:geojson|mvt}"
+)
+
+// routeAPIV2 routes the v2 API, which names resources in its paths and routes
+// by method. Its routes share their handlers with the original API, which
+// binds the route variables as it does any other parameter.
+//
+// The routes are added to the router itself, after the /api subrouter, since
+// mux answers a request with the wrong method as not found when a route added
+// after the one that failed on method matches a prefix of the path.
+func routeAPIV2(router *mux.Router) {
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, ErrMethodNotAllowed)
+	})
+
+	route := func(path string, handler http.HandlerFunc, methods ...string) {
+		router.HandleFunc("/api/v2"+path, handler).Methods(methods...)
+	}
+
+	// Logging in and out
+	route("/session", loginHandler, "POST")
+	route("/session", logoutHandler, "DELETE")
+	route("/token", tokenHandler, "POST", "DELETE")
+
+	// The logged in user
+	route("/me", loginHandler, "GET")
+	route("/me", userHandler, "PATCH")
+	route("/me/image", userImageHandler, "POST")
+	route("/me/last-activity-check-time", userLastActivityCheckTimeHandler, "PATCH")
+	route("/me/hoops", userMyHoopsHandler, "GET")
+	route("/me/other-hoops", userOtherHoopsHandler, "GET")
+	route("/me/followed-hoops", userFollowedHoopsHandler, "GET")
+	route("/me/followers", userFollowersHandler, "GET")
+	route("/me/following", userFollowingHandler, "GET")
+
+	// Users
+	route("/users", signupHandler, "POST")
+	route("/users/"+userIDVar, userHandler, "GET")
+	route("/users/"+userIDVar+"/follow", followHandler, "POST", "DELETE")
+	route("/users/"+userIDVar+"/followers", userFollowersHandler, "GET")
+	route("/users/"+userIDVar+"/following", userFollowingHandler, "GET")
+	route("/users/"+userIDVar+"/followed-hoops", userFollowedHoopsHandler, "GET")
+
+	// Hoops
+	route("/hoops", hoopsHandler, "GET")
+	route("/hoops", hoopHandler, "POST")
+	route("/hoops/nearby", nearbyHoopsHandler, "GET")
+	route("/hoops/box", boxHoopsHandler, "GET")
+	route("/hoops/clusters", hoopClustersHandler, "GET")
+	route("/hoops/popular", popularHoopsHandler, "GET")
+	route("/hoops/latest", latestHoopsHandler, "GET")
+	route("/hoops/"+hoopIDVar, hoopHandler, "GET", "PATCH", "DELETE")
+	route("/hoops/"+hoopIDVar+"/follow", hoopFollowHandler, "POST", "DELETE")
+	route("/hoops/"+hoopIDVar+"/merge", hoopMergeHandler, "POST")
+	route("/hoops/"+hoopIDVar+"/views", viewHoopHandler, "POST")
+	route("/hoops/"+hoopIDVar+"/likes", hoopLikesHandler, "GET")
+	route("/hoops/"+hoopIDVar+"/likes", likeHoopHandler, "POST")
+	route("/hoops/"+hoopIDVar+"/comments", hoopCommentsHandler, "GET")
+	route("/hoops/"+hoopIDVar+"/comments", commentHoopHandler, "POST")
+	route("/hoops/"+hoopIDVar+"/stories", storiesHandler, "GET")
+	route("/hoops/"+hoopIDVar+"/stories", storyHandler, "POST")
+
+	// Map tiles
+	route("/tiles/"+tileVars, tileHandler, "GET")
+
+	// Stories
+	route("/stories/"+storyIDVar, storyHandler, "GET", "PATCH", "DELETE")
+	route("/stories/"+storyIDVar+"/views", viewStoryHandler, "POST")
+	route("/stories/"+storyIDVar+"/likes", storyLikesHandler, "GET")
+	route("/stories/"+storyIDVar+"/likes", likeStoryHandler, "POST")
+	route("/stories/"+storyIDVar+"/comments", storyCommentsHandler, "GET")
+	route("/stories/"+storyIDVar+"/comments", commentStoryHandler, "POST")
+
+	// Comments
+	route("/comments/"+commentIDVar, commentHandler, "PATCH", "DELETE")
+
+	// Search
+	route("/search", searchHandler, "GET")
+
+	// Feeds
+	route("/activities", activitiesHandler, "GET")
+	route("/stream", streamHandler, "GET")
+
+	// Notifications
+	route("/notifications", notificationsHandler, "GET")
+	route("/notifications/read", notificationsReadHandler, "POST")
+	route("/notifications/preferences", notificationPreferencesHandler, "GET", "PATCH")
+	route("/notifications/"+notificationIDVar, notificationHandler, "PATCH")
+	route("/devices", deviceHandler, "POST")
+	route("/devices/{token}", deviceHandler, "DELETE")
+
+	// Administration
+	route("/jobs/dead", deadJobsHandler, "GET")
+	route("/jobs/dead/"+jobIDVar+"/requeue", deadJobRequeueHandler, "POST")
+}
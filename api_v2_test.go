@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAPIV2(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+	hoopPath := "/api/v2/hoops/" + itoa(hoop.ID)
+
+	var me User
+	c.ok("GET", "/api/v2/me", nil, &me)
+	if me.ID != user.ID {
+		t.Errorf("me is user %d, want %d", me.ID, user.ID)
+	}
+
+	// The hoop in the path is the hoop_id parameter
+	var got Hoop
+	c.ok("GET", hoopPath, nil, &got)
+	if got.ID != hoop.ID || got.Name != "Tondo Court" {
+		t.Errorf("got hoop %+v", got)
+	}
+	c.ok("PATCH", hoopPath, params{"description": "Covered court"}, nil)
+	c.ok("GET", hoopPath, nil, &got)
+	if got.Description != "Covered court" {
+		t.Errorf("description %q after PATCH", got.Description)
+	}
+
+	c.ok("POST", hoopPath+"/stories", params{"name": "First game", "image_url": "http://example.com/story.jpg"}, nil)
+	var stories []Story
+	c.list(hoopPath+"/stories", nil, &stories)
+	if len(stories) == 0 || stories[0].Name != "First game" {
+		t.Fatalf("stories %+v", stories)
+	}
+	storyPath := "/api/v2/stories/" + itoa(stories[0].ID)
+
+	c.ok("POST", storyPath+"/comments", params{"text": "Good game"}, nil)
+	var comments []Comment
+	c.list(storyPath+"/comments", nil, &comments)
+	if len(comments) != 1 || comments[0].Text != "Good game" {
+		t.Errorf("story comments %+v", comments)
+	}
+
+	c.ok("POST", hoopPath+"/likes", nil, nil)
+	var likes likeCount
+	c.ok("GET", hoopPath+"/likes", nil, &likes)
+	if likes.Count != 1 {
+		t.Errorf("%d hoop likes, want 1", likes.Count)
+	}
+
+	// Other methods are not allowed, and missing resources are not found
+	for _, method := range []string{"PUT", "POST"} {
+		if err := c.fails(method, hoopPath, nil, http.StatusMethodNotAllowed); err.Code != ErrMethodNotAllowed.Code {
+			t.Errorf("%s %s: %+v", method, hoopPath, err)
+		}
+	}
+	c.fails("DELETE", storyPath+"/likes", nil, http.StatusMethodNotAllowed)
+	if err := c.fails("GET", "/api/v2/hoops/999", nil, http.StatusNotFound); err.Code != ErrHoopNotFound.Code {
+		t.Errorf("missing hoop: %+v", err)
+	}
+	if err := c.fails("POST", "/api/v2/stories/999/comments", params{"text": "Good game"}, http.StatusNotFound); err.Code != ErrStoryNotFound.Code {
+		t.Errorf("comment on a missing story: %+v", err)
+	}
+}
+
+func TestAPIV2MergedHoop(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.signup("Juan")
+	makeAdmin(t, user.ID)
+	canonical := c.createHoop("Tondo Court")
+	duplicate := c.createHoop("Tondo Basketball Court")
+
+	c.ok("POST", "/api/v2/hoops/"+itoa(duplicate.ID)+"/merge", params{"into": canonical.ID}, nil)
+
+	// The redirect replaces the hoop in the path, not in the query
+	status, location := c.redirect("/api/v2/hoops/" + itoa(duplicate.ID) + "?lang=tl")
+	if want := "/api/v2/hoops/" + itoa(canonical.ID) + "?lang=tl"; status != http.StatusMovedPermanently || location != want {
+		t.Errorf("redirected with %d to %s, want %s", status, location, want)
+	}
+
+	var got Hoop
+	c.ok("GET", "/api/v2/hoops/"+itoa(duplicate.ID), nil, &got)
+	if got.ID != canonical.ID {
+		t.Errorf("got hoop %d through the redirect, want %d", got.ID, canonical.ID)
+	}
+}
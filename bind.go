@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Request bodies
+const (
+	MaxJSONBodySize = 1 << 20
+	maxFormMemory   = 32 << 20 // as for http.Request.FormValue
+)
+
+// Request parameters are bound into structs, with the fields of embedded
+// structs bound as if they were their own. Each field names its parameter
+// in its json tag and may list older names of it in its alias tag. Its
+// validate tag lists the rules that the value must follow:
+//
+//	required       the parameter must be sent and not be blank
+//	min=n,max=n    bounds on the length of a string or the value of a number
+//	oneof=a b      the value must be one of those listed
+//	date           the value must be a date in DateFormat
+//
+// A parameter that is not sent, or is blank, leaves its field unchanged, so
+// that defaults can be set before binding, and is only checked by required.
+// A failed rule reports a generic error such as too_short, unless the error
+// tag names the code of a more specific one.
+//
+// Pointer fields stay nil when their parameter is not sent, so that updates
+// can tell which values to change. Blank values are set in *string fields,
+// so that text can be cleared.
+//
+// Structs that need more than their tags implement requestValidator.
+type requestValidator interface {
+	validate(errs fieldErrors)
+}
+
+// requestParams are the parameters of a request, from the variables of its
+// route, its JSON body, and its query string and form, in that order.
+type requestParams struct {
+	path map[string]string
+	body map[string]json.RawMessage
+	form map[string][]string
+}
+
+// bind reads the parameters of the request into the struct that v points
+// to, and validates them. It returns an API error listing every field that
+// is invalid.
+func bind(r *http.Request, v interface{}) error {
+	params, err := readParams(r)
+	if err != nil {
+		return err
+	}
+
+	errs := fieldErrors{}
+	params.bind(reflect.ValueOf(v).Elem(), errs)
+
+	if validator, ok := v.(requestValidator); ok && len(errs) == 0 {
+		validator.validate(errs)
+	}
+
+	return errs.err()
+}
+
+// bind sets the fields of the struct, including those of embedded structs.
+func (params requestParams) bind(rv reflect.Value, errs fieldErrors) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			params.bind(rv.Field(i), errs)
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		names := []string{name}
+		if alias := field.Tag.Get("alias"); alias != "" {
+			names = append(names, strings.Split(alias, ",")...)
+		}
+
+		rules := parseRules(field.Tag.Get("validate"))
+
+		sent, err := params.set(rv.Field(i), names)
+		if err != nil {
+			errs.add(name, ErrInvalidValue)
+			continue
+		} else if !sent {
+			if _, ok := rules["required"]; ok {
+				errs.add(name, ErrRequired)
+			}
+			continue
+		}
+
+		if err := checkRules(rv.Field(i), rules); err != nil {
+			if code := field.Tag.Get("error"); code != "" && apiErrors[code] != nil {
+				err = apiErrors[code]
+			}
+			errs.add(name, err)
+		}
+	}
+}
+
+// readParams parses the route variables, query string and form of the
+// request, and its body if it is JSON. The body is kept so that the request
+// can be bound again.
+func readParams(r *http.Request) (params requestParams, err error) {
+	params.path = mux.Vars(r)
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if contentType == "application/json" && r.Body != nil {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxJSONBodySize+1))
+		if err != nil {
+			return params, err
+		} else if len(data) > MaxJSONBodySize {
+			return params, ErrInvalidJSON.withMessage("JSON body too large")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &params.body); err != nil {
+				return params, ErrInvalidJSON
+			}
+		}
+	}
+
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil && err != http.ErrNotMultipart {
+		return params, ErrBadRequest
+	}
+	params.form = r.Form
+
+	return params, nil
+}
+
+// set stores the value of the first of names that was sent in the field. It
+// reports whether one was sent.
+func (params requestParams) set(field reflect.Value, names []string) (bool, error) {
+	// Only optional strings can be cleared
+	clearable := field.Type() == reflect.TypeOf((*string)(nil))
+
+	for _, name := range names {
+		if value, ok := params.path[name]; ok {
+			return true, setStrings(field, []string{value})
+		}
+	}
+
+	for _, name := range names {
+		if raw, ok := params.body[name]; ok && string(raw) != "null" {
+			var s string
+			if !clearable && json.Unmarshal(raw, &s) == nil && strings.TrimSpace(s) == "" {
+				return false, nil
+			}
+			return true, setJSON(field, raw)
+		}
+	}
+
+	for _, name := range names {
+		if values, ok := params.form[name]; ok && len(values) > 0 {
+			if !clearable && field.Kind() != reflect.Slice && strings.TrimSpace(values[0]) == "" {
+				return false, nil
+			}
+			return true, setStrings(field, values)
+		}
+	}
+
+	return false, nil
+}
+
+// setJSON stores a JSON value in the field. Numbers and booleans may also be
+// sent as strings, as they would be in a form.
+func setJSON(field reflect.Value, raw json.RawMessage) error {
+	if field.Kind() == reflect.Ptr {
+		field.Set(reflect.New(field.Type().Elem()))
+		field = field.Elem()
+	}
+
+	if err := json.Unmarshal(raw, field.Addr().Interface()); err == nil {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	return setStrings(field, []string{s})
+}
+
+// setStrings stores form values in the field. Slices take every value, and
+// other fields the first.
+func setStrings(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Ptr {
+		field.Set(reflect.New(field.Type().Elem()))
+		field = field.Elem()
+	}
+
+	if field.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setString(slice.Index(i), value); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	return setString(field, values[0])
+}
+
+func setString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return err
+		} else if math.IsNaN(f) || math.IsInf(f, 0) {
+			return ErrInvalidValue
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		panic("bind: unsupported field type " + field.Type().String())
+	}
+	return nil
+}
+
+// parseRules parses a validate tag into the arguments of each rule.
+func parseRules(tag string) map[string]string {
+	rules := make(map[string]string)
+	for _, rule := range strings.Split(tag, ",") {
+		if rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) == 2 {
+			rules[parts[0]] = parts[1]
+		} else {
+			rules[parts[0]] = ""
+		}
+	}
+	return rules
+}
+
+// checkRules returns the error for the first rule that the value of the
+// field breaks.
+func checkRules(field reflect.Value, rules map[string]string) *APIError {
+	if field.Kind() == reflect.Ptr {
+		field = field.Elem()
+	}
+
+	var size float64
+	switch field.Kind() {
+	case reflect.String:
+		size = float64(utf8.RuneCountInString(field.String()))
+	case reflect.Int, reflect.Int64:
+		size = float64(field.Int())
+	case reflect.Float64:
+		size = field.Float()
+	}
+
+	isString := field.Kind() == reflect.String
+
+	if min, ok := rules["min"]; ok {
+		if n, _ := strconv.ParseFloat(min, 64); size < n {
+			if isString {
+				return ErrTooShort
+			}
+			return ErrOutOfRange
+		}
+	}
+
+	if max, ok := rules["max"]; ok {
+		if n, _ := strconv.ParseFloat(max, 64); size > n {
+			if isString {
+				return ErrTooLong
+			}
+			return ErrOutOfRange
+		}
+	}
+
+	if oneof, ok := rules["oneof"]; ok && isString {
+		found := false
+		for _, value := range strings.Fields(oneof) {
+			if field.String() == value {
+				found = true
+			}
+		}
+		if !found {
+			return ErrInvalidValue
+		}
+	}
+
+	if _, ok := rules["date"]; ok && isString {
+		if _, err := time.Parse(DateFormat, field.String()); err != nil {
+			return ErrInvalidDateFormat
+		}
+	}
+
+	return nil
+}
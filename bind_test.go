@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRequestValidation(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	tests := []struct {
+		method, path string
+		p            params
+		want         map[string]string
+	}{
+		{"POST", "/api/hoop", params{"latitude": 14.5, "longitude": 121}, map[string]string{"name": "required"}},
+		{"POST", "/api/hoop", params{"name": "", "latitude": 14.5, "longitude": 121}, map[string]string{"name": "required"}},
+		{"POST", "/api/hoop", params{"name": "Nowhere", "latitude": 95, "longitude": "east"}, map[string]string{"latitude": "out_of_range", "longitude": "invalid"}},
+		{"POST", "/api/story", params{"hoop_id": hoop.ID, "image_url": "http://example.com/story.jpg"}, map[string]string{"name": "required"}},
+		{"POST", "/api/story", params{"hoop_id": hoop.ID, "name": "", "image_url": "http://example.com/story.jpg"}, map[string]string{"name": "required"}},
+		{"PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "name": ""}, map[string]string{"name": "too_short"}},
+		{"POST", "/api/comment/hoop", params{"text": "x"}, map[string]string{"hoop_id": "required", "text": "too_short"}},
+		{"GET", "/api/activities", params{"scope": "nobody"}, map[string]string{"scope": "invalid"}},
+	}
+	for _, test := range tests {
+		err := c.fails(test.method, test.path, test.p, http.StatusBadRequest)
+		if err.Code != "invalid_fields" || len(err.Fields) != len(test.want) {
+			t.Errorf("%s %s %v: %+v, want %v", test.method, test.path, test.p, err, test.want)
+			continue
+		}
+		for name, code := range test.want {
+			if err.Fields[name].Code != code {
+				t.Errorf("%s %s %v: %s is %s, want %s", test.method, test.path, test.p, name, err.Fields[name].Code, code)
+			}
+		}
+	}
+
+	// Nothing invalid was stored
+	var hoops []Hoop
+	c.list("/api/hoops", nil, &hoops)
+	if len(hoops) != 1 {
+		t.Errorf("%d hoops after invalid requests, want 1", len(hoops))
+	}
+}
+
+func TestRequestAliases(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	// Older clients send forms with camelCase and dashed names
+	res, err := c.client.PostForm(server.URL+"/api/comment/hoop", url.Values{"hoop-id": {itoa(hoop.ID)}, "text": {"Nice court"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("form with old names: %d", res.StatusCode)
+	}
+
+	var got Hoop
+	c.ok("GET", "/api/hoop", params{"hoopID": hoop.ID}, &got)
+	if got.ID != hoop.ID {
+		t.Errorf("got hoop %d by its old parameter name, want %d", got.ID, hoop.ID)
+	}
+
+	var comments []Comment
+	c.list("/api/hoop/comments", params{"hoop-id": hoop.ID}, &comments)
+	if len(comments) != 1 || comments[0].Text != "Nice court" {
+		t.Errorf("hoop comments %+v", comments)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	ErrBlobNotFound   = errors.New("Blob not found")
+	ErrInvalidBlobKey = errors.New("Invalid blob key")
+)
+
+// BlobStore stores uploaded files. Keys are relative slash-separated paths.
+type BlobStore interface {
+	Put(key string, r io.Reader, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+
+	// URL returns the address clients use to fetch the blob.
+	URL(key string) string
+}
+
+var blobs BlobStore
+
+func newBlobStore(cfg Config) (BlobStore, error) {
+	switch cfg.Media.Backend {
+	case "s3":
+		return newS3BlobStore(cfg.Media.S3), nil
+	default:
+		return newLocalBlobStore(cfg.ContentDir, ContentPath), nil
+	}
+}
+
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
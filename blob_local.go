@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// localBlobStore keeps blobs in a directory that is served at urlPath.
+type localBlobStore struct {
+	dir     string
+	urlPath string
+}
+
+func newLocalBlobStore(dir, urlPath string) *localBlobStore {
+	return &localBlobStore{dir: dir, urlPath: urlPath}
+}
+
+func (s *localBlobStore) Put(key string, r io.Reader, contentType string) error {
+	if !validBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	destination := s.path(key)
+	folder := filepath.Dir(destination)
+
+	if err := os.MkdirAll(folder, os.ModeDir|0775); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see a
+	// partially written blob
+	tmp, err := ioutil.TempFile(folder, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0664); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), destination)
+}
+
+func (s *localBlobStore) Get(key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) URL(key string) string {
+	return s.urlPath + "/" + key
+}
+
+func (s *localBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	bucket := newLocalBlobStore(dir, ContentPath)
+
+	key := "images/2016/court.jpg"
+	if err := bucket.Put(key, strings.NewReader("first"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put(key, strings.NewReader("second"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := bucket.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "second" {
+		t.Errorf("got %q, want %q", data, "second")
+	}
+
+	// Nothing is left of the temporary files blobs are written through
+	files, err := ioutil.ReadDir(filepath.Join(dir, "images", "2016"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 {
+		t.Errorf("%d files in the blob's directory", len(files))
+	}
+
+	if url := bucket.URL(key); url != "content/images/2016/court.jpg" {
+		t.Errorf("URL %q", url)
+	}
+
+	if err := bucket.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Get(key); err != ErrBlobNotFound {
+		t.Errorf("get of a deleted blob: %v, want %v", err, ErrBlobNotFound)
+	}
+	if err := bucket.Delete(key); err != nil {
+		t.Errorf("delete of a deleted blob: %v", err)
+	}
+
+	// Keys cannot leave the directory
+	outside := filepath.Join(filepath.Dir(dir), "outside.jpg")
+	for _, key := range []string{"", "/images/a.jpg", "../outside.jpg", "images/../../outside.jpg", `images\a.jpg`} {
+		if err := bucket.Put(key, strings.NewReader("a"), ""); err != ErrInvalidBlobKey {
+			t.Errorf("put %q: %v, want %v", key, err, ErrInvalidBlobKey)
+		}
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("blob written outside the directory: %v", err)
+	}
+}
+
+func TestUploadServed(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	images := c.uploadStory(hoop.ID, testPNG(t, 10, 10, 128))
+	if !strings.HasPrefix(images.Full, ContentPath+"/") {
+		t.Fatalf("uploaded to %s", images.Full)
+	}
+
+	key := strings.TrimPrefix(images.Full, ContentPath+"/")
+	r, err := blobs.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if served := c.fetch(images.Full); !bytes.Equal(served, stored) {
+		t.Errorf("served %d bytes of %d", len(served), len(stored))
+	}
+}
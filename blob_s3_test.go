@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testS3Region    = "ap-southeast-1"
+)
+
+// fakeS3 is an S3 service holding objects in memory. It checks the signature
+// of each request as S3 would, and rejects those that do not match.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeS3Object
+	requests []string
+}
+
+type fakeS3Object struct {
+	data        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	s3 := &fakeS3{objects: make(map[string]fakeS3Object)}
+	server := httptest.NewServer(s3)
+	t.Cleanup(server.Close)
+	return s3, server
+}
+
+func (s *fakeS3) object(path string) (fakeS3Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[path]
+	return object, ok
+}
+
+// sent returns the method and path of each request so far.
+func (s *fakeS3) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Objects are kept by the path as sent, before unescaping
+	path := strings.SplitN(r.RequestURI, "?", 2)[0]
+	s.requests = append(s.requests, r.Method+" "+path)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkS3Signature(r, path, body); err != nil {
+		http.Error(w, "SignatureDoesNotMatch: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		s.objects[path] = fakeS3Object{data: body, contentType: r.Header.Get("Content-Type")}
+	case "GET":
+		object, ok := s.objects[path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Write(object.data)
+	case "DELETE":
+		if _, ok := s.objects[path]; !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		delete(s.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkS3Signature verifies the Signature Version 4 Authorization header of
+// a request for the path, signed with the test credentials.
+func checkS3Signature(r *http.Request, path string, body []byte) error {
+	amzDate := r.Header.Get("X-Amz-Date")
+	when, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return fmt.Errorf("X-Amz-Date %q", amzDate)
+	} else if d := time.Since(when); d < -time.Minute || d > time.Minute {
+		return fmt.Errorf("X-Amz-Date %s is %s off", amzDate, d)
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if sum := sha256Hex(body); payloadHash != sum {
+		return fmt.Errorf("X-Amz-Content-Sha256 %q, body hashes to %q", payloadHash, sum)
+	}
+
+	date := when.Format("20060102")
+	scope := date + "/" + testS3Region + "/s3/aws4_request"
+	canonicalRequest := r.Method + "\n" +
+		path + "\n" +
+		r.URL.RawQuery + "\n" +
+		"host:" + r.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n" +
+		"\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" +
+		payloadHash
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + testS3SecretKey)
+	for _, part := range []string{date, testS3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	want := "AWS4-HMAC-SHA256 Credential=" + testS3AccessKey + "/" + scope + ", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=" + signature
+	if got := r.Header.Get("Authorization"); got != want {
+		return fmt.Errorf("Authorization %q, want %q", got, want)
+	}
+	return nil
+}
+
+func newTestS3BlobStore(endpoint, secretKey string) *s3BlobStore {
+	return newS3BlobStore(S3Config{
+		Endpoint:  endpoint,
+		Region:    testS3Region,
+		Bucket:    "pinoy-hoops",
+		AccessKey: testS3AccessKey,
+		SecretKey: secretKey,
+	})
+}
+
+func TestS3BlobStore(t *testing.T) {
+	s3, server := newFakeS3(t)
+
+	// Endpoints may be under a path, as some S3-compatible servers are
+	bucket := newTestS3BlobStore(server.URL+"/storage/", testS3SecretKey)
+
+	key := "images/2016/court photo ñ.jpg"
+	path := "/storage/pinoy-hoops/images/2016/court%20photo%20%C3%B1.jpg"
+	data := []byte("not really a JPEG")
+
+	if err := bucket.Put(key, bytes.NewReader(data), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if object, ok := s3.object(path); !ok {
+		t.Fatalf("no object at %s after a put: %q", path, s3.sent())
+	} else if !bytes.Equal(object.data, data) || object.contentType != "image/jpeg" {
+		t.Errorf("put %q of type %q", object.data, object.contentType)
+	}
+
+	r, err := bucket.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+
+	if err := bucket.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s3.object(path); ok {
+		t.Error("object is left after a delete")
+	}
+
+	// Missing blobs are not found, and deleting them again does nothing
+	if _, err := bucket.Get(key); err != ErrBlobNotFound {
+		t.Errorf("get of a deleted blob: %v, want %v", err, ErrBlobNotFound)
+	}
+	if err := bucket.Delete(key); err != nil {
+		t.Errorf("delete of a deleted blob: %v", err)
+	}
+
+	want := []string{"PUT " + path, "GET " + path, "DELETE " + path, "GET " + path, "DELETE " + path}
+	if sent := s3.sent(); strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests %q, want %q", sent, want)
+	}
+}
+
+func TestS3BlobStoreErrors(t *testing.T) {
+	s3, server := newFakeS3(t)
+
+	// Keys that could leave the bucket are never sent
+	bucket := newTestS3BlobStore(server.URL, testS3SecretKey)
+	for _, key := range []string{"", "/images/a.jpg", "images/../a.jpg", "images//a.jpg", `images\a.jpg`} {
+		if err := bucket.Put(key, bytes.NewReader(nil), ""); err != ErrInvalidBlobKey {
+			t.Errorf("put %q: %v, want %v", key, err, ErrInvalidBlobKey)
+		}
+		if _, err := bucket.Get(key); err != ErrInvalidBlobKey {
+			t.Errorf("get %q: %v, want %v", key, err, ErrInvalidBlobKey)
+		}
+		if err := bucket.Delete(key); err != ErrInvalidBlobKey {
+			t.Errorf("delete %q: %v, want %v", key, err, ErrInvalidBlobKey)
+		}
+	}
+	if sent := s3.sent(); len(sent) != 0 {
+		t.Errorf("sent %q", sent)
+	}
+
+	// Other failures are errors, and not taken for missing blobs
+	wrong := newTestS3BlobStore(server.URL, "wrong secret")
+	if err := wrong.Put("a.jpg", bytes.NewReader([]byte("a")), ""); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("put with the wrong secret: %v", err)
+	}
+	if _, err := wrong.Get("a.jpg"); err == nil || err == ErrBlobNotFound {
+		t.Errorf("get with the wrong secret: %v", err)
+	}
+	if err := wrong.Delete("a.jpg"); err == nil {
+		t.Error("delete with the wrong secret succeeded")
+	}
+}
+
+func TestS3BlobStoreURL(t *testing.T) {
+	tests := []struct {
+		cfg  S3Config
+		key  string
+		want string
+	}{
+		{S3Config{Endpoint: "https://s3.ap-southeast-1.amazonaws.com", Bucket: "pinoy-hoops"}, "images/a.jpg", "https://s3.ap-southeast-1.amazonaws.com/pinoy-hoops/images/a.jpg"},
+		{S3Config{Endpoint: "s3.ap-southeast-1.amazonaws.com", Bucket: "pinoy-hoops"}, "images/a.jpg", "https://s3.ap-southeast-1.amazonaws.com/pinoy-hoops/images/a.jpg"},
+		{S3Config{Endpoint: "http://localhost:9000/", Bucket: "pinoy hoops"}, "images/a b.jpg", "http://localhost:9000/pinoy%20hoops/images/a%20b.jpg"},
+		{S3Config{Endpoint: "http://localhost:9000", Bucket: "pinoy-hoops", PublicURL: "https://cdn.pinoyhoops.com/"}, "images/ñ.jpg", "https://cdn.pinoyhoops.com/images/%C3%B1.jpg"},
+	}
+
+	for _, test := range tests {
+		if got := newS3BlobStore(test.cfg).URL(test.key); got != test.want {
+			t.Errorf("URL of %q with %+v: %q, want %q", test.key, test.cfg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Messages that a subscriber has not received yet are dropped once this
+// many are waiting, so one slow client cannot hold up the others.
+const subscriptionBuffer = 64
+
+// redisChannelPrefix namespaces the broker's Redis channels.
+const redisChannelPrefix = "pinoyhoops:"
+
+// Broker fans messages out to the subscribers of a channel.
+type Broker interface {
+	Publish(channel string, data []byte) error
+	Subscribe(channels ...string) *Subscription
+}
+
+var broker Broker
+
+type Message struct {
+	Channel string
+	Data    []byte
+}
+
+// Subscription receives the messages published to its channels on C until
+// it is closed.
+type Subscription struct {
+	C <-chan Message
+
+	c        chan Message
+	channels []string
+	close    func(*Subscription)
+	once     sync.Once
+}
+
+func (sub *Subscription) Close() {
+	sub.once.Do(func() { sub.close(sub) })
+}
+
+// newBroker returns the broker for the config. Servers that share a
+// Postgres database also share events through Redis; the memory store
+// keeps them in the process.
+func newBroker(cfg Config) Broker {
+	if cfg.Store == "memory" {
+		return newLocalBroker()
+	}
+	return newRedisBroker()
+}
+
+// localBroker delivers messages to subscribers in the same process.
+type localBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[*Subscription]bool
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{subs: make(map[string]map[*Subscription]bool)}
+}
+
+func (b *localBroker) Publish(channel string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs[channel] {
+		select {
+		case sub.c <- Message{Channel: channel, Data: data}:
+		default:
+			// The subscriber is falling behind
+		}
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(channels ...string) *Subscription {
+	c := make(chan Message, subscriptionBuffer)
+	sub := &Subscription{C: c, c: c, channels: channels, close: b.unsubscribe}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, channel := range channels {
+		if b.subs[channel] == nil {
+			b.subs[channel] = make(map[*Subscription]bool)
+		}
+		b.subs[channel][sub] = true
+	}
+	return sub
+}
+
+func (b *localBroker) unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, channel := range sub.channels {
+		delete(b.subs[channel], sub)
+		if len(b.subs[channel]) == 0 {
+			delete(b.subs, channel)
+		}
+	}
+	close(sub.c)
+}
+
+// redisBroker publishes messages through Redis so that they reach the
+// subscribers of every server. Each server receives all messages on one
+// connection and hands them to its own subscribers.
+type redisBroker struct {
+	local *localBroker
+}
+
+func newRedisBroker() *redisBroker {
+	b := &redisBroker{local: newLocalBroker()}
+	go b.receive()
+	return b
+}
+
+func (b *redisBroker) Publish(channel string, data []byte) error {
+	red, err := redisInstance()
+	if err != nil {
+		return err
+	}
+	defer red.Close()
+
+	_, err = red.Do("PUBLISH", redisChannelPrefix+channel, data)
+	return err
+}
+
+func (b *redisBroker) Subscribe(channels ...string) *Subscription {
+	return b.local.Subscribe(channels...)
+}
+
+// receive passes messages from Redis to the local subscribers, reconnecting
+// whenever the connection fails.
+func (b *redisBroker) receive() {
+	for {
+		if err := b.receiveOnce(); err != nil {
+			log.Println("broker:", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (b *redisBroker) receiveOnce() error {
+	red, err := redisInstance()
+	if err != nil {
+		return err
+	}
+
+	psc := redis.PubSubConn{Conn: red}
+	defer psc.Close()
+
+	if err := psc.PSubscribe(redisChannelPrefix + "*"); err != nil {
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.PMessage:
+			b.local.Publish(strings.TrimPrefix(v.Channel, redisChannelPrefix), v.Data)
+		case error:
+			return v
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// hoopComments returns the first page of the hoop's comments.
+func (c *testClient) hoopComments(hoopID int64) []Comment {
+	c.t.Helper()
+
+	var comments []Comment
+	c.list("/api/hoop/comments", params{"hoop_id": hoopID}, &comments)
+	return comments
+}
+
+func TestCommentThreads(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+	other := c.createHoop("Quiapo Court")
+
+	c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+	root := c.hoopComments(hoop.ID)[0]
+
+	// Replies nest up to the configured depth
+	parentID := root.ID
+	for depth := 1; depth <= config.Comments.MaxDepth; depth++ {
+		c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "parent_id": parentID, "text": "Reply " + itoa(int64(depth))}, nil)
+
+		comments := c.hoopComments(hoop.ID)
+		if len(comments) != 1 {
+			t.Fatalf("replies listed as top-level comments: %+v", comments)
+		}
+		reply := comments[0]
+		for i := 0; i < depth; i++ {
+			if len(reply.Replies) != 1 {
+				t.Fatalf("replies %+v at depth %d", reply.Replies, i+1)
+			}
+			reply = reply.Replies[0]
+		}
+		if reply.ParentID != parentID || reply.Depth != depth || reply.HoopID != hoop.ID {
+			t.Errorf("reply %+v", reply)
+		}
+		parentID = reply.ID
+	}
+	c.fails("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "parent_id": parentID, "text": "Too deep"}, http.StatusBadRequest)
+
+	// A reply stays on the hoop of its parent
+	c.fails("POST", "/api/comment/hoop", params{"hoop_id": other.ID, "parent_id": root.ID, "text": "Elsewhere"}, http.StatusBadRequest)
+	c.fails("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "parent_id": root.ID + 100, "text": "Nowhere"}, http.StatusBadRequest)
+
+	story := c.createStory(hoop.ID, "First game")
+	c.ok("PATCH", "/api/comment/story", params{"story_id": story.ID, "text": "Good game"}, nil)
+	var comments []Comment
+	c.list("/api/story/comments", params{"story_id": story.ID}, &comments)
+	c.ok("PATCH", "/api/comment/story", params{"story_id": story.ID, "parent_id": comments[0].ID, "text": "Thanks"}, nil)
+	c.fails("PATCH", "/api/comment/story", params{"story_id": story.ID, "parent_id": root.ID, "text": "From the hoop"}, http.StatusBadRequest)
+
+	c.list("/api/story/comments", params{"story_id": story.ID}, &comments)
+	if len(comments) != 1 || len(comments[0].Replies) != 1 || comments[0].Replies[0].StoryID != story.ID || comments[0].Replies[0].User.Firstname != "Juan" {
+		t.Errorf("story comments %+v", comments)
+	}
+}
+
+func TestCommentEditDelete(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	hoop := juan.createHoop("Tondo Court")
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	admin := newTestClient(t, server)
+	makeAdmin(t, admin.signup("Maria").ID)
+
+	juan.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+	comment := juan.hoopComments(hoop.ID)[0]
+	pedro.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "parent_id": comment.ID, "text": "Agreed"}, nil)
+
+	// Only the author may edit a comment, admins included
+	pedro.fails("PATCH", "/api/comment", params{"comment_id": comment.ID, "text": "Ugly court"}, http.StatusForbidden)
+	admin.fails("PATCH", "/api/comment", params{"comment_id": comment.ID, "text": "Ugly court"}, http.StatusForbidden)
+	juan.fails("PATCH", "/api/comment", params{"comment_id": comment.ID, "text": "x"}, http.StatusBadRequest)
+	juan.ok("PATCH", "/api/comment", params{"comment_id": comment.ID, "text": "Very nice court"}, nil)
+
+	got := juan.hoopComments(hoop.ID)[0]
+	if got.Text != "Very nice court" || got.EditedAt == nil {
+		t.Errorf("edited comment %+v", got)
+	}
+
+	// Deleted comments keep their place and replies, without their text
+	pedro.fails("DELETE", "/api/comment", params{"comment_id": comment.ID}, http.StatusForbidden)
+	admin.ok("DELETE", "/api/comment", params{"comment_id": comment.ID}, nil)
+	juan.fails("DELETE", "/api/comment", params{"comment_id": comment.ID}, http.StatusNotFound)
+	juan.fails("PATCH", "/api/comment", params{"comment_id": comment.ID, "text": "Back again"}, http.StatusNotFound)
+	pedro.fails("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "parent_id": comment.ID, "text": "Hello?"}, http.StatusBadRequest)
+
+	got = juan.hoopComments(hoop.ID)[0]
+	if !got.Deleted || got.Text != DeletedCommentText || got.UserID != 0 || got.Data["user"] != nil {
+		t.Errorf("deleted comment %+v", got)
+	}
+	if len(got.Replies) != 1 || got.Replies[0].Text != "Agreed" {
+		t.Errorf("replies %+v of a deleted comment", got.Replies)
+	}
+}
+
+func TestCommentRepliesCapped(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+	root := c.hoopComments(hoop.ID)[0]
+
+	// Replies to a reply count towards the thread too
+	c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "parent_id": root.ID, "text": "Reply 0"}, nil)
+	first := c.hoopComments(hoop.ID)[0].Replies[0]
+
+	total := MaxThreadReplies + 5
+	for i := 1; i < total; i++ {
+		parentID := root.ID
+		if i%2 == 0 {
+			parentID = first.ID
+		}
+		c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "parent_id": parentID, "text": "Reply " + itoa(int64(i))}, nil)
+	}
+
+	var texts []string
+	var walk func(comments []Comment)
+	walk = func(comments []Comment) {
+		for _, comment := range comments {
+			texts = append(texts, comment.Text)
+			walk(comment.Replies)
+		}
+	}
+
+	thread := c.hoopComments(hoop.ID)[0]
+	walk(thread.Replies)
+	if len(texts) != MaxThreadReplies {
+		t.Fatalf("%d replies listed, want %d", len(texts), MaxThreadReplies)
+	}
+	if thread.RepliesCursor == "" {
+		t.Fatal("thread with more replies has no replies cursor")
+	}
+
+	// The rest are paged, oldest first
+	var rest []string
+	cursor := thread.RepliesCursor
+	for cursor != "" {
+		var replies []Comment
+		cursor = c.list("/api/comment/replies", params{"comment_id": root.ID, "cursor": cursor, "limit": 2}, &replies)
+		for _, reply := range replies {
+			if reply.Data["user"] == nil {
+				t.Errorf("reply %+v has no user", reply)
+			}
+			rest = append(rest, reply.Text)
+		}
+	}
+	want := []string{}
+	for i := MaxThreadReplies; i < total; i++ {
+		want = append(want, "Reply "+itoa(int64(i)))
+	}
+	if strings.Join(rest, ",") != strings.Join(want, ",") {
+		t.Errorf("paged replies %q, want %q", rest, want)
+	}
+
+	// Threads within the limit have no cursor
+	c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Quiet thread"}, nil)
+	if quiet := c.hoopComments(hoop.ID)[0]; quiet.RepliesCursor != "" {
+		t.Errorf("thread without replies has the replies cursor %q", quiet.RepliesCursor)
+	}
+	c.fails("GET", "/api/comment/replies", params{"comment_id": root.ID + 1000}, http.StatusNotFound)
+}
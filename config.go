@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds the server settings. It is loaded from an optional JSON file,
+// then environment variables, then any command-line flags that were set.
+type Config struct {
+	Listen     string `json:"listen"`
+	Address    string `json:"address"`
+	ContentDir string `json:"content_dir"`
+	Store      string `json:"store"`
+
+	Database DatabaseConfig `json:"database"`
+	Redis    RedisConfig    `json:"redis"`
+	Media    MediaConfig    `json:"media"`
+	Comments CommentsConfig `json:"comments"`
+	Push     PushConfig     `json:"push"`
+
+	// SessionKeys authenticate the session cookie. New cookies are signed
+	// with the first key; the others are still accepted, so keys can be
+	// rotated by prepending a new one.
+	SessionKeys []string `json:"session_keys"`
+	GothicKey   string   `json:"gothic_key"`
+	TokenSecret string   `json:"token_secret"`
+
+	OAuth map[string]OAuthConfig `json:"oauth"`
+}
+
+type DatabaseConfig struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+	SSLMode  string `json:"sslmode"`
+}
+
+type RedisConfig struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Password string `json:"password"`
+}
+
+// MediaConfig selects where uploaded files are stored. The local backend
+// writes to ContentDir.
+type MediaConfig struct {
+	Backend string   `json:"backend"`
+	S3      S3Config `json:"s3"`
+}
+
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+
+	// PublicURL is the base URL clients fetch objects from. It defaults to
+	// the bucket URL on the endpoint.
+	PublicURL string `json:"public_url"`
+}
+
+// CommentsConfig limits comment threads. Top-level comments have depth 0, so
+// a MaxDepth of 0 disables replies.
+type CommentsConfig struct {
+	MaxDepth int `json:"max_depth"`
+}
+
+// PushConfig selects how push notifications are sent. The fake sender logs
+// them instead; the live sender uses whichever of APNs and FCM is set up.
+type PushConfig struct {
+	Sender string     `json:"sender"`
+	APNs   APNsConfig `json:"apns"`
+	FCM    FCMConfig  `json:"fcm"`
+}
+
+// APNsConfig sets up token-based authentication with APNs. KeyFile is the
+// .p8 auth key and Topic the app's bundle ID.
+type APNsConfig struct {
+	KeyFile string `json:"key_file"`
+	KeyID   string `json:"key_id"`
+	TeamID  string `json:"team_id"`
+	Topic   string `json:"topic"`
+	Sandbox bool   `json:"sandbox"`
+}
+
+// FCMConfig sets up FCM with a Google service account key file.
+type FCMConfig struct {
+	CredentialsFile string `json:"credentials_file"`
+}
+
+type OAuthConfig struct {
+	Key      string `json:"key"`
+	Secret   string `json:"secret"`
+	Callback string `json:"callback"`
+}
+
+// Session keys and token secrets shorter than this are rejected
+const MinSessionKeyLength = 32
+
+// Secrets starting with this are the placeholders of config.example.json,
+// which are public, so they are rejected
+const secretPlaceholder = "replace-with"
+
+// OAuth providers that can be configured
+var oauthProviders = []string{"facebook", "instagram", "twitter"}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+var ErrInvalidConfig = errors.New("Invalid config")
+
+var config Config
+
+func defaultConfig() Config {
+	return Config{
+		Listen:     ":8080",
+		Address:    "http://localhost:8080",
+		ContentDir: ContentDir,
+		Store:      "postgres",
+		Database: DatabaseConfig{
+			Host:    "localhost",
+			Port:    "5432",
+			User:    "postgres",
+			Name:    "postgres",
+			SSLMode: "disable",
+		},
+		Redis: RedisConfig{
+			Port: "6379",
+		},
+		Media: MediaConfig{
+			Backend: "local",
+			S3: S3Config{
+				Region: "us-east-1",
+			},
+		},
+		Comments: CommentsConfig{
+			MaxDepth: 3,
+		},
+		Push: PushConfig{
+			Sender: "fake",
+		},
+		OAuth: map[string]OAuthConfig{},
+	}
+}
+
+// loadConfig builds the effective config from the file at path (if any),
+// the environment and the command-line flags.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return cfg, err
+		}
+		defer file.Close()
+
+		if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	cfg.applyFlags()
+
+	for _, provider := range oauthProviders {
+		oauth := cfg.OAuth[provider]
+		if oauth.Callback == "" {
+			oauth.Callback = strings.TrimRight(cfg.Address, "/") + "/auth/" + provider + "/callback"
+		}
+		cfg.OAuth[provider] = oauth
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv() error {
+	setFromEnv(&cfg.Listen, "LISTEN_ADDRESS")
+	setFromEnv(&cfg.Address, "SERVER_ADDRESS")
+	setFromEnv(&cfg.ContentDir, "CONTENT_DIR")
+	setFromEnv(&cfg.Store, "STORE")
+
+	setFromEnv(&cfg.Database.Host, "DB_HOST")
+	setFromEnv(&cfg.Database.Port, "DB_PORT")
+	setFromEnv(&cfg.Database.User, "DB_USER")
+	setFromEnv(&cfg.Database.Password, "DB_PASSWORD")
+	setFromEnv(&cfg.Database.Name, "DB_NAME")
+	setFromEnv(&cfg.Database.SSLMode, "DB_SSLMODE")
+
+	setFromEnv(&cfg.Redis.Host, "REDIS_HOST")
+	setFromEnv(&cfg.Redis.Port, "REDIS_PORT")
+	setFromEnv(&cfg.Redis.Password, "REDIS_PASSWORD")
+
+	setFromEnv(&cfg.Media.Backend, "MEDIA_BACKEND")
+	setFromEnv(&cfg.Media.S3.Endpoint, "S3_ENDPOINT")
+	setFromEnv(&cfg.Media.S3.Region, "S3_REGION")
+	setFromEnv(&cfg.Media.S3.Bucket, "S3_BUCKET")
+	setFromEnv(&cfg.Media.S3.AccessKey, "S3_ACCESS_KEY")
+	setFromEnv(&cfg.Media.S3.SecretKey, "S3_SECRET_KEY")
+	setFromEnv(&cfg.Media.S3.PublicURL, "S3_PUBLIC_URL")
+
+	if err := setIntFromEnv(&cfg.Comments.MaxDepth, "COMMENT_MAX_DEPTH"); err != nil {
+		return err
+	}
+
+	setFromEnv(&cfg.Push.Sender, "PUSH_SENDER")
+	setFromEnv(&cfg.Push.APNs.KeyFile, "APNS_KEY_FILE")
+	setFromEnv(&cfg.Push.APNs.KeyID, "APNS_KEY_ID")
+	setFromEnv(&cfg.Push.APNs.TeamID, "APNS_TEAM_ID")
+	setFromEnv(&cfg.Push.APNs.Topic, "APNS_TOPIC")
+	if err := setBoolFromEnv(&cfg.Push.APNs.Sandbox, "APNS_SANDBOX"); err != nil {
+		return err
+	}
+	setFromEnv(&cfg.Push.FCM.CredentialsFile, "FCM_CREDENTIALS_FILE")
+
+	if keys := os.Getenv("SESSION_KEYS"); keys != "" {
+		cfg.SessionKeys = strings.Split(keys, ",")
+	}
+	setFromEnv(&cfg.GothicKey, "GOTHIC_KEY")
+	setFromEnv(&cfg.TokenSecret, "TOKEN_SECRET")
+
+	if cfg.OAuth == nil {
+		cfg.OAuth = map[string]OAuthConfig{}
+	}
+	for _, provider := range oauthProviders {
+		prefix := strings.ToUpper(provider) + "_"
+		oauth := cfg.OAuth[provider]
+		setFromEnv(&oauth.Key, prefix+"KEY")
+		setFromEnv(&oauth.Secret, prefix+"SECRET")
+		setFromEnv(&oauth.Callback, prefix+"CALLBACK")
+		cfg.OAuth[provider] = oauth
+	}
+
+	return nil
+}
+
+// applyFlags overrides the config with the command-line flags that were
+// explicitly set.
+func (cfg *Config) applyFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+
+		switch f.Name {
+		case "dbhost":
+			cfg.Database.Host = value
+		case "dbport":
+			cfg.Database.Port = value
+		case "dbpass":
+			cfg.Database.Password = value
+		case "cachehost":
+			cfg.Redis.Host = value
+		case "cacheport":
+			cfg.Redis.Port = value
+		case "address":
+			cfg.Address = value
+		case "port":
+			cfg.Listen = ":" + value
+		case "store":
+			cfg.Store = value
+		case "tokensecret":
+			cfg.TokenSecret = value
+		}
+	})
+}
+
+func setFromEnv(value *string, name string) {
+	if v := os.Getenv(name); v != "" {
+		*value = v
+	}
+}
+
+func setIntFromEnv(value *int, name string) error {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*value = n
+	}
+	return nil
+}
+
+func setBoolFromEnv(value *bool, name string) error {
+	if v := os.Getenv(name); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*value = b
+	}
+	return nil
+}
+
+// validate returns every problem found in the config.
+func (cfg Config) validate() []error {
+	var errs []error
+
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.Listen == "" {
+		invalid("listen address is required")
+	}
+	if cfg.Address == "" {
+		invalid("server address is required")
+	}
+	if cfg.ContentDir == "" {
+		invalid("content directory is required")
+	}
+
+	switch cfg.Store {
+	case "postgres":
+		if cfg.Database.Host == "" || cfg.Database.Port == "" {
+			invalid("database host and port are required")
+		}
+		if cfg.Database.User == "" || cfg.Database.Name == "" {
+			invalid("database user and name are required")
+		}
+		if !contains(sslModes, cfg.Database.SSLMode) {
+			invalid("unknown database sslmode %q", cfg.Database.SSLMode)
+		}
+		if cfg.Redis.Port == "" {
+			invalid("redis port is required")
+		}
+	case "memory":
+	default:
+		invalid("unknown store %q", cfg.Store)
+	}
+
+	switch cfg.Media.Backend {
+	case "local":
+	case "s3":
+		if cfg.Media.S3.Endpoint == "" || cfg.Media.S3.Bucket == "" {
+			invalid("s3 endpoint and bucket are required")
+		}
+		if cfg.Media.S3.Region == "" {
+			invalid("s3 region is required")
+		}
+		if cfg.Media.S3.AccessKey == "" || cfg.Media.S3.SecretKey == "" {
+			invalid("s3 access key and secret key are required")
+		}
+	default:
+		invalid("unknown media backend %q", cfg.Media.Backend)
+	}
+
+	if cfg.Comments.MaxDepth < 0 {
+		invalid("comment max depth must not be negative")
+	}
+
+	switch cfg.Push.Sender {
+	case "fake":
+	case "live":
+		apns := cfg.Push.APNs
+		if apns.KeyFile == "" && cfg.Push.FCM.CredentialsFile == "" {
+			invalid("live push sender needs an apns key file or fcm credentials file")
+		}
+		if apns.KeyFile != "" && (apns.KeyID == "" || apns.TeamID == "" || apns.Topic == "") {
+			invalid("apns key id, team id and topic are required")
+		}
+	default:
+		invalid("unknown push sender %q", cfg.Push.Sender)
+	}
+
+	if len(cfg.SessionKeys) == 0 {
+		invalid("at least one session key is required")
+	}
+	for i, key := range cfg.SessionKeys {
+		if strings.HasPrefix(key, secretPlaceholder) {
+			invalid("session key %d is the example placeholder", i+1)
+		} else if len(key) < MinSessionKeyLength {
+			invalid("session key %d is shorter than %d bytes", i+1, MinSessionKeyLength)
+		}
+	}
+	if cfg.GothicKey == "" {
+		invalid("gothic key is required")
+	} else if strings.HasPrefix(cfg.GothicKey, secretPlaceholder) {
+		invalid("gothic key is the example placeholder")
+	}
+	if strings.HasPrefix(cfg.TokenSecret, secretPlaceholder) {
+		invalid("token secret is the example placeholder")
+	} else if cfg.TokenSecret != "" && len(cfg.TokenSecret) < MinSessionKeyLength {
+		invalid("token secret is shorter than %d bytes", MinSessionKeyLength)
+	}
+
+	for provider := range cfg.OAuth {
+		if !contains(oauthProviders, provider) {
+			invalid("unknown oauth provider %q", provider)
+		}
+	}
+
+	return errs
+}
+
+// sessionKeyPairs returns the session keys in the form expected by
+// sessions.NewCookieStore, as hash keys without encryption.
+func (cfg Config) sessionKeyPairs() [][]byte {
+	var pairs [][]byte
+	for _, key := range cfg.SessionKeys {
+		pairs = append(pairs, []byte(key), nil)
+	}
+	return pairs
+}
+
+// databaseSource returns the lib/pq connection string.
+func (cfg Config) databaseSource() string {
+	values := []struct{ key, value string }{
+		{"host", cfg.Database.Host},
+		{"port", cfg.Database.Port},
+		{"user", cfg.Database.User},
+		{"password", cfg.Database.Password},
+		{"dbname", cfg.Database.Name},
+		{"sslmode", cfg.Database.SSLMode},
+	}
+
+	var parts []string
+	for _, v := range values {
+		if v.value != "" {
+			value := strings.Replace(v.value, `\`, `\\`, -1)
+			value = strings.Replace(value, `'`, `\'`, -1)
+			parts = append(parts, v.key+"='"+value+"'")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// redacted returns a copy of the config that is safe to print.
+func (cfg Config) redacted() Config {
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "********"
+	}
+
+	out := cfg
+	out.Database.Password = redact(cfg.Database.Password)
+	out.Redis.Password = redact(cfg.Redis.Password)
+	out.Media.S3.SecretKey = redact(cfg.Media.S3.SecretKey)
+	out.GothicKey = redact(cfg.GothicKey)
+	out.TokenSecret = redact(cfg.TokenSecret)
+
+	out.SessionKeys = make([]string, len(cfg.SessionKeys))
+	for i, key := range cfg.SessionKeys {
+		out.SessionKeys[i] = redact(key)
+	}
+
+	out.OAuth = make(map[string]OAuthConfig, len(cfg.OAuth))
+	for provider, oauth := range cfg.OAuth {
+		oauth.Secret = redact(oauth.Secret)
+		out.OAuth[provider] = oauth
+	}
+
+	return out
+}
+
+// configCommand runs the `config` subcommand.
+func configCommand(args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errors.New("usage: config check")
+	}
+
+	data, err := json.MarshalIndent(config.redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	if errs := config.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "config:", err)
+		}
+		return ErrInvalidConfig
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setConfigFlags parses args as the command line, with a fresh copy of the
+// flags so that those set do not leak into other tests.
+func setConfigFlags(t *testing.T, args ...string) {
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	saved.VisitAll(func(f *flag.Flag) {
+		flag.CommandLine.String(f.Name, f.DefValue, f.Usage)
+	})
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeConfigFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	for _, name := range []string{"LISTEN_ADDRESS", "SERVER_ADDRESS", "DB_HOST", "DB_USER", "DB_NAME", "SESSION_KEYS", "FACEBOOK_CALLBACK"} {
+		t.Setenv(name, "")
+	}
+
+	path := writeConfigFile(t, `{
+		"listen": ":9000",
+		"address": "https://file.example.com/",
+		"database": {"host": "file-host", "name": "file_db"},
+		"session_keys": ["file key"]
+	}`)
+
+	// The environment overrides the file, and flags that are set override
+	// the environment
+	t.Setenv("DB_HOST", "env-host")
+	t.Setenv("DB_NAME", "env_db")
+	t.Setenv("SESSION_KEYS", "new key,old key")
+	setConfigFlags(t, "-dbhost", "flag-host")
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setting, got, want string
+	}{
+		{"listen", cfg.Listen, ":9000"},
+		{"database.host", cfg.Database.Host, "flag-host"},
+		{"database.name", cfg.Database.Name, "env_db"},
+		{"database.user", cfg.Database.User, "postgres"},
+		{"database.port", cfg.Database.Port, "5432"},
+		{"session_keys", strings.Join(cfg.SessionKeys, ","), "new key,old key"},
+		{"oauth.facebook.callback", cfg.OAuth["facebook"].Callback, "https://file.example.com/auth/facebook/callback"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s %q, want %q", test.setting, test.got, test.want)
+		}
+	}
+
+	if _, err := loadConfig(writeConfigFile(t, `{"listen": 8080}`)); err == nil {
+		t.Error("loaded a config file of the wrong types")
+	}
+}
+
+func validTestConfig() Config {
+	cfg := defaultConfig()
+	cfg.SessionKeys = []string{strings.Repeat("k", MinSessionKeyLength)}
+	cfg.GothicKey = "gothic key"
+	return cfg
+}
+
+func TestConfigValidate(t *testing.T) {
+	if errs := validTestConfig().validate(); len(errs) != 0 {
+		t.Fatalf("valid config: %v", errs)
+	}
+
+	long := strings.Repeat("s", MinSessionKeyLength)
+	tests := []struct {
+		change func(cfg *Config)
+		want   string
+	}{
+		{func(cfg *Config) { cfg.SessionKeys = nil }, "at least one session key is required"},
+		{func(cfg *Config) { cfg.SessionKeys = append(cfg.SessionKeys, "short") }, "session key 2 is shorter than 32 bytes"},
+		{func(cfg *Config) { cfg.SessionKeys[0] = "replace-with-at-least-32-random-bytes" }, "session key 1 is the example placeholder"},
+		{func(cfg *Config) { cfg.GothicKey = "" }, "gothic key is required"},
+		{func(cfg *Config) { cfg.GothicKey = "replace-with-a-random-key" }, "gothic key is the example placeholder"},
+		{func(cfg *Config) { cfg.TokenSecret = "short" }, "token secret is shorter than 32 bytes"},
+		{func(cfg *Config) { cfg.TokenSecret = "replace-with-" + long }, "token secret is the example placeholder"},
+		{func(cfg *Config) { cfg.Store = "mysql" }, `unknown store "mysql"`},
+		{func(cfg *Config) { cfg.Database.SSLMode = "always" }, `unknown database sslmode "always"`},
+		{func(cfg *Config) { cfg.OAuth["myspace"] = OAuthConfig{} }, `unknown oauth provider "myspace"`},
+	}
+	for _, test := range tests {
+		cfg := validTestConfig()
+		test.change(&cfg)
+
+		errs := cfg.validate()
+		if len(errs) != 1 || errs[0].Error() != test.want {
+			t.Errorf("got %v, want %s", errs, test.want)
+		}
+	}
+
+	cfg := validTestConfig()
+	cfg.TokenSecret = long
+	if errs := cfg.validate(); len(errs) != 0 {
+		t.Errorf("config with a token secret: %v", errs)
+	}
+}
+
+func TestConfigExampleRejected(t *testing.T) {
+	setConfigFlags(t)
+	for _, name := range []string{"SESSION_KEYS", "GOTHIC_KEY", "TOKEN_SECRET"} {
+		t.Setenv(name, "")
+	}
+
+	// A deployment must replace the secrets of the example
+	cfg, err := loadConfig("config.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, err := range cfg.validate() {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"session key 1 is the example placeholder",
+		"gothic key is the example placeholder",
+		"token secret is the example placeholder",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := validTestConfig()
+	cfg.Database.Password = "db password"
+	cfg.TokenSecret = "token secret"
+	cfg.OAuth["facebook"] = OAuthConfig{Key: "facebook key", Secret: "facebook secret"}
+
+	redacted := cfg.redacted()
+	for _, secret := range []string{redacted.Database.Password, redacted.GothicKey, redacted.TokenSecret, redacted.SessionKeys[0], redacted.OAuth["facebook"].Secret} {
+		if secret != "********" {
+			t.Errorf("secret %q is not redacted", secret)
+		}
+	}
+	if redacted.OAuth["facebook"].Key != "facebook key" {
+		t.Errorf("facebook key %q", redacted.OAuth["facebook"].Key)
+	}
+	if cfg.TokenSecret != "token secret" || cfg.SessionKeys[0] == "********" {
+		t.Error("redacting changed the config")
+	}
+}
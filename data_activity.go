@@ -15,6 +15,7 @@ const (
 )
 
 type Activity struct {
+	ID        int64                  `json:"id"`
 	UserID    int64                  `json:"user_id"`
 	Type      int64                  `json:"type"`
 	HoopID    int64                  `json:"hoop_id,omitempty"`
@@ -24,48 +25,71 @@ type Activity struct {
 	CreatedAt time.Time              `json:"created_at"`
 }
 
-func (a *Activity) fetchData() {
+// The lookups of fetchData, which the stores and loader implement
+type (
+	userFinder interface {
+		UserExists(user *User, fetch bool) (bool, *User)
+	}
+	hoopFinder interface {
+		HoopExists(hoop *Hoop, fetch bool) (bool, *Hoop)
+	}
+	storyFinder interface {
+		StoryExists(story *Story, fetch bool) (bool, *Story)
+	}
+)
+
+func (a *Activity) fetchData(users userFinder, hoops hoopFinder, stories storyFinder) {
 	a.Data = make(map[string]interface{})
 
-	if ok, user := userExists(&User{ID: a.UserID}, true); ok {
+	if ok, user := users.UserExists(&User{ID: a.UserID}, true); ok {
 		a.Data["user"] = *user
 	}
 
 	switch a.Type {
 	case ACTIVITY_POST_HOOP:
-		if ok, hoop := hoopExists(&Hoop{ID: a.HoopID}, true); ok {
+		if ok, hoop := hoops.HoopExists(&Hoop{ID: a.HoopID}, true); ok {
 			a.Data["hoop"] = *hoop
 		}
 	case ACTIVITY_POST_STORY:
-		if ok, story := storyExists(&Story{ID: a.StoryID}, true); ok {
+		if ok, story := stories.StoryExists(&Story{ID: a.StoryID}, true); ok {
 			a.Data["story"] = *story
 		}
 	case ACTIVITY_POST_LIKE_HOOP:
-		if ok, hoop := hoopExists(&Hoop{ID: a.HoopID}, true); ok {
+		if ok, hoop := hoops.HoopExists(&Hoop{ID: a.HoopID}, true); ok {
 			a.Data["hoop"] = *hoop
 		}
 	case ACTIVITY_POST_LIKE_STORY:
-		if ok, story := storyExists(&Story{ID: a.StoryID}, true); ok {
+		if ok, story := stories.StoryExists(&Story{ID: a.StoryID}, true); ok {
 			a.Data["story"] = *story
 		}
 	case ACTIVITY_POST_COMMENT_HOOP:
-		if ok, hoop := hoopExists(&Hoop{ID: a.HoopID}, true); ok {
+		if ok, hoop := hoops.HoopExists(&Hoop{ID: a.HoopID}, true); ok {
 			a.Data["hoop"] = *hoop
 		}
 	case ACTIVITY_POST_COMMENT_STORY:
-		if ok, story := storyExists(&Story{ID: a.StoryID}, true); ok {
+		if ok, story := stories.StoryExists(&Story{ID: a.StoryID}, true); ok {
 			a.Data["story"] = *story
 		}
 	}
 }
 
-func getActivities(userID int64) ([]Activity, error) {
+func (s *pgStore) GetActivities(userID int64, page Page) ([]Activity, *Cursor, error) {
+	return s.getActivities(GET_ACTIVITIES_SQL, userID, page)
+}
+
+func (s *pgStore) GetFollowingActivities(userID int64, page Page) ([]Activity, *Cursor, error) {
+	return s.getActivities(GET_FOLLOWING_ACTIVITIES_SQL, userID, page)
+}
+
+// getActivities runs an activity feed query for the user.
+func (s *pgStore) getActivities(query string, userID int64, page Page) ([]Activity, *Cursor, error) {
 	var activities []Activity
 
-	rows, err := db.Query(GET_ACTIVITIES_SQL, userID)
+	rows, err := s.db.Query(query, append([]interface{}{userID}, page.timeKeyset()...)...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer rows.Close()
 
 	var hoopID, storyID sql.NullInt64
 
@@ -73,21 +97,42 @@ func getActivities(userID int64) ([]Activity, error) {
 		var activity Activity
 
 		if err := rows.Scan(
+			&activity.ID,
 			&activity.UserID,
 			&activity.Type,
 			&hoopID,
 			&storyID,
 			&activity.CreatedAt,
 		); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		activity.HoopID = fromNullInt64(hoopID)
 		activity.StoryID = fromNullInt64(storyID)
-		activity.fetchData()
 
 		activities = append(activities, activity)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(activities) > page.Limit {
+		activities = activities[:page.Limit]
+		last := activities[page.Limit-1]
+		next = &Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	l := s.newLoader()
+	for i := range activities {
+		activities[i].fetchData(l, l, l)
+	}
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+	for i := range activities {
+		activities[i].fetchData(l, l, l)
+	}
 
-	return activities, nil
+	return activities, next, nil
 }
@@ -2,36 +2,158 @@ package main
 
 import (
 	"database/sql"
-	"log"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// DeletedCommentText replaces the text of deleted comments, which stay in
+// their thread so that replies keep their place.
+const DeletedCommentText = "[deleted]"
+
+// Comment lists include the first MaxThreadReplies replies of each top-level
+// comment. The rest are paged through its replies cursor, so a popular thread
+// cannot make a page of comments arbitrarily large.
+const MaxThreadReplies = 20
+
 type Comment struct {
-	ID        int64                  `json:"id"`
-	UserID    int64                  `json:"user_id"`
-	HoopID    int64                  `json:"hoop_id,omitempty"`
-	StoryID   int64                  `json:"story_id,omitempty"`
-	User      User                   `json:"user"`
-	Text      string                 `json:"text"`
-	CreatedAt time.Time              `json:"created_at"`
-	UpdatedAt time.Time              `json:"updated_at"`
-	Data      map[string]interface{} `json:"data,omitempty"`
-}
-
-func insertHoopComment(userID, hoopID int64, text string) error {
+	ID        int64      `json:"id"`
+	UserID    int64      `json:"user_id"`
+	HoopID    int64      `json:"hoop_id,omitempty"`
+	StoryID   int64      `json:"story_id,omitempty"`
+	ParentID  int64      `json:"parent_id,omitempty"`
+	RootID    int64      `json:"-"`
+	Depth     int        `json:"depth"`
+	User      User       `json:"user"`
+	Text      string     `json:"text"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+	Replies   []Comment  `json:"replies,omitempty"`
+	// RepliesCursor pages through the replies left out of a thread
+	RepliesCursor string                 `json:"replies_cursor,omitempty"`
+	Data          map[string]interface{} `json:"data,omitempty"`
+}
+
+// reply returns the parent, root and depth of a reply to the comment, or
+// of a top-level comment if there is no parent.
+func (parent *Comment) reply() (parentID, rootID sql.NullInt64, depth int) {
+	if parent == nil {
+		return
+	}
+
+	parentID = sql.NullInt64{Int64: parent.ID, Valid: true}
+	rootID = parentID
+	if parent.RootID != 0 {
+		rootID.Int64 = parent.RootID
+	}
+	return parentID, rootID, parent.Depth + 1
+}
+
+// redact hides the text and author of a deleted comment.
+func (comment *Comment) redact() {
+	if comment.Deleted {
+		comment.Text = DeletedCommentText
+		comment.UserID = 0
+		comment.EditedAt = nil
+	}
+}
+
+// eachComment calls fn for every comment and reply in the threads.
+func eachComment(comments []Comment, fn func(*Comment) error) error {
+	for i := range comments {
+		if err := fn(&comments[i]); err != nil {
+			return err
+		}
+		if err := eachComment(comments[i].Replies, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// threadComments nests the replies, which are in order of creation, under
+// the top-level comments of their thread. Only the first MaxThreadReplies of
+// a thread are kept; as replies are created after their parent, every kept
+// reply still has its parent. A thread with more replies gets the cursor of
+// its last kept reply.
+func threadComments(comments, replies []Comment) {
+	counts := map[int64]int{}
+	last := map[int64]Cursor{}
+	more := map[int64]bool{}
+
+	children := map[int64][]Comment{}
+	for _, reply := range replies {
+		if counts[reply.RootID] == MaxThreadReplies {
+			more[reply.RootID] = true
+			continue
+		}
+		counts[reply.RootID]++
+		last[reply.RootID] = Cursor{CreatedAt: reply.CreatedAt, ID: reply.ID}
+		children[reply.ParentID] = append(children[reply.ParentID], reply)
+	}
+
+	for i := range comments {
+		if more[comments[i].ID] {
+			comments[i].RepliesCursor = last[comments[i].ID].String()
+		}
+	}
+
+	var nest func(comments []Comment)
+	nest = func(comments []Comment) {
+		for i := range comments {
+			replies := children[comments[i].ID]
+			for j := range replies {
+				replies[j].HoopID, replies[j].StoryID = comments[i].HoopID, comments[i].StoryID
+			}
+			comments[i].Replies = replies
+			nest(replies)
+		}
+	}
+	nest(comments)
+}
+
+func (s *pgStore) GetComment(commentID int64) (Comment, error) {
+	var comment Comment
+
+	err := scanComment(s.db.QueryRow(GET_COMMENT_SQL, commentID), &comment, &comment.HoopID, &comment.StoryID)
+	return comment, err
+}
+
+func (s *pgStore) InsertHoopComment(userID, hoopID int64, parent *Comment, text string) error {
 	// Start Transaction
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	parentID, rootID, depth := parent.reply()
+	comment := Comment{UserID: userID, HoopID: hoopID, ParentID: parentID.Int64, RootID: rootID.Int64, Depth: depth, Text: text}
 
 	// Insert Comment
-	if _, err = tx.Exec(INSERT_HOOP_COMMENT_SQL, userID, text, hoopID); err != nil {
+	if err = tx.QueryRow(INSERT_HOOP_COMMENT_SQL, userID, text, hoopID, parentID, rootID, depth).Scan(&comment.ID, &comment.CreatedAt); err != nil {
 		return err
 	}
+	comment.UpdatedAt = comment.CreatedAt
 
 	// Insert Activity
-	if _, err = db.Exec(INSERT_HOOP_COMMENT_ACTIVITY_SQL, userID, ACTIVITY_POST_COMMENT_HOOP, hoopID); err != nil {
+	activity := Activity{UserID: userID, Type: ACTIVITY_POST_COMMENT_HOOP, HoopID: hoopID}
+	if err = tx.QueryRow(INSERT_HOOP_COMMENT_ACTIVITY_SQL, userID, ACTIVITY_POST_COMMENT_HOOP, hoopID).Scan(&activity.ID, &activity.CreatedAt); err != nil {
+		return err
+	}
+
+	// Notify the hoop owner and followers
+	if err := notifyHoop(tx, userID, ACTIVITY_POST_COMMENT_HOOP, hoopID, 0); err != nil {
+		return err
+	}
+
+	// Stream the comment and activity
+	if err := enqueueJob(tx, JOB_STREAM_COMMENT, comment); err != nil {
+		return err
+	}
+	if err := enqueueJob(tx, JOB_STREAM_ACTIVITY, activity); err != nil {
 		return err
 	}
 
@@ -40,23 +162,44 @@ func insertHoopComment(userID, hoopID int64, text string) error {
 		return err
 	}
 
+	wakeJobWorkers()
+
 	return nil
 }
 
-func insertStoryComment(userID, storyID int64, text string) error {
+func (s *pgStore) InsertStoryComment(userID, storyID int64, parent *Comment, text string) error {
 	// Start Transaction
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	parentID, rootID, depth := parent.reply()
+	comment := Comment{UserID: userID, StoryID: storyID, ParentID: parentID.Int64, RootID: rootID.Int64, Depth: depth, Text: text}
 
 	// Insert Comment
-	if _, err = tx.Exec(INSERT_STORY_COMMENT_SQL, userID, text, storyID); err != nil {
+	if err = tx.QueryRow(INSERT_STORY_COMMENT_SQL, userID, text, storyID, parentID, rootID, depth).Scan(&comment.ID, &comment.CreatedAt); err != nil {
 		return err
 	}
+	comment.UpdatedAt = comment.CreatedAt
 
 	// Insert Activity
-	if _, err = db.Exec(INSERT_STORY_COMMENT_ACTIVITY_SQL, userID, ACTIVITY_POST_COMMENT_STORY, storyID); err != nil {
+	activity := Activity{UserID: userID, Type: ACTIVITY_POST_COMMENT_STORY, StoryID: storyID}
+	if err = tx.QueryRow(INSERT_STORY_COMMENT_ACTIVITY_SQL, userID, ACTIVITY_POST_COMMENT_STORY, storyID).Scan(&activity.ID, &activity.CreatedAt); err != nil {
+		return err
+	}
+
+	// Notify the story owner
+	if err := notifyStoryOwner(tx, userID, ACTIVITY_POST_COMMENT_STORY, storyID); err != nil {
+		return err
+	}
+
+	// Stream the comment and activity
+	if err := enqueueJob(tx, JOB_STREAM_COMMENT, comment); err != nil {
+		return err
+	}
+	if err := enqueueJob(tx, JOB_STREAM_ACTIVITY, activity); err != nil {
 		return err
 	}
 
@@ -65,79 +208,228 @@ func insertStoryComment(userID, storyID int64, text string) error {
 		return err
 	}
 
+	wakeJobWorkers()
+
 	return nil
 }
 
-func getHoopComments(hoopID int64) ([]Comment, error) {
-	var comments []Comment
+func (s *pgStore) UpdateComment(commentID int64, text string) error {
+	return s.execComment(UPDATE_COMMENT_SQL, text, commentID)
+}
 
-	rows, err := db.Query(GET_HOOP_COMMENTS_SQL, hoopID)
+func (s *pgStore) DeleteComment(commentID int64) error {
+	return s.execComment(DELETE_COMMENT_SQL, commentID)
+}
+
+// execComment runs a statement on a comment, returning sql.ErrNoRows if it
+// does not exist or was deleted.
+func (s *pgStore) execComment(query string, args ...interface{}) error {
+	result, err := s.db.Exec(query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var text sql.NullString
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
 
-	for rows.Next() {
-		var comment Comment
+	return nil
+}
 
-		if err := rows.Scan(
-			&comment.ID,
-			&comment.UserID,
-			&text,
-			&comment.HoopID,
-			&comment.CreatedAt,
-			&comment.UpdatedAt,
-		); err != nil {
-			return nil, err
+func (s *pgStore) GetHoopComments(hoopID int64, page Page) ([]Comment, *Cursor, error) {
+	comments, next, err := s.getComments(GET_HOOP_COMMENTS_SQL, hoopID, page)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l := s.newLoader()
+	eachComment(comments, func(comment *Comment) error {
+		l.addUser(comment.UserID)
+		return nil
+	})
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+
+	eachComment(comments, func(comment *Comment) error {
+		if user, ok := l.user(comment.UserID); ok && !comment.Deleted {
+			comment.Data = make(map[string]interface{})
+			comment.Data["user"] = user
 		}
-		comment.Text = fromNullString(text)
+		return nil
+	})
 
-		user, err := getUserByID(comment.UserID)
-		if err != nil {
-			log.Println(err)
+	return comments, next, nil
+}
+
+func (s *pgStore) GetStoryComments(storyID int64, page Page) ([]Comment, *Cursor, error) {
+	comments, next, err := s.getComments(GET_STORY_COMMENTS_SQL, storyID, page)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l := s.newLoader()
+	eachComment(comments, func(comment *Comment) error {
+		comment.StoryID, comment.HoopID = comment.HoopID, 0
+		l.addUser(comment.UserID)
+		return nil
+	})
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+
+	eachComment(comments, func(comment *Comment) error {
+		if user, ok := l.user(comment.UserID); ok && !comment.Deleted {
+			comment.User = user
+		}
+		return nil
+	})
+
+	return comments, next, nil
+}
+
+// getComments runs a top-level comment list query and fetches the replies
+// of the comments. The parent hoop or story ID is scanned into HoopID;
+// callers move it to the right field.
+func (s *pgStore) getComments(query string, parentID int64, page Page) ([]Comment, *Cursor, error) {
+	comments, err := s.queryComments(query, true, append([]interface{}{parentID}, page.timeKeyset()...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(comments) > page.Limit {
+		comments = comments[:page.Limit]
+		last := comments[page.Limit-1]
+		next = &Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	if len(comments) == 0 {
+		return comments, next, nil
+	}
+
+	ids := make([]int64, len(comments))
+	for i := range comments {
+		ids[i] = comments[i].ID
+	}
+
+	// One reply more than is kept shows whether a thread has more
+	replies, err := s.queryComments(GET_COMMENT_REPLIES_SQL, false, pq.Array(ids), MaxThreadReplies+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	threadComments(comments, replies)
+
+	return comments, next, nil
+}
+
+func (s *pgStore) GetReplies(rootID int64, page Page) ([]Comment, *Cursor, error) {
+	var replies []Comment
+
+	rows, err := s.db.Query(GET_THREAD_REPLIES_SQL, append([]interface{}{rootID}, page.timeKeyset()...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reply Comment
+		if err := scanComment(rows, &reply, &reply.HoopID, &reply.StoryID); err != nil {
+			return nil, nil, err
+		}
+		replies = append(replies, reply)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(replies) > page.Limit {
+		replies = replies[:page.Limit]
+		last := replies[page.Limit-1]
+		next = &Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	// The author is sent the way the hoop or story comment lists send it
+	for i := range replies {
+		if replies[i].Deleted {
 			continue
 		}
-		comment.Data = make(map[string]interface{})
-		comment.Data["user"] = user
 
-		comments = append(comments, comment)
+		user, err := s.GetUser(replies[i].UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if replies[i].HoopID != 0 {
+			replies[i].Data = map[string]interface{}{"user": user}
+		} else {
+			replies[i].User = user
+		}
 	}
 
-	return comments, nil
+	return replies, next, nil
 }
 
-func getStoryComments(storyID int64) ([]Comment, error) {
+// queryComments runs a comment query. If withParent is set, the column after
+// the comment columns is scanned into HoopID.
+func (s *pgStore) queryComments(query string, withParent bool, args ...interface{}) ([]Comment, error) {
 	var comments []Comment
 
-	rows, err := db.Query(GET_STORY_COMMENTS_SQL, storyID)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
-
-	var text sql.NullString
+	defer rows.Close()
 
 	for rows.Next() {
 		var comment Comment
-
-		if err := rows.Scan(
-			&comment.ID,
-			&comment.UserID,
-			&text,
-			&comment.StoryID,
-			&comment.CreatedAt,
-			&comment.UpdatedAt,
-		); err != nil {
-			return nil, err
+		var extra []interface{}
+		if withParent {
+			extra = append(extra, &comment.HoopID)
 		}
-		comment.Text = fromNullString(text)
 
-		if comment.User, err = getUserByID(comment.UserID); err != nil {
+		if err := scanComment(rows, &comment, extra...); err != nil {
 			return nil, err
 		}
 
 		comments = append(comments, comment)
 	}
 
-	return comments, nil
+	return comments, rows.Err()
+}
+
+// scanComment scans COMMENT_COLUMNS into the comment, followed by the extra
+// columns.
+func scanComment(row interface {
+	Scan(dest ...interface{}) error
+}, comment *Comment, extra ...interface{}) error {
+	var text sql.NullString
+	var parentID, rootID sql.NullInt64
+	var deletedAt *time.Time
+
+	dest := []interface{}{
+		&comment.ID,
+		&comment.UserID,
+		&text,
+		&parentID,
+		&rootID,
+		&comment.Depth,
+		&comment.CreatedAt,
+		&comment.UpdatedAt,
+		&comment.EditedAt,
+		&deletedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+
+	comment.Text = fromNullString(text)
+	comment.ParentID = fromNullInt64(parentID)
+	comment.RootID = fromNullInt64(rootID)
+	comment.Deleted = deletedAt != nil
+	comment.redact()
+
+	return nil
 }
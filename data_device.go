@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Device types that push notifications can be sent to
+const (
+	DEVICE_APNS = "apns"
+	DEVICE_FCM  = "fcm"
+)
+
+var deviceTypes = []string{DEVICE_APNS, DEVICE_FCM}
+
+// Device is a phone that a user registered for push notifications. Token is
+// the APNs device token or FCM registration token.
+type Device struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Type      string    `json:"type"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NotificationPreferences choose which notifications are pushed to a user's
+// devices. Every notification stays in the inbox either way.
+type NotificationPreferences struct {
+	Likes    bool `json:"likes"`
+	Comments bool `json:"comments"`
+	Stories  bool `json:"stories"`
+}
+
+func defaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{Likes: true, Comments: true, Stories: true}
+}
+
+// allows reports whether notifications of the activity type are pushed.
+func (prefs NotificationPreferences) allows(typ int64) bool {
+	switch typ {
+	case ACTIVITY_POST_LIKE_HOOP, ACTIVITY_POST_LIKE_STORY:
+		return prefs.Likes
+	case ACTIVITY_POST_COMMENT_HOOP, ACTIVITY_POST_COMMENT_STORY:
+		return prefs.Comments
+	case ACTIVITY_POST_STORY:
+		return prefs.Stories
+	default:
+		return false
+	}
+}
+
+func (s *pgStore) RegisterDevice(userID int64, typ, token string) (err error) {
+	_, err = s.db.Exec(INSERT_DEVICE_SQL, userID, typ, token)
+	return
+}
+
+// UnregisterDevice removes one of the user's devices. It returns
+// sql.ErrNoRows if the user has no device with the token.
+func (s *pgStore) UnregisterDevice(userID int64, token string) error {
+	result, err := s.db.Exec(DELETE_USER_DEVICE_SQL, userID, token)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DeleteDevice removes a device whatever user it belongs to, such as when
+// the push service reports that its token is no longer valid.
+func (s *pgStore) DeleteDevice(token string) (err error) {
+	_, err = s.db.Exec(DELETE_DEVICE_SQL, token)
+	return
+}
+
+func (s *pgStore) GetDevices(userID int64) ([]Device, error) {
+	var devices []Device
+
+	rows, err := s.db.Query(GET_DEVICES_SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var device Device
+		if err := rows.Scan(
+			&device.ID,
+			&device.UserID,
+			&device.Type,
+			&device.Token,
+			&device.CreatedAt,
+			&device.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// GetNotificationPreferences returns the user's preferences, or the defaults
+// if they never changed them.
+func (s *pgStore) GetNotificationPreferences(userID int64) (NotificationPreferences, error) {
+	var prefs NotificationPreferences
+
+	err := s.db.QueryRow(GET_NOTIFICATION_PREFERENCES_SQL, userID).Scan(&prefs.Likes, &prefs.Comments, &prefs.Stories)
+	if err == sql.ErrNoRows {
+		return defaultNotificationPreferences(), nil
+	}
+	return prefs, err
+}
+
+func (s *pgStore) UpdateNotificationPreferences(userID int64, prefs NotificationPreferences) (err error) {
+	_, err = s.db.Exec(UPSERT_NOTIFICATION_PREFERENCES_SQL, userID, prefs.Likes, prefs.Comments, prefs.Stories)
+	return
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+)
+
+// Profile is a user with their follow counts, as shown on their profile.
+// The hoops a user follows are listed by /api/user/followedhoops.
+type Profile struct {
+	User
+	FollowerCount     int64 `json:"follower_count"`
+	FollowingCount    int64 `json:"following_count"`
+	FollowedHoopCount int64 `json:"followed_hoop_count"`
+
+	// Followed tells whether the user viewing the profile follows the user
+	Followed bool `json:"followed,omitempty"`
+}
+
+// userProfile returns the profile of the user as seen by viewer, who may be
+// nil.
+func userProfile(follows FollowStore, user User, viewer *User) (profile Profile, err error) {
+	profile.User = user
+
+	if profile.FollowerCount, profile.FollowingCount, err = follows.CountFollows(user.ID); err != nil {
+		return
+	}
+
+	if profile.FollowedHoopCount, err = follows.CountFollowedHoops(user.ID); err != nil {
+		return
+	}
+
+	if viewer != nil && viewer.ID != user.ID {
+		if profile.Followed, err = follows.IsFollowing(viewer.ID, user.ID); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *pgStore) Follow(followerID, userID int64) (err error) {
+	_, err = s.db.Exec(INSERT_FOLLOW_SQL, followerID, userID)
+	return
+}
+
+func (s *pgStore) Unfollow(followerID, userID int64) (err error) {
+	_, err = s.db.Exec(DELETE_FOLLOW_SQL, followerID, userID)
+	return
+}
+
+func (s *pgStore) IsFollowing(followerID, userID int64) (bool, error) {
+	count := 0
+	if err := s.db.QueryRow(COUNT_FOLLOW_SQL, followerID, userID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *pgStore) CountFollows(userID int64) (followers, following int64, err error) {
+	err = s.db.QueryRow(COUNT_FOLLOWERS_SQL, userID).Scan(&followers, &following)
+	return
+}
+
+func (s *pgStore) GetFollowers(userID int64, page Page) ([]User, *Cursor, error) {
+	return s.getFollows(GET_FOLLOWERS_SQL, userID, page)
+}
+
+func (s *pgStore) GetFollowing(userID int64, page Page) ([]User, *Cursor, error) {
+	return s.getFollows(GET_FOLLOWING_SQL, userID, page)
+}
+
+// getFollows runs a follow list query, which returns user IDs with the time
+// they were followed.
+func (s *pgStore) getFollows(query string, userID int64, page Page) ([]User, *Cursor, error) {
+	var ids []int64
+	var times []time.Time
+
+	rows, err := s.db.Query(query, append([]interface{}{userID}, page.timeKeyset()...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var createdAt time.Time
+		if err := rows.Scan(&id, &createdAt); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		times = append(times, createdAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(ids) > page.Limit {
+		ids = ids[:page.Limit]
+		next = &Cursor{CreatedAt: times[page.Limit-1], ID: ids[page.Limit-1]}
+	}
+
+	l := s.newLoader()
+	for _, id := range ids {
+		l.addUser(id)
+	}
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+
+	users := make([]User, 0, len(ids))
+	for _, id := range ids {
+		if user, ok := l.user(id); ok {
+			users = append(users, user)
+		}
+	}
+
+	return users, next, nil
+}
+
+func (s *pgStore) FollowHoop(userID, hoopID int64) (err error) {
+	_, err = s.db.Exec(INSERT_HOOP_FOLLOW_SQL, userID, hoopID)
+	return
+}
+
+func (s *pgStore) UnfollowHoop(userID, hoopID int64) (err error) {
+	_, err = s.db.Exec(DELETE_HOOP_FOLLOW_SQL, userID, hoopID)
+	return
+}
+
+func (s *pgStore) IsFollowingHoop(userID, hoopID int64) (bool, error) {
+	count := 0
+	if err := s.db.QueryRow(COUNT_HOOP_FOLLOW_SQL, userID, hoopID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *pgStore) CountFollowedHoops(userID int64) (count int64, err error) {
+	err = s.db.QueryRow(COUNT_HOOP_FOLLOWS_SQL, userID).Scan(&count)
+	return
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"log"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type Hoop struct {
@@ -17,11 +19,43 @@ type Hoop struct {
 	CreatedAt   time.Time              `json:"created_at"`
 	UpdatedAt   time.Time              `json:"updated_at"`
 	Data        map[string]interface{} `json:"data,omitempty"`
+
+	// Distance is the distance in metres from the location of a nearby search
+	Distance *float64 `json:"distance,omitempty"`
+
+	// score is the value that a list of hoops is ordered by
+	score float64
 }
 
-func hoopExists(hoop *Hoop, fetch bool) (bool, *Hoop) {
+// Hoops on a map of a zoom level below HoopClusterMaxZoom are clustered into
+// cells of HoopClusterCellsPerTile across each 256 pixel tile.
+const (
+	HoopClusterMaxZoom      = 14
+	HoopClusterCellsPerTile = 4
+)
+
+// HoopCluster is the hoops in a cell of the map, at the mean of their
+// locations. A cluster of a single hoop names it.
+type HoopCluster struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int64   `json:"count"`
+	HoopID    int64   `json:"hoop_id,omitempty"`
+}
+
+// hoopClusterCellSize returns the width in degrees of the cells that hoops
+// are clustered into at the zoom level. Hoops are not clustered from
+// HoopClusterMaxZoom, where each cell holds the hoops at one location.
+func hoopClusterCellSize(zoom int) float64 {
+	if zoom >= HoopClusterMaxZoom {
+		return 1e-9
+	}
+	return 360 / float64(int64(1)<<uint(zoom)) / HoopClusterCellsPerTile
+}
+
+func (s *pgStore) HoopExists(hoop *Hoop, fetch bool) (bool, *Hoop) {
 	if fetch {
-		if newHoop, err := getHoop(hoop.ID); err != nil {
+		if newHoop, err := s.GetHoop(hoop.ID); err != nil {
 			log.Println(err)
 			return false, nil
 		} else {
@@ -32,7 +66,7 @@ func hoopExists(hoop *Hoop, fetch bool) (bool, *Hoop) {
 	} else {
 		count := 0
 
-		if err := db.QueryRow(COUNT_HOOP_SQL, hoop.ID).Scan(&count); err != nil || count == 0 {
+		if err := s.db.QueryRow(COUNT_HOOP_SQL, hoop.ID).Scan(&count); err != nil || count == 0 {
 			log.Println(err)
 			return false, nil
 		}
@@ -41,8 +75,8 @@ func hoopExists(hoop *Hoop, fetch bool) (bool, *Hoop) {
 	}
 }
 
-func getHoop(hoopID int64) (hoop Hoop, err error) {
-	if err = db.QueryRow(GET_HOOP_SQL, hoopID).Scan(
+func (s *pgStore) GetHoop(hoopID int64) (hoop Hoop, err error) {
+	if err = s.db.QueryRow(GET_HOOP_SQL, hoopID).Scan(
 		&hoop.ID,
 		&hoop.UserID,
 		&hoop.Name,
@@ -55,27 +89,90 @@ func getHoop(hoopID int64) (hoop Hoop, err error) {
 		return
 	}
 
-	if hoop.User, err = getUserByID(hoop.UserID); err != nil {
+	if hoop.User, err = s.GetUser(hoop.UserID); err != nil {
 		return
 	}
 
-	var featuredStory Story
-	if featuredStory, err = getFeaturedStory(hoop.ID); err != nil {
+	if hoop.Data, err = s.hoopData(hoop.ID); err != nil {
 		return
-	} else {
-		hoop.Data = map[string]interface{}{}
-		hoop.Data["featured_story"] = featuredStory
 	}
 
 	return
 }
 
-func getHoops(query string, args ...interface{}) (hoops []Hoop, err error) {
+func (s *pgStore) GetHoops(q HoopQuery, page Page) ([]Hoop, *Cursor, error) {
+	switch {
+	case q.Name != "":
+		return s.getHoops(GET_HOOPS_WITH_NAME_SQL, page, q.Name)
+	case q.UserID != 0:
+		return s.getHoops(GET_MY_HOOPS_SQL, page, q.UserID)
+	case q.FollowerID != 0:
+		return s.getHoops(GET_FOLLOWED_HOOPS_SQL, page, q.FollowerID)
+	case q.ExcludeUserID != 0:
+		return s.getHoops(GET_OTHER_HOOPS_SQL, page, q.ExcludeUserID)
+	case q.Box != nil:
+		return s.getHoops(GET_HOOPS_IN_BOX_SQL, page, q.Box.West, q.Box.South, q.Box.East, q.Box.North)
+	case q.Order == HOOP_ORDER_POPULAR:
+		return s.getHoops(GET_POPULAR_HOOPS_SQL, page)
+	case q.Order == HOOP_ORDER_LATEST:
+		return s.getHoops(GET_LATEST_HOOPS_SQL, page)
+	default:
+		return s.getHoops(GET_HOOPS_SQL, page)
+	}
+}
+
+func (s *pgStore) GetNearbyHoops(latitude, longitude, radius float64, page Page) ([]Hoop, *Cursor, error) {
+	args := []interface{}{latitude, longitude, radius}
+	if page.Cursor == nil {
+		args = append(args, nil, nil, page.Limit+1)
+	} else {
+		args = append(args, page.Cursor.Score, page.Cursor.ID, page.Limit+1)
+	}
+
+	hoops, next, err := s.queryHoops(GET_NEARBY_HOOPS_SQL, page, args...)
+	for i := range hoops {
+		distance := hoops[i].score
+		hoops[i].Distance = &distance
+	}
+
+	return hoops, next, err
+}
+
+func (s *pgStore) GetHoopClusters(box Box, zoom int) ([]HoopCluster, error) {
+	var clusters []HoopCluster
+
+	rows, err := s.db.Query(GET_HOOP_CLUSTERS_SQL, box.West, box.South, box.East, box.North, hoopClusterCellSize(zoom))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cluster HoopCluster
+		if err := rows.Scan(&cluster.Count, &cluster.Latitude, &cluster.Longitude, &cluster.HoopID); err != nil {
+			return nil, err
+		}
+		if cluster.Count > 1 {
+			cluster.HoopID = 0
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, rows.Err()
+}
+
+// getHoops runs a hoop list query whose trailing parameters are the page keyset.
+func (s *pgStore) getHoops(query string, page Page, args ...interface{}) ([]Hoop, *Cursor, error) {
+	return s.queryHoops(query, page, append(args, page.keyset()...)...)
+}
+
+func (s *pgStore) queryHoops(query string, page Page, args ...interface{}) (hoops []Hoop, next *Cursor, err error) {
 	var rows *sql.Rows
 
-	if rows, err = db.Query(query, args...); err != nil {
+	if rows, err = s.db.Query(query, args...); err != nil {
 		return
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var hoop Hoop
@@ -89,34 +186,51 @@ func getHoops(query string, args ...interface{}) (hoops []Hoop, err error) {
 			&hoop.Longitude,
 			&hoop.CreatedAt,
 			&hoop.UpdatedAt,
+			&hoop.score,
 		); err != nil {
 			return
 		}
 
-		if hoop.User, err = getUserByID(hoop.UserID); err != nil {
-			return
-		}
-
-		var featuredStory Story
-		if featuredStory, err = getFeaturedStory(hoop.ID); err != nil {
-			return
-		} else {
-			hoop.Data = map[string]interface{}{}
-			hoop.Data["featured_story"] = featuredStory
-		}
-
 		hoops = append(hoops, hoop)
 	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if len(hoops) > page.Limit {
+		hoops = hoops[:page.Limit]
+		last := hoops[page.Limit-1]
+		next = &Cursor{Score: last.score, CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	l := s.newLoader()
+	l.addHoops(hoops)
+	err = l.load()
 
 	return
 }
 
-func insertHoop(userID int64, name, description, imageURL string, latitude, longitude float64) error {
+// hoopData returns the extra data sent with a hoop. A hoop whose stories
+// have all been deleted has no featured story.
+func (s *pgStore) hoopData(hoopID int64) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+
+	if featuredStory, err := s.GetFeaturedStory(hoopID); err == nil {
+		data["featured_story"] = featuredStory
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *pgStore) InsertHoop(userID int64, name, description string, images Images, latitude, longitude float64) error {
 	// Start Transaction
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
 	var hoopID, storyID int64
 
@@ -126,7 +240,12 @@ func insertHoop(userID int64, name, description, imageURL string, latitude, long
 	}
 
 	// Insert Story
-	if err := tx.QueryRow(INSERT_STORY_SQL, hoopID, userID, name, description, imageURL).Scan(&storyID); err != nil {
+	if err := tx.QueryRow(INSERT_STORY_SQL, hoopID, userID, name, description, images).Scan(&storyID); err != nil {
+		return err
+	}
+
+	// Reference uploaded images
+	if err := referenceUploads(tx, images); err != nil {
 		return err
 	}
 
@@ -136,7 +255,17 @@ func insertHoop(userID int64, name, description, imageURL string, latitude, long
 	}
 
 	// Insert Activity
-	if _, err := tx.Exec(INSERT_POST_HOOP_ACTIVITY_SQL, userID, ACTIVITY_POST_HOOP, hoopID); err != nil {
+	activity := Activity{UserID: userID, Type: ACTIVITY_POST_HOOP, HoopID: hoopID}
+	if err := tx.QueryRow(INSERT_POST_HOOP_ACTIVITY_SQL, userID, ACTIVITY_POST_HOOP, hoopID).Scan(&activity.ID, &activity.CreatedAt); err != nil {
+		return err
+	}
+
+	// Stream the activity
+	if err := enqueueJob(tx, JOB_STREAM_ACTIVITY, activity); err != nil {
+		return err
+	}
+
+	if err := bumpHoopsVersion(tx); err != nil {
 		return err
 	}
 
@@ -145,5 +274,207 @@ func insertHoop(userID int64, name, description, imageURL string, latitude, long
 		return err
 	}
 
+	wakeJobWorkers()
+
 	return nil
 }
+
+func (s *pgStore) UpdateHoop(hoop *Hoop) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(UPDATE_HOOP_SQL, hoop.Name, hoop.Description, hoop.Latitude, hoop.Longitude, hoop.ID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := bumpHoopsVersion(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteHoop deletes the hoop with its stories, comments, likes, activities
+// and follows, and any redirects to it.
+func (s *pgStore) DeleteHoop(hoopID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockHoops(tx, hoopID); err != nil {
+		return err
+	}
+
+	images, err := hoopStoryImages(tx, hoopID)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		DELETE_HOOP_STORY_COMMENTS_SQL,
+		DELETE_HOOP_STORY_ACTIVITIES_SQL,
+		DELETE_HOOP_FEATURED_STORY_BY_HOOP_SQL,
+		DELETE_HOOP_STORIES_SQL,
+		DELETE_HOOP_COMMENTS_SQL,
+		DELETE_HOOP_ACTIVITIES_SQL,
+		DELETE_HOOP_REDIRECTS_SQL,
+		DELETE_HOOP_FOLLOWS_SQL,
+		DELETE_HOOP_SQL,
+	} {
+		if _, err := tx.Exec(query, hoopID); err != nil {
+			return err
+		}
+	}
+
+	for _, images := range images {
+		if err := releaseUploads(tx, images); err != nil {
+			return err
+		}
+	}
+
+	if err := bumpHoopsVersion(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	forgetViews(hoopID, "hoop")
+
+	return nil
+}
+
+// MergeHoops moves the stories, comments, likes, activities and follows of a
+// duplicate hoop to the canonical one, deletes the duplicate and redirects
+// it to the canonical hoop.
+func (s *pgStore) MergeHoops(duplicateID, canonicalID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockHoops(tx, duplicateID, canonicalID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(DELETE_HOOP_FEATURED_STORY_BY_HOOP_SQL, duplicateID); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		MOVE_HOOP_STORIES_SQL,
+		MOVE_HOOP_COMMENTS_SQL,
+		DELETE_DUPLICATE_HOOP_LIKES_SQL,
+		MOVE_HOOP_ACTIVITIES_SQL,
+		MOVE_HOOP_REDIRECTS_SQL,
+		MOVE_HOOP_FOLLOWS_SQL,
+		MOVE_HOOP_NOTIFICATIONS_SQL,
+	} {
+		if _, err := tx.Exec(query, duplicateID, canonicalID); err != nil {
+			return err
+		}
+	}
+
+	// The canonical hoop may have lost all its own stories
+	if _, err := tx.Exec(ELECT_HOOP_FEATURED_STORY_SQL, canonicalID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(DELETE_HOOP_SQL, duplicateID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(INSERT_HOOP_REDIRECT_SQL, duplicateID, canonicalID); err != nil {
+		return err
+	}
+
+	if err := bumpHoopsVersion(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	mergeViews(duplicateID, canonicalID, "hoop")
+
+	return nil
+}
+
+func (s *pgStore) HoopRedirect(hoopID int64) (targetID int64, err error) {
+	err = s.db.QueryRow(GET_HOOP_REDIRECT_SQL, hoopID).Scan(&targetID)
+	return
+}
+
+func (s *pgStore) HoopsVersion() (version int64, err error) {
+	err = s.db.QueryRow(GET_HOOPS_VERSION_SQL).Scan(&version)
+	return
+}
+
+// bumpHoopsVersion changes the version of the hoops in the transaction, so
+// that readers see the new version once they can see the change.
+func bumpHoopsVersion(tx execer) error {
+	_, err := tx.Exec(BUMP_HOOPS_VERSION_SQL)
+	return err
+}
+
+// lockHoops locks the hoops for the rest of the transaction. It returns
+// sql.ErrNoRows if any of them does not exist.
+func lockHoops(tx *sql.Tx, hoopIDs ...int64) error {
+	rows, err := tx.Query(LOCK_HOOPS_SQL, pq.Array(hoopIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if count != len(hoopIDs) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func hoopStoryImages(tx *sql.Tx, hoopID int64) ([]Images, error) {
+	var images []Images
+
+	rows, err := tx.Query(GET_HOOP_STORY_IMAGES_SQL, hoopID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var storyImages Images
+		if err := rows.Scan(&storyImages); err != nil {
+			return nil, err
+		}
+		images = append(images, storyImages)
+	}
+
+	return images, rows.Err()
+}
+
+func (s *pgStore) ViewHoop(hoopID int64) error {
+	return view(hoopID, "hoop")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ClaimJob takes the next due job and holds it for the lease. It returns
+// sql.ErrNoRows if no job is due.
+func (s *pgStore) ClaimJob(lease time.Duration) (job Job, err error) {
+	err = s.db.QueryRow(CLAIM_JOB_SQL, int(lease/time.Second)).Scan(
+		&job.ID,
+		&job.Type,
+		&job.Payload,
+		&job.Attempts,
+		&job.CreatedAt,
+	)
+	return
+}
+
+func (s *pgStore) CompleteJob(jobID int64) (err error) {
+	_, err = s.db.Exec(DELETE_JOB_SQL, jobID)
+	return
+}
+
+func (s *pgStore) RetryJob(jobID int64, delay time.Duration, lastError string) (err error) {
+	_, err = s.db.Exec(RETRY_JOB_SQL, jobID, int(delay/time.Second), lastError)
+	return
+}
+
+// FailJob moves the job to the dead jobs.
+func (s *pgStore) FailJob(jobID int64, lastError string) (err error) {
+	_, err = s.db.Exec(FAIL_JOB_SQL, jobID, lastError)
+	return
+}
+
+func (s *pgStore) GetDeadJobs(page Page) ([]DeadJob, *Cursor, error) {
+	var jobs []DeadJob
+
+	rows, err := s.db.Query(GET_DEAD_JOBS_SQL, page.timeKeyset()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job DeadJob
+		if err := rows.Scan(
+			&job.ID,
+			&job.Type,
+			&job.Payload,
+			&job.Attempts,
+			&job.LastError,
+			&job.CreatedAt,
+			&job.FailedAt,
+		); err != nil {
+			return nil, nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(jobs) > page.Limit {
+		jobs = jobs[:page.Limit]
+		last := jobs[page.Limit-1]
+		next = &Cursor{CreatedAt: last.FailedAt, ID: last.ID}
+	}
+
+	return jobs, next, nil
+}
+
+// RequeueDeadJob queues a dead job again with no attempts. It returns
+// sql.ErrNoRows if there is no such dead job.
+func (s *pgStore) RequeueDeadJob(jobID int64) error {
+	result, err := s.db.Exec(REQUEUE_DEAD_JOB_SQL, jobID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
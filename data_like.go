@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"time"
 )
 
@@ -11,10 +12,9 @@ type Like struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-func toggleLike(userID int64, otherID int64, typ string) error {
+func (s *pgStore) ToggleLike(userID int64, otherID int64, typ string) error {
 	var query string
 	var activity int
-	var err error
 
 	switch typ {
 	case "hoop":
@@ -25,38 +25,69 @@ func toggleLike(userID int64, otherID int64, typ string) error {
 		activity = ACTIVITY_POST_LIKE_STORY
 	}
 
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Check if user liked before
 	var count int64
-	if err := db.QueryRow(query, userID, activity, otherID).Scan(&count); err != nil {
+	if err := tx.QueryRow(query, userID, activity, otherID).Scan(&count); err != nil {
 		return err
 	} else {
 		if count > 0 {
-			if err := deleteLike(userID, otherID, typ); err != nil {
+			if err := deleteLike(tx, userID, otherID, typ); err != nil {
 				return err
 			}
-			return nil
+			return tx.Commit()
 		}
 	}
 
+	inserted := Activity{UserID: userID, Type: int64(activity)}
+
 	switch typ {
 	case "hoop":
 		query = INSERT_HOOP_LIKE_ACTIVITY_SQL
+		inserted.HoopID = otherID
 	case "story":
 		query = INSERT_STORY_LIKE_ACTIVITY_SQL
+		inserted.StoryID = otherID
 	}
 
 	// Insert Activity
-	if _, err = db.Exec(query, userID, activity, otherID); err != nil {
+	if err = tx.QueryRow(query, userID, activity, otherID).Scan(&inserted.ID, &inserted.CreatedAt); err != nil {
 		return err
 	}
 
+	// Notify the owner, and the followers of a hoop
+	switch typ {
+	case "hoop":
+		err = notifyHoop(tx, userID, activity, otherID, 0)
+	case "story":
+		err = notifyStoryOwner(tx, userID, activity, otherID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Stream the activity
+	if err := enqueueJob(tx, JOB_STREAM_ACTIVITY, inserted); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	wakeJobWorkers()
+
 	return nil
 }
 
-func deleteLike(userID int64, otherID int64, typ string) error {
+func deleteLike(tx *sql.Tx, userID int64, otherID int64, typ string) error {
 	var query string
 	var activity int
-	var err error
 
 	switch typ {
 	case "hoop":
@@ -68,9 +99,30 @@ func deleteLike(userID int64, otherID int64, typ string) error {
 	}
 
 	// Delete Activity
-	if _, err = db.Exec(query, userID, activity, otherID); err != nil {
+	if _, err := tx.Exec(query, userID, activity, otherID); err != nil {
+		return err
+	}
+
+	// Take back the notifications of the like
+	switch typ {
+	case "hoop":
+		query = DELETE_HOOP_NOTIFICATIONS_BY_ACTOR_SQL
+	case "story":
+		query = DELETE_STORY_NOTIFICATIONS_BY_ACTOR_SQL
+	}
+	if _, err := tx.Exec(query, userID, activity, otherID); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (s *pgStore) CountHoopLikes(hoopID int64) (count int64, err error) {
+	err = s.db.QueryRow(COUNT_HOOP_LIKES_SQL, hoopID).Scan(&count)
+	return
+}
+
+func (s *pgStore) CountStoryLikes(storyID int64) (count int64, err error) {
+	err = s.db.QueryRow(COUNT_STORY_LIKES_SQL, storyID).Scan(&count)
+	return
+}
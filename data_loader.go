@@ -0,0 +1,415 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lib/pq"
+)
+
+// loader fetches the users, hoops and stories that a list refers to with one
+// query for each kind, rather than with queries for each item of the list.
+//
+// It implements the lookups of fetchData in two passes. Before load, lookups
+// only collect the IDs asked for and find nothing; after load, they find
+// what was loaded.
+type loader struct {
+	s       *pgStore
+	loaded  bool
+	users   map[int64]*User
+	hoops   map[int64]*Hoop
+	stories map[int64]*Story
+}
+
+func (s *pgStore) newLoader() *loader {
+	return &loader{
+		s:       s,
+		users:   make(map[int64]*User),
+		hoops:   make(map[int64]*Hoop),
+		stories: make(map[int64]*Story),
+	}
+}
+
+func (l *loader) addUser(userID int64) {
+	if _, ok := l.users[userID]; !ok {
+		l.users[userID] = nil
+	}
+}
+
+func (l *loader) addHoop(hoopID int64) {
+	if _, ok := l.hoops[hoopID]; !ok {
+		l.hoops[hoopID] = nil
+	}
+}
+
+// addHoops adds hoops that were already queried, to be filled in by load.
+func (l *loader) addHoops(hoops []Hoop) {
+	for i := range hoops {
+		l.hoops[hoops[i].ID] = &hoops[i]
+	}
+}
+
+func (l *loader) addStory(storyID int64) {
+	if _, ok := l.stories[storyID]; !ok {
+		l.stories[storyID] = nil
+	}
+}
+
+// load fetches what was added: the stories, then the hoops with their
+// featured stories, then every user any of them refers to. Hoops get their
+// user and featured story as GetHoop returns them. Stories are returned as
+// StoryExists returns them, without their hoop and user.
+func (l *loader) load() error {
+	if err := l.loadStories(); err != nil {
+		return err
+	}
+
+	featured, err := l.loadHoops()
+	if err != nil {
+		return err
+	}
+
+	for _, hoop := range l.hoops {
+		if hoop != nil {
+			l.addUser(hoop.UserID)
+		}
+	}
+	for _, story := range featured {
+		l.addUser(story.UserID)
+	}
+
+	if err := l.loadUsers(); err != nil {
+		return err
+	}
+
+	for _, hoop := range l.hoops {
+		if hoop == nil {
+			continue
+		}
+
+		if user := l.users[hoop.UserID]; user != nil {
+			hoop.User = *user
+		}
+
+		hoop.Data = map[string]interface{}{}
+		if story, ok := featured[hoop.ID]; ok {
+			if user := l.users[story.UserID]; user != nil {
+				story.User = *user
+			}
+			hoop.Data["featured_story"] = story
+		}
+	}
+
+	l.loaded = true
+	return nil
+}
+
+func (l *loader) loadStories() error {
+	var ids []int64
+	for id, story := range l.stories {
+		if story == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	stories, err := queryStoryRows(l.s.db, GET_STORIES_BY_IDS_SQL, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	for i := range stories {
+		l.stories[stories[i].ID] = &stories[i]
+	}
+	return nil
+}
+
+// loadHoops fetches the hoops that were added by ID, and returns the
+// featured stories of every hoop by hoop ID.
+func (l *loader) loadHoops() (map[int64]Story, error) {
+	var ids []int64
+	for id, hoop := range l.hoops {
+		if hoop == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) > 0 {
+		rows, err := l.s.db.Query(GET_HOOPS_BY_IDS_SQL, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hoop Hoop
+			if err := rows.Scan(
+				&hoop.ID,
+				&hoop.UserID,
+				&hoop.Name,
+				&hoop.Description,
+				&hoop.Latitude,
+				&hoop.Longitude,
+				&hoop.CreatedAt,
+				&hoop.UpdatedAt,
+			); err != nil {
+				return nil, err
+			}
+			l.hoops[hoop.ID] = &hoop
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var hoopIDs []int64
+	for id, hoop := range l.hoops {
+		if hoop != nil {
+			hoopIDs = append(hoopIDs, id)
+		}
+	}
+	if len(hoopIDs) == 0 {
+		return nil, nil
+	}
+
+	stories, err := queryStoryRows(l.s.db, GET_FEATURED_STORIES_SQL, pq.Array(hoopIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	featured := make(map[int64]Story, len(stories))
+	for _, story := range stories {
+		featured[story.HoopID] = story
+	}
+	return featured, nil
+}
+
+// loadUsers fetches the users that were added, with their last activity
+// check times from Redis in a single round trip.
+func (l *loader) loadUsers() error {
+	var ids []int64
+	for id, user := range l.users {
+		if user == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	users, err := l.s.getUsers(ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range users {
+		l.users[users[i].ID] = &users[i]
+	}
+	return nil
+}
+
+// user returns a loaded user, adding its ID to be loaded before load.
+func (l *loader) user(userID int64) (User, bool) {
+	if !l.loaded {
+		l.addUser(userID)
+		return User{}, false
+	}
+
+	if user := l.users[userID]; user != nil {
+		return *user, true
+	}
+	return User{}, false
+}
+
+func (l *loader) UserExists(user *User, fetch bool) (bool, *User) {
+	found, ok := l.user(user.ID)
+	if ok {
+		*user = found
+	}
+	return ok, user
+}
+
+func (l *loader) HoopExists(hoop *Hoop, fetch bool) (bool, *Hoop) {
+	if !l.loaded {
+		l.addHoop(hoop.ID)
+		return false, nil
+	}
+
+	if found := l.hoops[hoop.ID]; found != nil {
+		*hoop = *found
+		return true, hoop
+	}
+	return false, nil
+}
+
+func (l *loader) StoryExists(story *Story, fetch bool) (bool, *Story) {
+	if !l.loaded {
+		l.addStory(story.ID)
+		return false, nil
+	}
+
+	if found := l.stories[story.ID]; found != nil {
+		*story = *found
+		return true, story
+	}
+	return false, nil
+}
+
+// getUsers returns the users with the IDs, leaving out those that do not
+// exist.
+func (s *pgStore) getUsers(ids []int64) ([]User, error) {
+	var users []User
+
+	rows, err := s.db.Query(GET_USERS_BY_IDS_SQL, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(users))
+	for i := range users {
+		keys[i] = fmt.Sprintf("user:%d", users[i].ID)
+	}
+
+	// Like GetUser, users are returned without their check time if Redis fails
+	if times, err := hgetInt64s(keys, "lastActivityCheckTime"); err != nil {
+		log.Println(err)
+	} else {
+		for i := range users {
+			if t, ok := times[keys[i]]; ok {
+				users[i].LatestActivityCheckTime = time.Unix(t, 0)
+			}
+		}
+	}
+
+	return users, nil
+}
+
+// scanUser scans the user columns of GET_USER_BY_ID_SQL into the user.
+func scanUser(row interface {
+	Scan(dest ...interface{}) error
+}, user *User) error {
+	var firstname, lastname, gender, birthdate, description, email, password, facebookID, instagramID, twitterID sql.NullString
+
+	if err := row.Scan(
+		&user.ID,
+		&firstname,
+		&lastname,
+		&gender,
+		&birthdate,
+		&description,
+		&email,
+		&password,
+		&facebookID,
+		&instagramID,
+		&twitterID,
+		&user.Images,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.IsAdmin,
+	); err != nil {
+		return err
+	}
+
+	user.Firstname = fromNullString(firstname)
+	user.Lastname = fromNullString(lastname)
+	user.Gender = fromNullString(gender)
+	user.Birthdate = fromNullString(birthdate)
+	user.Description = fromNullString(description)
+	user.Email = fromNullString(email)
+	user.Password = fromNullString(password)
+	user.FacebookID = fromNullString(facebookID)
+	user.InstagramID = fromNullString(instagramID)
+	user.TwitterID = fromNullString(twitterID)
+
+	return nil
+}
+
+// queryStoryRows runs a query that returns the story columns of
+// GET_STORY_SQL.
+func queryStoryRows(q queryer, query string, args ...interface{}) ([]Story, error) {
+	var stories []Story
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var story Story
+		var name, description sql.NullString
+
+		if err := rows.Scan(
+			&story.ID,
+			&story.HoopID,
+			&story.UserID,
+			&name,
+			&description,
+			&story.Images,
+			&story.CreatedAt,
+			&story.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		story.Name = fromNullString(name)
+		story.Description = fromNullString(description)
+
+		stories = append(stories, story)
+	}
+
+	return stories, rows.Err()
+}
+
+// hgetInt64s reads an integer field of each of the Redis hashes in one round
+// trip. Hashes without the field are left out.
+func hgetInt64s(keys []string, field string) (map[string]int64, error) {
+	values := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	red, err := redisInstance()
+	if err != nil {
+		return nil, err
+	}
+	defer red.Close()
+
+	for _, key := range keys {
+		if err := red.Send("HGET", key, field); err != nil {
+			return nil, err
+		}
+	}
+	if err := red.Flush(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		value, err := redis.Int64(red.Receive())
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+
+	return values, nil
+}
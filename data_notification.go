@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Notification tells a user about an activity. Its Type is the type of the
+// activity.
+type Notification struct {
+	ID        int64                  `json:"id"`
+	UserID    int64                  `json:"user_id"`
+	ActorID   int64                  `json:"actor_id"`
+	Type      int64                  `json:"type"`
+	HoopID    int64                  `json:"hoop_id,omitempty"`
+	StoryID   int64                  `json:"story_id,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	ReadAt    *time.Time             `json:"read_at,omitempty"`
+}
+
+func (n *Notification) fetchData(users userFinder, hoops hoopFinder, stories storyFinder) {
+	n.Data = make(map[string]interface{})
+
+	if ok, user := users.UserExists(&User{ID: n.ActorID}, true); ok {
+		n.Data["actor"] = *user
+	}
+
+	if n.StoryID != 0 {
+		if ok, story := stories.StoryExists(&Story{ID: n.StoryID}, true); ok {
+			n.Data["story"] = *story
+		}
+	} else if n.HoopID != 0 {
+		if ok, hoop := hoops.HoopExists(&Hoop{ID: n.HoopID}, true); ok {
+			n.Data["hoop"] = *hoop
+		}
+	}
+}
+
+// notifyHoop notifies the owner and followers of the hoop, other than the
+// actor, of an activity on it. storyID is 0 unless the activity is about a
+// story posted to the hoop.
+func notifyHoop(tx *sql.Tx, actorID int64, typ int, hoopID, storyID int64) error {
+	story := sql.NullInt64{Int64: storyID, Valid: storyID != 0}
+
+	return notify(tx, INSERT_HOOP_NOTIFICATIONS_SQL, actorID, typ, hoopID, story)
+}
+
+// notifyStoryOwner notifies the owner of the story of an activity on it,
+// unless they are the actor.
+func notifyStoryOwner(tx *sql.Tx, actorID int64, typ int, storyID int64) error {
+	return notify(tx, INSERT_STORY_NOTIFICATION_SQL, actorID, typ, storyID)
+}
+
+// notify runs a query that inserts notifications and queues a push of each.
+func notify(tx *sql.Tx, query string, args ...interface{}) error {
+	notifications, err := queryNotifications(tx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	for _, notification := range notifications {
+		if err := enqueueJob(tx, JOB_PUSH_NOTIFICATION, notification); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *pgStore) GetNotifications(userID int64, page Page) ([]Notification, *Cursor, error) {
+	notifications, err := queryNotifications(s.db, GET_NOTIFICATIONS_SQL, append([]interface{}{userID}, page.timeKeyset()...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(notifications) > page.Limit {
+		notifications = notifications[:page.Limit]
+		last := notifications[page.Limit-1]
+		next = &Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	l := s.newLoader()
+	for i := range notifications {
+		notifications[i].fetchData(l, l, l)
+	}
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+	for i := range notifications {
+		notifications[i].fetchData(l, l, l)
+	}
+
+	return notifications, next, nil
+}
+
+// queryNotifications runs a query that returns NOTIFICATION_COLUMNS.
+func queryNotifications(q queryer, query string, args ...interface{}) ([]Notification, error) {
+	var notifications []Notification
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var notification Notification
+		var hoopID, storyID sql.NullInt64
+
+		if err := rows.Scan(
+			&notification.ID,
+			&notification.UserID,
+			&notification.ActorID,
+			&notification.Type,
+			&hoopID,
+			&storyID,
+			&notification.CreatedAt,
+			&notification.ReadAt,
+		); err != nil {
+			return nil, err
+		}
+
+		notification.HoopID = fromNullInt64(hoopID)
+		notification.StoryID = fromNullInt64(storyID)
+
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, rows.Err()
+}
+
+func (s *pgStore) CountUnreadNotifications(userID int64) (count int64, err error) {
+	err = s.db.QueryRow(COUNT_UNREAD_NOTIFICATIONS_SQL, userID).Scan(&count)
+	return
+}
+
+// ReadNotification marks one of the user's notifications read. It returns
+// sql.ErrNoRows if the user has no such notification.
+func (s *pgStore) ReadNotification(userID, notificationID int64) error {
+	result, err := s.db.Exec(READ_NOTIFICATION_SQL, notificationID, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *pgStore) ReadAllNotifications(userID int64) (err error) {
+	_, err = s.db.Exec(READ_ALL_NOTIFICATIONS_SQL, userID)
+	return
+}
+
+// DeleteReadNotifications deletes the notifications read before the given
+// time and returns how many were deleted.
+func (s *pgStore) DeleteReadNotifications(before time.Time) (int64, error) {
+	result, err := s.db.Exec(DELETE_READ_NOTIFICATIONS_SQL, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
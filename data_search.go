@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Types of search results
+const (
+	SEARCH_HOOP    = "hoop"
+	SEARCH_STORY   = "story"
+	SEARCH_COMMENT = "comment"
+	SEARCH_USER    = "user"
+)
+
+var searchTypes = []string{SEARCH_HOOP, SEARCH_STORY, SEARCH_COMMENT, SEARCH_USER}
+
+// Matches are marked in highlights by the store with private use characters,
+// which searchHighlight turns into mark elements once the text is escaped.
+const (
+	searchMarkStart = "\ue000"
+	searchMarkStop  = "\ue001"
+)
+
+var searchHeadlineOptions = fmt.Sprintf("StartSel=%s, StopSel=%s, MaxFragments=2, MinWords=5, MaxWords=20", searchMarkStart, searchMarkStop)
+
+var searchMarks = strings.NewReplacer(searchMarkStart, "<mark>", searchMarkStop, "</mark>")
+
+// searchHighlight returns the text of a highlight as HTML.
+func searchHighlight(text string) string {
+	return searchMarks.Replace(html.EscapeString(text))
+}
+
+// SearchResult is a hoop, story, comment or user that matched a search. Its
+// highlight is HTML, with the matched words in mark elements. Anyone can
+// find users by name, so users are found without their email.
+type SearchResult struct {
+	Type      string      `json:"type"`
+	ID        int64       `json:"id"`
+	Rank      float64     `json:"rank"`
+	Highlight string      `json:"highlight"`
+	Data      interface{} `json:"data"`
+
+	createdAt time.Time
+}
+
+func (s *pgStore) Search(q SearchQuery, page Page) ([]SearchResult, *Cursor, error) {
+	var results []SearchResult
+	var next *Cursor
+
+	args := append([]interface{}{q.Text, pq.Array(q.Types), searchHeadlineOptions}, page.keyset()...)
+	rows, err := s.db.Query(SEARCH_SQL, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result SearchResult
+		var headline string
+
+		if err := rows.Scan(&result.Type, &result.ID, &result.Rank, &headline, &result.createdAt); err != nil {
+			return nil, nil, err
+		}
+
+		result.Highlight = searchHighlight(headline)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(results) > page.Limit {
+		results = results[:page.Limit]
+		last := results[page.Limit-1]
+		next = &Cursor{Score: last.Rank, CreatedAt: last.createdAt, ID: last.ID}
+	}
+
+	// Load what was found, then leave out anything deleted since
+	l := s.newLoader()
+	var commentIDs []int64
+	for _, result := range results {
+		switch result.Type {
+		case SEARCH_HOOP:
+			l.addHoop(result.ID)
+		case SEARCH_STORY:
+			l.addStory(result.ID)
+		case SEARCH_COMMENT:
+			commentIDs = append(commentIDs, result.ID)
+		case SEARCH_USER:
+			l.addUser(result.ID)
+		}
+	}
+
+	comments := make(map[int64]Comment, len(commentIDs))
+	if len(commentIDs) > 0 {
+		rows, err := s.db.Query(GET_COMMENTS_BY_IDS_SQL, pq.Array(commentIDs))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var comment Comment
+			if err := scanComment(rows, &comment, &comment.HoopID, &comment.StoryID); err != nil {
+				return nil, nil, err
+			}
+			comments[comment.ID] = comment
+			l.addUser(comment.UserID)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+
+	found := results[:0]
+	for _, result := range results {
+		switch result.Type {
+		case SEARCH_HOOP:
+			if ok, hoop := l.HoopExists(&Hoop{ID: result.ID}, true); ok {
+				result.Data = *hoop
+			}
+		case SEARCH_STORY:
+			if ok, story := l.StoryExists(&Story{ID: result.ID}, true); ok {
+				result.Data = *story
+			}
+		case SEARCH_COMMENT:
+			if comment, ok := comments[result.ID]; ok && !comment.Deleted {
+				comment.User, _ = l.user(comment.UserID)
+				result.Data = comment
+			}
+		case SEARCH_USER:
+			if user, ok := l.user(result.ID); ok {
+				user.Email = ""
+				result.Data = user
+			}
+		}
+
+		if result.Data != nil {
+			found = append(found, result)
+		}
+	}
+
+	return found, next, nil
+}
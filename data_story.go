@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"sort"
 	"time"
 )
 
@@ -14,7 +16,7 @@ type Story struct {
 	User        User      `json:"user"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
-	ImageURL    string    `json:"image_url"`
+	Images      Images    `json:"images"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	viewCount   int64     `json:"-"`
@@ -27,7 +29,7 @@ func (stories MostViewedStories) Len() int {
 }
 
 func (stories MostViewedStories) Less(i, j int) bool {
-	return stories[i].viewCount > stories[j].viewCount
+	return descending(stories[i].viewCursor(), stories[j].viewCursor())
 }
 
 func (stories MostViewedStories) Swap(i, j int) {
@@ -36,17 +38,21 @@ func (stories MostViewedStories) Swap(i, j int) {
 	stories[j] = tmp
 }
 
-func storyExists(story *Story, fetch bool) (bool, *Story) {
+func (story Story) viewCursor() Cursor {
+	return Cursor{Score: float64(story.viewCount), CreatedAt: story.CreatedAt, ID: story.ID}
+}
+
+func (s *pgStore) StoryExists(story *Story, fetch bool) (bool, *Story) {
 	if fetch {
-		var name, description, imageURL sql.NullString
+		var name, description sql.NullString
 
-		if err := db.QueryRow(GET_STORY_SQL, story.ID).Scan(
+		if err := s.db.QueryRow(GET_STORY_SQL, story.ID).Scan(
 			&story.ID,
 			&story.HoopID,
 			&story.UserID,
 			&name,
 			&description,
-			&imageURL,
+			&story.Images,
 			&story.CreatedAt,
 			&story.UpdatedAt,
 		); err != nil {
@@ -56,12 +62,11 @@ func storyExists(story *Story, fetch bool) (bool, *Story) {
 
 		story.Name = fromNullString(name)
 		story.Description = fromNullString(description)
-		story.ImageURL = fromNullString(imageURL)
 
 		return true, story
 	} else {
 		count := 0
-		if err := db.QueryRow(COUNT_STORY_SQL, story.ID).Scan(&count); err != nil || count == 0 {
+		if err := s.db.QueryRow(COUNT_STORY_SQL, story.ID).Scan(&count); err != nil || count == 0 {
 			log.Println(err)
 			return false, nil
 		}
@@ -69,63 +74,96 @@ func storyExists(story *Story, fetch bool) (bool, *Story) {
 	}
 }
 
-func getStory(storyID int64) (story Story, err error) {
-	if err = db.QueryRow(GET_STORY_SQL, storyID).Scan(
+func (s *pgStore) GetStory(storyID int64) (story Story, err error) {
+	if err = s.db.QueryRow(GET_STORY_SQL, storyID).Scan(
 		&story.ID,
 		&story.HoopID,
 		&story.UserID,
 		&story.Name,
 		&story.Description,
-		&story.ImageURL,
+		&story.Images,
 		&story.CreatedAt,
 		&story.UpdatedAt,
 	); err != nil {
 		return
 	}
 
-	if story.Hoop, err = getHoop(story.HoopID); err != nil {
+	if story.Hoop, err = s.GetHoop(story.HoopID); err != nil {
 		return
 	}
 
-	if story.User, err = getUserByID(story.UserID); err != nil {
+	if story.User, err = s.GetUser(story.UserID); err != nil {
 		return
 	}
 
 	return
 }
 
-func getFeaturedStory(hoopID int64) (story Story, err error) {
-	if err = db.QueryRow(GET_FEATURED_STORY_SQL, hoopID).Scan(
+func (s *pgStore) GetFeaturedStory(hoopID int64) (story Story, err error) {
+	if err = s.db.QueryRow(GET_FEATURED_STORY_SQL, hoopID).Scan(
 		&story.ID,
 		&story.HoopID,
 		&story.UserID,
 		&story.Name,
 		&story.Description,
-		&story.ImageURL,
+		&story.Images,
 		&story.CreatedAt,
 		&story.UpdatedAt,
 	); err != nil {
 		return
 	}
 
-	if story.User, err = getUserByID(story.UserID); err != nil {
+	if story.User, err = s.GetUser(story.UserID); err != nil {
 		return
 	}
 
 	return
 }
 
-func getStories(query string, hoopID int64) ([]Story, error) {
+func (s *pgStore) GetStories(hoopID int64, order int, page Page) ([]Story, *Cursor, error) {
+	switch order {
+	case STORY_ORDER_LATEST:
+		return s.getStories(GET_LATEST_STORIES_SQL, page, hoopID)
+	case STORY_ORDER_MOST_COMMENTED:
+		return s.getStories(GET_MOST_COMMENTED_STORIES_SQL, page, hoopID)
+	case STORY_ORDER_MOST_LIKED:
+		return s.getStories(GET_MOST_LIKED_STORIES_SQL, page, hoopID)
+	case STORY_ORDER_MOST_VIEWED:
+		return s.getMostViewedStories(hoopID, page)
+	default:
+		return s.getStories(GET_STORIES_SQL, page, hoopID)
+	}
+}
+
+// getStories runs a story list query whose trailing parameters are the page keyset.
+func (s *pgStore) getStories(query string, page Page, args ...interface{}) ([]Story, *Cursor, error) {
+	stories, scores, err := s.queryStories(query, append(args, page.keyset()...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(stories) > page.Limit {
+		stories = stories[:page.Limit]
+		last := stories[page.Limit-1]
+		return stories, &Cursor{Score: scores[page.Limit-1], CreatedAt: last.CreatedAt, ID: last.ID}, nil
+	}
+
+	return stories, nil, nil
+}
+
+func (s *pgStore) queryStories(query string, args ...interface{}) ([]Story, []float64, error) {
 	var stories []Story
+	var scores []float64
 
-	rows, err := db.Query(query, hoopID)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var story Story
+		var score float64
 
 		if err := rows.Scan(
 			&story.ID,
@@ -133,40 +171,189 @@ func getStories(query string, hoopID int64) ([]Story, error) {
 			&story.UserID,
 			&story.Name,
 			&story.Description,
-			&story.ImageURL,
+			&story.Images,
 			&story.CreatedAt,
 			&story.UpdatedAt,
+			&score,
 		); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		stories = append(stories, story)
+		scores = append(scores, score)
+	}
+
+	return stories, scores, rows.Err()
+}
+
+// getMostViewedStories orders stories by their view count kept in Redis,
+// so the page is cut in memory.
+func (s *pgStore) getMostViewedStories(hoopID int64, page Page) ([]Story, *Cursor, error) {
+	stories, _, err := s.queryStories(GET_ALL_STORIES_SQL, hoopID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, len(stories))
+	for i := range stories {
+		keys[i] = fmt.Sprintf("story:%d", stories[i].ID)
+	}
+
+	counts, err := hgetInt64s(keys, "view_count")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range stories {
+		stories[i].viewCount = counts[keys[i]]
 	}
 
-	return stories, nil
+	sort.Sort(MostViewedStories(stories))
+
+	start, end, next := page.window(len(stories), func(i int) Cursor {
+		return stories[i].viewCursor()
+	}, descending)
+
+	return stories[start:end], next, nil
 }
 
-func insertStory(hoopID, userID int64, name, description, imageURL string) error {
+func (s *pgStore) InsertStory(hoopID, userID int64, name, description string, images Images) error {
 	var storyID int64
 
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
 	// Insert Story
-	if err := tx.QueryRow(INSERT_STORY_SQL, hoopID, userID, name, description, imageURL).Scan(&storyID); err != nil {
+	if err := tx.QueryRow(INSERT_STORY_SQL, hoopID, userID, name, description, images).Scan(&storyID); err != nil {
+		return err
+	}
+
+	// Reference uploaded images
+	if err := referenceUploads(tx, images); err != nil {
 		return err
 	}
 
 	// Insert Activity
-	if _, err := tx.Exec(INSERT_POST_STORY_ACTIVITY_SQL, userID, ACTIVITY_POST_STORY, storyID); err != nil {
+	activity := Activity{UserID: userID, Type: ACTIVITY_POST_STORY, StoryID: storyID}
+	if err := tx.QueryRow(INSERT_POST_STORY_ACTIVITY_SQL, userID, ACTIVITY_POST_STORY, storyID).Scan(&activity.ID, &activity.CreatedAt); err != nil {
+		return err
+	}
+
+	// Notify the hoop owner and followers
+	if err := notifyHoop(tx, userID, ACTIVITY_POST_STORY, hoopID, storyID); err != nil {
+		return err
+	}
+
+	// Stream the activity
+	if err := enqueueJob(tx, JOB_STREAM_ACTIVITY, activity); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	wakeJobWorkers()
+
+	return nil
+}
+
+func (s *pgStore) UpdateStory(story *Story) error {
+	var hoopID int64
+	var oldImages Images
+
+	tx, err := s.db.Begin()
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(GET_STORY_FOR_UPDATE_SQL, story.ID).Scan(&hoopID, &oldImages); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(UPDATE_STORY_SQL, story.Name, story.Description, story.Images, story.ID); err != nil {
+		return err
+	}
+
+	// Move references to the new images
+	if err := referenceUploads(tx, story.Images); err != nil {
+		return err
+	}
+
+	if err := releaseUploads(tx, oldImages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteStory deletes the story with its comments, likes and activities. If
+// it was the featured story of its hoop, the latest remaining story of the
+// hoop is featured instead.
+func (s *pgStore) DeleteStory(storyID int64) error {
+	var hoopID int64
+	var images Images
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(GET_STORY_FOR_UPDATE_SQL, storyID).Scan(&hoopID, &images); err != nil {
+		return err
+	}
+
+	// Delete Comments
+	if _, err := tx.Exec(DELETE_STORY_COMMENTS_SQL, storyID); err != nil {
+		return err
+	}
+
+	// Delete Activities, including likes
+	if _, err := tx.Exec(DELETE_STORY_ACTIVITIES_SQL, storyID); err != nil {
+		return err
+	}
+
+	// Delete HoopFeaturedStory
+	result, err := tx.Exec(DELETE_HOOP_FEATURED_STORY_SQL, storyID)
+	if err != nil {
+		return err
+	}
+
+	featured, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// Delete Story
+	if _, err := tx.Exec(DELETE_STORY_SQL, storyID); err != nil {
+		return err
+	}
+
+	if err := releaseUploads(tx, images); err != nil {
+		return err
+	}
+
+	// Elect a new featured story
+	if featured > 0 {
+		if _, err := tx.Exec(ELECT_HOOP_FEATURED_STORY_SQL, hoopID); err != nil {
+			return err
+		}
+	}
 
 	if err := tx.Commit(); err != nil {
 		return err
 	}
 
+	forgetViews(storyID, "story")
+
 	return nil
 }
+
+func (s *pgStore) ViewStory(storyID int64) error {
+	return view(storyID, "story")
+}
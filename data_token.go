@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+type RefreshToken struct {
+	UserID    int64
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+func (token RefreshToken) valid() bool {
+	return token.RevokedAt.IsZero() && time.Now().Before(token.ExpiresAt)
+}
+
+func (s *pgStore) InsertRefreshToken(userID int64, tokenHash string, expiresAt time.Time) (err error) {
+	_, err = s.db.Exec(INSERT_REFRESH_TOKEN_SQL, userID, tokenHash, expiresAt)
+	return
+}
+
+func (s *pgStore) GetRefreshToken(tokenHash string) (token RefreshToken, err error) {
+	var revokedAt sql.NullTime
+
+	if err = s.db.QueryRow(GET_REFRESH_TOKEN_SQL, tokenHash).Scan(
+		&token.UserID,
+		&token.ExpiresAt,
+		&revokedAt,
+	); err != nil {
+		return
+	}
+
+	if revokedAt.Valid {
+		token.RevokedAt = revokedAt.Time
+	}
+
+	return
+}
+
+// RevokeRefreshToken revokes the token and reports whether it was still active.
+func (s *pgStore) RevokeRefreshToken(tokenHash string) (bool, error) {
+	result, err := s.db.Exec(REVOKE_REFRESH_TOKEN_SQL, tokenHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
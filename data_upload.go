@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// urls returns the distinct URLs of the image variants.
+func (images Images) urls() []string {
+	var urls []string
+	for _, url := range []string{images.Thumbnail, images.Medium, images.Full} {
+		if url != "" && !contains(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// ClaimUpload records an upload, or keeps an existing one from being swept.
+func (s *pgStore) ClaimUpload(key, url string) error {
+	for {
+		var inserted string
+		if err := s.db.QueryRow(INSERT_UPLOAD_SQL, key, url).Scan(&inserted); err == nil {
+			return nil
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		// The upload already exists
+		result, err := s.db.Exec(TOUCH_UPLOAD_SQL, key)
+		if err != nil {
+			return err
+		}
+
+		// Unless it was swept in the meantime
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n > 0 {
+			return nil
+		}
+	}
+}
+
+func (s *pgStore) OrphanedUploads(before time.Time, limit int) ([]string, error) {
+	var keys []string
+
+	rows, err := s.db.Query(GET_ORPHANED_UPLOADS_SQL, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// DeleteOrphanedUpload deletes the upload if it is still unreferenced and
+// was last used before the given time. The row stays locked while
+// deleteBlob runs, so the upload cannot be claimed again until the blob is
+// gone.
+func (s *pgStore) DeleteOrphanedUpload(key string, before time.Time, deleteBlob func() error) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(DELETE_ORPHANED_UPLOAD_SQL, key, before)
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	if err := deleteBlob(); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func referenceUploads(tx execer, images Images) (err error) {
+	if urls := images.urls(); len(urls) > 0 {
+		_, err = tx.Exec(REFERENCE_UPLOADS_SQL, pq.Array(urls))
+	}
+	return
+}
+
+func releaseUploads(tx execer, images Images) (err error) {
+	if urls := images.urls(); len(urls) > 0 {
+		_, err = tx.Exec(RELEASE_UPLOADS_SQL, pq.Array(urls))
+	}
+	return
+}
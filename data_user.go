@@ -21,24 +21,67 @@ type User struct {
 	FacebookID              string    `json:"facebook_id,omitempty"`
 	InstagramID             string    `json:"instagram_id,omitempty"`
 	TwitterID               string    `json:"twitter_id,omitempty"`
-	ImageURL                string    `json:"image_url,omitempty"`
+	Images                  Images    `json:"images"`
 	CreatedAt               time.Time `json:"created_at"`
 	UpdatedAt               time.Time `json:"updated_at"`
 	LatestActivityCheckTime time.Time `json:"latest_activity_check_time,omitempty"`
+	IsAdmin                 bool      `json:"is_admin,omitempty"`
 }
 
-func (user *User) updateUserImage(imageURL string) (err error) {
-	_, err = db.Exec(UPDATE_USER_IMAGE_SQL, imageURL, user.ID)
+func (s *pgStore) UpdateUserImage(userID int64, images Images) error {
+	var oldImages Images
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(GET_USER_IMAGES_FOR_UPDATE_SQL, userID).Scan(&oldImages); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(UPDATE_USER_IMAGE_SQL, images, userID); err != nil {
+		return err
+	}
+
+	if err := referenceUploads(tx, images); err != nil {
+		return err
+	}
+
+	if err := releaseUploads(tx, oldImages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *pgStore) UpdateUserSocialID(userID int64, provider, socialID string) (err error) {
+	var query string
+
+	switch provider {
+	case "facebook":
+		query = UPDATE_USER_FACEBOOK_SQL
+	case "instagram":
+		query = UPDATE_USER_INSTAGRAM_SQL
+	case "twitter":
+		query = UPDATE_USER_TWITTER_SQL
+	default:
+		return ErrUnknownProvider
+	}
+
+	_, err = s.db.Exec(query, socialID, userID)
 	return
 }
 
-func (user *User) lastActivityCheckTime() (time.Time, error) {
+func (s *pgStore) LastActivityCheckTime(userID int64) (time.Time, error) {
 	red, err := redisInstance()
 	if err != nil {
 		return time.Time{}, err
 	}
+	defer red.Close()
 
-	if reply, err := red.Do("HGET", fmt.Sprintf("user:%d", user.ID), "lastActivityCheckTime"); err != nil {
+	if reply, err := red.Do("HGET", fmt.Sprintf("user:%d", userID), "lastActivityCheckTime"); err != nil {
 		return time.Time{}, err
 	} else if t, err := redis.Int64(reply, err); err != nil {
 		if err != redis.ErrNil {
@@ -50,25 +93,26 @@ func (user *User) lastActivityCheckTime() (time.Time, error) {
 	return time.Time{}, nil
 }
 
-func (user *User) updateLastActivityCheckTime(secs int64) error {
+func (s *pgStore) UpdateLastActivityCheckTime(userID, secs int64) error {
 	red, err := redisInstance()
 	if err != nil {
 		return err
 	}
+	defer red.Close()
 
-	if _, err := red.Do("HSET", fmt.Sprintf("user:%d", user.ID), "lastActivityCheckTime", secs); err != nil {
+	if _, err := red.Do("HSET", fmt.Sprintf("user:%d", userID), "lastActivityCheckTime", secs); err != nil {
 		return err
 	}
 	return nil
 }
 
-func userExists(user *User, fetch bool) (bool, *User) {
+func (s *pgStore) UserExists(user *User, fetch bool) (bool, *User) {
 	var err error
 
 	if fetch {
-		var firstname, lastname, gender, birthdate, description, email, password, facebookID, instagramID, twitterID, imageURL sql.NullString
+		var firstname, lastname, gender, birthdate, description, email, password, facebookID, instagramID, twitterID sql.NullString
 
-		if err = db.QueryRow(GET_USER_SQL, user.ID, user.Email, user.FacebookID, user.InstagramID, user.TwitterID).Scan(
+		if err = s.db.QueryRow(GET_USER_SQL, user.ID, user.Email, user.FacebookID, user.InstagramID, user.TwitterID).Scan(
 			&user.ID,
 			&firstname,
 			&lastname,
@@ -80,9 +124,10 @@ func userExists(user *User, fetch bool) (bool, *User) {
 			&facebookID,
 			&instagramID,
 			&twitterID,
-			&imageURL,
+			&user.Images,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.IsAdmin,
 		); err != nil {
 			if err != sql.ErrNoRows {
 				log.Println(err)
@@ -100,8 +145,7 @@ func userExists(user *User, fetch bool) (bool, *User) {
 		user.FacebookID = fromNullString(facebookID)
 		user.InstagramID = fromNullString(instagramID)
 		user.TwitterID = fromNullString(twitterID)
-		user.ImageURL = fromNullString(imageURL)
-		if user.LatestActivityCheckTime, err = user.lastActivityCheckTime(); err != nil {
+		if user.LatestActivityCheckTime, err = s.LastActivityCheckTime(user.ID); err != nil {
 			log.Println(err)
 			return false, nil
 		}
@@ -109,7 +153,7 @@ func userExists(user *User, fetch bool) (bool, *User) {
 		return true, user
 	} else {
 		count := 0
-		if err = db.QueryRow(COUNT_USER_SQL, user.ID, user.Email, user.FacebookID, user.InstagramID, user.TwitterID).Scan(&count); err != nil || count == 0 {
+		if err = s.db.QueryRow(COUNT_USER_SQL, user.ID, user.Email, user.FacebookID, user.InstagramID, user.TwitterID).Scan(&count); err != nil || count == 0 {
 			log.Println(err)
 			return false, nil
 		}
@@ -117,42 +161,15 @@ func userExists(user *User, fetch bool) (bool, *User) {
 	}
 }
 
-func getUserByID(userID int64) (User, error) {
+func (s *pgStore) GetUser(userID int64) (User, error) {
 	var user User
-	var firstname, lastname, gender, birthdate, description, email, password, facebookID, instagramID, twitterID, imageURL sql.NullString
 	var err error
 
-	if err = db.QueryRow(GET_USER_BY_ID_SQL, userID).Scan(
-		&user.ID,
-		&firstname,
-		&lastname,
-		&gender,
-		&birthdate,
-		&description,
-		&email,
-		&password,
-		&facebookID,
-		&instagramID,
-		&twitterID,
-		&imageURL,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	); err != nil {
+	if err = scanUser(s.db.QueryRow(GET_USER_BY_ID_SQL, userID), &user); err != nil {
 		return user, err
 	}
 
-	user.Firstname = fromNullString(firstname)
-	user.Lastname = fromNullString(lastname)
-	user.Gender = fromNullString(gender)
-	user.Birthdate = fromNullString(birthdate)
-	user.Description = fromNullString(description)
-	user.Email = fromNullString(email)
-	user.Password = fromNullString(password)
-	user.FacebookID = fromNullString(facebookID)
-	user.InstagramID = fromNullString(instagramID)
-	user.TwitterID = fromNullString(twitterID)
-	user.ImageURL = fromNullString(imageURL)
-	if user.LatestActivityCheckTime, err = user.lastActivityCheckTime(); err != nil {
+	if user.LatestActivityCheckTime, err = s.LastActivityCheckTime(user.ID); err != nil {
 		log.Println(err)
 		return user, nil
 	}
@@ -160,10 +177,16 @@ func getUserByID(userID int64) (User, error) {
 	return user, nil
 }
 
-func insertUser(user *User) (int64, error) {
+func (s *pgStore) InsertUser(user *User) (int64, error) {
 	var userID int64
 
-	if err := db.QueryRow(
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(
 		INSERT_USER_SQL,
 		&user.Firstname,
 		&user.Lastname,
@@ -175,16 +198,26 @@ func insertUser(user *User) (int64, error) {
 		&user.FacebookID,
 		&user.InstagramID,
 		&user.TwitterID,
-		&user.ImageURL,
-	).Scan(&userID); err != nil && err != sql.ErrNoRows {
+		user.Images,
+	).Scan(&userID); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if err := referenceUploads(tx, user.Images); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
 
 	return userID, nil
 }
 
-func updateUser(user *User) (err error) {
-	_, err = db.Exec(
+func (s *pgStore) UpdateUser(user *User) (err error) {
+	_, err = s.db.Exec(
 		UPDATE_USER_SQL,
 		&user.Firstname,
 		&user.Lastname,
@@ -201,9 +234,52 @@ func view(otherID int64, typ string) error {
 	if err != nil {
 		return err
 	}
+	defer red.Close()
 
 	if _, err := red.Do("HINCRBY", fmt.Sprintf("%s:%d", typ, otherID), "view_count", 1); err != nil {
 		return err
 	}
 	return nil
 }
+
+// forgetViews drops the view count. Failures are only logged since the
+// count is not essential.
+func forgetViews(otherID int64, typ string) {
+	red, err := redisInstance()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer red.Close()
+
+	if _, err := red.Do("DEL", fmt.Sprintf("%s:%d", typ, otherID)); err != nil {
+		log.Println(err)
+	}
+}
+
+// mergeViews adds the view count of one item to another and drops it.
+func mergeViews(fromID, toID int64, typ string) {
+	red, err := redisInstance()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer red.Close()
+
+	count, err := redis.Int64(red.Do("HGET", fmt.Sprintf("%s:%d", typ, fromID), "view_count"))
+	if err == redis.ErrNil {
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if _, err := red.Do("HINCRBY", fmt.Sprintf("%s:%d", typ, toID), "view_count", count); err != nil {
+		log.Println(err)
+		return
+	}
+
+	if _, err := red.Do("DEL", fmt.Sprintf("%s:%d", typ, fromID)); err != nil {
+		log.Println(err)
+	}
+}
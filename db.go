@@ -19,7 +19,7 @@ func fromNullInt64(i sql.NullInt64) int64 {
 }
 
 const CREATE_USER_TABLE_SQL = `
-CREATE TABLE "user" (
+CREATE TABLE IF NOT EXISTS "user" (
 	id bigserial PRIMARY KEY,
 	firstname varchar(255),
 	lastname varchar(255),
@@ -38,7 +38,7 @@ CREATE TABLE "user" (
 )`
 
 const CREATE_HOOP_TABLE_SQL = `
-CREATE TABLE hoop (
+CREATE TABLE IF NOT EXISTS hoop (
 	id bigserial primary key,
 	user_id bigserial not null,
 	name varchar(255) not null,
@@ -52,7 +52,7 @@ CREATE TABLE hoop (
 )`
 
 const CREATE_STORY_TABLE_SQL = `
-CREATE TABLE story (
+CREATE TABLE IF NOT EXISTS story (
 	id bigserial primary key,
 	hoop_id bigserial not null,
 	user_id bigserial not null,
@@ -66,7 +66,7 @@ CREATE TABLE story (
 )`
 
 const CREATE_ACTIVITY_TABLE_SQL = `
-CREATE TABLE activity (
+CREATE TABLE IF NOT EXISTS activity (
 	id bigserial primary key,
 	user_id bigserial not null,
 	type bigint not null,
@@ -77,7 +77,7 @@ CREATE TABLE activity (
 )`
 
 const CREATE_HOOP_FEATURED_STORY_TABLE_SQL = `
-CREATE TABLE hoop_featured_story (
+CREATE TABLE IF NOT EXISTS hoop_featured_story (
 	hoop_id bigserial primary key,
 	story_id bigserial not null,
 	FOREIGN KEY(hoop_id) REFERENCES hoop (id),
@@ -86,7 +86,7 @@ CREATE TABLE hoop_featured_story (
 )`
 
 const CREATE_COMMENT_TABLE_SQL = `
-CREATE TABLE comment (
+CREATE TABLE IF NOT EXISTS comment (
     id bigserial primary key,
     user_id bigserial not null,
     text varchar(255) not null,
@@ -97,9 +97,393 @@ CREATE TABLE comment (
 	FOREIGN KEY(user_id) REFERENCES "user" (id)
 )`
 
+const DROP_USER_TABLE_SQL = `DROP TABLE IF EXISTS "user"`
+
+const DROP_HOOP_TABLE_SQL = `DROP TABLE IF EXISTS hoop`
+
+const DROP_STORY_TABLE_SQL = `DROP TABLE IF EXISTS story`
+
+const DROP_ACTIVITY_TABLE_SQL = `DROP TABLE IF EXISTS activity`
+
+const DROP_HOOP_FEATURED_STORY_TABLE_SQL = `DROP TABLE IF EXISTS hoop_featured_story`
+
+const DROP_COMMENT_TABLE_SQL = `DROP TABLE IF EXISTS comment`
+
+const CREATE_REFRESH_TOKEN_TABLE_SQL = `
+CREATE TABLE IF NOT EXISTS refresh_token (
+	id bigserial primary key,
+	user_id bigint not null,
+	token_hash varchar(64) not null,
+	expires_at timestamp with time zone not null,
+	revoked_at timestamp with time zone,
+	created_at timestamp with time zone not null,
+	UNIQUE (token_hash),
+	FOREIGN KEY(user_id) REFERENCES "user" (id)
+)`
+
+const DROP_REFRESH_TOKEN_TABLE_SQL = `DROP TABLE IF EXISTS refresh_token`
+
+// Image variants replace the single image URL of users and stories
+const ADD_IMAGE_VARIANTS_SQL = `
+ALTER TABLE "user" ADD COLUMN images jsonb not null default '{}';
+UPDATE "user" SET images = jsonb_build_object('thumbnail', image_url, 'medium', image_url, 'full', image_url)
+WHERE image_url IS NOT NULL AND image_url != '';
+ALTER TABLE "user" DROP COLUMN image_url;
+ALTER TABLE story ADD COLUMN images jsonb not null default '{}';
+UPDATE story SET images = jsonb_build_object('thumbnail', image_url, 'medium', image_url, 'full', image_url)
+WHERE image_url != '';
+ALTER TABLE story DROP COLUMN image_url`
+
+const DROP_IMAGE_VARIANTS_SQL = `
+ALTER TABLE "user" ADD COLUMN image_url varchar(255);
+UPDATE "user" SET image_url = images->>'full';
+ALTER TABLE "user" DROP COLUMN images;
+ALTER TABLE story ADD COLUMN image_url varchar(255) not null default '';
+UPDATE story SET image_url = COALESCE(images->>'full', '');
+ALTER TABLE story ALTER COLUMN image_url DROP DEFAULT;
+ALTER TABLE story DROP COLUMN images`
+
+const CREATE_UPLOAD_TABLE_SQL = `
+CREATE TABLE IF NOT EXISTS upload (
+	key varchar(255) primary key,
+	url text not null,
+	ref_count integer not null default 0,
+	created_at timestamp with time zone not null,
+	updated_at timestamp with time zone not null
+);
+CREATE INDEX upload_url_idx ON upload (url);
+CREATE INDEX upload_orphaned_idx ON upload (updated_at) WHERE ref_count = 0`
+
+const DROP_UPLOAD_TABLE_SQL = `DROP TABLE IF EXISTS upload`
+
+const ADD_USER_ADMIN_SQL = `
+ALTER TABLE "user" ADD COLUMN is_admin boolean not null default false`
+
+const DROP_USER_ADMIN_SQL = `
+ALTER TABLE "user" DROP COLUMN is_admin`
+
+// Hoop names are no longer unique; duplicates are merged instead
+const CREATE_HOOP_REDIRECT_TABLE_SQL = `
+ALTER TABLE hoop DROP CONSTRAINT IF EXISTS hoop_name_key;
+CREATE TABLE IF NOT EXISTS hoop_redirect (
+	hoop_id bigint primary key,
+	target_hoop_id bigint not null,
+	created_at timestamp with time zone not null,
+	FOREIGN KEY(target_hoop_id) REFERENCES hoop (id)
+);
+CREATE INDEX hoop_redirect_target_hoop_id_idx ON hoop_redirect (target_hoop_id)`
+
+const DROP_HOOP_REDIRECT_TABLE_SQL = `
+DROP TABLE IF EXISTS hoop_redirect;
+ALTER TABLE hoop ADD CONSTRAINT hoop_name_key UNIQUE (name)`
+
+// Comment threads. The hoop_id and story_id columns lose their sequence
+// defaults so that a comment only has the one it belongs to.
+const ADD_COMMENT_THREADS_SQL = `
+ALTER TABLE comment
+	ALTER COLUMN hoop_id DROP NOT NULL,
+	ALTER COLUMN hoop_id DROP DEFAULT,
+	ALTER COLUMN story_id DROP NOT NULL,
+	ALTER COLUMN story_id DROP DEFAULT,
+	ADD COLUMN parent_id bigint REFERENCES comment (id),
+	ADD COLUMN root_id bigint REFERENCES comment (id),
+	ADD COLUMN depth integer not null default 0,
+	ADD COLUMN edited_at timestamp with time zone,
+	ADD COLUMN deleted_at timestamp with time zone;
+CREATE INDEX comment_root_id_idx ON comment (root_id)`
+
+const DROP_COMMENT_THREADS_SQL = `
+DROP INDEX IF EXISTS comment_root_id_idx;
+ALTER TABLE comment
+	DROP COLUMN deleted_at,
+	DROP COLUMN edited_at,
+	DROP COLUMN depth,
+	DROP COLUMN root_id,
+	DROP COLUMN parent_id;
+UPDATE comment SET hoop_id = nextval('comment_hoop_id_seq') WHERE hoop_id IS NULL;
+UPDATE comment SET story_id = nextval('comment_story_id_seq') WHERE story_id IS NULL;
+ALTER TABLE comment
+	ALTER COLUMN hoop_id SET DEFAULT nextval('comment_hoop_id_seq'),
+	ALTER COLUMN hoop_id SET NOT NULL,
+	ALTER COLUMN story_id SET DEFAULT nextval('comment_story_id_seq'),
+	ALTER COLUMN story_id SET NOT NULL`
+
+const CREATE_FOLLOW_TABLES_SQL = `
+CREATE TABLE IF NOT EXISTS follow (
+	follower_id bigint not null,
+	user_id bigint not null,
+	created_at timestamp with time zone not null,
+	PRIMARY KEY (follower_id, user_id),
+	CHECK (follower_id != user_id),
+	FOREIGN KEY(follower_id) REFERENCES "user" (id),
+	FOREIGN KEY(user_id) REFERENCES "user" (id)
+);
+CREATE INDEX follow_user_id_created_at_idx ON follow (user_id, created_at DESC, follower_id DESC);
+CREATE INDEX follow_follower_id_created_at_idx ON follow (follower_id, created_at DESC, user_id DESC);
+CREATE TABLE IF NOT EXISTS hoop_follow (
+	user_id bigint not null,
+	hoop_id bigint not null,
+	created_at timestamp with time zone not null,
+	PRIMARY KEY (user_id, hoop_id),
+	FOREIGN KEY(user_id) REFERENCES "user" (id),
+	FOREIGN KEY(hoop_id) REFERENCES hoop (id)
+);
+CREATE INDEX hoop_follow_hoop_id_idx ON hoop_follow (hoop_id)`
+
+const DROP_FOLLOW_TABLES_SQL = `
+DROP TABLE IF EXISTS hoop_follow;
+DROP TABLE IF EXISTS follow`
+
+// Notifications tell users about activity they did not see in their feed.
+// They go away with the hoop or story they are about.
+const CREATE_NOTIFICATION_TABLE_SQL = `
+CREATE TABLE IF NOT EXISTS notification (
+	id bigserial primary key,
+	user_id bigint not null,
+	actor_id bigint not null,
+	type integer not null,
+	hoop_id bigint REFERENCES hoop (id) ON DELETE CASCADE,
+	story_id bigint REFERENCES story (id) ON DELETE CASCADE,
+	created_at timestamp with time zone not null,
+	FOREIGN KEY(user_id) REFERENCES "user" (id),
+	FOREIGN KEY(actor_id) REFERENCES "user" (id)
+);
+CREATE INDEX notification_user_id_created_at_id_idx ON notification (user_id, created_at DESC, id DESC)`
+
+const DROP_NOTIFICATION_TABLE_SQL = `DROP TABLE IF EXISTS notification`
+
+const ADD_NOTIFICATION_READ_AT_SQL = `
+ALTER TABLE notification ADD COLUMN read_at timestamp with time zone;
+CREATE INDEX notification_unread_user_id_idx ON notification (user_id) WHERE read_at IS NULL`
+
+const DROP_NOTIFICATION_READ_AT_SQL = `
+DROP INDEX IF EXISTS notification_unread_user_id_idx;
+ALTER TABLE notification DROP COLUMN read_at`
+
+// Devices receive push notifications. A token belongs to the user who
+// registered it last.
+const CREATE_DEVICE_TABLES_SQL = `
+CREATE TABLE IF NOT EXISTS device (
+	id bigserial primary key,
+	user_id bigint not null,
+	type varchar(8) not null,
+	token text not null,
+	created_at timestamp with time zone not null,
+	updated_at timestamp with time zone not null,
+	UNIQUE (token),
+	FOREIGN KEY(user_id) REFERENCES "user" (id)
+);
+CREATE INDEX device_user_id_idx ON device (user_id);
+CREATE TABLE IF NOT EXISTS notification_preference (
+	user_id bigint primary key,
+	likes boolean not null,
+	comments boolean not null,
+	stories boolean not null,
+	updated_at timestamp with time zone not null,
+	FOREIGN KEY(user_id) REFERENCES "user" (id)
+)`
+
+const DROP_DEVICE_TABLES_SQL = `
+DROP TABLE IF EXISTS notification_preference;
+DROP TABLE IF EXISTS device`
+
+// Jobs are side effects of writes, queued in the same transaction. Jobs that
+// keep failing are moved to dead_job with their last error.
+const CREATE_JOB_TABLES_SQL = `
+CREATE TABLE IF NOT EXISTS job (
+	id bigserial primary key,
+	type varchar(32) not null,
+	payload jsonb not null,
+	attempts integer not null default 0,
+	run_at timestamp with time zone not null,
+	locked_until timestamp with time zone,
+	last_error text,
+	created_at timestamp with time zone not null
+);
+CREATE INDEX job_run_at_idx ON job (run_at, id);
+CREATE TABLE IF NOT EXISTS dead_job (
+	id bigint primary key,
+	type varchar(32) not null,
+	payload jsonb not null,
+	attempts integer not null,
+	last_error text not null,
+	created_at timestamp with time zone not null,
+	failed_at timestamp with time zone not null
+);
+CREATE INDEX dead_job_failed_at_id_idx ON dead_job (failed_at DESC, id DESC)`
+
+const DROP_JOB_TABLES_SQL = `
+DROP TABLE IF EXISTS dead_job;
+DROP TABLE IF EXISTS job`
+
+// Comments and activities refer to their hoop or story by foreign key, so
+// that a missing one is reported as such. An activity only has the one it is
+// about, so the other column loses its sequence default. Rows that refer to
+// a hoop or story that is gone are copied to orphaned_comment and
+// orphaned_activity before they are deleted, and are kept there when the
+// migration is reverted.
+const ADD_HOOP_STORY_FOREIGN_KEYS_SQL = `
+ALTER TABLE activity
+	ALTER COLUMN hoop_id DROP NOT NULL,
+	ALTER COLUMN hoop_id DROP DEFAULT,
+	ALTER COLUMN story_id DROP NOT NULL,
+	ALTER COLUMN story_id DROP DEFAULT;
+UPDATE activity SET story_id = NULL WHERE type IN (1, 101, 201);
+UPDATE activity SET hoop_id = NULL WHERE type IN (2, 102, 202);
+CREATE TABLE IF NOT EXISTS orphaned_activity (LIKE activity);
+CREATE TABLE IF NOT EXISTS orphaned_comment (LIKE comment);
+INSERT INTO orphaned_activity SELECT * FROM activity
+WHERE (type IN (1, 101, 201) AND NOT EXISTS (SELECT 1 FROM hoop WHERE hoop.id = activity.hoop_id))
+OR (type IN (2, 102, 202) AND NOT EXISTS (SELECT 1 FROM story WHERE story.id = activity.story_id));
+INSERT INTO orphaned_comment SELECT * FROM comment
+WHERE (hoop_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM hoop WHERE hoop.id = comment.hoop_id))
+OR (story_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM story WHERE story.id = comment.story_id));
+DELETE FROM activity WHERE id IN (SELECT id FROM orphaned_activity);
+DELETE FROM comment WHERE id IN (SELECT id FROM orphaned_comment);
+ALTER TABLE comment
+	ADD CONSTRAINT comment_hoop_id_fkey FOREIGN KEY (hoop_id) REFERENCES hoop (id),
+	ADD CONSTRAINT comment_story_id_fkey FOREIGN KEY (story_id) REFERENCES story (id);
+ALTER TABLE activity
+	ADD CONSTRAINT activity_hoop_id_fkey FOREIGN KEY (hoop_id) REFERENCES hoop (id),
+	ADD CONSTRAINT activity_story_id_fkey FOREIGN KEY (story_id) REFERENCES story (id);
+CREATE INDEX activity_hoop_id_idx ON activity (hoop_id);
+CREATE INDEX activity_story_id_idx ON activity (story_id)`
+
+const DROP_HOOP_STORY_FOREIGN_KEYS_SQL = `
+DROP INDEX IF EXISTS activity_story_id_idx;
+DROP INDEX IF EXISTS activity_hoop_id_idx;
+ALTER TABLE activity
+	DROP CONSTRAINT IF EXISTS activity_story_id_fkey,
+	DROP CONSTRAINT IF EXISTS activity_hoop_id_fkey;
+ALTER TABLE comment
+	DROP CONSTRAINT IF EXISTS comment_story_id_fkey,
+	DROP CONSTRAINT IF EXISTS comment_hoop_id_fkey;
+UPDATE activity SET hoop_id = 0 WHERE hoop_id IS NULL;
+UPDATE activity SET story_id = 0 WHERE story_id IS NULL;
+ALTER TABLE activity
+	ALTER COLUMN hoop_id SET DEFAULT nextval('activity_hoop_id_seq'),
+	ALTER COLUMN hoop_id SET NOT NULL,
+	ALTER COLUMN story_id SET DEFAULT nextval('activity_story_id_seq'),
+	ALTER COLUMN story_id SET NOT NULL`
+
+// Hoop locations, as PostGIS points kept in step with the coordinates
+const ADD_HOOP_LOCATION_SQL = `
+CREATE EXTENSION IF NOT EXISTS postgis;
+ALTER TABLE hoop ADD COLUMN location geography(Point, 4326)
+	GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography) STORED;
+CREATE INDEX hoop_location_idx ON hoop USING GIST (location)`
+
+const DROP_HOOP_LOCATION_SQL = `
+DROP INDEX IF EXISTS hoop_location_idx;
+ALTER TABLE hoop DROP COLUMN IF EXISTS location`
+
+// The hoops version is a single row that every write to hoops updates, in
+// the writing transaction, and that map tiles are cached by. The row lock
+// serializes hoop writes with each other, and any change to any hoop
+// invalidates every cached tile. Hoops are written rarely next to how often
+// tiles are read, which is what makes that acceptable; if writes become
+// frequent, the version should be kept per tile or region instead.
+const CREATE_HOOPS_VERSION_TABLE_SQL = `
+CREATE TABLE IF NOT EXISTS hoops_version (
+	version bigint not null
+);
+INSERT INTO hoops_version (version) VALUES (0)`
+
+const DROP_HOOPS_VERSION_TABLE_SQL = `DROP TABLE IF EXISTS hoops_version`
+
+// Search, over text with its accents and case removed. The unaccented
+// configuration does not stem words, which suits names and mixed Filipino
+// and English. The trigram indexes find names that are misspelled.
+const CREATE_SEARCH_SQL = `
+CREATE EXTENSION IF NOT EXISTS unaccent;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE TEXT SEARCH CONFIGURATION unaccented (COPY = simple);
+ALTER TEXT SEARCH CONFIGURATION unaccented ALTER MAPPING FOR hword, hword_part, word WITH unaccent, simple;
+CREATE FUNCTION unaccented(text) RETURNS text AS $$
+	SELECT lower(public.unaccent('public.unaccent', $1))
+$$ LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE;
+ALTER TABLE hoop ADD COLUMN search tsvector GENERATED ALWAYS AS (
+	setweight(to_tsvector('unaccented', name), 'A') ||
+	setweight(to_tsvector('unaccented', description), 'B')) STORED;
+ALTER TABLE story ADD COLUMN search tsvector GENERATED ALWAYS AS (
+	setweight(to_tsvector('unaccented', name), 'A') ||
+	setweight(to_tsvector('unaccented', description), 'B')) STORED;
+ALTER TABLE comment ADD COLUMN search tsvector GENERATED ALWAYS AS (
+	to_tsvector('unaccented', text)) STORED;
+ALTER TABLE "user" ADD COLUMN search tsvector GENERATED ALWAYS AS (
+	to_tsvector('unaccented', coalesce(firstname, '') || ' ' || coalesce(lastname, ''))) STORED;
+CREATE INDEX hoop_search_idx ON hoop USING GIN (search);
+CREATE INDEX story_search_idx ON story USING GIN (search);
+CREATE INDEX comment_search_idx ON comment USING GIN (search);
+CREATE INDEX user_search_idx ON "user" USING GIN (search);
+CREATE INDEX hoop_name_trgm_idx ON hoop USING GIN (unaccented(name) gin_trgm_ops);
+CREATE INDEX story_name_trgm_idx ON story USING GIN (unaccented(name) gin_trgm_ops);
+CREATE INDEX user_name_trgm_idx ON "user" USING GIN (unaccented(coalesce(firstname, '') || ' ' || coalesce(lastname, '')) gin_trgm_ops)`
+
+const DROP_SEARCH_SQL = `
+DROP INDEX IF EXISTS user_name_trgm_idx;
+DROP INDEX IF EXISTS story_name_trgm_idx;
+DROP INDEX IF EXISTS hoop_name_trgm_idx;
+DROP INDEX IF EXISTS user_search_idx;
+DROP INDEX IF EXISTS comment_search_idx;
+DROP INDEX IF EXISTS story_search_idx;
+DROP INDEX IF EXISTS hoop_search_idx;
+ALTER TABLE "user" DROP COLUMN IF EXISTS search;
+ALTER TABLE comment DROP COLUMN IF EXISTS search;
+ALTER TABLE story DROP COLUMN IF EXISTS search;
+ALTER TABLE hoop DROP COLUMN IF EXISTS search;
+DROP FUNCTION IF EXISTS unaccented(text);
+DROP TEXT SEARCH CONFIGURATION IF EXISTS unaccented`
+
+// Pagination indexes
+const CREATE_PAGINATION_INDEXES_SQL = `
+CREATE INDEX hoop_created_at_id_idx ON hoop (created_at DESC, id DESC);
+CREATE INDEX story_hoop_id_created_at_id_idx ON story (hoop_id, created_at DESC, id DESC);
+CREATE INDEX comment_hoop_id_created_at_id_idx ON comment (hoop_id, created_at DESC, id DESC);
+CREATE INDEX comment_story_id_created_at_id_idx ON comment (story_id, created_at DESC, id DESC);
+CREATE INDEX activity_created_at_id_idx ON activity (created_at DESC, id DESC)`
+
+const DROP_PAGINATION_INDEXES_SQL = `
+DROP INDEX IF EXISTS hoop_created_at_id_idx;
+DROP INDEX IF EXISTS story_hoop_id_created_at_id_idx;
+DROP INDEX IF EXISTS comment_hoop_id_created_at_id_idx;
+DROP INDEX IF EXISTS comment_story_id_created_at_id_idx;
+DROP INDEX IF EXISTS activity_created_at_id_idx`
+
+// Schema migrations
+const CREATE_SCHEMA_MIGRATIONS_TABLE_SQL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint primary key,
+	name varchar(255) not null,
+	applied_at timestamp with time zone not null
+)`
+
+const LOCK_SCHEMA_MIGRATIONS_SQL = `
+SELECT pg_advisory_xact_lock($1)`
+
+const COUNT_SCHEMA_MIGRATION_SQL = `
+SELECT COUNT(version) FROM schema_migrations
+WHERE version = $1`
+
+const GET_SCHEMA_MIGRATIONS_SQL = `
+SELECT version, applied_at FROM schema_migrations
+ORDER BY version ASC`
+
+const GET_LATEST_SCHEMA_MIGRATION_SQL = `
+SELECT version FROM schema_migrations
+ORDER BY version DESC
+LIMIT 1`
+
+const INSERT_SCHEMA_MIGRATION_SQL = `
+INSERT INTO schema_migrations (version, name, applied_at)
+VALUES ($1, $2, NOW())`
+
+const DELETE_SCHEMA_MIGRATION_SQL = `
+DELETE FROM schema_migrations WHERE version = $1`
+
 // User
 const INSERT_USER_SQL = `
-INSERT INTO "user" (firstname, lastname, gender, birthdate, description, email, password, facebook_id, instagram_id, twitter_id, image_url, created_at, updated_at)
+INSERT INTO "user" (firstname, lastname, gender, birthdate, description, email, password, facebook_id, instagram_id, twitter_id, images, created_at, updated_at)
 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW(), NOW())
 ON CONFLICT (email, facebook_id, instagram_id, twitter_id)
 DO NOTHING
@@ -120,7 +504,7 @@ firstname = $1,
 lastname = $2,
 email = $3,
 password = $4,
-image_url = $5,
+images = $5,
 updated_at = NOW()`
 
 const UPDATE_USER_FACEBOOK_SQL = `
@@ -133,10 +517,13 @@ const UPDATE_USER_TWITTER_SQL = `
 UPDATE "user" SET twitter_id = $1 WHERE id = $2`
 
 const UPDATE_USER_IMAGE_SQL = `
-UPDATE "user" SET image_url = $1 WHERE id = $2`
+UPDATE "user" SET images = $1 WHERE id = $2`
+
+const GET_USER_IMAGES_FOR_UPDATE_SQL = `
+SELECT images FROM "user" WHERE id = $1 FOR UPDATE`
 
 const GET_USER_SQL = `
-SELECT id, firstname, lastname, gender, birthdate, description, email, password, facebook_id, instagram_id, twitter_id, image_url, created_at, updated_at FROM "user"
+SELECT id, firstname, lastname, gender, birthdate, description, email, password, facebook_id, instagram_id, twitter_id, images, created_at, updated_at, is_admin FROM "user"
 WHERE id = $1
 OR (email = $2 AND email != '')
 OR (facebook_id = $3 AND facebook_id != '')
@@ -145,10 +532,14 @@ OR (twitter_id = $5 AND twitter_id != '')
 LIMIT 1`
 
 const GET_USER_BY_ID_SQL = `
-SELECT id, firstname, lastname, gender, birthdate, description, email, password, facebook_id, instagram_id, twitter_id, image_url, created_at, updated_at FROM "user"
+SELECT id, firstname, lastname, gender, birthdate, description, email, password, facebook_id, instagram_id, twitter_id, images, created_at, updated_at, is_admin FROM "user"
 WHERE id = $1
 LIMIT 1`
 
+const GET_USERS_BY_IDS_SQL = `
+SELECT id, firstname, lastname, gender, birthdate, description, email, password, facebook_id, instagram_id, twitter_id, images, created_at, updated_at, is_admin FROM "user"
+WHERE id = ANY($1)`
+
 const COUNT_USER_SQL = `
 SELECT COUNT(id) FROM "user"
 WHERE id = $1 OR email = $2 OR facebook_id = $3 OR instagram_id = $4 OR twitter_id = $5
@@ -165,90 +556,281 @@ SELECT id, user_id, name, description, latitude, longitude, created_at, updated_
 WHERE id = $1
 LIMIT 1`
 
+const GET_HOOPS_BY_IDS_SQL = `
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at FROM hoop
+WHERE id = ANY($1)`
+
 const COUNT_HOOP_SQL = `
 SELECT COUNT(id) FROM hoop
 WHERE id = $1
 LIMIT 1`
 
+const UPDATE_HOOP_SQL = `
+UPDATE hoop SET
+name = $1,
+description = $2,
+latitude = $3,
+longitude = $4,
+updated_at = NOW()
+WHERE id = $5`
+
+const LOCK_HOOPS_SQL = `
+SELECT id FROM hoop WHERE id = ANY($1) ORDER BY id FOR UPDATE`
+
+const GET_HOOP_STORY_IMAGES_SQL = `
+SELECT images FROM story WHERE hoop_id = $1`
+
+const DELETE_HOOP_STORY_COMMENTS_SQL = `
+DELETE FROM comment WHERE story_id IN (SELECT id FROM story WHERE hoop_id = $1)`
+
+const DELETE_HOOP_STORY_ACTIVITIES_SQL = `
+DELETE FROM activity WHERE type IN (2, 102, 202) AND story_id IN (SELECT id FROM story WHERE hoop_id = $1)`
+
+const DELETE_HOOP_STORIES_SQL = `
+DELETE FROM story WHERE hoop_id = $1`
+
+const DELETE_HOOP_COMMENTS_SQL = `
+DELETE FROM comment WHERE hoop_id = $1`
+
+const DELETE_HOOP_ACTIVITIES_SQL = `
+DELETE FROM activity WHERE hoop_id = $1 AND type IN (1, 101, 201)`
+
+const DELETE_HOOP_FEATURED_STORY_BY_HOOP_SQL = `
+DELETE FROM hoop_featured_story WHERE hoop_id = $1`
+
+const DELETE_HOOP_FOLLOWS_SQL = `
+DELETE FROM hoop_follow WHERE hoop_id = $1`
+
+const DELETE_HOOP_SQL = `
+DELETE FROM hoop WHERE id = $1`
+
+// Merging hoops moves everything from hoop $1 to hoop $2
+const MOVE_HOOP_STORIES_SQL = `
+UPDATE story SET hoop_id = $2 WHERE hoop_id = $1`
+
+const MOVE_HOOP_COMMENTS_SQL = `
+UPDATE comment SET hoop_id = $2 WHERE hoop_id = $1`
+
+const MOVE_HOOP_FOLLOWS_SQL = `
+WITH moved AS (DELETE FROM hoop_follow WHERE hoop_id = $1 RETURNING user_id, created_at)
+INSERT INTO hoop_follow (user_id, hoop_id, created_at)
+SELECT user_id, $2, created_at FROM moved
+ON CONFLICT DO NOTHING`
+
+const MOVE_HOOP_NOTIFICATIONS_SQL = `
+UPDATE notification SET hoop_id = $2 WHERE hoop_id = $1`
+
+const DELETE_DUPLICATE_HOOP_LIKES_SQL = `
+DELETE FROM activity a
+WHERE a.hoop_id = $1 AND a.type = 201
+AND EXISTS (SELECT 1 FROM activity b WHERE b.hoop_id = $2 AND b.type = 201 AND b.user_id = a.user_id)`
+
+const MOVE_HOOP_ACTIVITIES_SQL = `
+UPDATE activity SET hoop_id = $2 WHERE hoop_id = $1 AND type IN (1, 101, 201)`
+
+const MOVE_HOOP_REDIRECTS_SQL = `
+UPDATE hoop_redirect SET target_hoop_id = $2 WHERE target_hoop_id = $1`
+
+// Hoop redirect
+const INSERT_HOOP_REDIRECT_SQL = `
+INSERT INTO hoop_redirect (hoop_id, target_hoop_id, created_at)
+VALUES ($1, $2, NOW())`
+
+const GET_HOOP_REDIRECT_SQL = `
+SELECT target_hoop_id FROM hoop_redirect
+WHERE hoop_id = $1
+LIMIT 1`
+
+const DELETE_HOOP_REDIRECTS_SQL = `
+DELETE FROM hoop_redirect WHERE target_hoop_id = $1`
+
+// Hoops version
+const GET_HOOPS_VERSION_SQL = `
+SELECT version FROM hoops_version`
+
+const BUMP_HOOPS_VERSION_SQL = `
+UPDATE hoops_version SET version = version + 1`
+
 const GET_HOOPS_SQL = `
-SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at
-FROM hoop`
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, 0::float8
+FROM hoop
+WHERE ($1::float8 IS NULL OR (0::float8, created_at, id) < ($1, $2, $3))
+ORDER BY created_at DESC, id DESC
+LIMIT $4`
 
 const GET_MY_HOOPS_SQL = `
-SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, 0::float8
 FROM hoop
-WHERE user_id = $1`
+WHERE user_id = $1
+AND ($2::float8 IS NULL OR (0::float8, created_at, id) < ($2, $3, $4))
+ORDER BY created_at DESC, id DESC
+LIMIT $5`
+
+const GET_FOLLOWED_HOOPS_SQL = `
+SELECT id, hoop.user_id, name, description, latitude, longitude, hoop.created_at, updated_at, 0::float8
+FROM hoop JOIN hoop_follow ON hoop_follow.hoop_id = hoop.id
+WHERE hoop_follow.user_id = $1
+AND ($2::float8 IS NULL OR (0::float8, hoop.created_at, id) < ($2, $3, $4))
+ORDER BY hoop.created_at DESC, id DESC
+LIMIT $5`
 
 const GET_OTHER_HOOPS_SQL = `
-SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, 0::float8
 FROM hoop
-WHERE user_id != $1`
-
-const DISTANCE_CALC = `(acos(sin(radians(h.latitude)) * sin(radians($1)) + cos(radians(h.latitude)) * cos(radians($2)) * cos(radians(h.longitude - $3))) * 6371 * 1000)`
+WHERE user_id != $1
+AND ($2::float8 IS NULL OR (0::float8, created_at, id) < ($2, $3, $4))
+ORDER BY created_at DESC, id DESC
+LIMIT $5`
 
 const GET_NEARBY_HOOPS_SQL = `
-SELECT * FROM (SELECT ` + DISTANCE_CALC + ` computedDistance, * FROM hoop h) AS tempQuery WHERE computedDistance < $4 ORDER BY computedDistance ASC LIMIT 100`
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, distance FROM (
+	SELECT *, ST_Distance(location, ST_MakePoint($2, $1)::geography) distance FROM hoop
+	WHERE ST_DWithin(location, ST_MakePoint($2, $1)::geography, $3)
+) AS nearby
+WHERE ($4::float8 IS NULL OR (distance, id) > ($4, $5))
+ORDER BY distance ASC, id ASC
+LIMIT $6`
 
-const GET_POPULAR_HOOPS_SQL = `
-SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at
+// The index finds the hoops in the box on the sphere, whose edges bulge
+// past those of the box on the map; the coordinates trim them.
+const HOOPS_IN_BOX_SQL = `
+location && ST_MakeEnvelope($1, $2, $3, $4, 4326)::geography
+AND longitude BETWEEN $1 AND $3
+AND latitude BETWEEN $2 AND $4`
+
+const GET_HOOPS_IN_BOX_SQL = `
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, 0::float8
+FROM hoop
+WHERE ` + HOOPS_IN_BOX_SQL + `
+AND ($5::float8 IS NULL OR (0::float8, created_at, id) < ($5, $6, $7))
+ORDER BY created_at DESC, id DESC
+LIMIT $8`
+
+const GET_HOOP_CLUSTERS_SQL = `
+SELECT count(*), avg(latitude), avg(longitude), min(id)
 FROM hoop
-ORDER BY (SELECT COUNT(id) FROM story WHERE hoop_id = hoop.id) DESC
-LIMIT 100`
+WHERE ` + HOOPS_IN_BOX_SQL + `
+GROUP BY floor(longitude / $5::float8), floor(latitude / $5::float8)
+ORDER BY min(id)`
+
+const GET_POPULAR_HOOPS_SQL = `
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, score FROM (SELECT (SELECT COUNT(id) FROM story WHERE hoop_id = hoop.id)::float8 score, * FROM hoop) AS tempQuery
+WHERE ($1::float8 IS NULL OR (score, created_at, id) < ($1, $2, $3))
+ORDER BY score DESC, created_at DESC, id DESC
+LIMIT $4`
 
 const GET_LATEST_HOOPS_SQL = `
-SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, 0::float8
 FROM hoop
-ORDER BY created_at DESC
-LIMIT 100`
+WHERE ($1::float8 IS NULL OR (0::float8, created_at, id) < ($1, $2, $3))
+ORDER BY created_at DESC, id DESC
+LIMIT $4`
 
+// Hoops whose names contain $1, whatever their accents and case
 const GET_HOOPS_WITH_NAME_SQL = `
-SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at
+SELECT id, user_id, name, description, latitude, longitude, created_at, updated_at, 0::float8
 FROM hoop
-WHERE name LIKE $1`
+WHERE strpos(unaccented(name), unaccented($1)) > 0
+AND ($2::float8 IS NULL OR (0::float8, created_at, id) < ($2, $3, $4))
+ORDER BY created_at DESC, id DESC
+LIMIT $5`
 
 // Story
 const INSERT_STORY_SQL = `
-INSERT INTO story (hoop_id, user_id, name, description, image_url, created_at, updated_at)
+INSERT INTO story (hoop_id, user_id, name, description, images, created_at, updated_at)
 VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
 RETURNING id`
 
 const GET_STORY_SQL = `
-SELECT id, hoop_id, user_id, name, description, image_url, created_at, updated_at FROM story
+SELECT id, hoop_id, user_id, name, description, images, created_at, updated_at FROM story
 WHERE id = $1
 LIMIT 1`
 
 const GET_FEATURED_STORY_SQL = `
-SELECT id, hoop_id, user_id, name, description, image_url, created_at, updated_at FROM story
-WHERE hoop_id = $1
+SELECT story.id, story.hoop_id, story.user_id, story.name, story.description, story.images, story.created_at, story.updated_at FROM story
+JOIN hoop_featured_story ON hoop_featured_story.story_id = story.id
+WHERE hoop_featured_story.hoop_id = $1
 LIMIT 1`
 
+const GET_STORIES_BY_IDS_SQL = `
+SELECT id, hoop_id, user_id, name, description, images, created_at, updated_at FROM story
+WHERE id = ANY($1)`
+
+const GET_FEATURED_STORIES_SQL = `
+SELECT story.id, story.hoop_id, story.user_id, story.name, story.description, story.images, story.created_at, story.updated_at FROM story
+JOIN hoop_featured_story ON hoop_featured_story.story_id = story.id
+WHERE hoop_featured_story.hoop_id = ANY($1)`
+
+const UPDATE_STORY_SQL = `
+UPDATE story SET
+name = $1,
+description = $2,
+images = $3,
+updated_at = NOW()
+WHERE id = $4`
+
+const GET_STORY_FOR_UPDATE_SQL = `
+SELECT hoop_id, images FROM story WHERE id = $1 FOR UPDATE`
+
+const DELETE_STORY_SQL = `
+DELETE FROM story WHERE id = $1`
+
+const DELETE_STORY_COMMENTS_SQL = `
+DELETE FROM comment WHERE story_id = $1`
+
+const DELETE_STORY_ACTIVITIES_SQL = `
+DELETE FROM activity WHERE story_id = $1 AND type IN (2, 102, 202)`
+
+const DELETE_HOOP_FEATURED_STORY_SQL = `
+DELETE FROM hoop_featured_story WHERE story_id = $1`
+
+const ELECT_HOOP_FEATURED_STORY_SQL = `
+INSERT INTO hoop_featured_story (hoop_id, story_id)
+SELECT hoop_id, id FROM story
+WHERE hoop_id = $1
+ORDER BY created_at DESC, id DESC
+LIMIT 1
+ON CONFLICT (hoop_id) DO NOTHING`
+
 const COUNT_STORY_SQL = `
 SELECT COUNT(id) FROM story
 WHERE id = $1
 LIMIT 1`
 
 const GET_STORIES_SQL = `
-SELECT id, hoop_id, user_id, name, description, image_url, created_at, updated_at
+SELECT id, hoop_id, user_id, name, description, images, created_at, updated_at, 0::float8
 FROM story
-WHERE hoop_id = $1`
+WHERE hoop_id = $1
+AND ($2::float8 IS NULL OR (0::float8, created_at, id) < ($2, $3, $4))
+ORDER BY created_at DESC, id DESC
+LIMIT $5`
 
 const GET_MOST_COMMENTED_STORIES_SQL = `
-SELECT id, hoop_id, user_id, name, description, image_url, created_at, updated_at
-FROM story
+SELECT id, hoop_id, user_id, name, description, images, created_at, updated_at, score FROM (SELECT (SELECT COUNT(id) FROM activity WHERE type = 102 AND story_id = story.id)::float8 score, * FROM story) AS tempQuery
 WHERE hoop_id = $1
-ORDER BY (SELECT COUNT(id) FROM activity WHERE type = 102 AND story_id = story.id) DESC`
+AND ($2::float8 IS NULL OR (score, created_at, id) < ($2, $3, $4))
+ORDER BY score DESC, created_at DESC, id DESC
+LIMIT $5`
 
 const GET_MOST_LIKED_STORIES_SQL = `
-SELECT id, hoop_id, user_id, name, description, image_url, created_at, updated_at
-FROM story
+SELECT id, hoop_id, user_id, name, description, images, created_at, updated_at, score FROM (SELECT (SELECT COUNT(id) FROM activity WHERE type = 202 AND story_id = story.id)::float8 score, * FROM story) AS tempQuery
 WHERE hoop_id = $1
-ORDER BY (SELECT COUNT(id) FROM activity WHERE type = 202 AND story_id = story.id) DESC`
+AND ($2::float8 IS NULL OR (score, created_at, id) < ($2, $3, $4))
+ORDER BY score DESC, created_at DESC, id DESC
+LIMIT $5`
 
 const GET_LATEST_STORIES_SQL = `
-SELECT id, hoop_id, user_id, name, description, image_url, created_at, updated_at
+SELECT id, hoop_id, user_id, name, description, images, created_at, updated_at, 0::float8
 FROM story
 WHERE hoop_id = $1
-ORDER BY created_at DESC`
+AND ($2::float8 IS NULL OR (0::float8, created_at, id) < ($2, $3, $4))
+ORDER BY created_at DESC, id DESC
+LIMIT $5`
+
+const GET_ALL_STORIES_SQL = `
+SELECT id, hoop_id, user_id, name, description, images, created_at, updated_at, 0::float8
+FROM story
+WHERE hoop_id = $1`
 
 // HoopFeaturedStory
 const INSERT_HOOP_FEATURED_STORY_SQL = `
@@ -257,34 +839,57 @@ VALUES ($1, $2)`
 
 // Activity
 const GET_ACTIVITIES_SQL = `
-SELECT user_id, type, hoop_id, story_id, created_at FROM activity
+SELECT id, user_id, type, hoop_id, story_id, created_at FROM activity
 WHERE user_id != $1
-ORDER BY created_at DESC
-LIMIT 100`
+AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3))
+ORDER BY created_at DESC, id DESC
+LIMIT $4`
+
+// The following feed has the activities of followed users and the
+// activities on followed hoops and their stories
+const GET_FOLLOWING_ACTIVITIES_SQL = `
+SELECT id, user_id, type, hoop_id, story_id, created_at FROM activity
+WHERE user_id != $1
+AND (
+	user_id IN (SELECT user_id FROM follow WHERE follower_id = $1)
+	OR (type IN (1, 101, 201) AND hoop_id IN (SELECT hoop_id FROM hoop_follow WHERE user_id = $1))
+	OR (type IN (2, 102, 202) AND story_id IN (
+		SELECT story.id FROM story JOIN hoop_follow ON hoop_follow.hoop_id = story.hoop_id
+		WHERE hoop_follow.user_id = $1))
+)
+AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3))
+ORDER BY created_at DESC, id DESC
+LIMIT $4`
 
 const INSERT_POST_HOOP_ACTIVITY_SQL = `
 INSERT INTO activity (user_id, type, hoop_id, created_at)
-VALUES ($1, $2, $3, NOW())`
+VALUES ($1, $2, $3, NOW())
+RETURNING id, created_at`
 
 const INSERT_POST_STORY_ACTIVITY_SQL = `
 INSERT INTO activity (user_id, type, story_id, created_at)
-VALUES ($1, $2, $3, NOW())`
+VALUES ($1, $2, $3, NOW())
+RETURNING id, created_at`
 
 const INSERT_HOOP_COMMENT_ACTIVITY_SQL = `
 INSERT INTO activity (user_id, type, hoop_id, created_at)
-VALUES ($1, $2, $3, NOW())`
+VALUES ($1, $2, $3, NOW())
+RETURNING id, created_at`
 
 const INSERT_STORY_COMMENT_ACTIVITY_SQL = `
 INSERT INTO activity (user_id, type, story_id, created_at)
-VALUES ($1, $2, $3, NOW())`
+VALUES ($1, $2, $3, NOW())
+RETURNING id, created_at`
 
 const INSERT_HOOP_LIKE_ACTIVITY_SQL = `
-INSERT INTO activity (user_id, type, hoop_id, story_id, created_at)
-VALUES ($1, $2, $3, 0, NOW())`
+INSERT INTO activity (user_id, type, hoop_id, created_at)
+VALUES ($1, $2, $3, NOW())
+RETURNING id, created_at`
 
 const INSERT_STORY_LIKE_ACTIVITY_SQL = `
-INSERT INTO activity (user_id, type, hoop_id, story_id, created_at)
-VALUES ($1, $2, 0, $3, NOW())`
+INSERT INTO activity (user_id, type, story_id, created_at)
+VALUES ($1, $2, $3, NOW())
+RETURNING id, created_at`
 
 const DELETE_HOOP_ACTIVITY_SQL = `
 DELETE FROM activity WHERE user_id = $1 AND type = $2 AND hoop_id = $3`
@@ -293,29 +898,236 @@ const DELETE_STORY_ACTIVITY_SQL = `
 DELETE FROM activity WHERE user_id = $1 AND type = $2 AND story_id = $3`
 
 // Comment
+const COMMENT_COLUMNS = `id, user_id, text, parent_id, root_id, depth, created_at, updated_at, edited_at, deleted_at`
+
+// Comment lists page through top-level comments; their replies are
+// fetched by thread.
 const GET_HOOP_COMMENTS_SQL = `
-SELECT id, user_id, text, hoop_id, created_at, updated_at FROM comment
-WHERE hoop_id = $1
-ORDER BY created_at DESC`
+SELECT ` + COMMENT_COLUMNS + `, hoop_id FROM comment
+WHERE hoop_id = $1 AND parent_id IS NULL
+AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3))
+ORDER BY created_at DESC, id DESC
+LIMIT $4`
 
 const GET_STORY_COMMENTS_SQL = `
-SELECT id, user_id, text, story_id, created_at, updated_at FROM comment
-WHERE story_id = $1
-ORDER BY created_at DESC`
+SELECT ` + COMMENT_COLUMNS + `, story_id FROM comment
+WHERE story_id = $1 AND parent_id IS NULL
+AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3))
+ORDER BY created_at DESC, id DESC
+LIMIT $4`
+
+// Up to $2 replies of each thread, oldest first
+const GET_COMMENT_REPLIES_SQL = `
+SELECT ` + COMMENT_COLUMNS + ` FROM (
+	SELECT *, row_number() OVER (PARTITION BY root_id ORDER BY created_at, id) AS n
+	FROM comment
+	WHERE root_id = ANY($1)
+) reply
+WHERE n <= $2
+ORDER BY created_at, id`
+
+const GET_THREAD_REPLIES_SQL = `
+SELECT ` + COMMENT_COLUMNS + `, COALESCE(hoop_id, 0), COALESCE(story_id, 0) FROM comment
+WHERE root_id = $1
+AND ($2::timestamptz IS NULL OR (created_at, id) > ($2, $3))
+ORDER BY created_at, id
+LIMIT $4`
+
+const GET_COMMENT_SQL = `
+SELECT ` + COMMENT_COLUMNS + `, COALESCE(hoop_id, 0), COALESCE(story_id, 0) FROM comment
+WHERE id = $1`
 
 const INSERT_HOOP_COMMENT_SQL = `
-INSERT INTO comment (user_id, text, hoop_id, created_at, updated_at)
-VALUES ($1, $2, $3, NOW(), NOW())
-RETURNING id`
+INSERT INTO comment (user_id, text, hoop_id, parent_id, root_id, depth, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+RETURNING id, created_at`
 
 const INSERT_STORY_COMMENT_SQL = `
-INSERT INTO comment (user_id, text, story_id, created_at, updated_at)
+INSERT INTO comment (user_id, text, story_id, parent_id, root_id, depth, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+RETURNING id, created_at`
+
+const UPDATE_COMMENT_SQL = `
+UPDATE comment SET text = $1, edited_at = NOW(), updated_at = NOW()
+WHERE id = $2 AND deleted_at IS NULL`
+
+const GET_COMMENTS_BY_IDS_SQL = `
+SELECT ` + COMMENT_COLUMNS + `, COALESCE(hoop_id, 0), COALESCE(story_id, 0) FROM comment
+WHERE id = ANY($1)`
+
+// Deleted comments keep their place in the thread but lose their text
+const DELETE_COMMENT_SQL = `
+UPDATE comment SET text = '', deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL`
+
+// Follow
+const INSERT_FOLLOW_SQL = `
+INSERT INTO follow (follower_id, user_id, created_at) VALUES ($1, $2, NOW())
+ON CONFLICT DO NOTHING`
+
+const DELETE_FOLLOW_SQL = `
+DELETE FROM follow WHERE follower_id = $1 AND user_id = $2`
+
+const COUNT_FOLLOW_SQL = `
+SELECT COUNT(*) FROM follow WHERE follower_id = $1 AND user_id = $2`
+
+const COUNT_FOLLOWERS_SQL = `
+SELECT
+	(SELECT COUNT(*) FROM follow WHERE user_id = $1),
+	(SELECT COUNT(*) FROM follow WHERE follower_id = $1)`
+
+const GET_FOLLOWERS_SQL = `
+SELECT follower_id, created_at FROM follow
+WHERE user_id = $1
+AND ($2::timestamptz IS NULL OR (created_at, follower_id) < ($2, $3))
+ORDER BY created_at DESC, follower_id DESC
+LIMIT $4`
+
+const GET_FOLLOWING_SQL = `
+SELECT user_id, created_at FROM follow
+WHERE follower_id = $1
+AND ($2::timestamptz IS NULL OR (created_at, user_id) < ($2, $3))
+ORDER BY created_at DESC, user_id DESC
+LIMIT $4`
+
+const COUNT_HOOP_FOLLOW_SQL = `
+SELECT COUNT(*) FROM hoop_follow WHERE user_id = $1 AND hoop_id = $2`
+
+const COUNT_HOOP_FOLLOWS_SQL = `
+SELECT COUNT(*) FROM hoop_follow WHERE user_id = $1`
+
+const INSERT_HOOP_FOLLOW_SQL = `
+INSERT INTO hoop_follow (user_id, hoop_id, created_at) VALUES ($1, $2, NOW())
+ON CONFLICT DO NOTHING`
+
+const DELETE_HOOP_FOLLOW_SQL = `
+DELETE FROM hoop_follow WHERE user_id = $1 AND hoop_id = $2`
+
+// Notification
+
+const NOTIFICATION_COLUMNS = `id, user_id, actor_id, type, hoop_id, story_id, created_at, read_at`
+
+// Notifies the owner and followers of hoop $3, except the actor $1, of
+// activity of type $2, on story $4 if not null
+const INSERT_HOOP_NOTIFICATIONS_SQL = `
+INSERT INTO notification (user_id, actor_id, type, hoop_id, story_id, created_at)
+SELECT user_id, $1, $2, $3, $4, NOW() FROM (
+	SELECT user_id FROM hoop_follow WHERE hoop_id = $3
+	UNION
+	SELECT user_id FROM hoop WHERE id = $3
+) recipient
+WHERE user_id != $1
+RETURNING ` + NOTIFICATION_COLUMNS
+
+// Notifies the owner of story $3, unless they are the actor $1, of activity
+// of type $2
+const INSERT_STORY_NOTIFICATION_SQL = `
+INSERT INTO notification (user_id, actor_id, type, hoop_id, story_id, created_at)
+SELECT user_id, $1, $2, hoop_id, id, NOW() FROM story
+WHERE id = $3 AND user_id != $1
+RETURNING ` + NOTIFICATION_COLUMNS
+
+const DELETE_HOOP_NOTIFICATIONS_BY_ACTOR_SQL = `
+DELETE FROM notification WHERE actor_id = $1 AND type = $2 AND hoop_id = $3 AND story_id IS NULL`
+
+const DELETE_STORY_NOTIFICATIONS_BY_ACTOR_SQL = `
+DELETE FROM notification WHERE actor_id = $1 AND type = $2 AND story_id = $3`
+
+const GET_NOTIFICATIONS_SQL = `
+SELECT ` + NOTIFICATION_COLUMNS + ` FROM notification
+WHERE user_id = $1
+AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3))
+ORDER BY created_at DESC, id DESC
+LIMIT $4`
+
+const COUNT_UNREAD_NOTIFICATIONS_SQL = `
+SELECT COUNT(*) FROM notification WHERE user_id = $1 AND read_at IS NULL`
+
+const READ_NOTIFICATION_SQL = `
+UPDATE notification SET read_at = COALESCE(read_at, NOW()) WHERE id = $1 AND user_id = $2`
+
+const READ_ALL_NOTIFICATIONS_SQL = `
+UPDATE notification SET read_at = NOW() WHERE user_id = $1 AND read_at IS NULL`
+
+const DELETE_READ_NOTIFICATIONS_SQL = `
+DELETE FROM notification WHERE read_at < $1`
+
+// Device
+
+// Registers device token $3 of type $2 to user $1, taking it over from any
+// other user
+const INSERT_DEVICE_SQL = `
+INSERT INTO device (user_id, type, token, created_at, updated_at)
 VALUES ($1, $2, $3, NOW(), NOW())
-RETURNING id`
+ON CONFLICT (token) DO UPDATE SET user_id = $1, type = $2, updated_at = NOW()`
+
+const DELETE_USER_DEVICE_SQL = `
+DELETE FROM device WHERE user_id = $1 AND token = $2`
+
+const DELETE_DEVICE_SQL = `
+DELETE FROM device WHERE token = $1`
+
+const GET_DEVICES_SQL = `
+SELECT id, user_id, type, token, created_at, updated_at FROM device
+WHERE user_id = $1
+ORDER BY id`
+
+const GET_NOTIFICATION_PREFERENCES_SQL = `
+SELECT likes, comments, stories FROM notification_preference WHERE user_id = $1`
+
+const UPSERT_NOTIFICATION_PREFERENCES_SQL = `
+INSERT INTO notification_preference (user_id, likes, comments, stories, updated_at)
+VALUES ($1, $2, $3, $4, NOW())
+ON CONFLICT (user_id) DO UPDATE SET likes = $2, comments = $3, stories = $4, updated_at = NOW()`
+
+// Job
+
+const INSERT_JOB_SQL = `
+INSERT INTO job (type, payload, run_at, created_at) VALUES ($1, $2, NOW(), NOW())`
+
+// Takes the next due job that no worker holds, holding it for $1 seconds
+const CLAIM_JOB_SQL = `
+UPDATE job SET attempts = attempts + 1, locked_until = NOW() + $1::integer * interval '1 second'
+WHERE id = (
+	SELECT id FROM job
+	WHERE run_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW())
+	ORDER BY run_at, id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, type, payload, attempts, created_at`
+
+const DELETE_JOB_SQL = `
+DELETE FROM job WHERE id = $1`
+
+// Runs job $1 again in $2 seconds
+const RETRY_JOB_SQL = `
+UPDATE job SET run_at = NOW() + $2::integer * interval '1 second', locked_until = NULL, last_error = $3
+WHERE id = $1`
+
+const FAIL_JOB_SQL = `
+WITH failed AS (
+	DELETE FROM job WHERE id = $1 RETURNING id, type, payload, attempts, created_at
+)
+INSERT INTO dead_job (id, type, payload, attempts, last_error, created_at, failed_at)
+SELECT id, type, payload, attempts, $2, created_at, NOW() FROM failed`
+
+const GET_DEAD_JOBS_SQL = `
+SELECT id, type, payload, attempts, last_error, created_at, failed_at FROM dead_job
+WHERE ($1::timestamptz IS NULL OR (failed_at, id) < ($1, $2))
+ORDER BY failed_at DESC, id DESC
+LIMIT $3`
+
+const REQUEUE_DEAD_JOB_SQL = `
+WITH dead AS (
+	DELETE FROM dead_job WHERE id = $1 RETURNING type, payload, created_at
+)
+INSERT INTO job (type, payload, run_at, created_at)
+SELECT type, payload, NOW(), created_at FROM dead`
 
 // Like
 const COUNT_HOOP_LIKES_SQL = `
-SELECT COUNT(id) FROM activity WHERE hoop_id = $1 AND type = 202`
+SELECT COUNT(id) FROM activity WHERE hoop_id = $1 AND type = 201`
 
 const COUNT_STORY_LIKES_SQL = `
 SELECT COUNT(id) FROM activity WHERE story_id = $1 AND type = 202`
@@ -325,3 +1137,78 @@ SELECT COUNT(id) FROM activity WHERE user_id = $1 AND type = $2 AND hoop_id = $3
 
 const COUNT_STORY_ACTIVITY_BY_USER_SQL = `
 SELECT COUNT(id) FROM activity WHERE user_id = $1 AND type = $2 AND story_id = $3`
+
+// Refresh token
+const INSERT_REFRESH_TOKEN_SQL = `
+INSERT INTO refresh_token (user_id, token_hash, expires_at, created_at)
+VALUES ($1, $2, $3, NOW())`
+
+const GET_REFRESH_TOKEN_SQL = `
+SELECT user_id, expires_at, revoked_at FROM refresh_token
+WHERE token_hash = $1
+LIMIT 1`
+
+const REVOKE_REFRESH_TOKEN_SQL = `
+UPDATE refresh_token SET revoked_at = NOW()
+WHERE token_hash = $1 AND revoked_at IS NULL`
+
+// Upload
+const INSERT_UPLOAD_SQL = `
+INSERT INTO upload (key, url, ref_count, created_at, updated_at)
+VALUES ($1, $2, 0, NOW(), NOW())
+ON CONFLICT (key) DO NOTHING
+RETURNING key`
+
+const TOUCH_UPLOAD_SQL = `
+UPDATE upload SET updated_at = NOW() WHERE key = $1`
+
+const REFERENCE_UPLOADS_SQL = `
+UPDATE upload SET ref_count = ref_count + 1, updated_at = NOW()
+WHERE url = ANY($1)`
+
+const RELEASE_UPLOADS_SQL = `
+UPDATE upload SET ref_count = ref_count - 1, updated_at = NOW()
+WHERE url = ANY($1) AND ref_count > 0`
+
+const GET_ORPHANED_UPLOADS_SQL = `
+SELECT key FROM upload
+WHERE ref_count = 0 AND updated_at < $1
+ORDER BY updated_at
+LIMIT $2`
+
+const DELETE_ORPHANED_UPLOAD_SQL = `
+DELETE FROM upload WHERE key = $1 AND ref_count = 0 AND updated_at < $2`
+
+// Search
+//
+// Finds the hoops, stories, comments and users of the types $2 that match
+// the words of $1, or whose names are like it, best first. Only the page is
+// highlighted, with the ts_headline options $3.
+const SEARCH_SQL = `
+WITH query AS (
+	SELECT websearch_to_tsquery('unaccented', $1) words, unaccented($1) name
+)
+SELECT type, id, rank, ts_headline('unaccented', document, words, $3), created_at
+FROM (
+	SELECT 'hoop' type, id, greatest(ts_rank(search, words), similarity(unaccented(name), query.name))::float8 rank,
+		name || ' ' || description document, created_at
+	FROM hoop, query
+	WHERE 'hoop' = ANY($2) AND (search @@ words OR unaccented(name) % query.name)
+	UNION ALL
+	SELECT 'story', id, greatest(ts_rank(search, words), similarity(unaccented(name), query.name))::float8,
+		name || ' ' || description, created_at
+	FROM story, query
+	WHERE 'story' = ANY($2) AND (search @@ words OR unaccented(name) % query.name)
+	UNION ALL
+	SELECT 'comment', id, ts_rank(search, words)::float8, text, created_at
+	FROM comment, query
+	WHERE 'comment' = ANY($2) AND deleted_at IS NULL AND search @@ words
+	UNION ALL
+	SELECT 'user', id, greatest(ts_rank(search, words), similarity(unaccented(coalesce(firstname, '') || ' ' || coalesce(lastname, '')), query.name))::float8,
+		coalesce(firstname, '') || ' ' || coalesce(lastname, ''), created_at
+	FROM "user", query
+	WHERE 'user' = ANY($2) AND (search @@ words OR unaccented(coalesce(firstname, '') || ' ' || coalesce(lastname, '')) % query.name)
+) AS results, query
+WHERE ($4::float8 IS NULL OR (rank, created_at, id) < ($4, $5, $6))
+ORDER BY rank DESC, created_at DESC, id DESC
+LIMIT $7`
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// makeAdmin lets the user edit and delete what others created.
+func makeAdmin(t *testing.T, userID int64) {
+	m := store.Users.(*memoryStore)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		t.Fatalf("user %d does not exist", userID)
+	}
+	user.IsAdmin = true
+	m.users[userID] = user
+}
+
+// featuredStory returns the name of the hoop's featured story, or "" if it
+// has none.
+func (c *testClient) featuredStory(hoopID int64) string {
+	c.t.Helper()
+
+	var hoop Hoop
+	c.ok("GET", "/api/hoop", params{"hoop_id": hoopID}, &hoop)
+	story, _ := hoop.Data["featured_story"].(map[string]interface{})
+	name, _ := story["name"].(string)
+	return name
+}
+
+func TestStoryEdit(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	hoop := juan.createHoop("Tondo Court")
+	story := juan.createStory(hoop.ID, "First game")
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	admin := newTestClient(t, server)
+	makeAdmin(t, admin.signup("Maria").ID)
+
+	// Only the author and admins may edit a story
+	newTestClient(t, server).fails("PATCH", "/api/story", params{"story_id": story.ID, "name": "Mine"}, http.StatusForbidden)
+	pedro.fails("PATCH", "/api/story", params{"story_id": story.ID, "name": "Mine"}, http.StatusForbidden)
+	juan.fails("PATCH", "/api/story", params{"story_id": story.ID + 100, "name": "Gone"}, http.StatusNotFound)
+
+	juan.ok("PATCH", "/api/story", params{"story_id": story.ID, "description": "Close game"}, nil)
+	admin.ok("PATCH", "/api/story", params{"story_id": story.ID, "name": "Final"}, nil)
+
+	var got Story
+	juan.ok("GET", "/api/story", params{"story_id": story.ID}, &got)
+	if got.Name != "Final" || got.Description != "Close game" || got.Images.Full != "http://example.com/story.jpg" {
+		t.Errorf("edited story %+v", got)
+	}
+
+	// A description sent empty is cleared, one left out is kept
+	juan.ok("PATCH", "/api/story", params{"story_id": story.ID, "description": ""}, nil)
+	juan.ok("GET", "/api/story", params{"story_id": story.ID}, &got)
+	if got.Name != "Final" || got.Description != "" {
+		t.Errorf("story %+v after clearing its description", got)
+	}
+}
+
+func TestStoryDelete(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	hoop := juan.createHoop("Tondo Court")
+	first := juan.createStory(hoop.ID, "First game")
+	second := juan.createStory(hoop.ID, "Second game")
+	juan.ok("PATCH", "/api/comment/story", params{"story_id": first.ID, "text": "Good game"}, nil)
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	admin := newTestClient(t, server)
+	makeAdmin(t, admin.signup("Maria").ID)
+
+	newTestClient(t, server).fails("DELETE", "/api/story", params{"story_id": first.ID}, http.StatusForbidden)
+	pedro.fails("DELETE", "/api/story", params{"story_id": first.ID}, http.StatusForbidden)
+
+	juan.ok("DELETE", "/api/story", params{"story_id": first.ID}, nil)
+	juan.fails("GET", "/api/story", params{"story_id": first.ID}, http.StatusNotFound)
+	juan.fails("DELETE", "/api/story", params{"story_id": first.ID}, http.StatusNotFound)
+
+	// Its comments go with it
+	var comments []Comment
+	juan.list("/api/story/comments", params{"story_id": first.ID}, &comments)
+	if len(comments) != 0 {
+		t.Errorf("comments %+v of a deleted story", comments)
+	}
+
+	// Deleting the featured story features the latest one left, and none
+	// once they are all deleted
+	var stories []Story
+	juan.list("/api/stories", params{"hoop_id": hoop.ID}, &stories)
+	if len(stories) != 2 || stories[1].Name != "Tondo Court" {
+		t.Fatalf("stories %+v", stories)
+	}
+	if name := juan.featuredStory(hoop.ID); name != "Tondo Court" {
+		t.Errorf("featured story %q, want the hoop's own", name)
+	}
+
+	admin.ok("DELETE", "/api/story", params{"story_id": stories[1].ID}, nil)
+	if name := juan.featuredStory(hoop.ID); name != "Second game" {
+		t.Errorf("featured story %q after deleting the hoop's own", name)
+	}
+
+	admin.ok("DELETE", "/api/story", params{"story_id": second.ID}, nil)
+	juan.list("/api/stories", params{"hoop_id": hoop.ID}, &stories)
+	if len(stories) != 0 {
+		t.Errorf("stories %+v after deleting them all", stories)
+	}
+	if name := juan.featuredStory(hoop.ID); name != "" {
+		t.Errorf("featured story %q after deleting them all", name)
+	}
+}
+
+// redirect gets the path without following a redirect, and returns the status
+// and where it redirects to.
+func (c *testClient) redirect(path string) (int, string) {
+	c.t.Helper()
+
+	client := *c.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	res, err := client.Get(c.server.URL + path)
+	if err != nil {
+		c.t.Fatalf("GET %s: %v", path, err)
+	}
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("Location")
+}
+
+func TestHoopEdit(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	hoop := juan.createHoop("Tondo Court")
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	admin := newTestClient(t, server)
+	makeAdmin(t, admin.signup("Maria").ID)
+
+	newTestClient(t, server).fails("PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "name": "Mine"}, http.StatusForbidden)
+	pedro.fails("PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "name": "Mine"}, http.StatusForbidden)
+	juan.fails("PATCH", "/api/hoop", params{"hoop_id": hoop.ID + 100, "name": "Gone"}, http.StatusNotFound)
+	juan.fails("PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "name": ""}, http.StatusBadRequest)
+	juan.fails("PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "latitude": "north"}, http.StatusBadRequest)
+
+	juan.ok("PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "description": "Covered court"}, nil)
+	admin.ok("PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "name": "Tondo Sports Complex", "latitude": 14.6}, nil)
+
+	var got Hoop
+	juan.ok("GET", "/api/hoop", params{"hoop_id": hoop.ID}, &got)
+	if got.Name != "Tondo Sports Complex" || got.Description != "Covered court" || got.Latitude != 14.6 || got.Longitude != 120.9842 {
+		t.Errorf("edited hoop %+v", got)
+	}
+}
+
+func TestHoopDelete(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	hoop := juan.createHoop("Tondo Court")
+	juan.createStory(hoop.ID, "First game")
+	other := juan.createHoop("Quiapo Court")
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	admin := newTestClient(t, server)
+	makeAdmin(t, admin.signup("Maria").ID)
+
+	newTestClient(t, server).fails("DELETE", "/api/hoop", params{"hoop_id": hoop.ID}, http.StatusForbidden)
+	pedro.fails("DELETE", "/api/hoop", params{"hoop_id": hoop.ID}, http.StatusForbidden)
+
+	juan.ok("DELETE", "/api/hoop", params{"hoop_id": hoop.ID}, nil)
+	juan.fails("GET", "/api/hoop", params{"hoop_id": hoop.ID}, http.StatusNotFound)
+	juan.fails("DELETE", "/api/hoop", params{"hoop_id": hoop.ID}, http.StatusNotFound)
+
+	// Its stories go with it
+	var stories []Story
+	juan.list("/api/stories", params{"hoop_id": hoop.ID}, &stories)
+	if len(stories) != 0 {
+		t.Errorf("stories %+v of a deleted hoop", stories)
+	}
+
+	admin.ok("DELETE", "/api/hoop", params{"hoop_id": other.ID}, nil)
+	var hoops []Hoop
+	juan.list("/api/hoops", nil, &hoops)
+	if len(hoops) != 0 {
+		t.Errorf("hoops %+v after deleting them all", hoops)
+	}
+}
+
+func TestHoopMerge(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	canonical := juan.createHoop("Tondo Court")
+	duplicate := juan.createHoop("Tondo Basketball Court")
+	juan.createStory(duplicate.ID, "First game")
+	juan.ok("POST", "/api/like/hoop", params{"hoop_id": canonical.ID}, nil)
+	juan.ok("POST", "/api/like/hoop", params{"hoop_id": duplicate.ID}, nil)
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	pedro.ok("POST", "/api/like/hoop", params{"hoop_id": duplicate.ID}, nil)
+	admin := newTestClient(t, server)
+	makeAdmin(t, admin.signup("Maria").ID)
+
+	older := juan.createHoop("Old Tondo Court")
+	admin.ok("POST", "/api/hoop/merge", params{"hoop_id": older.ID, "into": duplicate.ID}, nil)
+
+	// Only admins may merge, even the hoop's creator may not
+	merge := params{"hoop_id": duplicate.ID, "into": canonical.ID}
+	juan.fails("POST", "/api/hoop/merge", merge, http.StatusForbidden)
+	admin.fails("POST", "/api/hoop/merge", params{"hoop_id": duplicate.ID, "into": duplicate.ID}, http.StatusBadRequest)
+	admin.fails("POST", "/api/hoop/merge", params{"hoop_id": duplicate.ID, "into": canonical.ID + 100}, http.StatusNotFound)
+	admin.fails("GET", "/api/hoop/merge", merge, http.StatusMethodNotAllowed)
+	admin.ok("POST", "/api/hoop/merge", merge, nil)
+
+	// The stories and likes of the duplicate move, without liking twice
+	var stories []Story
+	juan.list("/api/stories", params{"hoop_id": canonical.ID}, &stories)
+	var names []string
+	for _, story := range stories {
+		names = append(names, story.Name)
+	}
+	if strings.Join(names, ",") != "Old Tondo Court,First game,Tondo Basketball Court,Tondo Court" {
+		t.Errorf("stories %q of the merged hoop", names)
+	}
+
+	var likes likeCount
+	juan.ok("GET", "/api/hoop/likes", params{"hoop_id": canonical.ID}, &likes)
+	if likes.Count != 2 {
+		t.Errorf("%d likes of the merged hoop, want 2", likes.Count)
+	}
+
+	// Links to the duplicate redirect to the hoop it was merged into,
+	// keeping the rest of the query
+	status, location := juan.redirect("/api/hoop?hoop_id=" + itoa(duplicate.ID) + "&lang=tl")
+	if want := "/api/hoop?hoop_id=" + itoa(canonical.ID) + "&lang=tl"; status != http.StatusMovedPermanently || location != want {
+		t.Errorf("redirected with %d to %s, want %s", status, location, want)
+	}
+	status, location = juan.redirect("/api/hoop?hoopID=" + itoa(duplicate.ID))
+	if want := "/api/hoop?hoop_id=" + itoa(canonical.ID); status != http.StatusMovedPermanently || location != want {
+		t.Errorf("redirected with %d to %s, want %s", status, location, want)
+	}
+	if status, location := juan.redirect("/hoop/" + itoa(duplicate.ID)); status != http.StatusMovedPermanently || location != "/hoop/"+itoa(canonical.ID) {
+		t.Errorf("page redirected with %d to %s", status, location)
+	}
+
+	var got Hoop
+	juan.ok("GET", "/api/hoop", params{"hoop_id": duplicate.ID}, &got)
+	if got.ID != canonical.ID {
+		t.Errorf("got hoop %d through the redirect, want %d", got.ID, canonical.ID)
+	}
+
+	// As do links to hoops merged into the duplicate before
+	if status, location := juan.redirect("/hoop/" + itoa(older.ID)); status != http.StatusMovedPermanently || location != "/hoop/"+itoa(canonical.ID) {
+		t.Errorf("page of a hoop merged twice redirected with %d to %s", status, location)
+	}
+	admin.fails("POST", "/api/hoop/merge", params{"hoop_id": canonical.ID, "into": duplicate.ID}, http.StatusNotFound)
+}
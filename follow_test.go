@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// profile returns the user's profile as the client sees it.
+func (c *testClient) profile(userID int64) Profile {
+	c.t.Helper()
+
+	var profile Profile
+	c.ok("GET", "/api/user", params{"user_id": userID}, &profile)
+	return profile
+}
+
+func TestFollows(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juanUser := juan.signup("Juan")
+	pedro := newTestClient(t, server)
+	pedroUser := pedro.signup("Pedro")
+	maria := newTestClient(t, server)
+	maria.signup("Maria")
+
+	newTestClient(t, server).fails("POST", "/api/follow", params{"user_id": pedroUser.ID}, http.StatusForbidden)
+	juan.fails("POST", "/api/follow", params{"user_id": juanUser.ID}, http.StatusBadRequest)
+	juan.fails("POST", "/api/follow", params{"user_id": pedroUser.ID + 100}, http.StatusNotFound)
+
+	// Following twice is the same as following once
+	juan.ok("POST", "/api/follow", params{"user_id": pedroUser.ID}, nil)
+	juan.ok("POST", "/api/follow", params{"user_id": pedroUser.ID}, nil)
+	maria.ok("POST", "/api/follow", params{"user_id": pedroUser.ID}, nil)
+	pedro.ok("POST", "/api/follow", params{"user_id": juanUser.ID}, nil)
+
+	if p := juan.profile(pedroUser.ID); p.FollowerCount != 2 || p.FollowingCount != 1 || !p.Followed || p.Firstname != "Pedro" {
+		t.Errorf("profile %+v", p)
+	}
+	if p := newTestClient(t, server).profile(pedroUser.ID); p.FollowerCount != 2 || p.Followed {
+		t.Errorf("profile %+v seen when logged out", p)
+	}
+	var own Profile
+	juan.ok("GET", "/api/login", nil, &own)
+	if own.ID != juanUser.ID || own.FollowerCount != 1 || own.FollowingCount != 1 {
+		t.Errorf("own profile %+v", own)
+	}
+	juan.fails("GET", "/api/user", params{"user_id": pedroUser.ID + 100}, http.StatusNotFound)
+
+	var users []User
+	juan.list("/api/user/followers", params{"user_id": pedroUser.ID}, &users)
+	if len(users) != 2 {
+		t.Errorf("followers %+v", users)
+	}
+	pedro.list("/api/user/following", nil, &users)
+	if len(users) != 1 || users[0].ID != juanUser.ID {
+		t.Errorf("following %+v", users)
+	}
+	newTestClient(t, server).fails("GET", "/api/user/following", nil, http.StatusForbidden)
+
+	juan.ok("DELETE", "/api/follow", params{"user_id": pedroUser.ID}, nil)
+	if p := juan.profile(pedroUser.ID); p.FollowerCount != 1 || p.Followed {
+		t.Errorf("profile %+v after unfollowing", p)
+	}
+}
+
+func TestFollowingFeed(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	pedro := newTestClient(t, server)
+	pedroUser := pedro.signup("Pedro")
+	maria := newTestClient(t, server)
+	mariaUser := maria.signup("Maria")
+
+	followed := maria.createHoop("Tondo Court")
+	other := maria.createHoop("Quiapo Court")
+	juan.ok("POST", "/api/follow", params{"user_id": pedroUser.ID}, nil)
+	juan.ok("POST", "/api/hoop/follow", params{"hoop_id": followed.ID}, nil)
+	juan.fails("POST", "/api/hoop/follow", params{"hoop_id": other.ID + 100}, http.StatusNotFound)
+
+	// Pedro is followed anywhere, Maria only on the followed hoop
+	pedro.ok("POST", "/api/comment/hoop", params{"hoop_id": other.ID, "text": "Pedro was here"}, nil)
+	maria.createStory(followed.ID, "Followed game")
+	maria.createStory(other.ID, "Other game")
+	maria.ok("POST", "/api/comment/hoop", params{"hoop_id": other.ID, "text": "Maria was here"}, nil)
+
+	type feedItem struct {
+		user  int64
+		typ   int64
+		story string
+	}
+	feed := func(scope string) []feedItem {
+		t.Helper()
+		var activities []Activity
+		juan.list("/api/activities", params{"scope": scope}, &activities)
+
+		var items []feedItem
+		for _, activity := range activities {
+			item := feedItem{user: activity.UserID, typ: activity.Type}
+			if story, ok := activity.Data["story"].(map[string]interface{}); ok {
+				item.story, _ = story["name"].(string)
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+
+	following := feed("following")
+	want := []feedItem{
+		{mariaUser.ID, ACTIVITY_POST_STORY, "Followed game"},
+		{pedroUser.ID, ACTIVITY_POST_COMMENT_HOOP, ""},
+		{mariaUser.ID, ACTIVITY_POST_HOOP, ""},
+	}
+	if len(following) != len(want) {
+		t.Fatalf("following feed %+v, want %+v", following, want)
+	}
+	for i := range want {
+		if following[i] != want[i] {
+			t.Errorf("following feed %+v, want %+v", following, want)
+			break
+		}
+	}
+	if everyone := feed("everyone"); len(everyone) <= len(following) {
+		t.Errorf("feed of everyone %+v", everyone)
+	}
+	juan.fails("GET", "/api/activities", params{"scope": "friends"}, http.StatusBadRequest)
+
+	// Unfollowing the hoop leaves only Pedro
+	juan.ok("DELETE", "/api/hoop/follow", params{"hoop_id": followed.ID}, nil)
+	if following := feed("following"); len(following) != 1 || following[0].user != pedroUser.ID {
+		t.Errorf("following feed %+v after unfollowing the hoop", following)
+	}
+}
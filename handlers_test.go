@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// newTestServer serves the API from a new memory store, with the globals that
+// main sets up pointed at test doubles.
+func newTestServer(t *testing.T) *httptest.Server {
+	config = defaultConfig()
+	config.Store = "memory"
+	config.ContentDir = t.TempDir()
+
+	store = newStore(newMemoryStore())
+	blobs = newLocalBlobStore(config.ContentDir, ContentPath)
+	broker = newLocalBroker()
+	pushSender = &fakePushSender{}
+	ss = sessions.NewCookieStore([]byte("test session key"))
+	if err := setAccessTokenKey("test token secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testClient calls the API with its own session cookie, and with the bearer
+// token if one is set.
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+	token  string
+}
+
+func newTestClient(t *testing.T, server *httptest.Server) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, server: server, client: &http.Client{Jar: jar}}
+}
+
+// params are the form values of a request. Values that are testFiles are
+// uploaded as files.
+type params map[string]interface{}
+
+type testFile struct {
+	name string
+	data []byte
+}
+
+func (p params) hasFile() bool {
+	for _, value := range p {
+		if _, ok := value.(testFile); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends the params in the query of a GET or DELETE, as a multipart form
+// if they include a file, and otherwise as a JSON object. It returns the
+// status and body of the response.
+func (c *testClient) do(method, path string, p params) (int, []byte) {
+	var body bytes.Buffer
+	var contentType string
+	if method == "GET" || method == "DELETE" {
+		query := url.Values{}
+		for name, value := range p {
+			query.Set(name, fmt.Sprint(value))
+		}
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+	} else if !p.hasFile() {
+		if err := json.NewEncoder(&body).Encode(p); err != nil {
+			c.t.Fatal(err)
+		}
+		contentType = "application/json"
+	} else {
+		form := multipart.NewWriter(&body)
+		for name, value := range p {
+			if file, ok := value.(testFile); ok {
+				part, err := form.CreateFormFile(name, file.name)
+				if err != nil {
+					c.t.Fatal(err)
+				}
+				part.Write(file.data)
+			} else if err := form.WriteField(name, fmt.Sprint(value)); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		if err := form.Close(); err != nil {
+			c.t.Fatal(err)
+		}
+		contentType = form.FormDataContentType()
+	}
+
+	req, err := http.NewRequest(method, c.server.URL+path, &body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return res.StatusCode, data
+}
+
+// ok sends the request and fails the test unless it succeeds, decoding the
+// data of the response into v if it is not nil.
+func (c *testClient) ok(method, path string, p params, v interface{}) {
+	c.t.Helper()
+
+	status, data := c.do(method, path, p)
+	if status != http.StatusOK {
+		c.t.Fatalf("%s %s: %d %s", method, path, status, data)
+	}
+	if v != nil {
+		c.decode(method, path, data, &struct {
+			Data interface{} `json:"data"`
+		}{v})
+	}
+}
+
+// fails sends the request and fails the test unless it fails with the
+// status. It returns the error of the response.
+func (c *testClient) fails(method, path string, p params, status int) *APIError {
+	c.t.Helper()
+
+	got, data := c.do(method, path, p)
+	if got != status {
+		c.t.Fatalf("%s %s: got %d %s, want %d", method, path, got, data, status)
+	}
+
+	var res errorResponse
+	c.decode(method, path, data, &res)
+	if res.Error == nil {
+		c.t.Fatalf("%s %s: no error in %s", method, path, data)
+	}
+	return res.Error
+}
+
+// list gets a page of a list into v, and returns the cursor of the next page.
+func (c *testClient) list(path string, p params, v interface{}) string {
+	c.t.Helper()
+
+	status, data := c.do("GET", path, p)
+	if status != http.StatusOK {
+		c.t.Fatalf("GET %s: %d %s", path, status, data)
+	}
+
+	page := struct {
+		Data       interface{} `json:"data"`
+		NextCursor string      `json:"next_cursor"`
+	}{Data: v}
+	c.decode("GET", path, data, &page)
+	return page.NextCursor
+}
+
+func (c *testClient) decode(method, path string, data []byte, v interface{}) {
+	c.t.Helper()
+
+	if err := json.Unmarshal(data, v); err != nil {
+		c.t.Fatalf("%s %s: %v in %s", method, path, err, data)
+	}
+}
+
+// signup signs up a new user with the first name, and an email made from it,
+// and logs the client in.
+func (c *testClient) signup(firstname string) User {
+	c.t.Helper()
+
+	c.ok("POST", "/api/signup", params{
+		"email":     strings.ToLower(firstname) + "@example.com",
+		"password":  "password",
+		"gender":    "male",
+		"birthdate": "1990-01-02",
+		"firstname": firstname,
+		"lastname":  "dela Cruz",
+	}, nil)
+
+	var user User
+	c.ok("GET", "/api/login", nil, &user)
+	return user
+}
+
+// createHoop adds a hoop and returns it.
+func (c *testClient) createHoop(name string) Hoop {
+	c.t.Helper()
+
+	c.ok("POST", "/api/hoop", params{
+		"name":      name,
+		"latitude":  14.5995,
+		"longitude": 120.9842,
+		"image_url": "http://example.com/hoop.jpg",
+	}, nil)
+
+	var hoops []Hoop
+	c.list("/api/hoops", nil, &hoops)
+	for _, hoop := range hoops {
+		if hoop.Name == name {
+			return hoop
+		}
+	}
+	c.t.Fatalf("hoop %q is not listed", name)
+	return Hoop{}
+}
+
+// createStory adds a story to the hoop and returns it.
+func (c *testClient) createStory(hoopID int64, name string) Story {
+	c.t.Helper()
+
+	c.ok("POST", "/api/story", params{
+		"hoop_id":   hoopID,
+		"name":      name,
+		"image_url": "http://example.com/story.jpg",
+	}, nil)
+
+	var stories []Story
+	c.list("/api/stories", params{"hoop_id": hoopID}, &stories)
+	for _, story := range stories {
+		if story.Name == name {
+			return story
+		}
+	}
+	c.t.Fatalf("story %q is not listed", name)
+	return Story{}
+}
+
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func TestSignupLogin(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+
+	c.fails("GET", "/api/login", nil, http.StatusForbidden)
+
+	user := c.signup("Juan")
+	if user.ID == 0 || user.Email != "juan@example.com" || user.Firstname != "Juan" {
+		t.Errorf("signed up as %+v", user)
+	}
+	if user.Password != "" {
+		t.Error("profile includes the password")
+	}
+
+	c.ok("POST", "/api/logout", nil, nil)
+	c.fails("GET", "/api/login", nil, http.StatusForbidden)
+
+	c.fails("POST", "/api/login", params{"email": "juan@example.com", "password": "wrong password"}, http.StatusForbidden)
+	c.fails("POST", "/api/login", params{"email": "pedro@example.com", "password": "password"}, http.StatusForbidden)
+
+	c.ok("POST", "/api/login", params{"email": "juan@example.com", "password": "password"}, nil)
+	var again User
+	c.ok("GET", "/api/login", nil, &again)
+	if again.ID != user.ID {
+		t.Errorf("logged in as user %d, want %d", again.ID, user.ID)
+	}
+}
+
+func TestSignupInvalid(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+
+	valid := params{
+		"email":     "juan@example.com",
+		"password":  "password",
+		"gender":    "male",
+		"birthdate": "1990-01-02",
+	}
+	tests := []struct {
+		name, value string
+		want        *APIError
+	}{
+		{"email", "j@x", ErrEmailTooShort},
+		{"password", "short", ErrPasswordTooShort},
+		{"gender", "other", ErrInvalidGender},
+		{"birthdate", "02/01/1990", ErrInvalidDateFormat},
+	}
+	for _, test := range tests {
+		p := params{}
+		for name, value := range valid {
+			p[name] = value
+		}
+		p[test.name] = test.value
+
+		err := c.fails("POST", "/api/signup", p, http.StatusBadRequest)
+		if field := err.Fields[test.name]; err.Code != "invalid_fields" || field.Code != test.want.Code || len(err.Fields) != 1 {
+			t.Errorf("%s %q: %+v, want %s", test.name, test.value, err, test.want.Code)
+		}
+	}
+	c.fails("GET", "/api/login", nil, http.StatusForbidden)
+}
+
+func TestHoopsAndStories(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+
+	c.fails("POST", "/api/hoop", params{"name": "Tondo Court", "latitude": 14.5, "longitude": 121}, http.StatusForbidden)
+
+	user := c.signup("Juan")
+	c.fails("POST", "/api/hoop", params{"name": "Nowhere", "latitude": "north", "longitude": 121}, http.StatusBadRequest)
+
+	hoop := c.createHoop("Tondo Court")
+	if hoop.UserID != user.ID || hoop.User.ID != user.ID {
+		t.Errorf("hoop of user %d (%d), want %d", hoop.UserID, hoop.User.ID, user.ID)
+	}
+
+	var got Hoop
+	c.ok("GET", "/api/hoop", params{"hoop_id": hoop.ID}, &got)
+	if got.Name != "Tondo Court" || got.Latitude != 14.5995 || got.Longitude != 120.9842 {
+		t.Errorf("got hoop %+v", got)
+	}
+
+	story := c.createStory(hoop.ID, "First game")
+	if story.HoopID != hoop.ID || story.UserID != user.ID {
+		t.Errorf("got story %+v", story)
+	}
+
+	// A story of a hoop that does not exist is not stored
+	if err := c.fails("POST", "/api/story", params{"hoop_id": 999, "name": "Lost game", "image": testFile{"upload.jpg", testJPEG(t, 10, 10, 0)}}, http.StatusNotFound); err.Code != ErrHoopNotFound.Code {
+		t.Errorf("story of a missing hoop: %+v", err)
+	}
+
+	var gotStory Story
+	c.ok("GET", "/api/story", params{"story_id": story.ID}, &gotStory)
+	if gotStory.Name != "First game" || gotStory.Images.Full != "http://example.com/story.jpg" {
+		t.Errorf("got story %+v", gotStory)
+	}
+}
+
+func TestHoopsByName(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+
+	for _, name := range []string{"Tondo Court", "100% Court", "Fresno_Court"} {
+		c.createHoop(name)
+	}
+
+	// Wildcards in names match only themselves, and older clients may still
+	// wrap names in them
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"court", []string{"Fresno_Court", "100% Court", "Tondo Court"}},
+		{"0% C", []string{"100% Court"}},
+		{"o_C", []string{"Fresno_Court"}},
+		{"%tondo%", []string{"Tondo Court"}},
+		{"t%C", nil},
+	}
+	for _, test := range tests {
+		var hoops []Hoop
+		c.list("/api/hoops", params{"name": test.name}, &hoops)
+
+		var got []string
+		for _, hoop := range hoops {
+			got = append(got, hoop.Name)
+		}
+		if strings.Join(got, ", ") != strings.Join(test.want, ", ") {
+			t.Errorf("hoops named %q: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+	story := c.createStory(hoop.ID, "First game")
+
+	c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+	c.ok("PATCH", "/api/comment/story", params{"story_id": story.ID, "text": "Good game"}, nil)
+	c.fails("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "x"}, http.StatusBadRequest)
+	c.fails("POST", "/api/comment/hoop", params{"hoop_id": 999, "text": "Nice court"}, http.StatusNotFound)
+	c.fails("PATCH", "/api/comment/story", params{"story_id": 999, "text": "Good game"}, http.StatusNotFound)
+	newTestClient(t, server).fails("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, http.StatusForbidden)
+
+	var comments []Comment
+	c.list("/api/hoop/comments", params{"hoop_id": hoop.ID}, &comments)
+	if len(comments) != 1 || comments[0].Text != "Nice court" {
+		t.Errorf("hoop comments %+v", comments)
+	}
+
+	c.list("/api/story/comments", params{"story_id": story.ID}, &comments)
+	if len(comments) != 1 || comments[0].Text != "Good game" {
+		t.Errorf("story comments %+v", comments)
+	}
+}
+
+func TestLikes(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+	story := c.createStory(hoop.ID, "First game")
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+
+	likes := func(path string, p params) int64 {
+		t.Helper()
+		var likes likeCount
+		c.ok("GET", path, p, &likes)
+		return likes.Count
+	}
+
+	c.ok("POST", "/api/like/hoop", params{"hoop_id": hoop.ID}, nil)
+	pedro.ok("POST", "/api/like/hoop", params{"hoop_id": hoop.ID}, nil)
+	if n := likes("/api/hoop/likes", params{"hoop_id": hoop.ID}); n != 2 {
+		t.Errorf("%d hoop likes, want 2", n)
+	}
+
+	// Liking again takes the like back
+	c.ok("POST", "/api/like/hoop", params{"hoop_id": hoop.ID}, nil)
+	if n := likes("/api/hoop/likes", params{"hoop_id": hoop.ID}); n != 1 {
+		t.Errorf("%d hoop likes, want 1", n)
+	}
+
+	pedro.ok("POST", "/api/like/story", params{"story_id": story.ID}, nil)
+	if n := likes("/api/story/likes", params{"story_id": story.ID}); n != 1 {
+		t.Errorf("%d story likes, want 1", n)
+	}
+
+	c.fails("POST", "/api/like/hoop", params{"hoop_id": 999}, http.StatusNotFound)
+	c.fails("POST", "/api/like/story", params{"story_id": 999}, http.StatusNotFound)
+
+	newTestClient(t, server).fails("POST", "/api/like/story", params{"story_id": story.ID}, http.StatusForbidden)
+	c.fails("GET", "/api/like/story", nil, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Upload limits
+const (
+	MaxImageUploadSize = 20 << 20
+	MaxImagePixels     = 50 * 1000 * 1000
+)
+
+const imageJPEGQuality = 85
+
+var (
+	ErrUnsupportedImage = newAPIError(http.StatusUnsupportedMediaType, "unsupported_image", "Unsupported image format")
+	ErrImageTooLarge    = newAPIError(http.StatusRequestEntityTooLarge, "image_too_large", "Image too large")
+)
+
+// Image variants, each fitting in a square of the given size
+var imageVariants = []struct {
+	name string
+	size int
+}{
+	{"thumbnail", 200},
+	{"medium", 800},
+	{"full", 2048},
+}
+
+var imageContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// Images holds the URLs of the variants of an uploaded image.
+type Images struct {
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Medium    string `json:"medium,omitempty"`
+	Full      string `json:"full,omitempty"`
+}
+
+// singleImage returns Images that use one URL for every variant, for images
+// that were not uploaded to us such as social profile pictures.
+func singleImage(url string) Images {
+	return Images{Thumbnail: url, Medium: url, Full: url}
+}
+
+func (images Images) Value() (driver.Value, error) {
+	return json.Marshal(images)
+}
+
+func (images *Images) Scan(src interface{}) error {
+	*images = Images{}
+
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(src, images)
+	case string:
+		return json.Unmarshal([]byte(src), images)
+	default:
+		return fmt.Errorf("cannot scan %T into Images", src)
+	}
+}
+
+func (images *Images) set(variant, url string) {
+	switch variant {
+	case "thumbnail":
+		images.Thumbnail = url
+	case "medium":
+		images.Medium = url
+	case "full":
+		images.Full = url
+	}
+}
+
+// saveImage processes the image uploaded in the named form field and stores
+// its variants. Images are re-encoded, which also drops their metadata such
+// as GPS location. Only the first frame of animated images is kept. It
+// returns empty Images if no file was uploaded.
+func saveImage(r *http.Request, name string) (images Images, err error) {
+	infile, _, err := r.FormFile(name)
+	if err != nil {
+		if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+			err = nil
+		}
+		return
+	}
+	defer infile.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(infile, MaxImageUploadSize+1))
+	if err != nil {
+		return
+	} else if len(data) > MaxImageUploadSize {
+		return images, ErrImageTooLarge
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return
+	}
+
+	// Turn the image upright once it is no larger than the biggest variant
+	largest := imageVariants[len(imageVariants)-1].size
+	img = orientImage(fitImage(img, largest), jpegOrientation(data))
+
+	for _, variant := range imageVariants {
+		dst := fitImage(img, variant.size)
+
+		var buf bytes.Buffer
+		var ext, contentType string
+
+		if opaque(dst) {
+			ext, contentType = ".jpg", "image/jpeg"
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: imageJPEGQuality})
+		} else {
+			ext, contentType = ".png", "image/png"
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return
+		}
+
+		var url string
+		if url, err = storeUpload(buf.Bytes(), ext, contentType); err != nil {
+			return
+		}
+		images.set(variant.name, url)
+	}
+
+	return
+}
+
+// decodeImage checks the image format by its content and decodes it.
+func decodeImage(data []byte) (image.Image, error) {
+	if !contains(imageContentTypes, http.DetectContentType(data)) {
+		return nil, ErrUnsupportedImage
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	} else if cfg.Width*cfg.Height > MaxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	return img, nil
+}
+
+// fitImage scales img down to fit in a square of the given size. Smaller
+// images are returned as is.
+func fitImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	if w > h {
+		w, h = size, h*size/w
+	} else {
+		w, h = w*size/h, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return true
+}
+
+// orientImage turns img upright according to its EXIF orientation.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, or 1 if it
+// has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Markers without a length
+			i += 2
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			// Image data starts, so there is no EXIF segment
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of EXIF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		// Orientation is a SHORT stored in the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// testJPEG encodes an opaque image of the size, with an EXIF segment holding
+// the orientation if it is not zero.
+func testJPEG(t *testing.T, w, h, orientation int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h, 255), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if orientation == 0 {
+		return data
+	}
+
+	// A big-endian TIFF header and an IFD with only the orientation tag
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], uint16(orientation))
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+// testPNG encodes an image of the size with the alpha.
+func testPNG(t *testing.T, w, h int, alpha uint8) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(w, h, alpha)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testImage is red on its left half and blue on its right, so that turning
+// it can be seen.
+func testImage(w, h int, alpha uint8) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, color.NRGBA{255, 0, 0, alpha})
+			} else {
+				img.Set(x, y, color.NRGBA{0, 0, 255, alpha})
+			}
+		}
+	}
+	return img
+}
+
+// fetch gets the uploaded file at the URL.
+func (c *testClient) fetch(url string) []byte {
+	c.t.Helper()
+
+	res, err := c.client.Get(c.server.URL + "/" + url)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	} else if res.StatusCode != http.StatusOK {
+		c.t.Fatalf("GET %s: %d", url, res.StatusCode)
+	}
+	return data
+}
+
+// uploadStory adds a story with the image to the hoop and returns its images.
+func (c *testClient) uploadStory(hoopID int64, image []byte) Images {
+	c.t.Helper()
+
+	c.ok("POST", "/api/story", params{"hoop_id": hoopID, "name": "Upload", "image": testFile{"upload", image}}, nil)
+
+	var stories []Story
+	c.list("/api/stories", params{"hoop_id": hoopID}, &stories)
+	if len(stories) == 0 || stories[0].Name != "Upload" {
+		c.t.Fatalf("stories %+v", stories)
+	}
+	return stories[0].Images
+}
+
+func TestImageVariants(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	tests := []struct {
+		name   string
+		image  []byte
+		format string
+		sizes  [3]image.Point
+	}{
+		{"large JPEG", testJPEG(t, 3000, 1500, 0), "jpeg", [3]image.Point{{200, 100}, {800, 400}, {2048, 1024}}},
+		{"small JPEG", testJPEG(t, 300, 100, 0), "jpeg", [3]image.Point{{200, 66}, {300, 100}, {300, 100}}},
+		{"transparent PNG", testPNG(t, 1000, 2000, 128), "png", [3]image.Point{{100, 200}, {400, 800}, {1000, 2000}}},
+		{"opaque PNG", testPNG(t, 400, 400, 255), "jpeg", [3]image.Point{{200, 200}, {400, 400}, {400, 400}}},
+	}
+	for _, test := range tests {
+		images := c.uploadStory(hoop.ID, test.image)
+
+		for i, url := range []string{images.Thumbnail, images.Medium, images.Full} {
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(c.fetch(url)))
+			if err != nil {
+				t.Fatalf("%s variant %d: %v", test.name, i, err)
+			}
+			if format != test.format || cfg.Width != test.sizes[i].X || cfg.Height != test.sizes[i].Y {
+				t.Errorf("%s variant %d: %s of %dx%d, want %s of %v", test.name, i, format, cfg.Width, cfg.Height, test.format, test.sizes[i])
+			}
+		}
+	}
+}
+
+func TestImageOrientation(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	// Turned a quarter clockwise, the red left half of the image is on top
+	images := c.uploadStory(hoop.ID, testJPEG(t, 40, 20, 6))
+	data := c.fetch(images.Full)
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("oriented image is %dx%d", b.Dx(), b.Dy())
+	}
+	if r, _, b, _ := img.At(10, 5).RGBA(); r < b {
+		t.Error("top of the oriented image is not red")
+	}
+
+	// Metadata such as GPS location is not kept
+	if bytes.Contains(data, []byte("Exif")) {
+		t.Error("stored image has EXIF data")
+	}
+}
+
+func TestImageRejected(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	bmp := append([]byte("BM"), make([]byte, 100)...)
+	for _, data := range [][]byte{[]byte("not an image"), bmp, testJPEG(t, 10, 10, 0)[:100]} {
+		c.fails("POST", "/api/story", params{"hoop_id": hoop.ID, "name": "Upload", "image": testFile{"upload.jpg", data}}, http.StatusUnsupportedMediaType)
+	}
+	c.fails("POST", "/api/user/image", params{"image": testFile{"profile.jpg", []byte("not an image")}}, http.StatusUnsupportedMediaType)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		if got := jpegOrientation(testJPEG(t, 4, 2, orientation)); got != orientation {
+			t.Errorf("orientation %d read as %d", orientation, got)
+		}
+	}
+	if got := jpegOrientation(testJPEG(t, 4, 2, 0)); got != 1 {
+		t.Errorf("image without EXIF has orientation %d", got)
+	}
+	if got := jpegOrientation(testPNG(t, 4, 2, 255)); got != 1 {
+		t.Errorf("PNG has orientation %d", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Job types
+const (
+	JOB_STREAM_ACTIVITY   = "stream_activity"
+	JOB_STREAM_COMMENT    = "stream_comment"
+	JOB_PUSH_NOTIFICATION = "push_notification"
+)
+
+// Job worker settings. A job that fails is retried after JobRetryDelay,
+// doubling with each attempt up to MaxJobRetryDelay, and moved to the dead
+// jobs after MaxJobAttempts. A worker that stops while holding a job loses
+// it after JobLease.
+const (
+	JobWorkers       = 4
+	JobPollInterval  = time.Second
+	JobLease         = 5 * time.Minute
+	MaxJobAttempts   = 8
+	JobRetryDelay    = 10 * time.Second
+	MaxJobRetryDelay = time.Hour
+)
+
+// Job is a side effect of a write, queued in the same transaction so that it
+// runs once the write is committed and not at all if it rolls back.
+type Job struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// DeadJob is a job that failed every attempt.
+type DeadJob struct {
+	Job
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// jobHandlers run the jobs of each type with their payload.
+var jobHandlers = map[string]func(payload []byte) error{
+	JOB_STREAM_ACTIVITY:   streamActivity,
+	JOB_STREAM_COMMENT:    streamComment,
+	JOB_PUSH_NOTIFICATION: pushNotification,
+}
+
+// enqueueJob queues a job in the transaction.
+func enqueueJob(tx execer, typ string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(INSERT_JOB_SQL, typ, string(data))
+	return err
+}
+
+// jobsReady wakes a waiting worker of this server when jobs are queued.
+// Workers of other servers find them on their next poll.
+var jobsReady = make(chan struct{}, 1)
+
+// wakeJobWorkers is called once jobs are committed. It does not block, so
+// stores may call it while holding locks.
+func wakeJobWorkers() {
+	select {
+	case jobsReady <- struct{}{}:
+	default:
+	}
+}
+
+func startJobWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go jobWorker()
+	}
+}
+
+// jobWorker runs jobs until the process exits.
+func jobWorker() {
+	poll := time.NewTicker(JobPollInterval)
+	defer poll.Stop()
+
+	for {
+		job, err := store.Jobs.ClaimJob(JobLease)
+		if err == nil {
+			// There may be more, so let another worker look
+			wakeJobWorkers()
+			runJob(job)
+			continue
+		} else if err != sql.ErrNoRows {
+			log.Println("jobs:", err)
+		}
+
+		select {
+		case <-jobsReady:
+		case <-poll.C:
+		}
+	}
+}
+
+// runJob runs the job and records how it went.
+func runJob(job Job) {
+	err := callJobHandler(job)
+
+	switch {
+	case err == nil:
+		err = store.Jobs.CompleteJob(job.ID)
+	case job.Attempts >= MaxJobAttempts:
+		log.Printf("jobs: %s job %d failed for good: %v", job.Type, job.ID, err)
+		err = store.Jobs.FailJob(job.ID, err.Error())
+	default:
+		err = store.Jobs.RetryJob(job.ID, jobRetryDelay(job.Attempts), err.Error())
+	}
+
+	if err != nil {
+		log.Println("jobs:", err)
+	}
+}
+
+func callJobHandler(job Job) (err error) {
+	handler, ok := jobHandlers[job.Type]
+	if !ok {
+		return fmt.Errorf("unknown job type %q", job.Type)
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+
+	return handler(job.Payload)
+}
+
+// jobRetryDelay returns how long to wait before the next attempt of a job
+// that has failed attempts times.
+func jobRetryDelay(attempts int) time.Duration {
+	delay := JobRetryDelay
+	for i := 1; i < attempts; i++ {
+		if delay *= 2; delay >= MaxJobRetryDelay {
+			return MaxJobRetryDelay
+		}
+	}
+	return delay
+}
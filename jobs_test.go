@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// runJobs runs the jobs that are due until none are left, as the job workers
+// would.
+func runJobs(t *testing.T) {
+	for {
+		job, err := store.Jobs.ClaimJob(JobLease)
+		if err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		runJob(job)
+	}
+}
+
+// queueTestJob queues a job of a type that only the test handles.
+func queueTestJob(t *testing.T, handler func(payload []byte) error) {
+	jobHandlers["test"] = handler
+	t.Cleanup(func() { delete(jobHandlers, "test") })
+
+	m := store.Jobs.(*memoryStore)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enqueueJob("test", "payload")
+}
+
+// retryJobsNow makes the jobs waiting for a retry due, and returns how long
+// each of them had left to wait.
+func retryJobsNow() []time.Duration {
+	m := store.Jobs.(*memoryStore)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var waits []time.Duration
+	now := time.Now()
+	for i := range m.jobs {
+		waits = append(waits, m.jobs[i].runAt.Sub(now))
+		m.jobs[i].runAt = now
+	}
+	return waits
+}
+
+func TestJobRetry(t *testing.T) {
+	newTestServer(t)
+
+	calls := 0
+	queueTestJob(t, func(payload []byte) error {
+		if string(payload) != `"payload"` {
+			t.Errorf("payload %s", payload)
+		}
+		if calls++; calls < 3 {
+			return errors.New("court closed")
+		}
+		return nil
+	})
+
+	// Failed jobs wait longer after each attempt
+	for _, want := range []time.Duration{JobRetryDelay, 2 * JobRetryDelay} {
+		runJobs(t)
+		waits := retryJobsNow()
+		if len(waits) != 1 || waits[0] <= want-time.Second || waits[0] > want {
+			t.Fatalf("job waits %v for a retry, want %v", waits, want)
+		}
+	}
+
+	runJobs(t)
+	if waits := retryJobsNow(); len(waits) != 0 || calls != 3 {
+		t.Errorf("%d jobs left after %d calls", len(waits), calls)
+	}
+}
+
+func TestJobDeadLetter(t *testing.T) {
+	server := newTestServer(t)
+	admin := newTestClient(t, server)
+	makeAdmin(t, admin.signup("Maria").ID)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	runJobs(t)
+
+	failing := true
+	calls := 0
+	queueTestJob(t, func([]byte) error {
+		calls++
+		if failing {
+			panic("court closed")
+		}
+		return nil
+	})
+
+	// A job that fails every attempt is moved to the dead jobs
+	for i := 0; i < MaxJobAttempts; i++ {
+		runJobs(t)
+		retryJobsNow()
+	}
+	if calls != MaxJobAttempts {
+		t.Errorf("job ran %d times, want %d", calls, MaxJobAttempts)
+	}
+
+	juan.fails("GET", "/api/jobs/dead", nil, http.StatusForbidden)
+	var dead []DeadJob
+	admin.list("/api/jobs/dead", nil, &dead)
+	if len(dead) != 1 || dead[0].Type != "test" || dead[0].Attempts != MaxJobAttempts || dead[0].LastError != "panic: court closed" {
+		t.Fatalf("dead jobs %+v", dead)
+	}
+
+	// Requeued, it runs again from the first attempt
+	juan.fails("POST", "/api/jobs/dead/requeue", params{"job_id": dead[0].ID}, http.StatusForbidden)
+	admin.fails("POST", "/api/jobs/dead/requeue", params{"job_id": dead[0].ID + 100}, http.StatusNotFound)
+	admin.ok("POST", "/api/jobs/dead/requeue", params{"job_id": dead[0].ID}, nil)
+	failing = false
+	runJobs(t)
+
+	admin.list("/api/jobs/dead", nil, &dead)
+	if len(dead) != 0 || calls != MaxJobAttempts+1 {
+		t.Errorf("dead jobs %+v after %d calls", dead, calls)
+	}
+}
+
+func TestJobRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	for _, test := range tests {
+		if got := jobRetryDelay(test.attempts); got != test.want {
+			t.Errorf("delay after %d attempts %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
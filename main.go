@@ -2,19 +2,12 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -25,7 +18,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/pat"
 	"github.com/gorilla/sessions"
-	"github.com/lib/pq"
+	_ "github.com/lib/pq"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"github.com/markbates/goth/providers/facebook"
@@ -35,14 +28,14 @@ import (
 )
 
 var db *sql.DB
-var ss = sessions.NewCookieStore([]byte("SHuADRV4npfjU4stuN5dvcYaMmblSZlUyZbEl/mKyyw="))
+var store Store
+var ss *sessions.CookieStore
 
 // URLs
 var urls = []string{
 	"/about",
 	"/activities",
 	"/add-hoop",
-	"/hoop/{hoop:[0-9]+}",
 	"/login",
 	"/login-email",
 	"/map",
@@ -51,7 +44,9 @@ var urls = []string{
 	"/story/{storyID:[0-9]+}",
 }
 
-// Command-line flags
+// Command-line flags. They override the settings from the config file and
+// the environment.
+var configPath = flag.String("config", os.Getenv("CONFIG_FILE"), "config file")
 var dbhost = flag.String("dbhost", "localhost", "database host")
 var dbport = flag.String("dbport", "5432", "database port")
 var dbpass = flag.String("dbpass", "", "database password")
@@ -59,28 +54,30 @@ var cachehost = flag.String("cachehost", "", "cache host")
 var cacheport = flag.String("cacheport", "6379", "cache port")
 var address = flag.String("address", "http://localhost:8080", "server address")
 var port = flag.String("port", "8080", "server port")
+var storeBackendName = flag.String("store", "postgres", "data store backend (postgres or memory)")
+var tokenSecret = flag.String("tokensecret", "", "access token signing secret")
 
 // Errors
 var (
-	ErrEmailTooShort     = errors.New("Email too short")
-	ErrPasswordTooShort  = errors.New("Password too short")
-	ErrNotLoggedIn       = errors.New("User is not logged in")
-	ErrPasswordMismatch  = errors.New("Password mismatch")
-	ErrInvalidGender     = errors.New("Invalid gender")
-	ErrInvalidDateFormat = errors.New("Invalid date format")
+	ErrEmailTooShort     = newAPIError(http.StatusBadRequest, "email_too_short", "Email too short")
+	ErrPasswordTooShort  = newAPIError(http.StatusBadRequest, "password_too_short", "Password too short")
+	ErrNotLoggedIn       = newAPIError(http.StatusForbidden, "not_logged_in", "User is not logged in")
+	ErrPasswordMismatch  = newAPIError(http.StatusForbidden, "password_mismatch", "Password mismatch")
+	ErrInvalidGender     = newAPIError(http.StatusBadRequest, "invalid_gender", "Invalid gender")
+	ErrInvalidDateFormat = newAPIError(http.StatusBadRequest, "invalid_date_format", "Invalid date format")
+	ErrUnknownProvider   = newAPIError(http.StatusBadRequest, "unknown_provider", "Unknown provider")
 )
 
 // Constants
 const (
-	PublicDir  = "public"
-	ContentDir = PublicDir + "/content"
+	PublicDir   = "public"
+	ContentDir  = PublicDir + "/content"
+	ContentPath = "content"
 
 	DateFormat = "2006-01-02"
 )
 
 func main() {
-	var err error
-
 	// Handle OS signals
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
@@ -96,67 +93,127 @@ func main() {
 	// Parse command-line flags
 	flag.Parse()
 
-	// Connect to database
-	if db, err = sql.Open("postgres", "user=postgres dbname=postgres sslmode=disable host="+*dbhost+" port="+*dbport+" password="+*dbpass); err != nil {
-		log.Fatal(err)
-	}
-
-	if err = db.Ping(); err != nil {
+	// Load config
+	var err error
+	if config, err = loadConfig(*configPath); err != nil {
 		log.Fatal(err)
 	}
 
-	// Prepare database
-	if _, err := db.Exec(CREATE_USER_TABLE_SQL); err != nil {
-		if err := err.(*pq.Error); err.Code != "42P07" {
+	// Run subcommands
+	switch flag.Arg(0) {
+	case "config":
+		if err := configCommand(flag.Args()[1:]); err != nil {
 			log.Fatal(err)
 		}
-	}
-	if _, err := db.Exec(CREATE_HOOP_TABLE_SQL); err != nil {
-		if err := err.(*pq.Error); err.Code != "42P07" {
+		return
+	case "openapi":
+		if err := openAPICommand(flag.Args()[1:]); err != nil {
 			log.Fatal(err)
 		}
-	}
-	if _, err := db.Exec(CREATE_STORY_TABLE_SQL); err != nil {
-		if err := err.(*pq.Error); err.Code != "42P07" {
+		return
+	case "migrate":
+		connectDatabase()
+		if err := migrateCommand(flag.Args()[1:]); err != nil {
 			log.Fatal(err)
 		}
+		return
+	case "":
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
 	}
-	if _, err := db.Exec(CREATE_COMMENT_TABLE_SQL); err != nil {
-		if err := err.(*pq.Error); err.Code != "42P07" {
-			log.Fatal(err)
+
+	if errs := config.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Println("config:", err)
 		}
+		log.Fatal(ErrInvalidConfig)
 	}
-	if _, err := db.Exec(CREATE_ACTIVITY_TABLE_SQL); err != nil {
-		if err := err.(*pq.Error); err.Code != "42P07" {
+
+	// Prepare data store
+	switch config.Store {
+	case "postgres":
+		connectDatabase()
+		if err := migrateUp(); err != nil {
 			log.Fatal(err)
 		}
+		store = newStore(newPostgresStore(db))
+	case "memory":
+		store = newStore(newMemoryStore())
+	default:
+		log.Fatalf("Unknown store: %s", config.Store)
 	}
-	if _, err := db.Exec(CREATE_HOOP_FEATURED_STORY_TABLE_SQL); err != nil {
-		if err := err.(*pq.Error); err.Code != "42P07" {
-			log.Fatal(err)
-		}
+
+	// Prepare access tokens
+	if config.TokenSecret == "" {
+		log.Println("No token secret set; access tokens will not survive a restart")
+	}
+	if err := setAccessTokenKey(config.TokenSecret); err != nil {
+		log.Fatal(err)
+	}
+
+	// Prepare media storage
+	if blobs, err = newBlobStore(config); err != nil {
+		log.Fatal(err)
+	}
+
+	// Clean up uploads that nothing refers to
+	go sweepUploads(UploadSweepInterval)
+
+	// Clean up notifications that were read long ago
+	go pruneNotifications(NotificationPruneInterval)
+
+	// Stream new activities and comments
+	broker = newBroker(config)
+
+	// Push notifications to phones
+	if pushSender, err = newPushSender(config); err != nil {
+		log.Fatal(err)
 	}
 
+	// Run the side effects of writes
+	startJobWorkers(JobWorkers)
+
+	// Prepare sessions
+	ss = sessions.NewCookieStore(config.sessionKeyPairs()...)
+
 	// Setup social logins
-	gothic.Store = sessions.NewFilesystemStore(os.TempDir(), []byte("pinoy-hoops"))
+	gothic.Store = sessions.NewFilesystemStore(os.TempDir(), []byte(config.GothicKey))
+	facebookConfig := config.OAuth["facebook"]
+	instagramConfig := config.OAuth["instagram"]
+	twitterConfig := config.OAuth["twitter"]
 	goth.UseProviders(
-		facebook.New(os.Getenv("FACEBOOK_KEY"), os.Getenv("FACEBOOK_SECRET"), *address+"/auth/facebook/callback"),
-		instagram.New(os.Getenv("INSTAGRAM_KEY"), os.Getenv("INSTAGRAM_SECRET"), *address+"/auth/instagram/callback"),
-		twitter.New(os.Getenv("TWITTER_KEY"), os.Getenv("TWITTER_SECRET"), *address+"/auth/twitter/callback"),
+		facebook.New(facebookConfig.Key, facebookConfig.Secret, facebookConfig.Callback),
+		instagram.New(instagramConfig.Key, instagramConfig.Secret, instagramConfig.Callback),
+		twitter.New(twitterConfig.Key, twitterConfig.Secret, twitterConfig.Callback),
 	)
 
-	// Prepare web server
+	// Run web server
+	n := negroni.Classic()
+	n.UseHandler(newRouter())
+	n.Run(config.Listen)
+}
+
+// newRouter routes the API, social logins, uploaded content and app URLs.
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
 	apiRouter := router.PathPrefix("/api").Subrouter()
 	apiRouter.HandleFunc("/login", loginHandler)
 	apiRouter.HandleFunc("/signup", signupHandler)
 	apiRouter.HandleFunc("/logout", logoutHandler)
+	apiRouter.HandleFunc("/token", tokenHandler)
 	apiRouter.HandleFunc("/user", userHandler)
 	apiRouter.HandleFunc("/hoop", hoopHandler)
 	apiRouter.HandleFunc("/hoops", hoopsHandler)
 	apiRouter.HandleFunc("/story", storyHandler)
 	apiRouter.HandleFunc("/stories", storiesHandler)
 	apiRouter.HandleFunc("/activities", activitiesHandler)
+	apiRouter.HandleFunc("/stream", streamHandler)
+	apiRouter.HandleFunc("/notification", notificationHandler)
+	apiRouter.HandleFunc("/notifications", notificationsHandler)
+	apiRouter.HandleFunc("/device", deviceHandler)
+	apiRouter.HandleFunc("/follow", followHandler)
+	apiRouter.HandleFunc("/comment", commentHandler)
+	apiRouter.HandleFunc("/comment/replies", commentRepliesHandler)
 	apiRouter.HandleFunc("/comment/hoop", commentHoopHandler)
 	apiRouter.HandleFunc("/comment/story", commentStoryHandler)
 	apiRouter.HandleFunc("/like/hoop", likeHoopHandler)
@@ -168,10 +225,23 @@ func main() {
 	apiRouter.HandleFunc("/user/image", userImageHandler)
 	apiRouter.HandleFunc("/user/myhoops", userMyHoopsHandler)
 	apiRouter.HandleFunc("/user/otherhoops", userOtherHoopsHandler)
+	apiRouter.HandleFunc("/user/followedhoops", userFollowedHoopsHandler)
+	apiRouter.HandleFunc("/notifications/read", notificationsReadHandler)
+	apiRouter.HandleFunc("/notifications/preferences", notificationPreferencesHandler)
+	apiRouter.HandleFunc("/user/followers", userFollowersHandler)
+	apiRouter.HandleFunc("/user/following", userFollowingHandler)
+	apiRouter.HandleFunc("/hoop/follow", hoopFollowHandler)
+	apiRouter.HandleFunc("/hoop/merge", hoopMergeHandler)
+	apiRouter.HandleFunc("/jobs/dead", deadJobsHandler)
+	apiRouter.HandleFunc("/jobs/dead/requeue", deadJobRequeueHandler)
 	apiRouter.HandleFunc("/hoop/comments", hoopCommentsHandler)
 	apiRouter.HandleFunc("/hoop/likes", hoopLikesHandler)
 	apiRouter.HandleFunc("/hoops/nearby", nearbyHoopsHandler)
+	apiRouter.HandleFunc("/hoops/box", boxHoopsHandler)
+	apiRouter.HandleFunc("/hoops/clusters", hoopClustersHandler)
 	apiRouter.HandleFunc("/hoops/popular", popularHoopsHandler)
+	apiRouter.HandleFunc("/tile", tileHandler)
+	apiRouter.HandleFunc("/search", searchHandler)
 	apiRouter.HandleFunc("/hoops/latest", latestHoopsHandler)
 	apiRouter.HandleFunc("/story/likes", storyLikesHandler)
 	apiRouter.HandleFunc("/story/comments", storyCommentsHandler)
@@ -180,6 +250,10 @@ func main() {
 	apiRouter.HandleFunc("/stories/mostviewed", mostViewedStoriesHandler)
 	apiRouter.HandleFunc("/stories/latest", latestStoriesHandler)
 	apiRouter.HandleFunc("/user/lastactivitychecktime", userLastActivityCheckTimeHandler)
+	apiRouter.HandleFunc("/openapi.json", openAPIHandler)
+
+	// Prepare the resource routes of the v2 API
+	routeAPIV2(router)
 
 	// Prepare social login authenticators
 	patHandler := pat.New()
@@ -187,17 +261,32 @@ func main() {
 	patHandler.Get("/auth/{provider}", gothic.BeginAuthHandler)
 	router.PathPrefix("/auth").Handler(patHandler)
 
+	// Serve uploaded content
+	if config.Media.Backend == "local" {
+		router.PathPrefix("/" + ContentPath + "/").Handler(http.StripPrefix("/"+ContentPath+"/", http.FileServer(http.Dir(config.ContentDir))))
+	}
+
 	// Serve app urls
+	router.HandleFunc("/hoop/{hoop:[0-9]+}", hoopPageHandler)
 	for _, url := range urls {
 		router.HandleFunc(url, func(w http.ResponseWriter, r *http.Request) {
 			http.ServeFile(w, r, "public/index.html")
 		})
 	}
 
-	// Run web server
-	n := negroni.Classic()
-	n.UseHandler(router)
-	n.Run(":" + *port)
+	return router
+}
+
+func connectDatabase() {
+	var err error
+
+	if db, err = sql.Open("postgres", config.databaseSource()); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = db.Ping(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func authHandler(w http.ResponseWriter, r *http.Request) {
@@ -209,32 +298,20 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if loggedIn, user := loggedIn(w, r, true); loggedIn {
-		switch authuser.Provider {
-		case "facebook":
-			if _, err := db.Exec(UPDATE_USER_FACEBOOK_SQL, authuser.UserID, user.ID); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-		case "instagram":
-			if _, err := db.Exec(UPDATE_USER_INSTAGRAM_SQL, authuser.NickName, user.ID); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-		case "twitter":
-			if _, err := db.Exec(UPDATE_USER_TWITTER_SQL, authuser.UserID, user.ID); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		socialID := authuser.UserID
+		if authuser.Provider == "instagram" {
+			socialID = authuser.NickName
+		}
 
-		default:
+		if err := store.Users.UpdateUserSocialID(user.ID, authuser.Provider, socialID); err == ErrUnknownProvider {
 			w.WriteHeader(http.StatusBadRequest)
 			return
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
@@ -256,7 +333,7 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if exists, user := userExists(user, true); exists {
+	if exists, user := store.Users.UserExists(user, true); exists {
 		if err := logIn(w, r, user); err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -276,9 +353,9 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	user.Description = authuser.Description
 	user.Email = authuser.Email
-	user.ImageURL = authuser.AvatarURL
+	user.Images = singleImage(authuser.AvatarURL)
 
-	if user.ID, err = insertUser(user); err != nil {
+	if user.ID, err = store.Users.InsertUser(user); err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -293,146 +370,209 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// ownProfile is the profile of the logged in user.
+type ownProfile struct {
+	Profile
+	UnreadNotificationCount int64 `json:"unread_notification_count"`
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		if ok, user := loggedIn(w, r, true); !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
+		} else if profile, err := userProfile(store.Follows, *user, user); err != nil {
+			writeError(w, err)
+		} else if unread, err := store.Notifications.CountUnreadNotifications(user.ID); err != nil {
+			writeError(w, err)
 		} else {
-			if data, err := json.Marshal(user); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-			} else {
-				w.Write(data)
-			}
+			writeData(w, ownProfile{profile, unread})
 		}
 	case "POST":
-		email := r.FormValue("email")
-		if len(email) < 6 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Email is too short"))
-			return
-		}
-
-		password := r.FormValue("password")
-		if len(password) < 8 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Password is too short"))
+		var req loginRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		user := &User{Email: email}
-		if exists, user := userExists(user, true); exists {
-			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-				w.WriteHeader(http.StatusForbidden)
+		user := &User{Email: req.Email}
+		if exists, user := store.Users.UserExists(user, true); exists {
+			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+				writeError(w, ErrInvalidCredentials)
 			} else {
 				if err := logIn(w, r, user); err != nil {
-					log.Println(err)
-					w.WriteHeader(http.StatusInternalServerError)
+					writeError(w, err)
 				} else {
-					w.WriteHeader(http.StatusOK)
+					writeOK(w)
 				}
 			}
 		} else {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrInvalidCredentials)
 		}
 
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func signupHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		email := r.FormValue("email")
-		if len(email) < 6 {
-			http.Error(w, ErrEmailTooShort.Error(), http.StatusBadRequest)
+		var req signupRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		images, err := saveImage(r, "image")
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		password := r.FormValue("password")
-		if len(password) < 8 {
-			http.Error(w, ErrPasswordTooShort.Error(), http.StatusBadRequest)
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		gender := r.FormValue("gender")
-		if !(gender == "male" || gender == "female") {
-			http.Error(w, ErrInvalidGender.Error(), http.StatusBadRequest)
+		user := &User{
+			Firstname: req.Firstname,
+			Lastname:  req.Lastname,
+			Gender:    req.Gender,
+			Birthdate: req.Birthdate,
+			Email:     req.Email,
+			Password:  string(hashedPassword),
+			Images:    images,
+		}
+
+		if user.ID, err = store.Users.InsertUser(user); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		if _, err := time.Parse(DateFormat, r.FormValue("birthdate")); err != nil {
-			http.Error(w, ErrInvalidDateFormat.Error(), http.StatusBadRequest)
+		if err = logIn(w, r, user); err != nil {
+			writeError(w, err)
 			return
 		}
-		birthdate := r.FormValue("birthdate")
 
-		firstname := r.FormValue("firstname")
-		lastname := r.FormValue("lastname")
+		writeOK(w)
 
-		imageURL := ""
-		if destination, err := copyFile(r, "image", ContentDir, randomFilename()); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var req tokenRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
-		} else {
-			imageURL = destination
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		var tokens *tokenResponse
+		var err error
+
+		switch req.GrantType {
+		case "password":
+			var login loginRequest
+			if err := bind(r, &login); err != nil {
+				writeError(w, err)
+				return
+			}
+
+			exists, user := store.Users.UserExists(&User{Email: login.Email}, true)
+			if !exists {
+				writeError(w, ErrInvalidCredentials)
+				return
+			}
+
+			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(login.Password)); err != nil {
+				writeError(w, ErrInvalidCredentials)
+				return
+			}
+
+			tokens, err = issueTokens(user.ID)
+
+		case "refresh_token":
+			// Invalid and expired tokens are API errors
+			tokens, err = refreshTokens(req.RefreshToken)
+		}
+
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		user := &User{
-			Firstname: firstname,
-			Lastname:  lastname,
-			Gender:    gender,
-			Birthdate: birthdate,
-			Email:     email,
-			Password:  string(hashedPassword),
-			ImageURL:  imageURL,
-		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeData(w, tokens)
 
-		if user.ID, err = insertUser(user); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+	case "DELETE":
+		var req refreshTokenRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		if err = logIn(w, r, user); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if _, err := store.Tokens.RevokeRefreshToken(hashRefreshToken(req.RefreshToken)); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeOK(w)
 
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func userHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case "GET":
+		var req userRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		user, err := store.Users.GetUser(req.UserID)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrUserNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		_, viewer := loggedIn(w, r, true)
+
+		profile, err := userProfile(store.Follows, user, viewer)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeData(w, profile)
 	case "PATCH":
 		loggedIn, user := loggedIn(w, r, true)
 		if !loggedIn {
-			http.Error(w, ErrNotLoggedIn.Error(), http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req userUpdateRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
 		// Set user firstname and lastname
-		name := strings.Trim(r.FormValue("name"), " ")
-		nameparts := strings.Split(name, " ")
+		if req.Name != nil {
+			nameparts := strings.Split(strings.Trim(*req.Name, " "), " ")
 
-		if len(nameparts) > 0 {
 			user.Firstname = nameparts[0]
-
 			if len(nameparts) > 1 {
 				user.Lastname = nameparts[len(nameparts)-1]
 			} else {
@@ -440,938 +580,1737 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// Set user gender
-		gender := strings.ToLower(r.FormValue("gender"))
-		if gender == "male" || gender == "female" {
-			user.Gender = gender
-		} else {
-			http.Error(w, ErrInvalidGender.Error(), http.StatusBadRequest)
-			return
+		if req.Gender != nil {
+			user.Gender = *req.Gender
 		}
 
-		// Set user birthdate
-		birthdate := r.FormValue("birthdate")
-		if _, err := time.Parse(DateFormat, birthdate); err != nil {
-			http.Error(w, ErrInvalidDateFormat.Error(), http.StatusBadRequest)
-			return
-		} else {
-			user.Birthdate = birthdate
+		if req.Birthdate != nil {
+			user.Birthdate = *req.Birthdate
 		}
 
-		if err := updateUser(user); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if err := store.Users.UpdateUser(user); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeOK(w)
 
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	if err := logOut(w, r); err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, err)
+		return
 	}
-	w.WriteHeader(http.StatusOK)
+	writeOK(w)
 }
 
 func hoopHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		hoopID, err := strconv.ParseInt(r.FormValue("hoopID"), 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		hoop, err := getHoop(hoopID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		hoop, err := store.Hoops.GetHoop(req.HoopID)
+		if err == sql.ErrNoRows {
+			// Merged hoops redirect to the hoop they were merged into
+			if targetID, err := store.Hoops.HoopRedirect(req.HoopID); err == nil {
+				redirectMergedHoop(w, r, targetID)
+			} else if err == sql.ErrNoRows {
+				writeError(w, ErrHoopNotFound)
+			} else {
+				writeError(w, err)
+			}
 			return
-		}
-
-		data, err := json.Marshal(hoop)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		} else if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeData(w, hoop)
 
 	case "POST":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req hoopCreateRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		imageURL := r.FormValue("image_url")
-		if imageURL == "" {
-			if destination, err := copyFile(r, "image", ContentDir, randomFilename()); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
+		images := singleImage(req.ImageURL)
+		if images.Full == "" {
+			var err error
+			if images, err = saveImage(r, "image"); err != nil {
+				writeError(w, err)
 				return
-			} else {
-				imageURL = destination
 			}
 		}
 
-		latitude, err := strconv.ParseFloat(r.FormValue("latitude"), 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		if err := store.Hoops.InsertHoop(user.ID, req.Name, req.Description, images, req.Latitude, req.Longitude); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		longitude, err := strconv.ParseFloat(r.FormValue("longitude"), 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		writeOK(w)
+	case "PATCH":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		if latitude == 0 && longitude == 0 {
-			w.WriteHeader(http.StatusBadRequest)
+		var req hoopUpdateRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		name := r.FormValue("name")
-		description := r.FormValue("description")
-
-		if err := insertHoop(user.ID, name, description, imageURL, latitude, longitude); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		hoop, err := store.Hoops.GetHoop(req.HoopID)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrHoopNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
-
-func hoopsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		var hoops []Hoop
-		var data []byte
-		var err error
-
-		if name := r.FormValue("name"); name != "" {
-			hoops, err = getHoops(GET_HOOPS_WITH_NAME_SQL, name)
-		} else {
-			hoops, err = getHoops(GET_HOOPS_SQL)
-		}
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if !canModify(user, hoop.UserID) {
+			writeError(w, ErrForbidden)
 			return
 		}
 
-		data, err = json.Marshal(hoops)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if req.Name != nil {
+			hoop.Name = *req.Name
 		}
 
-		w.Write(data)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
+		if req.Description != nil {
+			hoop.Description = *req.Description
+		}
 
-func storyHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		storyID, err := strconv.ParseInt(r.FormValue("storyID"), 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		if req.Latitude != nil {
+			hoop.Latitude = *req.Latitude
 		}
 
-		story, err := getStory(storyID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if req.Longitude != nil {
+			hoop.Longitude = *req.Longitude
 		}
 
-		data, err := json.Marshal(story)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if err := store.Hoops.UpdateHoop(&hoop); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
-	case "POST":
+		writeOK(w)
+
+	case "DELETE":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop_id"), 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		imageURL := r.FormValue("image_url")
-		if imageURL == "" {
-			if destination, err := copyFile(r, "image", ContentDir, randomFilename()); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			} else {
-				imageURL = destination
-			}
-		}
-
-		name := r.FormValue("name")
-		description := r.FormValue("description")
-
-		if err := insertStory(hoopID, user.ID, name, description, imageURL); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		hoop, err := store.Hoops.GetHoop(req.HoopID)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrHoopNotFound)
 			return
-		}
-
-		w.WriteHeader(http.StatusOK)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
-
-func storiesHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop_id"), 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		} else if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		stories, err := getStories(GET_STORIES_SQL, hoopID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if !canModify(user, hoop.UserID) {
+			writeError(w, ErrForbidden)
 			return
 		}
 
-		data, err := json.Marshal(stories)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if err := store.Hoops.DeleteHoop(req.HoopID); err == sql.ErrNoRows {
+			writeError(w, ErrHoopNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeOK(w)
+
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func activitiesHandler(w http.ResponseWriter, r *http.Request) {
+func hoopFollowHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case "GET":
+	case "POST", "DELETE":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		activities, err := getActivities(user.ID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		data, err := json.Marshal(activities)
+		var err error
+		if r.Method == "POST" {
+			if exists, _ := store.Hoops.HoopExists(&Hoop{ID: req.HoopID}, false); !exists {
+				writeError(w, ErrHoopNotFound)
+				return
+			}
+			err = store.Follows.FollowHoop(user.ID, req.HoopID)
+		} else {
+			err = store.Follows.UnfollowHoop(user.ID, req.HoopID)
+		}
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeOK(w)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func commentHoopHandler(w http.ResponseWriter, r *http.Request) {
+func hoopMergeHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		ok, user := loggedIn(w, r, true)
-		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+		if !ok || !user.IsAdmin {
+			writeError(w, ErrForbidden)
 			return
 		}
 
-		text := r.FormValue("text")
-		if len(text) < 2 {
-			w.WriteHeader(http.StatusBadRequest)
+		var req hoopMergeRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop-id"), 10, 64)
+		if err := store.Hoops.MergeHoops(req.HoopID, req.Into); err == sql.ErrNoRows {
+			writeError(w, ErrHoopNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// redirectMergedHoop redirects a request for a merged hoop to the same URL
+// with the hoop it was merged into, keeping the rest of the query. The hoop
+// is replaced where the route has it, in the path or in the query.
+func redirectMergedHoop(w http.ResponseWriter, r *http.Request, targetID int64) {
+	target := *r.URL
+	vars := mux.Vars(r)
+	if _, ok := vars["hoop_id"]; ok {
+		var pairs []string
+		for name, value := range vars {
+			if name == "hoop_id" {
+				value = strconv.FormatInt(targetID, 10)
+			}
+			pairs = append(pairs, name, value)
+		}
+
+		path, err := mux.CurrentRoute(r).URLPath(pairs...)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, err)
+			return
+		}
+		target.Path = path.Path
+	} else {
+		query := target.Query()
+		query.Del("hoopID")
+		query.Del("hoop-id")
+		query.Set("hoop_id", strconv.FormatInt(targetID, 10))
+		target.RawQuery = query.Encode()
+	}
+
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
+// deadJobsHandler lists the jobs that failed every attempt, latest first.
+func deadJobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ok, user := loggedIn(w, r, true)
+		if !ok || !user.IsAdmin {
+			writeError(w, ErrForbidden)
+			return
+		}
+
+		jobs, next, err := store.Jobs.GetDeadJobs(page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, jobs, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// deadJobRequeueHandler runs a dead job again, such as once the cause of its
+// failure is fixed.
+func deadJobRequeueHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		ok, user := loggedIn(w, r, true)
+		if !ok || !user.IsAdmin {
+			writeError(w, ErrForbidden)
+			return
+		}
+
+		var req jobRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := store.Jobs.RequeueDeadJob(req.JobID); err == sql.ErrNoRows {
+			writeError(w, ErrJobNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// hoopPageHandler serves the app for a hoop, redirecting links to merged
+// hoops.
+func hoopPageHandler(w http.ResponseWriter, r *http.Request) {
+	hoopID, err := strconv.ParseInt(mux.Vars(r)["hoop"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if targetID, err := store.Hoops.HoopRedirect(hoopID); err == nil {
+		http.Redirect(w, r, "/hoop/"+strconv.FormatInt(targetID, 10), http.StatusMovedPermanently)
+		return
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+	}
+
+	http.ServeFile(w, r, "public/index.html")
+}
+
+func hoopsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var req hoopsRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		// Older clients wrap the name in LIKE wildcards
+		hoops, next, err := store.Hoops.GetHoops(HoopQuery{Name: strings.Trim(req.Name, "%")}, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, hoops, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func storyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var req storyRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		story, err := store.Stories.GetStory(req.StoryID)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrStoryNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeData(w, story)
+	case "POST":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req storyCreateRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if exists, _ := store.Hoops.HoopExists(&Hoop{ID: req.HoopID}, false); !exists {
+			writeError(w, ErrHoopNotFound)
+			return
+		}
+
+		images := singleImage(req.ImageURL)
+		if images.Full == "" {
+			var err error
+			if images, err = saveImage(r, "image"); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+
+		if err := store.Stories.InsertStory(req.HoopID, user.ID, req.Name, req.Description, images); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	case "PATCH":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req storyUpdateRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		story, err := store.Stories.GetStory(req.StoryID)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrStoryNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if !canModify(user, story.UserID) {
+			writeError(w, ErrForbidden)
+			return
+		}
+
+		if req.Name != nil {
+			story.Name = *req.Name
+		}
+
+		if req.Description != nil {
+			story.Description = *req.Description
+		}
+
+		if req.ImageURL != "" {
+			story.Images = singleImage(req.ImageURL)
+		} else if images, err := saveImage(r, "image"); err != nil {
+			writeError(w, err)
+			return
+		} else if images.Full != "" {
+			story.Images = images
+		}
+
+		if err := store.Stories.UpdateStory(&story); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	case "DELETE":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req storyRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		story, err := store.Stories.GetStory(req.StoryID)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrStoryNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if !canModify(user, story.UserID) {
+			writeError(w, ErrForbidden)
+			return
+		}
+
+		if err := store.Stories.DeleteStory(req.StoryID); err == sql.ErrNoRows {
+			writeError(w, ErrStoryNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func storiesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var req storiesRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		stories, next, err := store.Stories.GetStories(req.HoopID, storyOrders[req.Order], page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, stories, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func activitiesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var req activitiesRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var activities []Activity
+		var next *Cursor
+
+		if req.Scope == "following" {
+			activities, next, err = store.Activities.GetFollowingActivities(user.ID, page)
+		} else {
+			activities, next, err = store.Activities.GetActivities(user.ID, page)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, activities, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// streamHandler sends new activities and comments as server-sent events.
+// Activities are filtered like the activity feed of the scope, and comments
+// are sent for each hoop_id and story_id given.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var req streamRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, ErrInternalServerError)
+			return
+		}
+
+		var channels []string
+
+		if req.Scope != "none" {
+			channels = append(channels, activitiesChannel)
+		}
+
+		for _, hoopID := range req.HoopIDs {
+			channels = append(channels, hoopCommentsChannel(hoopID))
+		}
+
+		for _, storyID := range req.StoryIDs {
+			channels = append(channels, storyCommentsChannel(storyID))
+		}
+
+		if len(channels) == 0 {
+			writeError(w, ErrBadRequest)
+			return
+		}
+
+		sub := broker.Subscribe(channels...)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(StreamHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case msg, ok := <-sub.C:
+				if !ok {
+					return
+				}
+
+				event := "comment"
+				if msg.Channel == activitiesChannel {
+					event = "activity"
+					if in, err := inFeed(user, req.Scope, msg.Data); err != nil {
+						log.Println(err)
+						continue
+					} else if !in {
+						continue
+					}
+				}
+
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, msg.Data)
+			}
+			flusher.Flush()
+		}
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func commentHoopHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req hoopCommentRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if exists, _ := store.Hoops.HoopExists(&Hoop{ID: req.HoopID}, false); !exists {
+			writeError(w, ErrHoopNotFound)
+			return
+		}
+
+		parent, ok := replyParent(w, req.ParentID, func(parent Comment) bool { return parent.HoopID == req.HoopID })
+		if !ok {
+			return
+		}
+
+		if err := store.Comments.InsertHoopComment(user.ID, req.HoopID, parent, req.Text); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// commentStoryHandler adds a comment to a story. Older clients send PATCH.
+func commentStoryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "PATCH":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		if err := insertHoopComment(user.ID, hoopID, text); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req storyCommentRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		if exists, _ := store.Stories.StoryExists(&Story{ID: req.StoryID}, false); !exists {
+			writeError(w, ErrStoryNotFound)
+			return
+		}
+
+		parent, ok := replyParent(w, req.ParentID, func(parent Comment) bool { return parent.StoryID == req.StoryID })
+		if !ok {
+			return
+		}
+
+		if err := store.Comments.InsertStoryComment(user.ID, req.StoryID, parent, req.Text); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func commentStoryHandler(w http.ResponseWriter, r *http.Request) {
+func likeHoopHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case "PATCH":
+	case "POST":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		storyID, err := strconv.ParseInt(r.FormValue("story-id"), 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		text := r.FormValue("text")
-		if len(text) < 2 {
-			w.WriteHeader(http.StatusBadRequest)
+		if exists, _ := store.Hoops.HoopExists(&Hoop{ID: req.HoopID}, false); !exists {
+			writeError(w, ErrHoopNotFound)
 			return
 		}
 
-		if err := insertStoryComment(user.ID, storyID, text); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if err := store.Likes.ToggleLike(user.ID, req.HoopID, "hoop"); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeOK(w)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func likeHoopHandler(w http.ResponseWriter, r *http.Request) {
+func likeStoryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req storyRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if exists, _ := store.Stories.StoryExists(&Story{ID: req.StoryID}, false); !exists {
+			writeError(w, ErrStoryNotFound)
+			return
+		}
+
+		if err := store.Likes.ToggleLike(user.ID, req.StoryID, "story"); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// viewHoopHandler counts a view of a hoop. Older clients send PATCH.
+func viewHoopHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "PATCH":
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := store.Hoops.ViewHoop(req.HoopID); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// viewStoryHandler counts a view of a story. Older clients send PATCH.
+func viewStoryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "PATCH":
+		var req storyRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := store.Stories.ViewStory(req.StoryID); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func userImageHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		if hoopID := r.FormValue("hoop-id"); hoopID != "" {
-			hoopID, err := strconv.ParseInt(hoopID, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+		if images, err := saveImage(r, "image"); err != nil {
+			writeError(w, err)
+		} else if images.Full == "" {
+			writeError(w, invalidField("image", ErrRequired))
+		} else {
+			if err := store.Users.UpdateUserImage(user.ID, images); err != nil {
+				writeError(w, err)
 				return
 			}
+			writeOK(w)
+		}
+
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func followHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req userRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		} else if req.UserID == user.ID {
+			writeError(w, invalidField("user_id", ErrInvalidValue))
+			return
+		}
 
-			if err := toggleLike(user.ID, hoopID, "hoop"); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
+		var err error
+		if r.Method == "POST" {
+			if exists, _ := store.Users.UserExists(&User{ID: req.UserID}, false); !exists {
+				writeError(w, ErrUserNotFound)
 				return
 			}
+			err = store.Follows.Follow(user.ID, req.UserID)
 		} else {
-			w.WriteHeader(http.StatusBadRequest)
+			err = store.Follows.Unfollow(user.ID, req.UserID)
+		}
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeOK(w)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func likeStoryHandler(w http.ResponseWriter, r *http.Request) {
+func userFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	followsHandler(w, r, store.Follows.GetFollowers)
+}
+
+func userFollowingHandler(w http.ResponseWriter, r *http.Request) {
+	followsHandler(w, r, store.Follows.GetFollowing)
+}
+
+// followsHandler lists the followers or followed users of the user given by
+// user_id, or of the logged in user.
+func followsHandler(w http.ResponseWriter, r *http.Request, list func(userID int64, page Page) ([]User, *Cursor, error)) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var req optionalUserRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var userID int64
+		if req.UserID != nil {
+			userID = *req.UserID
+		} else if ok, user := loggedIn(w, r, true); ok {
+			userID = user.ID
+		} else {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		users, next, err := list(userID, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, users, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func userMyHoopsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		hoops, next, err := store.Hoops.GetHoops(HoopQuery{UserID: user.ID}, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, hoops, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// userFollowedHoopsHandler lists the hoops followed by the user given by
+// user_id, or by the logged in user.
+func userFollowedHoopsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var req optionalUserRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var userID int64
+		if req.UserID != nil {
+			userID = *req.UserID
+		} else if ok, user := loggedIn(w, r, true); ok {
+			userID = user.ID
+		} else {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		hoops, next, err := store.Hoops.GetHoops(HoopQuery{FollowerID: userID}, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, hoops, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		notifications, next, err := store.Notifications.GetNotifications(user.ID, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, notifications, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// notificationHandler marks one notification read.
+func notificationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PATCH":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req notificationRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := store.Notifications.ReadNotification(user.ID, req.NotificationID); err == sql.ErrNoRows {
+			writeError(w, ErrNotificationNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// notificationsReadHandler marks all of the user's notifications read.
+func notificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		if err := store.Notifications.ReadAllNotifications(user.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// notificationPreferencesHandler reads and changes which notifications are
+// pushed to the user's devices. PATCH changes only the preferences given.
+func notificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "PATCH":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		prefs, err := store.Devices.GetNotificationPreferences(user.ID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if r.Method == "PATCH" {
+			var req notificationPreferencesRequest
+			if err := bind(r, &req); err != nil {
+				writeError(w, err)
+				return
+			}
+
+			for _, pref := range []struct {
+				value *bool
+				set   *bool
+			}{
+				{&prefs.Likes, req.Likes},
+				{&prefs.Comments, req.Comments},
+				{&prefs.Stories, req.Stories},
+			} {
+				if pref.set != nil {
+					*pref.value = *pref.set
+				}
+			}
+
+			if err := store.Devices.UpdateNotificationPreferences(user.ID, prefs); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+
+		writeData(w, prefs)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// deviceHandler registers the user's device for push notifications and
+// unregisters it, such as when they log out.
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req deviceRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := store.Devices.RegisterDevice(user.ID, req.Type, strings.TrimSpace(req.Token)); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeOK(w)
+	case "DELETE":
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
+			return
+		}
+
+		var req deviceTokenRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		if storyID := r.FormValue("story-id"); storyID != "" {
-			storyID, err := strconv.ParseInt(storyID, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			if err := toggleLike(user.ID, storyID, "story"); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
+		if err := store.Devices.UnregisterDevice(user.ID, strings.TrimSpace(req.Token)); err == sql.ErrNoRows {
+			writeError(w, ErrDeviceNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeOK(w)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func viewHoopHandler(w http.ResponseWriter, r *http.Request) {
+func userOtherHoopsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case "PATCH":
-		if hoopID := r.FormValue("hoop-id"); hoopID != "" {
-			hoopID, err := strconv.ParseInt(hoopID, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 
-			if err := view(hoopID, "hoop"); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
+		ok, user := loggedIn(w, r, true)
+		if !ok {
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		hoops, next, err := store.Hoops.GetHoops(HoopQuery{ExcludeUserID: user.ID}, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeList(w, hoops, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func viewStoryHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "PATCH":
-		if storyID := r.FormValue("story-id"); storyID != "" {
-			storyID, err := strconv.ParseInt(storyID, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
+// replyParent returns the comment with parentID, or nil for a top-level
+// comment if parentID is nil. The parent must be on the same hoop or story
+// and leave room for a reply within the configured depth. It returns false
+// if it has responded with an error.
+func replyParent(w http.ResponseWriter, parentID *int64, sameThread func(Comment) bool) (*Comment, bool) {
+	if parentID == nil {
+		return nil, true
+	}
 
-			if err := view(storyID, "story"); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	parent, err := store.Comments.GetComment(*parentID)
+	if err == sql.ErrNoRows || (err == nil && (parent.Deleted || !sameThread(parent))) {
+		writeError(w, invalidField("parent_id", ErrCommentNotFound))
+		return nil, false
+	} else if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
 
-		w.WriteHeader(http.StatusOK)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if parent.Depth+1 > config.Comments.MaxDepth {
+		message := fmt.Sprintf("Replies are limited to a depth of %d", config.Comments.MaxDepth)
+		writeError(w, invalidField("parent_id", ErrReplyTooDeep.withMessage(message)))
+		return nil, false
 	}
+
+	return &parent, true
 }
 
-func userImageHandler(w http.ResponseWriter, r *http.Request) {
+func commentHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case "POST":
+	case "PATCH":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		if destination, err := copyFile(r, "image", ContentDir, randomFilename()); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-		} else if destination == "" {
-			w.WriteHeader(http.StatusBadRequest)
-		} else {
-			user.updateUserImage(destination)
-			w.WriteHeader(http.StatusOK)
+		var req commentUpdateRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
 		}
 
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
+		comment, err := store.Comments.GetComment(req.CommentID)
+		if err == sql.ErrNoRows || (err == nil && comment.Deleted) {
+			writeError(w, ErrCommentNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
 
-func userMyHoopsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		var hoops []Hoop
-		var data []byte
-		var err error
+		// Only the author may put words in their mouth
+		if comment.UserID != user.ID {
+			writeError(w, ErrForbidden)
+			return
+		}
+
+		if err := store.Comments.UpdateComment(req.CommentID, req.Text); err == sql.ErrNoRows {
+			writeError(w, ErrCommentNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
 
+		writeOK(w)
+	case "DELETE":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		hoops, err = getHoops(GET_MY_HOOPS_SQL, user.ID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req commentRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		data, err = json.Marshal(hoops)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		comment, err := store.Comments.GetComment(req.CommentID)
+		if err == sql.ErrNoRows || (err == nil && comment.Deleted) {
+			writeError(w, ErrCommentNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		if !canModify(user, comment.UserID) {
+			writeError(w, ErrForbidden)
+			return
+		}
+
+		if err := store.Comments.DeleteComment(req.CommentID); err == sql.ErrNoRows {
+			writeError(w, ErrCommentNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
+			return
+		}
 
+		writeOK(w)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func userOtherHoopsHandler(w http.ResponseWriter, r *http.Request) {
+// commentRepliesHandler pages through the replies of a top-level comment,
+// oldest first, for threads with more replies than comment lists include.
+func commentRepliesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		var hoops []Hoop
-		var data []byte
-		var err error
-
-		ok, user := loggedIn(w, r, true)
-		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		if hoops, err = getHoops(GET_OTHER_HOOPS_SQL, user.ID); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req commentRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		if data, err = json.Marshal(hoops); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if _, err := store.Comments.GetComment(req.CommentID); err == sql.ErrNoRows {
+			writeError(w, ErrCommentNotFound)
+			return
+		} else if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		replies, next, err := store.Comments.GetReplies(req.CommentID, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 
+		writeList(w, replies, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func hoopCommentsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop-id"), 10, 64)
+		page, err := parsePage(r)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		comments, err := getHoopComments(hoopID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		data, err := json.Marshal(comments)
+		comments, next, err := store.Comments.GetHoopComments(req.HoopID, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, comments, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func storyCommentsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		storyID, err := strconv.ParseInt(r.FormValue("story-id"), 10, 64)
+		page, err := parsePage(r)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		comments, err := getStoryComments(storyID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req storyRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		data, err := json.Marshal(comments)
+		comments, next, err := store.Comments.GetStoryComments(req.StoryID, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, comments, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
+// likeCount is the data of the like count responses.
+type likeCount struct {
+	Count int64 `json:"count"`
+}
+
 func hoopLikesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		var count int64
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
 
-		if hoopID, err := strconv.ParseInt(r.FormValue("hoop-id"), 10, 64); err == nil {
-			if err := db.QueryRow(COUNT_STORY_LIKES_SQL, hoopID).Scan(&count); err == nil {
-				w.Write([]byte(strconv.FormatInt(count, 10)))
-				return
-			}
+		count, err := store.Likes.CountHoopLikes(req.HoopID)
+		if err != nil {
+			writeError(w, err)
+			return
 		}
 
-		w.WriteHeader(http.StatusBadRequest)
+		writeData(w, likeCount{Count: count})
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func storyLikesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		var count int64
+		var req storyRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
 
-		if storyID, err := strconv.ParseInt(r.FormValue("story-id"), 10, 64); err == nil {
-			if err := db.QueryRow(COUNT_STORY_LIKES_SQL, storyID).Scan(&count); err == nil {
-				w.Write([]byte(strconv.FormatInt(count, 10)))
-				return
-			}
+		count, err := store.Likes.CountStoryLikes(req.StoryID)
+		if err != nil {
+			writeError(w, err)
+			return
 		}
 
-		w.WriteHeader(http.StatusBadRequest)
+		writeData(w, likeCount{Count: count})
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func nearbyHoopsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		var hoops []Hoop
-
-		latitude, err := strconv.ParseFloat(r.FormValue("latitude"), 64)
+		page, err := parsePage(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, err)
 			return
 		}
 
-		longitude, err := strconv.ParseFloat(r.FormValue("longitude"), 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		req := nearbyHoopsRequest{Radius: 100}
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		radius, err := strconv.ParseFloat(r.FormValue("radius"), 64)
+		hoops, next, err := store.Hoops.GetNearbyHoops(req.Latitude, req.Longitude, req.Radius, page)
 		if err != nil {
-			radius = 100
+			writeError(w, err)
+			return
 		}
 
-		rows, err := db.Query(GET_NEARBY_HOOPS_SQL, latitude, latitude, longitude, radius)
+		writeList(w, hoops, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var hoop Hoop
 
-			if err := rows.Scan(
-				&hoop.ID,
-				&hoop.UserID,
-				&hoop.Name,
-				&hoop.Description,
-				&hoop.Latitude,
-				&hoop.Longitude,
-				&hoop.CreatedAt,
-				&hoop.UpdatedAt,
-			); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			hoops = append(hoops, hoop)
+		var req searchRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
 		}
 
-		data, err := json.Marshal(hoops)
+		results, next, err := store.Search.Search(SearchQuery{Text: req.Query, Types: req.types()}, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, results, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func popularHoopsHandler(w http.ResponseWriter, r *http.Request) {
+func boxHoopsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		var hoops []Hoop
-
-		rows, err := db.Query(GET_POPULAR_HOOPS_SQL)
+		page, err := parsePage(r)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
+			return
+		}
+
+		var req boxRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
-		defer rows.Close()
 
-		for rows.Next() {
-			var hoop Hoop
+		box := req.box()
+		hoops, next, err := store.Hoops.GetHoops(HoopQuery{Box: &box}, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 
-			if err := rows.Scan(
-				&hoop.ID,
-				&hoop.UserID,
-				&hoop.Name,
-				&hoop.Description,
-				&hoop.Latitude,
-				&hoop.Longitude,
-				&hoop.CreatedAt,
-				&hoop.UpdatedAt,
-			); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		writeList(w, hoops, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
 
-			hoops = append(hoops, hoop)
+func hoopClustersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var req hoopClustersRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
 		}
 
-		data, err := json.Marshal(hoops)
+		clusters, err := store.Hoops.GetHoopClusters(req.box(), req.Zoom)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		if clusters == nil {
+			clusters = []HoopCluster{}
+		}
+		writeData(w, clusters)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func latestHoopsHandler(w http.ResponseWriter, r *http.Request) {
+func popularHoopsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		var hoops []Hoop
-
-		rows, err := db.Query(GET_LATEST_HOOPS_SQL)
+		page, err := parsePage(r)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
-		defer rows.Close()
 
-		for rows.Next() {
-			var hoop Hoop
+		hoops, next, err := store.Hoops.GetHoops(HoopQuery{Order: HOOP_ORDER_POPULAR}, page)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 
-			if err := rows.Scan(
-				&hoop.ID,
-				&hoop.UserID,
-				&hoop.Name,
-				&hoop.Description,
-				&hoop.Latitude,
-				&hoop.Longitude,
-				&hoop.CreatedAt,
-				&hoop.UpdatedAt,
-			); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		writeList(w, hoops, next)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
 
-			hoops = append(hoops, hoop)
+func latestHoopsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		page, err := parsePage(r)
+		if err != nil {
+			writeError(w, err)
+			return
 		}
 
-		data, err := json.Marshal(hoops)
+		hoops, next, err := store.Hoops.GetHoops(HoopQuery{Order: HOOP_ORDER_LATEST}, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, hoops, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func mostCommentedStoriesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop_id"), 10, 64)
+		page, err := parsePage(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, err)
 			return
 		}
 
-		stories, err := getStories(GET_MOST_COMMENTED_STORIES_SQL, hoopID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		data, err := json.Marshal(stories)
+		stories, next, err := store.Stories.GetStories(req.HoopID, STORY_ORDER_MOST_COMMENTED, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, stories, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func mostLikedStoriesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop_id"), 10, 64)
+		page, err := parsePage(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, err)
 			return
 		}
 
-		stories, err := getStories(GET_MOST_LIKED_STORIES_SQL, hoopID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		data, err := json.Marshal(stories)
+		stories, next, err := store.Stories.GetStories(req.HoopID, STORY_ORDER_MOST_LIKED, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, stories, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func mostViewedStoriesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop_id"), 10, 64)
+		page, err := parsePage(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, err)
 			return
 		}
 
-		stories, err := getStories(GET_STORIES_SQL, hoopID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		for i := range stories {
-			red, err := redisInstance()
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			if reply, err := red.Do("HGET", fmt.Sprintf("story:%d", stories[i].ID), "view_count"); err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			} else if count, err := redis.Int64(reply, err); err != nil {
-				if err != redis.ErrNil {
-					log.Println(err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				continue
-			} else {
-				stories[i].viewCount = count
-			}
-		}
-
-		mostViewedStories := MostViewedStories(stories)
-		sort.Sort(mostViewedStories)
-
-		data, err := json.Marshal(mostViewedStories)
+		stories, next, err := store.Stories.GetStories(req.HoopID, STORY_ORDER_MOST_VIEWED, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, stories, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
 func latestStoriesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		hoopID, err := strconv.ParseInt(r.FormValue("hoop_id"), 10, 64)
+		page, err := parsePage(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, err)
 			return
 		}
 
-		stories, err := getStories(GET_LATEST_STORIES_SQL, hoopID)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		var req hoopRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		data, err := json.Marshal(stories)
+		stories, next, err := store.Stories.GetStories(req.HoopID, STORY_ORDER_LATEST, page)
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 
-		w.Write(data)
+		writeList(w, stories, next)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
@@ -1380,89 +2319,68 @@ func userLastActivityCheckTimeHandler(w http.ResponseWriter, r *http.Request) {
 	case "PATCH":
 		ok, user := loggedIn(w, r, true)
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
+			writeError(w, ErrNotLoggedIn)
 			return
 		}
 
-		secs, err := strconv.ParseInt(r.FormValue("time"), 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		var req lastActivityCheckTimeRequest
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		if err := user.updateLastActivityCheckTime(secs); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if err := store.Users.UpdateLastActivityCheckTime(user.ID, req.Time); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeOK(w)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, ErrMethodNotAllowed)
 	}
 }
 
-func copyFile(r *http.Request, name string, folder, filename string) (destination string, err error) {
-	var fileheader *multipart.FileHeader
-
-	if _, fileheader, err = r.FormFile("image"); err != nil {
-		if err == http.ErrMissingFile {
-			err = nil
-		}
-		return
-	} else {
-		var infile multipart.File
-		var outfile *os.File
-
-		if err = os.MkdirAll(folder, os.ModeDir|0775); err != nil {
-			return
-		}
-
-		destination = folder + "/" + filename
-
-		// Open received file
-		if infile, err = fileheader.Open(); err != nil {
-			return
-		}
-		defer infile.Close()
+// canModify reports whether the user may edit or delete something created
+// by ownerID.
+func canModify(user *User, ownerID int64) bool {
+	return user.ID == ownerID || user.IsAdmin
+}
 
-		// Create destination file
-		if outfile, err = os.OpenFile(destination, os.O_CREATE|os.O_WRONLY, 0664); err != nil {
-			return
-		}
-		defer outfile.Close()
+// Redis connections are pooled so that requests do not dial Redis for every
+// command.
+const (
+	RedisMaxIdle     = 16
+	RedisIdleTimeout = 4 * time.Minute
+)
 
-		// Copy file to destination
-		if _, err = io.Copy(outfile, infile); err != nil {
-			return
-		}
+var redisPool = &redis.Pool{
+	MaxIdle:     RedisMaxIdle,
+	IdleTimeout: RedisIdleTimeout,
+	Dial:        dialRedis,
+}
 
-		if destination, err = filepath.Rel(PublicDir, destination); err != nil {
-			return
-		}
+// redisInstance returns a pooled Redis connection, which is returned to the
+// pool when closed.
+func redisInstance() (redis.Conn, error) {
+	red := redisPool.Get()
+	if err := red.Err(); err != nil {
+		red.Close()
+		return nil, err
 	}
-
-	return
+	return red, nil
 }
 
-func randomFilename() string {
-	cmd := exec.Command("openssl", "rand", "-base64", "64")
-
-	output, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
+func dialRedis() (red redis.Conn, err error) {
+	if red, err = redis.Dial("tcp", config.Redis.Host+":"+config.Redis.Port); err != nil {
+		return
 	}
 
-	for i := range output {
-		if output[i] == '/' || output[i] == '\n' {
-			output[i] = '-'
+	if config.Redis.Password != "" {
+		if _, err = red.Do("AUTH", config.Redis.Password); err != nil {
+			red.Close()
+			return nil, err
 		}
 	}
 
-	return string(output)
-}
-
-func redisInstance() (red redis.Conn, err error) {
-	red, err = redis.Dial("tcp", *cachehost+":"+*cacheport)
 	return
 }
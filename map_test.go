@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// createHoopAt adds a hoop at the location and returns its ID.
+func (c *testClient) createHoopAt(name string, latitude, longitude float64) int64 {
+	c.t.Helper()
+
+	c.ok("POST", "/api/hoop", params{
+		"name":      name,
+		"latitude":  latitude,
+		"longitude": longitude,
+		"image_url": "http://example.com/hoop.jpg",
+	}, nil)
+
+	var hoops []Hoop
+	c.list("/api/hoops", params{"name": name}, &hoops)
+	if len(hoops) != 1 {
+		c.t.Fatalf("hoops %+v named %q", hoops, name)
+	}
+	return hoops[0].ID
+}
+
+// mapHoops is a pair of hoops a block apart in Tondo, one in Quezon City,
+// and one in Cebu, far from the others.
+func mapHoops(c *testClient) (tondo, block, quezon, cebu int64) {
+	tondo = c.createHoopAt("Tondo Court", 14.60, 120.98)
+	block = c.createHoopAt("Tondo Covered Court", 14.601, 120.981)
+	quezon = c.createHoopAt("Quezon City Court", 14.70, 121.10)
+	cebu = c.createHoopAt("Cebu Court", 10.31, 123.89)
+	return
+}
+
+// metroManila is a box around the hoops of mapHoops but the one in Cebu.
+var metroManila = params{"south": 14.5, "west": 120.9, "north": 14.8, "east": 121.2}
+
+func hoopIDs(hoops []Hoop) []int64 {
+	var ids []int64
+	for _, hoop := range hoops {
+		ids = append(ids, hoop.ID)
+	}
+	return ids
+}
+
+func TestNearbyHoops(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	tondo, block, _, _ := mapHoops(c)
+
+	var hoops []Hoop
+	c.list("/api/hoops/nearby", params{"latitude": 14.60, "longitude": 120.98, "radius": 1000}, &hoops)
+	if ids := hoopIDs(hoops); !reflect.DeepEqual(ids, []int64{tondo, block}) {
+		t.Fatalf("nearby hoops %v, want %v", ids, []int64{tondo, block})
+	}
+
+	// The hoop at the searched point itself is at no distance
+	if d := hoops[0].Distance; d == nil || *d != 0 {
+		t.Errorf("distance %v of the hoop at the searched point", d)
+	}
+	if d := hoops[1].Distance; d == nil || *d < 100 || *d > 200 {
+		t.Errorf("distance %v of the hoop a block away", d)
+	}
+}
+
+func TestBoxHoops(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	tondo, block, quezon, _ := mapHoops(c)
+
+	var hoops []Hoop
+	c.list("/api/hoops/box", metroManila, &hoops)
+	if ids, want := hoopIDs(hoops), []int64{quezon, block, tondo}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("hoops %v in the box, want %v", ids, want)
+	}
+
+	c.list("/api/v2/hoops/box", params{"south": 14.55, "west": 120.95, "north": 14.65, "east": 121}, &hoops)
+	if ids, want := hoopIDs(hoops), []int64{block, tondo}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("hoops %v in the small box, want %v", ids, want)
+	}
+
+	err := c.fails("GET", "/api/hoops/box", params{"south": 14.8, "west": 120.9, "north": 14.5, "east": 121.2}, http.StatusBadRequest)
+	if err.Fields["north"].Code != ErrInvalidValue.Code {
+		t.Errorf("box with its north below its south: %+v", err)
+	}
+}
+
+func TestHoopClusters(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	_, _, quezon, _ := mapHoops(c)
+
+	clusters := func(zoom int) []HoopCluster {
+		t.Helper()
+		p := params{"zoom": zoom}
+		for name, value := range metroManila {
+			p[name] = value
+		}
+		var clusters []HoopCluster
+		c.ok("GET", "/api/hoops/clusters", p, &clusters)
+		return clusters
+	}
+
+	// At a city's zoom level the Tondo hoops are one cluster at their mean
+	// location, and the one in Quezon City another
+	got := clusters(10)
+	if len(got) != 2 {
+		t.Fatalf("clusters %+v at zoom 10", got)
+	}
+	tondo := got[0]
+	if tondo.Count != 2 || tondo.HoopID != 0 || math.Abs(tondo.Latitude-14.6005) > 1e-9 || math.Abs(tondo.Longitude-120.9805) > 1e-9 {
+		t.Errorf("Tondo cluster %+v", tondo)
+	}
+	if got[1] != (HoopCluster{Latitude: 14.70, Longitude: 121.10, Count: 1, HoopID: quezon}) {
+		t.Errorf("Quezon City cluster %+v", got[1])
+	}
+
+	// Zoomed in, each hoop is its own
+	if got := clusters(HoopClusterMaxZoom); len(got) != 3 {
+		t.Errorf("clusters %+v at zoom %d", got, HoopClusterMaxZoom)
+	}
+
+	err := c.fails("GET", "/api/hoops/clusters", params{"south": 14.5, "west": 120.9, "north": 14.8, "east": 121.2, "zoom": 23}, http.StatusBadRequest)
+	if err.Fields["zoom"].Code != ErrOutOfRange.Code {
+		t.Errorf("cluster at zoom 23: %+v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migrationLockID is the advisory lock key held while migrating so that two
+// server instances never migrate the same database concurrently.
+const migrationLockID = 7461701
+
+var ErrUnknownMigration = errors.New("Unknown migration")
+
+type migration struct {
+	version int64
+	name    string
+	up      []string
+	down    []string
+}
+
+type migrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+	Applied   bool
+}
+
+// migrateUp applies every pending migration in order.
+func migrateUp() error {
+	if err := prepareMigrations(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied, err := applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		} else if applied {
+			log.Printf("Applied migration %d (%s)", m.version, m.name)
+		}
+	}
+
+	return nil
+}
+
+// migrateDown reverts the latest applied migration.
+func migrateDown() error {
+	if err := prepareMigrations(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(LOCK_SCHEMA_MIGRATIONS_SQL, migrationLockID); err != nil {
+		return err
+	}
+
+	var version int64
+	if err := tx.QueryRow(GET_LATEST_SCHEMA_MIGRATION_SQL).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			log.Println("No migrations to revert")
+			return nil
+		}
+		return err
+	}
+
+	m, ok := findMigration(version)
+	if !ok {
+		return fmt.Errorf("migration %d: %v", version, ErrUnknownMigration)
+	}
+
+	for _, query := range m.down {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+
+	if _, err := tx.Exec(DELETE_SCHEMA_MIGRATION_SQL, m.version); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Reverted migration %d (%s)", m.version, m.name)
+	return nil
+}
+
+// migrationStatuses reports every known migration and whether it has been applied.
+func migrationStatuses() ([]migrationStatus, error) {
+	if err := prepareMigrations(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(GET_SCHEMA_MIGRATIONS_SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []migrationStatus
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.version]
+		statuses = append(statuses, migrationStatus{
+			Version:   m.version,
+			Name:      m.name,
+			AppliedAt: appliedAt,
+			Applied:   ok,
+		})
+	}
+
+	return statuses, nil
+}
+
+// prepareMigrations creates the schema_migrations bookkeeping table.
+func prepareMigrations() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(LOCK_SCHEMA_MIGRATIONS_SQL, migrationLockID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(CREATE_SCHEMA_MIGRATIONS_TABLE_SQL); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applyMigration runs a single migration in its own transaction. It returns
+// false if another instance applied it first.
+func applyMigration(m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(LOCK_SCHEMA_MIGRATIONS_SQL, migrationLockID); err != nil {
+		return false, err
+	}
+
+	var count int64
+	if err := tx.QueryRow(COUNT_SCHEMA_MIGRATION_SQL, m.version).Scan(&count); err != nil {
+		return false, err
+	} else if count > 0 {
+		return false, nil
+	}
+
+	for _, query := range m.up {
+		if _, err := tx.Exec(query); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := tx.Exec(INSERT_SCHEMA_MIGRATION_SQL, m.version, m.name); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func findMigration(version int64) (migration, bool) {
+	for _, m := range migrations {
+		if m.version == version {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// migrateCommand implements `pinoy-hoops-server migrate up|down|status`.
+func migrateCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp()
+	case "down":
+		return migrateDown()
+	case "status":
+		statuses, err := migrationStatuses()
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Printf("%4d  %-40s  applied %s\n", status.Version, status.Name, status.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%4d  %-40s  pending\n", status.Version, status.Name)
+			}
+		}
+		return nil
+	default:
+		return errors.New("usage: migrate up|down|status")
+	}
+}
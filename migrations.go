@@ -0,0 +1,122 @@
+package main
+
+// Migrations are applied in order of version. Never edit a migration that
+// has been released; add a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: []string{
+			CREATE_USER_TABLE_SQL,
+			CREATE_HOOP_TABLE_SQL,
+			CREATE_STORY_TABLE_SQL,
+			CREATE_COMMENT_TABLE_SQL,
+			CREATE_ACTIVITY_TABLE_SQL,
+			CREATE_HOOP_FEATURED_STORY_TABLE_SQL,
+		},
+		down: []string{
+			DROP_HOOP_FEATURED_STORY_TABLE_SQL,
+			DROP_ACTIVITY_TABLE_SQL,
+			DROP_COMMENT_TABLE_SQL,
+			DROP_STORY_TABLE_SQL,
+			DROP_HOOP_TABLE_SQL,
+			DROP_USER_TABLE_SQL,
+		},
+	},
+	{
+		version: 2,
+		name:    "pagination indexes",
+		up:      []string{CREATE_PAGINATION_INDEXES_SQL},
+		down:    []string{DROP_PAGINATION_INDEXES_SQL},
+	},
+	{
+		version: 3,
+		name:    "refresh tokens",
+		up:      []string{CREATE_REFRESH_TOKEN_TABLE_SQL},
+		down:    []string{DROP_REFRESH_TOKEN_TABLE_SQL},
+	},
+	{
+		version: 4,
+		name:    "image variants",
+		up:      []string{ADD_IMAGE_VARIANTS_SQL},
+		down:    []string{DROP_IMAGE_VARIANTS_SQL},
+	},
+	{
+		version: 5,
+		name:    "uploads",
+		up:      []string{CREATE_UPLOAD_TABLE_SQL},
+		down:    []string{DROP_UPLOAD_TABLE_SQL},
+	},
+	{
+		version: 6,
+		name:    "admin users",
+		up:      []string{ADD_USER_ADMIN_SQL},
+		down:    []string{DROP_USER_ADMIN_SQL},
+	},
+	{
+		version: 7,
+		name:    "hoop redirects",
+		up:      []string{CREATE_HOOP_REDIRECT_TABLE_SQL},
+		down:    []string{DROP_HOOP_REDIRECT_TABLE_SQL},
+	},
+	{
+		version: 8,
+		name:    "comment threads",
+		up:      []string{ADD_COMMENT_THREADS_SQL},
+		down:    []string{DROP_COMMENT_THREADS_SQL},
+	},
+	{
+		version: 9,
+		name:    "follows",
+		up:      []string{CREATE_FOLLOW_TABLES_SQL},
+		down:    []string{DROP_FOLLOW_TABLES_SQL},
+	},
+	{
+		version: 10,
+		name:    "notifications",
+		up:      []string{CREATE_NOTIFICATION_TABLE_SQL},
+		down:    []string{DROP_NOTIFICATION_TABLE_SQL},
+	},
+	{
+		version: 11,
+		name:    "notification read state",
+		up:      []string{ADD_NOTIFICATION_READ_AT_SQL},
+		down:    []string{DROP_NOTIFICATION_READ_AT_SQL},
+	},
+	{
+		version: 12,
+		name:    "push devices",
+		up:      []string{CREATE_DEVICE_TABLES_SQL},
+		down:    []string{DROP_DEVICE_TABLES_SQL},
+	},
+	{
+		version: 13,
+		name:    "jobs",
+		up:      []string{CREATE_JOB_TABLES_SQL},
+		down:    []string{DROP_JOB_TABLES_SQL},
+	},
+	{
+		version: 14,
+		name:    "hoop and story foreign keys",
+		up:      []string{ADD_HOOP_STORY_FOREIGN_KEYS_SQL},
+		down:    []string{DROP_HOOP_STORY_FOREIGN_KEYS_SQL},
+	},
+	{
+		version: 15,
+		name:    "hoop locations",
+		up:      []string{ADD_HOOP_LOCATION_SQL},
+		down:    []string{DROP_HOOP_LOCATION_SQL},
+	},
+	{
+		version: 16,
+		name:    "hoops version",
+		up:      []string{CREATE_HOOPS_VERSION_TABLE_SQL},
+		down:    []string{DROP_HOOPS_VERSION_TABLE_SQL},
+	},
+	{
+		version: 17,
+		name:    "search",
+		up:      []string{CREATE_SEARCH_SQL},
+		down:    []string{DROP_SEARCH_SQL},
+	},
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Read notifications are deleted once they are older than
+// ReadNotificationRetention. Unread ones are kept until they are read.
+const (
+	ReadNotificationRetention = 30 * 24 * time.Hour
+	NotificationPruneInterval = time.Hour
+)
+
+// pruneNotifications deletes old read notifications every interval until
+// the process exits.
+func pruneNotifications(interval time.Duration) {
+	for {
+		if n, err := store.Notifications.DeleteReadNotifications(time.Now().Add(-ReadNotificationRetention)); err != nil {
+			log.Println("prune notifications:", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d read notifications", n)
+		}
+
+		time.Sleep(interval)
+	}
+}
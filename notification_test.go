@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// notifications returns the types of the client's notifications, newest
+// first.
+func (c *testClient) notifications() []int64 {
+	c.t.Helper()
+
+	var notifications []Notification
+	c.list("/api/notifications", nil, &notifications)
+
+	types := []int64{}
+	for _, n := range notifications {
+		types = append(types, n.Type)
+	}
+	return types
+}
+
+func equalTypes(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHoopNotifications(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juanUser := juan.signup("Juan")
+	pedro := newTestClient(t, server)
+	pedroUser := pedro.signup("Pedro")
+
+	hoop := pedro.createHoop("Tondo Court")
+	other := pedro.createHoop("Quiapo Court")
+	juan.ok("POST", "/api/hoop/follow", params{"hoop_id": hoop.ID}, nil)
+	pedro.ok("POST", "/api/hoop/follow", params{"hoop_id": hoop.ID}, nil)
+
+	// Followers are told of what others do on the hoop, but not on others
+	pedro.createStory(hoop.ID, "First game")
+	pedro.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+	pedro.ok("POST", "/api/like/hoop", params{"hoop_id": hoop.ID}, nil)
+	pedro.createStory(other.ID, "Elsewhere")
+	juan.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Thanks"}, nil)
+
+	want := []int64{ACTIVITY_POST_LIKE_HOOP, ACTIVITY_POST_COMMENT_HOOP, ACTIVITY_POST_STORY}
+	if got := juan.notifications(); !equalTypes(got, want) {
+		t.Errorf("notifications %v, want %v", got, want)
+	}
+	if got := pedro.notifications(); !equalTypes(got, []int64{ACTIVITY_POST_COMMENT_HOOP}) {
+		t.Errorf("notifications %v of the hoop's creator", got)
+	}
+
+	var notifications []Notification
+	juan.list("/api/notifications", nil, &notifications)
+	n := notifications[2]
+	if n.UserID != juanUser.ID || n.ActorID != pedroUser.ID || n.HoopID != hoop.ID || n.StoryID == 0 {
+		t.Errorf("story notification %+v", n)
+	}
+	if story, _ := n.Data["story"].(map[string]interface{}); story["name"] != "First game" {
+		t.Errorf("story notification data %+v", n.Data)
+	}
+
+	// Taking a like back takes its notification back
+	pedro.ok("POST", "/api/like/hoop", params{"hoop_id": hoop.ID}, nil)
+	if got := juan.notifications(); !equalTypes(got, want[1:]) {
+		t.Errorf("notifications %v after unliking", got)
+	}
+
+	// Unfollowing stops them
+	juan.ok("DELETE", "/api/hoop/follow", params{"hoop_id": hoop.ID}, nil)
+	pedro.createStory(hoop.ID, "Second game")
+	if got := juan.notifications(); !equalTypes(got, want[1:]) {
+		t.Errorf("notifications %v after unfollowing", got)
+	}
+
+	newTestClient(t, server).fails("GET", "/api/notifications", nil, http.StatusForbidden)
+}
+
+func TestFollowedHoops(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juanUser := juan.signup("Juan")
+
+	hoop := juan.createHoop("Tondo Court")
+	juan.createHoop("Quiapo Court")
+	juan.ok("POST", "/api/hoop/follow", params{"hoop_id": hoop.ID}, nil)
+
+	var hoops []Hoop
+	juan.list("/api/user/followedhoops", nil, &hoops)
+	if len(hoops) != 1 || hoops[0].ID != hoop.ID {
+		t.Errorf("followed hoops %+v", hoops)
+	}
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	pedro.list("/api/user/followedhoops", params{"user_id": juanUser.ID}, &hoops)
+	if len(hoops) != 1 {
+		t.Errorf("followed hoops %+v of another user", hoops)
+	}
+	if p := pedro.profile(juanUser.ID); p.FollowedHoopCount != 1 {
+		t.Errorf("profile %+v", p)
+	}
+	newTestClient(t, server).fails("GET", "/api/user/followedhoops", nil, http.StatusForbidden)
+}
+
+// unreadCount returns the client's count of unread notifications.
+func (c *testClient) unreadCount() int64 {
+	c.t.Helper()
+
+	var me struct {
+		UnreadNotificationCount int64 `json:"unread_notification_count"`
+	}
+	c.ok("GET", "/api/login", nil, &me)
+	return me.UnreadNotificationCount
+}
+
+func TestNotificationReadState(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+
+	// Creators are notified of what others do on their hoops and stories
+	hoop := juan.createHoop("Tondo Court")
+	story := juan.createStory(hoop.ID, "First game")
+	pedro.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+	pedro.ok("POST", "/api/like/story", params{"story_id": story.ID}, nil)
+	pedro.createStory(hoop.ID, "Second game")
+
+	want := []int64{ACTIVITY_POST_STORY, ACTIVITY_POST_LIKE_STORY, ACTIVITY_POST_COMMENT_HOOP}
+	if got := juan.notifications(); !equalTypes(got, want) {
+		t.Fatalf("notifications %v, want %v", got, want)
+	}
+	if n := juan.unreadCount(); n != 3 {
+		t.Errorf("%d unread notifications, want 3", n)
+	}
+
+	var notifications []Notification
+	juan.list("/api/notifications", nil, &notifications)
+	first := notifications[2]
+
+	// Only the user's own notifications can be read
+	pedro.fails("PATCH", "/api/notification", params{"notification_id": first.ID}, http.StatusNotFound)
+	newTestClient(t, server).fails("PATCH", "/api/notification", params{"notification_id": first.ID}, http.StatusForbidden)
+	juan.ok("PATCH", "/api/notification", params{"notification_id": first.ID}, nil)
+	juan.ok("PATCH", "/api/notification", params{"notification_id": first.ID}, nil)
+	if n := juan.unreadCount(); n != 2 {
+		t.Errorf("%d unread notifications after reading one, want 2", n)
+	}
+
+	juan.list("/api/notifications", nil, &notifications)
+	for i, n := range notifications {
+		if read := n.ReadAt != nil; read != (i == 2) {
+			t.Errorf("notification %d read at %v", i, n.ReadAt)
+		}
+	}
+
+	juan.ok("POST", "/api/notifications/read", nil, nil)
+	if n := juan.unreadCount(); n != 0 {
+		t.Errorf("%d unread notifications after reading all", n)
+	}
+
+	// Pruning deletes the notifications read before the cutoff, but never
+	// unread ones
+	pedro.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "See you there"}, nil)
+	if n, err := store.Notifications.DeleteReadNotifications(time.Now().Add(-ReadNotificationRetention)); err != nil || n != 0 {
+		t.Fatalf("pruned %d recently read notifications: %v", n, err)
+	}
+	if n, err := store.Notifications.DeleteReadNotifications(time.Now().Add(time.Second)); err != nil || n != 3 {
+		t.Fatalf("pruned %d read notifications, want 3: %v", n, err)
+	}
+	if got := juan.notifications(); !equalTypes(got, []int64{ACTIVITY_POST_COMMENT_HOOP}) || juan.unreadCount() != 1 {
+		t.Errorf("notifications %v after pruning", got)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrOpenAPIDrift = errors.New("routes and OpenAPI document differ")
+
+// apiOperation describes what a route does with a method, for the OpenAPI
+// document. Parameters are read from the request struct the handler binds,
+// and responses from the type of the data it writes.
+type apiOperation struct {
+	Method  string
+	Path    string   // under /api
+	V2      []string // method and path under /api/v2 of the same operation
+	Summary string
+
+	LoggedIn   bool
+	Admin      bool
+	Deprecated bool
+
+	Request  interface{} // request struct, if any
+	Upload   string      // name of an image file in a multipart form
+	Paged    bool        // takes limit and cursor, and lists Response
+	Response interface{} // data of the response, nil for none
+	Content  string      // media types of a response without an envelope, separated by spaces
+}
+
+var apiOperations = []apiOperation{
+	// Logging in and out
+	{Method: "GET", Path: "/login", V2: []string{"GET /me"}, Summary: "Get the logged in user", LoggedIn: true, Response: ownProfile{}},
+	{Method: "POST", Path: "/login", V2: []string{"POST /session"}, Summary: "Log in", Request: loginRequest{}},
+	{Method: "POST", Path: "/logout", V2: []string{"DELETE /session"}, Summary: "Log out"},
+	{Method: "POST", Path: "/signup", V2: []string{"POST /users"}, Summary: "Sign up and log in", Request: signupRequest{}, Upload: "image"},
+	{Method: "POST", Path: "/token", V2: []string{"POST /token"}, Summary: "Issue access and refresh tokens", Request: tokenRequest{}, Response: tokenResponse{}},
+	{Method: "DELETE", Path: "/token", V2: []string{"DELETE /token"}, Summary: "Revoke a refresh token", Request: refreshTokenRequest{}},
+
+	// Users
+	{Method: "GET", Path: "/user", V2: []string{"GET /users/{user_id}"}, Summary: "Get a user", Request: userRequest{}, Response: Profile{}},
+	{Method: "PATCH", Path: "/user", V2: []string{"PATCH /me"}, Summary: "Edit the logged in user", LoggedIn: true, Request: userUpdateRequest{}},
+	{Method: "POST", Path: "/user/image", V2: []string{"POST /me/image"}, Summary: "Change the logged in user's image", LoggedIn: true, Upload: "image"},
+	{Method: "PATCH", Path: "/user/lastactivitychecktime", V2: []string{"PATCH /me/last-activity-check-time"}, Summary: "Set when the logged in user last checked the activities", LoggedIn: true, Request: lastActivityCheckTimeRequest{}},
+	{Method: "GET", Path: "/user/myhoops", V2: []string{"GET /me/hoops"}, Summary: "List the logged in user's hoops", LoggedIn: true, Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/user/otherhoops", V2: []string{"GET /me/other-hoops"}, Summary: "List the hoops of other users", LoggedIn: true, Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/user/followedhoops", V2: []string{"GET /me/followed-hoops", "GET /users/{user_id}/followed-hoops"}, Summary: "List the hoops a user follows", Request: optionalUserRequest{}, Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/user/followers", V2: []string{"GET /me/followers", "GET /users/{user_id}/followers"}, Summary: "List a user's followers", Request: optionalUserRequest{}, Paged: true, Response: User{}},
+	{Method: "GET", Path: "/user/following", V2: []string{"GET /me/following", "GET /users/{user_id}/following"}, Summary: "List the users a user follows", Request: optionalUserRequest{}, Paged: true, Response: User{}},
+	{Method: "POST", Path: "/follow", V2: []string{"POST /users/{user_id}/follow"}, Summary: "Follow a user", LoggedIn: true, Request: userRequest{}},
+	{Method: "DELETE", Path: "/follow", V2: []string{"DELETE /users/{user_id}/follow"}, Summary: "Unfollow a user", LoggedIn: true, Request: userRequest{}},
+
+	// Hoops
+	{Method: "GET", Path: "/hoops", V2: []string{"GET /hoops"}, Summary: "List hoops", Request: hoopsRequest{}, Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/hoops/nearby", V2: []string{"GET /hoops/nearby"}, Summary: "List hoops within radius meters, nearest first, with their distance", Request: nearbyHoopsRequest{}, Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/hoops/box", V2: []string{"GET /hoops/box"}, Summary: "List the hoops in an area of the map, latest first", Request: boxRequest{}, Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/hoops/clusters", V2: []string{"GET /hoops/clusters"}, Summary: "Cluster the hoops in an area of the map at a zoom level", Request: hoopClustersRequest{}, Response: []HoopCluster{}},
+	{Method: "GET", Path: "/tile", V2: []string{"GET /tiles/{z}/{x}/{y}.{format}"}, Summary: "Get the hoop markers of a map tile, as GeoJSON or a vector tile", Request: tileRequest{}, Content: GeoJSONContentType + " " + MVTContentType},
+	{Method: "GET", Path: "/hoops/popular", V2: []string{"GET /hoops/popular"}, Summary: "List popular hoops", Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/hoops/latest", V2: []string{"GET /hoops/latest"}, Summary: "List the latest hoops", Paged: true, Response: Hoop{}},
+	{Method: "GET", Path: "/hoop", V2: []string{"GET /hoops/{hoop_id}"}, Summary: "Get a hoop", Request: hoopRequest{}, Response: Hoop{}},
+	{Method: "POST", Path: "/hoop", V2: []string{"POST /hoops"}, Summary: "Add a hoop", LoggedIn: true, Request: hoopCreateRequest{}, Upload: "image"},
+	{Method: "PATCH", Path: "/hoop", V2: []string{"PATCH /hoops/{hoop_id}"}, Summary: "Edit a hoop", LoggedIn: true, Request: hoopUpdateRequest{}},
+	{Method: "DELETE", Path: "/hoop", V2: []string{"DELETE /hoops/{hoop_id}"}, Summary: "Delete a hoop", LoggedIn: true, Request: hoopRequest{}},
+	{Method: "POST", Path: "/hoop/follow", V2: []string{"POST /hoops/{hoop_id}/follow"}, Summary: "Follow a hoop", LoggedIn: true, Request: hoopRequest{}},
+	{Method: "DELETE", Path: "/hoop/follow", V2: []string{"DELETE /hoops/{hoop_id}/follow"}, Summary: "Unfollow a hoop", LoggedIn: true, Request: hoopRequest{}},
+	{Method: "POST", Path: "/hoop/merge", V2: []string{"POST /hoops/{hoop_id}/merge"}, Summary: "Merge a duplicate hoop into another", Admin: true, Request: hoopMergeRequest{}},
+	{Method: "POST", Path: "/view/hoop", V2: []string{"POST /hoops/{hoop_id}/views"}, Summary: "Count a view of a hoop", Request: hoopRequest{}},
+	{Method: "PATCH", Path: "/view/hoop", Summary: "Count a view of a hoop", Deprecated: true, Request: hoopRequest{}},
+	{Method: "GET", Path: "/hoop/likes", V2: []string{"GET /hoops/{hoop_id}/likes"}, Summary: "Count the likes of a hoop", Request: hoopRequest{}, Response: likeCount{}},
+	{Method: "POST", Path: "/like/hoop", V2: []string{"POST /hoops/{hoop_id}/likes"}, Summary: "Like or unlike a hoop", LoggedIn: true, Request: hoopRequest{}},
+	{Method: "GET", Path: "/hoop/comments", V2: []string{"GET /hoops/{hoop_id}/comments"}, Summary: "List the comments on a hoop", Request: hoopRequest{}, Paged: true, Response: Comment{}},
+	{Method: "POST", Path: "/comment/hoop", V2: []string{"POST /hoops/{hoop_id}/comments"}, Summary: "Comment on a hoop", LoggedIn: true, Request: hoopCommentRequest{}},
+
+	// Stories
+	{Method: "GET", Path: "/stories", V2: []string{"GET /hoops/{hoop_id}/stories"}, Summary: "List the stories of a hoop", Request: storiesRequest{}, Paged: true, Response: Story{}},
+	{Method: "GET", Path: "/stories/latest", Summary: "List the latest stories of a hoop", Request: hoopRequest{}, Paged: true, Response: Story{}},
+	{Method: "GET", Path: "/stories/mostcommented", Summary: "List the most commented stories of a hoop", Request: hoopRequest{}, Paged: true, Response: Story{}},
+	{Method: "GET", Path: "/stories/mostliked", Summary: "List the most liked stories of a hoop", Request: hoopRequest{}, Paged: true, Response: Story{}},
+	{Method: "GET", Path: "/stories/mostviewed", Summary: "List the most viewed stories of a hoop", Request: hoopRequest{}, Paged: true, Response: Story{}},
+	{Method: "GET", Path: "/story", V2: []string{"GET /stories/{story_id}"}, Summary: "Get a story", Request: storyRequest{}, Response: Story{}},
+	{Method: "POST", Path: "/story", V2: []string{"POST /hoops/{hoop_id}/stories"}, Summary: "Post a story to a hoop", LoggedIn: true, Request: storyCreateRequest{}, Upload: "image"},
+	{Method: "PATCH", Path: "/story", V2: []string{"PATCH /stories/{story_id}"}, Summary: "Edit a story", LoggedIn: true, Request: storyUpdateRequest{}, Upload: "image"},
+	{Method: "DELETE", Path: "/story", V2: []string{"DELETE /stories/{story_id}"}, Summary: "Delete a story", LoggedIn: true, Request: storyRequest{}},
+	{Method: "POST", Path: "/view/story", V2: []string{"POST /stories/{story_id}/views"}, Summary: "Count a view of a story", Request: storyRequest{}},
+	{Method: "PATCH", Path: "/view/story", Summary: "Count a view of a story", Deprecated: true, Request: storyRequest{}},
+	{Method: "GET", Path: "/story/likes", V2: []string{"GET /stories/{story_id}/likes"}, Summary: "Count the likes of a story", Request: storyRequest{}, Response: likeCount{}},
+	{Method: "POST", Path: "/like/story", V2: []string{"POST /stories/{story_id}/likes"}, Summary: "Like or unlike a story", LoggedIn: true, Request: storyRequest{}},
+	{Method: "GET", Path: "/story/comments", V2: []string{"GET /stories/{story_id}/comments"}, Summary: "List the comments on a story", Request: storyRequest{}, Paged: true, Response: Comment{}},
+	{Method: "POST", Path: "/comment/story", V2: []string{"POST /stories/{story_id}/comments"}, Summary: "Comment on a story", LoggedIn: true, Request: storyCommentRequest{}},
+	{Method: "PATCH", Path: "/comment/story", Summary: "Comment on a story", LoggedIn: true, Deprecated: true, Request: storyCommentRequest{}},
+
+	// Comments
+	{Method: "GET", Path: "/comment/replies", Summary: "List the replies to a comment beyond those in its thread, oldest first", Request: commentRequest{}, Paged: true, Response: Comment{}},
+	{Method: "PATCH", Path: "/comment", V2: []string{"PATCH /comments/{comment_id}"}, Summary: "Edit a comment", LoggedIn: true, Request: commentUpdateRequest{}},
+	{Method: "DELETE", Path: "/comment", V2: []string{"DELETE /comments/{comment_id}"}, Summary: "Delete a comment", LoggedIn: true, Request: commentRequest{}},
+
+	// Search
+	{Method: "GET", Path: "/search", V2: []string{"GET /search"}, Summary: "Search hoops, stories, comments and users, best matches first", Request: searchRequest{}, Paged: true, Response: SearchResult{}},
+
+	// Feeds
+	{Method: "GET", Path: "/activities", V2: []string{"GET /activities"}, Summary: "List the activity feed", LoggedIn: true, Request: activitiesRequest{}, Paged: true, Response: Activity{}},
+	{Method: "GET", Path: "/stream", V2: []string{"GET /stream"}, Summary: "Stream new activities and comments as server-sent events", LoggedIn: true, Request: streamRequest{}, Content: "text/event-stream"},
+
+	// Notifications
+	{Method: "GET", Path: "/notifications", V2: []string{"GET /notifications"}, Summary: "List notifications, newest first", LoggedIn: true, Paged: true, Response: Notification{}},
+	{Method: "PATCH", Path: "/notification", V2: []string{"PATCH /notifications/{notification_id}"}, Summary: "Mark a notification read", LoggedIn: true, Request: notificationRequest{}},
+	{Method: "POST", Path: "/notifications/read", V2: []string{"POST /notifications/read"}, Summary: "Mark every notification read", LoggedIn: true},
+	{Method: "GET", Path: "/notifications/preferences", V2: []string{"GET /notifications/preferences"}, Summary: "Get which notifications are pushed", LoggedIn: true, Response: NotificationPreferences{}},
+	{Method: "PATCH", Path: "/notifications/preferences", V2: []string{"PATCH /notifications/preferences"}, Summary: "Change which notifications are pushed", LoggedIn: true, Request: notificationPreferencesRequest{}, Response: NotificationPreferences{}},
+	{Method: "POST", Path: "/device", V2: []string{"POST /devices"}, Summary: "Register a device for push notifications", LoggedIn: true, Request: deviceRequest{}},
+	{Method: "DELETE", Path: "/device", V2: []string{"DELETE /devices/{token}"}, Summary: "Unregister a device", LoggedIn: true, Request: deviceTokenRequest{}},
+
+	// Administration
+	{Method: "GET", Path: "/jobs/dead", V2: []string{"GET /jobs/dead"}, Summary: "List the jobs that failed every attempt", Admin: true, Paged: true, Response: DeadJob{}},
+	{Method: "POST", Path: "/jobs/dead/requeue", V2: []string{"POST /jobs/dead/{job_id}/requeue"}, Summary: "Run a dead job again", Admin: true, Request: jobRequest{}},
+
+	{Method: "GET", Path: "/openapi.json", Summary: "Get this document", Content: "application/json"},
+}
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument []byte
+)
+
+// openAPIHandler serves the OpenAPI document of the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		openAPIOnce.Do(func() {
+			var err error
+			if openAPIDocument, err = json.Marshal(newOpenAPIDocument()); err != nil {
+				panic(err)
+			}
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// openAPICommand prints the OpenAPI document, or with check, compares it
+// with the routes.
+func openAPICommand(args []string) error {
+	switch {
+	case len(args) == 0:
+		data, err := json.MarshalIndent(newOpenAPIDocument(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	case len(args) == 1 && args[0] == "check":
+		return checkOpenAPI(newRouter())
+	default:
+		return errors.New("usage: openapi [check]")
+	}
+}
+
+// routeVarPattern matches the pattern of a route variable, which OpenAPI
+// paths leave out.
+var routeVarPattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+// checkOpenAPI reports the API routes that the document leaves out and the
+// operations it describes that are not routed. Routes of the original API
+// take every method, so only their paths are compared.
+func checkOpenAPI(router *mux.Router) error {
+	documented := make(map[string]bool)
+	for path, methods := range newOpenAPIDocument().Paths {
+		documented[path] = true
+		for method := range methods {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	routed := make(map[string]bool)
+	var problems []string
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/") {
+			return nil
+		}
+		path := routeVarPattern.ReplaceAllString(template, "{$1}")
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			routed[path] = true
+			if !documented[path] {
+				problems = append(problems, "not documented: "+path)
+			}
+			return nil
+		}
+
+		for _, method := range methods {
+			routed[method+" "+path] = true
+			if !documented[method+" "+path] {
+				problems = append(problems, "not documented: "+method+" "+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key := range documented {
+		path := key[strings.Index(key, " ")+1:]
+		if strings.Contains(key, " ") && !routed[key] && !routed[path] {
+			problems = append(problems, "not routed: "+key)
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "openapi:", problem)
+		}
+		return ErrOpenAPIDrift
+	}
+
+	return nil
+}
+
+type openAPI struct {
+	OpenAPI    string                            `json:"openapi"`
+	Info       map[string]string                 `json:"info"`
+	Servers    []map[string]string               `json:"servers,omitempty"`
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components map[string]interface{}            `json:"components"`
+}
+
+// openAPISchemas builds JSON schemas from Go types, collecting the named
+// struct types as components.
+type openAPISchemas map[string]interface{}
+
+// newOpenAPIDocument describes apiOperations as an OpenAPI document.
+func newOpenAPIDocument() *openAPI {
+	schemas := openAPISchemas{}
+
+	doc := &openAPI{
+		OpenAPI: "3.1.0",
+		Info: map[string]string{
+			"title":   "Pinoy Hoops API",
+			"version": "2",
+		},
+		Paths: make(map[string]map[string]interface{}),
+	}
+
+	if config.Address != "" {
+		doc.Servers = []map[string]string{{"url": config.Address}}
+	}
+
+	for _, op := range apiOperations {
+		doc.addOperation(op.Method, "/api"+op.Path, "v1", op, schemas)
+		for _, v2 := range op.V2 {
+			parts := strings.SplitN(v2, " ", 2)
+			doc.addOperation(parts[0], "/api/v2"+parts[1], "v2", op, schemas)
+		}
+	}
+
+	codes := make([]string, 0, len(apiErrors)+1)
+	for code := range apiErrors {
+		codes = append(codes, code)
+	}
+	codes = append(codes, "invalid_fields")
+	sort.Strings(codes)
+
+	schemas["Error"] = object(map[string]interface{}{
+		"error": object(map[string]interface{}{
+			"code":    map[string]interface{}{"type": "string", "enum": codes},
+			"message": map[string]interface{}{"type": "string"},
+			"fields": map[string]interface{}{
+				"type": "object",
+				"additionalProperties": object(map[string]interface{}{
+					"code":    map[string]interface{}{"type": "string", "enum": codes},
+					"message": map[string]interface{}{"type": "string"},
+				}, "code", "message"),
+			},
+		}, "code", "message"),
+	}, "error")
+
+	doc.Components = map[string]interface{}{
+		"schemas": schemas,
+		"responses": map[string]interface{}{
+			"Error": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": ref("Error")},
+				},
+			},
+		},
+		"securitySchemes": map[string]interface{}{
+			"bearer":  map[string]interface{}{"type": "http", "scheme": "bearer"},
+			"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "pinoyHoopsSession"},
+		},
+	}
+
+	return doc
+}
+
+// addOperation describes op as routed with method and path.
+func (doc *openAPI) addOperation(method, path, tag string, op apiOperation, schemas openAPISchemas) {
+	operation := map[string]interface{}{
+		"summary":   op.Summary,
+		"tags":      []string{tag},
+		"responses": schemas.responses(op),
+	}
+
+	if op.Deprecated {
+		operation["deprecated"] = true
+	}
+
+	if op.LoggedIn || op.Admin {
+		operation["security"] = []map[string][]string{{"bearer": {}}, {"session": {}}}
+	}
+	if op.Admin {
+		operation["description"] = "Only for administrators."
+	}
+
+	var params []interface{}
+	properties := make(map[string]interface{})
+	var required []string
+
+	if op.Request != nil {
+		for _, field := range requestFields(reflect.TypeOf(op.Request)) {
+			schema := schemas.parameterSchema(field)
+
+			if strings.Contains(path, "{"+field.name+"}") {
+				delete(schema, "description")
+				params = append(params, map[string]interface{}{
+					"name": field.name, "in": "path", "required": true, "schema": schema,
+				})
+			} else if method == "GET" || method == "DELETE" {
+				param := map[string]interface{}{"name": field.name, "in": "query", "schema": schema}
+				if field.required {
+					param["required"] = true
+				}
+				params = append(params, param)
+			} else {
+				properties[field.name] = schema
+				if field.required {
+					required = append(required, field.name)
+				}
+			}
+		}
+	}
+
+	if op.Paged {
+		params = append(params,
+			map[string]interface{}{"name": "limit", "in": "query", "schema": map[string]interface{}{
+				"type": "integer", "minimum": 1, "maximum": MaxPageLimit, "default": DefaultPageLimit,
+			}},
+			map[string]interface{}{"name": "cursor", "in": "query", "schema": map[string]interface{}{
+				"type": "string", "description": "next_cursor of the previous page",
+			}},
+		)
+	}
+
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+
+	if len(properties) > 0 || op.Upload != "" {
+		form := object(properties, required...)
+		content := map[string]interface{}{
+			"application/json":                  map[string]interface{}{"schema": form},
+			"application/x-www-form-urlencoded": map[string]interface{}{"schema": form},
+		}
+
+		if op.Upload != "" {
+			multipart := make(map[string]interface{}, len(properties)+1)
+			for name, schema := range properties {
+				multipart[name] = schema
+			}
+			multipart[op.Upload] = map[string]interface{}{"type": "string", "format": "binary"}
+			content["multipart/form-data"] = map[string]interface{}{"schema": object(multipart, required...)}
+		}
+
+		operation["requestBody"] = map[string]interface{}{"content": content}
+	}
+
+	if doc.Paths[path] == nil {
+		doc.Paths[path] = make(map[string]interface{})
+	}
+	doc.Paths[path][strings.ToLower(method)] = operation
+}
+
+// responses describes the response to op and the errors it may return.
+func (schemas openAPISchemas) responses(op apiOperation) map[string]interface{} {
+	var content map[string]interface{}
+
+	switch {
+	case op.Content != "":
+		content = make(map[string]interface{})
+		for _, contentType := range strings.Fields(op.Content) {
+			content[contentType] = map[string]interface{}{}
+		}
+	case op.Paged:
+		content = map[string]interface{}{"application/json": map[string]interface{}{"schema": object(map[string]interface{}{
+			"data":        map[string]interface{}{"type": "array", "items": schemas.schema(reflect.TypeOf(op.Response))},
+			"next_cursor": map[string]interface{}{"type": "string"},
+		}, "data")}}
+	case op.Response != nil:
+		content = map[string]interface{}{"application/json": map[string]interface{}{"schema": object(map[string]interface{}{
+			"data": schemas.schema(reflect.TypeOf(op.Response)),
+		}, "data")}}
+	default:
+		content = map[string]interface{}{"application/json": map[string]interface{}{"schema": object(map[string]interface{}{
+			"data": map[string]interface{}{"type": "null"},
+		}, "data")}}
+	}
+
+	return map[string]interface{}{
+		"200":     map[string]interface{}{"description": "OK", "content": content},
+		"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+}
+
+// requestField is a field of a request struct, named as its parameter.
+type requestField struct {
+	reflect.StructField
+	name     string
+	rules    map[string]string
+	required bool
+}
+
+// requestFields returns the fields of a request struct as bind reads them.
+func requestFields(t reflect.Type) []requestField {
+	var fields []requestField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, requestFields(field.Type)...)
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		rules := parseRules(field.Tag.Get("validate"))
+		_, required := rules["required"]
+		fields = append(fields, requestField{field, name, rules, required})
+	}
+	return fields
+}
+
+// parameterSchema describes the values that the validation rules of the
+// field accept.
+func (schemas openAPISchemas) parameterSchema(field requestField) map[string]interface{} {
+	t := field.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	schema := make(map[string]interface{})
+	for k, v := range schemas.schema(t) {
+		schema[k] = v
+	}
+
+	bounds := [2]string{"minimum", "maximum"}
+	if t.Kind() == reflect.String {
+		bounds = [2]string{"minLength", "maxLength"}
+	}
+	for i, rule := range []string{"min", "max"} {
+		if value, ok := field.rules[rule]; ok {
+			n, _ := strconv.ParseFloat(value, 64)
+			schema[bounds[i]] = n
+		}
+	}
+
+	if oneof, ok := field.rules["oneof"]; ok {
+		schema["enum"] = strings.Fields(oneof)
+	}
+	if _, ok := field.rules["date"]; ok {
+		schema["format"] = "date"
+	}
+
+	if alias := field.Tag.Get("alias"); alias != "" {
+		schema["description"] = "Also accepted as " + strings.Join(strings.Split(alias, ","), " and ") + "."
+	}
+
+	return schema
+}
+
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	rawMessage = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the JSON schema of values of type t, referring to named
+// structs as components.
+func (schemas openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessage:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemas.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemas.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemas.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return schemas.object(t)
+		}
+
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			// Set first, as the struct may refer to itself
+			schemas[name] = nil
+			schemas[name] = schemas.object(t)
+		}
+		return ref(name)
+	}
+
+	return map[string]interface{}{}
+}
+
+// object returns the schema of a struct as it is marshaled to JSON.
+func (schemas openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				addFields(field.Type)
+				continue
+			} else if field.PkgPath != "" {
+				continue
+			}
+
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			} else if name == "" {
+				name = field.Name
+			}
+
+			properties[name] = schemas.schema(field.Type)
+			if !contains(tag[1:], "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	return object(properties, required...)
+}
+
+// schemaName names the component of a struct type, as exported.
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+func object(properties map[string]interface{}, required ...string) map[string]interface{} {
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
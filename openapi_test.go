@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// The document must describe every API route, so that it fails here and not
+// in the hands of client developers.
+func TestOpenAPIDocumentsRoutes(t *testing.T) {
+	if err := checkOpenAPI(newRouter()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenAPICheckFindsDrift(t *testing.T) {
+	router := newRouter()
+	router.HandleFunc("/api/undocumented", func(w http.ResponseWriter, r *http.Request) {})
+	if err := checkOpenAPI(router); err != ErrOpenAPIDrift {
+		t.Errorf("undocumented route: %v, want %v", err, ErrOpenAPIDrift)
+	}
+
+	router = newRouter()
+	router.HandleFunc("/api/v2/hoops/{hoop_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {}).Methods("PUT")
+	if err := checkOpenAPI(router); err != ErrOpenAPIDrift {
+		t.Errorf("undocumented method: %v, want %v", err, ErrOpenAPIDrift)
+	}
+}
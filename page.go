@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Page sizes
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+var (
+	ErrInvalidCursor = newAPIError(http.StatusBadRequest, "invalid_cursor", "Invalid cursor")
+	ErrInvalidLimit  = newAPIError(http.StatusBadRequest, "invalid_limit", "Invalid limit")
+)
+
+// Cursor identifies the last item of the previous page. Lists are ordered by
+// (Score, CreatedAt, ID) so that items inserted after the first page was
+// fetched never shift later pages. Lists without a score leave it at zero.
+type Cursor struct {
+	Score     float64   `json:"s,omitempty"`
+	CreatedAt time.Time `json:"t"`
+	ID        int64     `json:"i"`
+}
+
+// Page requests up to Limit items following Cursor. A nil Cursor requests
+// the first page.
+type Page struct {
+	Cursor *Cursor
+	Limit  int
+}
+
+type listResponse struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func (c Cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// descending reports whether a sorts ahead of b when lists are ordered by
+// (Score, CreatedAt, ID) descending.
+func descending(a, b Cursor) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+// ascending reports whether a sorts ahead of b when lists are ordered by
+// (Score, ID) ascending, as nearby hoops are by distance.
+func ascending(a, b Cursor) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.ID < b.ID
+}
+
+// chronological reports whether a sorts ahead of b when lists are ordered by
+// (CreatedAt, ID) ascending, as replies are.
+func chronological(a, b Cursor) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
+
+// parsePage reads the cursor and limit request parameters.
+func parsePage(r *http.Request) (Page, error) {
+	page := Page{Limit: DefaultPageLimit}
+
+	if limit := r.FormValue("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return page, invalidField("limit", ErrInvalidLimit)
+		}
+		if n > MaxPageLimit {
+			n = MaxPageLimit
+		}
+		page.Limit = n
+	}
+
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		var err error
+		if page.Cursor, err = parseCursor(cursor); err != nil {
+			return page, invalidField("cursor", ErrInvalidCursor)
+		}
+	}
+
+	return page, nil
+}
+
+// keyset returns the score, created_at and id query arguments followed by
+// the row limit. One extra row is requested to detect whether another
+// page follows.
+func (page Page) keyset() []interface{} {
+	if page.Cursor == nil {
+		return []interface{}{nil, nil, nil, page.Limit + 1}
+	}
+	return []interface{}{page.Cursor.Score, page.Cursor.CreatedAt, page.Cursor.ID, page.Limit + 1}
+}
+
+// timeKeyset is like keyset for lists ordered only by (created_at, id).
+func (page Page) timeKeyset() []interface{} {
+	if page.Cursor == nil {
+		return []interface{}{nil, nil, page.Limit + 1}
+	}
+	return []interface{}{page.Cursor.CreatedAt, page.Cursor.ID, page.Limit + 1}
+}
+
+// window returns the bounds of the page within n items that are already
+// sorted by less, and the cursor of the following page if any. key returns
+// the cursor of the i-th item.
+func (page Page) window(n int, key func(i int) Cursor, less func(a, b Cursor) bool) (start, end int, next *Cursor) {
+	if page.Cursor != nil {
+		start = sort.Search(n, func(i int) bool {
+			return less(*page.Cursor, key(i))
+		})
+	}
+
+	end = start + page.Limit
+	if end >= n {
+		return start, n, nil
+	}
+
+	cursor := key(end - 1)
+	return start, end, &cursor
+}
+
+func writeList(w http.ResponseWriter, items interface{}, next *Cursor) {
+	if v := reflect.ValueOf(items); v.Kind() == reflect.Slice && v.IsNil() {
+		items = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+	}
+
+	response := listResponse{Data: items}
+	if next != nil {
+		response.NextCursor = next.String()
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// walk lists every page of limit items, calling between after the first, and
+// returns the IDs of the items in order.
+func (c *testClient) walk(path string, p params, limit int, between func()) []int64 {
+	c.t.Helper()
+
+	var ids []int64
+	cursor := ""
+	for pages := 0; pages == 0 || cursor != ""; pages++ {
+		q := params{"limit": limit}
+		for name, value := range p {
+			q[name] = value
+		}
+		if cursor != "" {
+			q["cursor"] = cursor
+		}
+
+		var items []struct {
+			ID int64 `json:"id"`
+		}
+		cursor = c.list(path, q, &items)
+		if len(items) > limit || (cursor != "" && len(items) < limit) {
+			c.t.Fatalf("GET %s: %d items on a page of %d", path, len(items), limit)
+		}
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+
+		if pages == 0 && between != nil {
+			between()
+		}
+	}
+	return ids
+}
+
+func TestPagination(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+
+	var hoop Hoop
+	for i := 0; i < 5; i++ {
+		hoop = c.createHoop(fmt.Sprintf("Court %d", i))
+	}
+	for i := 0; i < 5; i++ {
+		c.createStory(hoop.ID, fmt.Sprintf("Game %d", i))
+		c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": fmt.Sprintf("Comment %d", i)}, nil)
+	}
+
+	// Pages of any size list the same items, and items added while paging
+	// neither repeat nor push others off a page
+	lists := []struct {
+		path   string
+		params params
+		add    func()
+	}{
+		{"/api/hoops", nil, func() { c.createHoop("Court 5") }},
+		{"/api/hoops/latest", nil, func() { c.createHoop("Court 6") }},
+		{"/api/stories", params{"hoop_id": hoop.ID}, func() { c.createStory(hoop.ID, "Game 5") }},
+		{"/api/hoop/comments", params{"hoop_id": hoop.ID}, func() {
+			c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Comment 5"}, nil)
+		}},
+	}
+	for _, list := range lists {
+		all := c.walk(list.path, list.params, MaxPageLimit, nil)
+		if len(all) < 5 {
+			t.Fatalf("%s: %d items", list.path, len(all))
+		}
+
+		for _, limit := range []int{1, 2, len(all)} {
+			if got := c.walk(list.path, list.params, limit, nil); fmt.Sprint(got) != fmt.Sprint(all) {
+				t.Errorf("%s in pages of %d: %v, want %v", list.path, limit, got, all)
+			}
+		}
+
+		if got := c.walk(list.path, list.params, 2, list.add); fmt.Sprint(got) != fmt.Sprint(all) {
+			t.Errorf("%s with an item added while paging: %v, want %v", list.path, got, all)
+		}
+	}
+
+	for _, p := range []params{{"cursor": "not a cursor"}, {"limit": 0}, {"limit": "all"}} {
+		c.fails("GET", "/api/hoops", p, http.StatusBadRequest)
+	}
+}
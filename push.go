@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The push service returns ErrInvalidDeviceToken for tokens that will never
+// work again, such as those of uninstalled apps. Such devices are deleted.
+var ErrInvalidDeviceToken = errors.New("Invalid device token")
+
+// PushMessage is the content of a push notification.
+type PushMessage struct {
+	Title string
+	Body  string
+
+	// Badge is the number of unread notifications
+	Badge int64
+
+	// Data lets the app open what the notification is about
+	Data map[string]string
+}
+
+// PushSender sends push notifications to devices.
+type PushSender interface {
+	Send(device Device, message PushMessage) error
+}
+
+var pushSender PushSender
+
+// newPushSender returns the sender for the config. The fake sender only
+// logs messages, so nothing needs the real push services unless asked to.
+func newPushSender(cfg Config) (PushSender, error) {
+	switch cfg.Push.Sender {
+	case "live":
+		return newLivePushSender(cfg.Push)
+	default:
+		return &fakePushSender{}, nil
+	}
+}
+
+// livePushSender sends each device's messages through the service of its
+// type.
+type livePushSender struct {
+	senders map[string]PushSender
+}
+
+func newLivePushSender(cfg PushConfig) (*livePushSender, error) {
+	s := &livePushSender{senders: make(map[string]PushSender)}
+
+	if cfg.APNs.KeyFile != "" {
+		apns, err := newAPNsSender(cfg.APNs)
+		if err != nil {
+			return nil, err
+		}
+		s.senders[DEVICE_APNS] = apns
+	}
+
+	if cfg.FCM.CredentialsFile != "" {
+		fcm, err := newFCMSender(cfg.FCM)
+		if err != nil {
+			return nil, err
+		}
+		s.senders[DEVICE_FCM] = fcm
+	}
+
+	return s, nil
+}
+
+func (s *livePushSender) Send(device Device, message PushMessage) error {
+	sender, ok := s.senders[device.Type]
+	if !ok {
+		return fmt.Errorf("no push service configured for %s devices", device.Type)
+	}
+	return sender.Send(device, message)
+}
+
+// fakePushSender logs and keeps the messages instead of sending them, for
+// development and tests.
+type fakePushSender struct {
+	mu   sync.Mutex
+	sent []fakePush
+}
+
+type fakePush struct {
+	Device  Device
+	Message PushMessage
+}
+
+func (s *fakePushSender) Send(device Device, message PushMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, fakePush{Device: device, Message: message})
+	log.Printf("push: %s device %d of user %d: %s", device.Type, device.ID, device.UserID, message.Body)
+	return nil
+}
+
+// Sent returns the messages sent so far.
+func (s *fakePushSender) Sent() []fakePush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]fakePush(nil), s.sent...)
+}
+
+// pushNotification sends a new notification to its user's devices.
+func pushNotification(payload []byte) error {
+	var notification Notification
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		return err
+	}
+
+	return deliverPush(notification)
+}
+
+// deliverPush sends the notification to each of its user's devices, unless
+// their preferences turn it off.
+func deliverPush(notification Notification) error {
+	prefs, err := store.Devices.GetNotificationPreferences(notification.UserID)
+	if err != nil {
+		return err
+	} else if !prefs.allows(notification.Type) {
+		return nil
+	}
+
+	devices, err := store.Devices.GetDevices(notification.UserID)
+	if err != nil || len(devices) == 0 {
+		return err
+	}
+
+	// The notification may be about something deleted since
+	message, err := pushMessage(notification)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		switch err := pushSender.Send(device, message); err {
+		case nil:
+		case ErrInvalidDeviceToken:
+			if err := store.Devices.DeleteDevice(device.Token); err != nil {
+				log.Println("push:", err)
+			}
+		default:
+			log.Printf("push: %s device %d: %v", device.Type, device.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// pushMessage describes the notification to its user.
+func pushMessage(notification Notification) (message PushMessage, err error) {
+	actor, err := store.Users.GetUser(notification.ActorID)
+	if err != nil {
+		return
+	}
+
+	hoop, err := store.Hoops.GetHoop(notification.HoopID)
+	if err != nil {
+		return
+	}
+
+	name := strings.TrimSpace(actor.Firstname + " " + actor.Lastname)
+	if name == "" {
+		name = "Someone"
+	}
+
+	switch notification.Type {
+	case ACTIVITY_POST_STORY:
+		message.Body = fmt.Sprintf("%s posted a story to %s", name, hoop.Name)
+	case ACTIVITY_POST_COMMENT_HOOP:
+		message.Body = fmt.Sprintf("%s commented on %s", name, hoop.Name)
+	case ACTIVITY_POST_COMMENT_STORY:
+		message.Body = fmt.Sprintf("%s commented on your story at %s", name, hoop.Name)
+	case ACTIVITY_POST_LIKE_HOOP:
+		message.Body = fmt.Sprintf("%s liked %s", name, hoop.Name)
+	case ACTIVITY_POST_LIKE_STORY:
+		message.Body = fmt.Sprintf("%s liked your story at %s", name, hoop.Name)
+	}
+
+	message.Title = "Pinoy Hoops"
+	message.Data = map[string]string{
+		"notification_id": strconv.FormatInt(notification.ID, 10),
+		"type":            strconv.FormatInt(notification.Type, 10),
+		"hoop_id":         strconv.FormatInt(notification.HoopID, 10),
+	}
+	if notification.StoryID != 0 {
+		message.Data["story_id"] = strconv.FormatInt(notification.StoryID, 10)
+	}
+
+	message.Badge, err = store.Notifications.CountUnreadNotifications(notification.UserID)
+	return
+}
+
+// signJWT returns a JSON Web Token with the header and claims. sign is given
+// the SHA-256 digest of the signed part.
+func signJWT(header, claims interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	var parts []string
+	for _, part := range []interface{}{header, claims} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+
+	payload := strings.Join(parts, ".")
+	digest := sha256.Sum256([]byte(payload))
+
+	signature, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parsePrivateKey parses a PEM encoded PKCS #8 private key, the format of
+// APNs auth keys and Google service account keys.
+func parsePrivateKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in private key")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// APNs provider tokens must be renewed at least hourly, but not more often
+// than every 20 minutes.
+const apnsTokenTTL = 50 * time.Minute
+
+const (
+	apnsProductionURL = "https://api.push.apple.com"
+	apnsSandboxURL    = "https://api.sandbox.push.apple.com"
+)
+
+// apnsSender sends notifications through the Apple Push Notification
+// service, authenticating with a token signed by an APNs auth key. Go's
+// HTTP client speaks HTTP/2 to it as APNs requires.
+type apnsSender struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+	topic  string
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func newAPNsSender(cfg APNsConfig) (*apnsSender, error) {
+	data, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.KeyFile, err)
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ECDSA key", cfg.KeyFile)
+	}
+
+	url := apnsProductionURL
+	if cfg.Sandbox {
+		url = apnsSandboxURL
+	}
+
+	return &apnsSender{
+		key:    ecKey,
+		keyID:  cfg.KeyID,
+		teamID: cfg.TeamID,
+		topic:  cfg.Topic,
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *apnsSender) Send(device Device, message PushMessage) error {
+	token, err := s.providerToken()
+	if err != nil {
+		return err
+	}
+
+	// Custom data goes beside the aps dictionary
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": message.Title, "body": message.Body},
+			"badge": message.Badge,
+			"sound": "default",
+		},
+	}
+	for key, value := range message.Data {
+		payload[key] = value
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url+"/3/device/"+device.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", s.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var reply struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return ErrInvalidDeviceToken
+	case reply.Reason == "BadDeviceToken" || reply.Reason == "DeviceTokenNotForTopic":
+		return ErrInvalidDeviceToken
+	case reply.Reason != "":
+		return errors.New("apns: " + reply.Reason)
+	default:
+		return fmt.Errorf("apns: %s", resp.Status)
+	}
+}
+
+// providerToken returns the current provider token, signing a new one when
+// it is due.
+func (s *apnsSender) providerToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Sub(s.issuedAt) < apnsTokenTTL {
+		return s.token, nil
+	}
+
+	header := map[string]string{"alg": "ES256", "kid": s.keyID}
+	claims := map[string]interface{}{"iss": s.teamID, "iat": now.Unix()}
+
+	token, err := signJWT(header, claims, func(digest []byte) ([]byte, error) {
+		r, ss, err := ecdsa.Sign(rand.Reader, s.key, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// ES256 signatures are r and s as 32-byte big-endian integers
+		signature := make([]byte, 64)
+		fillBytes(r, signature[:32])
+		fillBytes(ss, signature[32:])
+		return signature, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.token, s.issuedAt = token, now
+	return token, nil
+}
+
+// fillBytes writes n to buf as a zero-padded big-endian integer.
+func fillBytes(n *big.Int, buf []byte) {
+	b := n.Bytes()
+	copy(buf[len(buf)-len(b):], b)
+}
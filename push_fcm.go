@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fcmScope    = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmTokenURL = "https://oauth2.googleapis.com/token"
+	fcmSendURL  = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+)
+
+// fcmSender sends notifications through the Firebase Cloud Messaging HTTP v1
+// API. It signs in as a Google service account with the OAuth 2.0 JWT bearer
+// flow.
+type fcmSender struct {
+	key       *rsa.PrivateKey
+	email     string
+	projectID string
+	tokenURL  string
+	client    *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// fcmCredentials holds the fields used from a service account key file.
+type fcmCredentials struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func newFCMSender(cfg FCMConfig) (*fcmSender, error) {
+	data, err := ioutil.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds fcmCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.CredentialsFile, err)
+	}
+
+	key, err := parsePrivateKey([]byte(creds.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.CredentialsFile, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", cfg.CredentialsFile)
+	}
+
+	tokenURL := creds.TokenURI
+	if tokenURL == "" {
+		tokenURL = fcmTokenURL
+	}
+
+	return &fcmSender{
+		key:       rsaKey,
+		email:     creds.ClientEmail,
+		projectID: creds.ProjectID,
+		tokenURL:  tokenURL,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *fcmSender) Send(device Device, message PushMessage) error {
+	accessToken, err := s.token()
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": device.Token,
+			"notification": map[string]string{
+				"title": message.Title,
+				"body":  message.Body,
+			},
+			"android": map[string]interface{}{
+				"notification": map[string]interface{}{"notification_count": message.Badge},
+			},
+			"data": message.Data,
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf(fcmSendURL, s.projectID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var reply struct {
+		Error struct {
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+
+	for _, detail := range reply.Error.Details {
+		if detail.ErrorCode == "UNREGISTERED" {
+			return ErrInvalidDeviceToken
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrInvalidDeviceToken
+	}
+
+	if reply.Error.Message != "" {
+		return errors.New("fcm: " + reply.Error.Message)
+	}
+	return fmt.Errorf("fcm: %s", resp.Status)
+}
+
+// token returns an OAuth 2.0 access token, fetching a new one shortly before
+// the current one expires.
+func (s *fcmSender) token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.accessToken != "" && now.Before(s.expiresAt.Add(-time.Minute)) {
+		return s.accessToken, nil
+	}
+
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	claims := map[string]interface{}{
+		"iss":   s.email,
+		"scope": fcmScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	assertion, err := signJWT(header, claims, func(digest []byte) ([]byte, error) {
+		return rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+
+	resp, err := s.client.Post(s.tokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", err
+	}
+	if reply.AccessToken == "" {
+		return "", errors.New("fcm: no access token: " + strconv.Quote(reply.Error))
+	}
+
+	s.accessToken = reply.AccessToken
+	s.expiresAt = now.Add(time.Duration(reply.ExpiresIn) * time.Second)
+	return s.accessToken, nil
+}
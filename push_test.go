@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// expiringPushSender rejects the tokens of uninstalled apps.
+type expiringPushSender struct {
+	*fakePushSender
+	expired string
+}
+
+func (s expiringPushSender) Send(device Device, message PushMessage) error {
+	if device.Token == s.expired {
+		return ErrInvalidDeviceToken
+	}
+	return s.fakePushSender.Send(device, message)
+}
+
+func TestPushNotification(t *testing.T) {
+	server := newTestServer(t)
+	sender := pushSender.(*fakePushSender)
+
+	juan := newTestClient(t, server)
+	juan.signup("Juan")
+	juan.fails("POST", "/api/device", params{"type": "pager", "token": "juan-pager"}, http.StatusBadRequest)
+	juan.ok("POST", "/api/device", params{"type": DEVICE_FCM, "token": "juan-phone"}, nil)
+	hoop := juan.createHoop("Tondo Court")
+
+	pedro := newTestClient(t, server)
+	pedro.signup("Pedro")
+	pedro.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+
+	// Nothing is pushed until the job runs
+	if sent := sender.Sent(); len(sent) != 0 {
+		t.Fatalf("pushed %+v before the job ran", sent)
+	}
+	runJobs(t)
+
+	sent := sender.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("pushed %d messages, want 1", len(sent))
+	}
+	push := sent[0]
+	if push.Device.Token != "juan-phone" || push.Device.Type != DEVICE_FCM {
+		t.Errorf("pushed to %+v", push.Device)
+	}
+	if want := "Pedro dela Cruz commented on Tondo Court"; push.Message.Body != want {
+		t.Errorf("body %q, want %q", push.Message.Body, want)
+	}
+	if push.Message.Badge != 1 {
+		t.Errorf("badge %d, want 1", push.Message.Badge)
+	}
+	if push.Message.Data["hoop_id"] != itoa(hoop.ID) {
+		t.Errorf("data %v", push.Message.Data)
+	}
+
+	// Users who turn off likes get none
+	juan.fails("PATCH", "/api/notifications/preferences", params{"likes": "never"}, http.StatusBadRequest)
+	juan.ok("PATCH", "/api/notifications/preferences", params{"likes": false}, nil)
+	var prefs NotificationPreferences
+	juan.ok("GET", "/api/notifications/preferences", nil, &prefs)
+	if prefs.Likes || !prefs.Comments || !prefs.Stories {
+		t.Errorf("preferences %+v", prefs)
+	}
+	pedro.ok("POST", "/api/like/hoop", params{"hoop_id": hoop.ID}, nil)
+	runJobs(t)
+	if sent := sender.Sent(); len(sent) != 1 {
+		t.Errorf("pushed %+v after likes were turned off", sent[1:])
+	}
+
+	// Nor do users who act themselves
+	juan.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Thanks"}, nil)
+	runJobs(t)
+	if sent := sender.Sent(); len(sent) != 1 {
+		t.Errorf("pushed %+v for the user's own comment", sent[1:])
+	}
+
+	// Devices whose tokens no longer work are forgotten
+	juan.ok("POST", "/api/device", params{"type": DEVICE_APNS, "token": "juan-tablet"}, nil)
+	pushSender = expiringPushSender{sender, "juan-phone"}
+	pedro.createStory(hoop.ID, "First game")
+	runJobs(t)
+
+	pushSender = sender
+	pedro.createStory(hoop.ID, "Second game")
+	runJobs(t)
+
+	sent = sender.Sent()
+	if len(sent) != 3 || sent[1].Device.Token != "juan-tablet" || sent[2].Device.Token != "juan-tablet" {
+		t.Errorf("pushed %+v after the phone's token expired", sent[1:])
+	}
+	juan.fails("DELETE", "/api/device", params{"token": "juan-phone"}, http.StatusNotFound)
+	juan.ok("DELETE", "/api/device", params{"token": "juan-tablet"}, nil)
+}
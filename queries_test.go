@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Page sizes that lists are compared at
+const (
+	queriesSmallPage = 1
+	queriesLargePage = 20
+)
+
+// queryCount is the number of statements run by connections of the
+// countingDriver.
+var queryCount int64
+
+// countingDriver is the Postgres driver, counting the statements it runs.
+type countingDriver struct {
+	pq.Driver
+}
+
+func init() {
+	sql.Register("postgres-counting", countingDriver{})
+}
+
+func (d countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn}, nil
+}
+
+type countingConn struct {
+	driver.Conn
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt64(&queryCount, 1)
+	return c.Conn.Prepare(query)
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	atomic.AddInt64(&queryCount, 1)
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	atomic.AddInt64(&queryCount, 1)
+	return execer.ExecContext(ctx, query, args)
+}
+
+// queriesList is a list to count the queries of. It returns the number of
+// items on the page.
+type queriesList struct {
+	name string
+	list func(page Page) (int, error)
+}
+
+// checkListQueries fails the test for each list that takes more queries for
+// a large page than for a small one, which a query for each item would. The
+// lists must hold more than a large page, and the items of each must refer to
+// the same kinds of things, so that a page of one refers to every kind that a
+// large page does.
+func checkListQueries(t *testing.T, lists []queriesList) {
+	count := func(l queriesList, limit int) int64 {
+		before := atomic.LoadInt64(&queryCount)
+		n, err := l.list(Page{Limit: limit})
+		if err != nil {
+			t.Fatalf("%s: %v", l.name, err)
+		} else if n != limit {
+			t.Fatalf("%s: %d items for a page of %d", l.name, n, limit)
+		}
+		return atomic.LoadInt64(&queryCount) - before
+	}
+
+	for _, l := range lists {
+		small, large := count(l, queriesSmallPage), count(l, queriesLargePage)
+		if small != large {
+			t.Errorf("%s takes %d queries for a page of %d, and %d for a page of %d", l.name, small, queriesSmallPage, large, queriesLargePage)
+		}
+	}
+}
+
+// TestListQueries checks that lists load the users, hoops and stories they
+// refer to with a query for each kind, whatever the page size. It needs a
+// Postgres database with PostGIS, named by TEST_DB_NAME, which it migrates
+// and adds rows to, and Redis. The other DB_ and REDIS_ variables say where
+// they are, as for the server.
+func TestListQueries(t *testing.T) {
+	name := os.Getenv("TEST_DB_NAME")
+	if name == "" {
+		t.Skip("TEST_DB_NAME is not set")
+	}
+
+	config = defaultConfig()
+	if err := config.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	config.Database.Name = name
+
+	var err error
+	if db, err = sql.Open("postgres-counting", config.databaseSource()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		db = nil
+	}()
+	if err := migrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newPostgresStore(db)
+	store = newStore(s)
+	seed := newQueriesSeed(t, s)
+
+	lists := []queriesList{
+		{"hoops", func(page Page) (int, error) {
+			hoops, _, err := s.GetHoops(HoopQuery{}, page)
+			return len(hoops), err
+		}},
+		{"popular hoops", func(page Page) (int, error) {
+			hoops, _, err := s.GetHoops(HoopQuery{Order: HOOP_ORDER_POPULAR}, page)
+			return len(hoops), err
+		}},
+		{"user's hoops", func(page Page) (int, error) {
+			hoops, _, err := s.GetHoops(HoopQuery{UserID: seed.owner}, page)
+			return len(hoops), err
+		}},
+		{"followed hoops", func(page Page) (int, error) {
+			hoops, _, err := s.GetHoops(HoopQuery{FollowerID: seed.actors[0]}, page)
+			return len(hoops), err
+		}},
+		{"hoops in a box", func(page Page) (int, error) {
+			box := Box{South: seed.latitude - 0.1, West: seed.longitude - 0.1, North: seed.latitude + 0.1, East: seed.longitude + 0.1}
+			hoops, _, err := s.GetHoops(HoopQuery{Box: &box}, page)
+			return len(hoops), err
+		}},
+		{"nearby hoops", func(page Page) (int, error) {
+			hoops, _, err := s.GetNearbyHoops(seed.latitude, seed.longitude, 10000, page)
+			return len(hoops), err
+		}},
+		{"latest stories", func(page Page) (int, error) {
+			stories, _, err := s.GetStories(seed.hoops[0], STORY_ORDER_LATEST, page)
+			return len(stories), err
+		}},
+		{"most commented stories", func(page Page) (int, error) {
+			stories, _, err := s.GetStories(seed.hoops[0], STORY_ORDER_MOST_COMMENTED, page)
+			return len(stories), err
+		}},
+		{"most liked stories", func(page Page) (int, error) {
+			stories, _, err := s.GetStories(seed.hoops[0], STORY_ORDER_MOST_LIKED, page)
+			return len(stories), err
+		}},
+		{"most viewed stories", func(page Page) (int, error) {
+			stories, _, err := s.GetStories(seed.hoops[0], STORY_ORDER_MOST_VIEWED, page)
+			return len(stories), err
+		}},
+		{"hoop comments", func(page Page) (int, error) {
+			comments, _, err := s.GetHoopComments(seed.hoops[0], page)
+			return len(comments), err
+		}},
+		{"story comments", func(page Page) (int, error) {
+			comments, _, err := s.GetStoryComments(seed.stories[0], page)
+			return len(comments), err
+		}},
+		{"followers", func(page Page) (int, error) {
+			users, _, err := s.GetFollowers(seed.owner, page)
+			return len(users), err
+		}},
+		{"following", func(page Page) (int, error) {
+			users, _, err := s.GetFollowing(seed.owner, page)
+			return len(users), err
+		}},
+	}
+	for _, typ := range searchTypes {
+		typ := typ
+		lists = append(lists, queriesList{"search for " + typ, func(page Page) (int, error) {
+			results, _, err := s.Search(SearchQuery{Text: seed.word, Types: []string{typ}}, page)
+			return len(results), err
+		}})
+	}
+	checkListQueries(t, lists)
+
+	// Activities and notifications about hoops refer to other things than
+	// those about stories, so the latest are made all of one, then the other
+	feeds := []queriesList{
+		{"activities", func(page Page) (int, error) {
+			activities, _, err := s.GetActivities(seed.owner, page)
+			return len(activities), err
+		}},
+		{"following activities", func(page Page) (int, error) {
+			activities, _, err := s.GetFollowingActivities(seed.owner, page)
+			return len(activities), err
+		}},
+		{"notifications", func(page Page) (int, error) {
+			notifications, _, err := s.GetNotifications(seed.owner, page)
+			return len(notifications), err
+		}},
+	}
+
+	for i, actor := range seed.actors {
+		if err := s.ToggleLike(actor, seed.hoops[i], "hoop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkListQueries(t, feeds)
+
+	for i, actor := range seed.actors {
+		if err := s.ToggleLike(actor, seed.stories[i], "story"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkListQueries(t, feeds)
+}
+
+// queriesSeed is what TestListQueries adds to the database: an owner of
+// hoops and stories, and actors who follow and are followed by the owner,
+// and who comment on the first hoop and story. The first actor follows every
+// hoop. There are more of each than a large page, and all of them have a word
+// of their own that search finds.
+type queriesSeed struct {
+	word                string
+	latitude, longitude float64
+	owner               int64
+	actors              []int64
+	hoops               []int64
+	stories             []int64
+}
+
+func newQueriesSeed(t *testing.T, s *pgStore) *queriesSeed {
+	run := time.Now().UnixNano()
+	seed := &queriesSeed{
+		word: fmt.Sprintf("queries%d", run),
+
+		// Somewhere other runs are unlikely to have left hoops
+		latitude:  -(float64(run%8000) / 100),
+		longitude: -(float64(run%17000) / 100),
+	}
+
+	insertUser := func(i int) int64 {
+		id, err := s.InsertUser(&User{
+			Firstname: seed.word,
+			Lastname:  fmt.Sprint(i),
+			Email:     fmt.Sprintf("%s.%d@example.com", seed.word, i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	seed.owner = insertUser(0)
+	for i := 1; i <= queriesLargePage+1; i++ {
+		actor := insertUser(i)
+		seed.actors = append(seed.actors, actor)
+
+		if err := s.Follow(actor, seed.owner); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Follow(seed.owner, actor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range seed.actors {
+		name := fmt.Sprintf("%s hoop %d", seed.word, i)
+		latitude, longitude := seed.latitude+float64(i)/1000, seed.longitude+float64(i)/1000
+		if err := s.InsertHoop(seed.owner, name, "", Images{}, latitude, longitude); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hoops, _, err := s.GetHoops(HoopQuery{UserID: seed.owner}, Page{Limit: len(seed.actors)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hoop := range hoops {
+		seed.hoops = append(seed.hoops, hoop.ID)
+	}
+
+	// The first hoop has a story for each actor, and the others one each,
+	// so that every hoop has a featured story
+	for i, hoopID := range seed.hoops {
+		for j := 0; j == 0 || (i == 0 && j < len(seed.actors)); j++ {
+			name := fmt.Sprintf("%s story %d", seed.word, j)
+			if err := s.InsertStory(hoopID, seed.owner, name, "", Images{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stories, _, err := s.GetStories(seed.hoops[0], STORY_ORDER_LATEST, Page{Limit: len(seed.actors)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, story := range stories {
+		seed.stories = append(seed.stories, story.ID)
+	}
+
+	for i, actor := range seed.actors {
+		if err := s.FollowHoop(seed.actors[0], seed.hoops[i]); err != nil {
+			t.Fatal(err)
+		}
+
+		text := fmt.Sprintf("%s comment %d", seed.word, i)
+		if err := s.InsertHoopComment(actor, seed.hoops[0], nil, text); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertStoryComment(actor, seed.stories[0], nil, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return seed
+}
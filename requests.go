@@ -0,0 +1,277 @@
+package main
+
+import "strings"
+
+// Request parameters of the API handlers, bound with bind. Parameters are
+// named in snake_case; the names that older clients send are kept as
+// aliases.
+
+type loginRequest struct {
+	Email    string `json:"email" validate:"required,min=6" error:"email_too_short"`
+	Password string `json:"password" validate:"required,min=8" error:"password_too_short"`
+}
+
+type signupRequest struct {
+	loginRequest
+	Gender    string `json:"gender" validate:"required,oneof=male female" error:"invalid_gender"`
+	Birthdate string `json:"birthdate" validate:"required,date" error:"invalid_date_format"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+}
+
+// tokenRequest is validated further as loginRequest for the password grant.
+type tokenRequest struct {
+	GrantType    string `json:"grant_type" validate:"required,oneof=password refresh_token"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type userRequest struct {
+	UserID int64 `json:"user_id" alias:"userID" validate:"required"`
+}
+
+// optionalUserRequest names a user, or the logged in user if UserID is nil.
+type optionalUserRequest struct {
+	UserID *int64 `json:"user_id" alias:"userID"`
+}
+
+type userUpdateRequest struct {
+	Name      *string `json:"name"`
+	Gender    *string `json:"gender"`
+	Birthdate *string `json:"birthdate" validate:"date" error:"invalid_date_format"`
+}
+
+// validate accepts the gender in any case, as profile edits always have.
+func (req *userUpdateRequest) validate(errs fieldErrors) {
+	if req.Gender != nil {
+		*req.Gender = strings.ToLower(*req.Gender)
+		if *req.Gender != "male" && *req.Gender != "female" {
+			errs.add("gender", ErrInvalidGender)
+		}
+	}
+}
+
+type lastActivityCheckTimeRequest struct {
+	Time int64 `json:"time" validate:"required"`
+}
+
+type hoopRequest struct {
+	HoopID int64 `json:"hoop_id" alias:"hoopID,hoop-id" validate:"required"`
+}
+
+// hoopsRequest lists the hoops whose names contain Name, if it is set.
+type hoopsRequest struct {
+	Name string `json:"name"`
+}
+
+type hoopCreateRequest struct {
+	Name        string  `json:"name" validate:"required,min=1"`
+	Description string  `json:"description"`
+	ImageURL    string  `json:"image_url"`
+	Latitude    float64 `json:"latitude" validate:"required,min=-90,max=90"`
+	Longitude   float64 `json:"longitude" validate:"required,min=-180,max=180"`
+}
+
+// validate rejects the location that clients send when they have none.
+func (req *hoopCreateRequest) validate(errs fieldErrors) {
+	if req.Latitude == 0 && req.Longitude == 0 {
+		errs.add("latitude", ErrInvalidValue)
+		errs.add("longitude", ErrInvalidValue)
+	}
+}
+
+type hoopUpdateRequest struct {
+	hoopRequest
+	Name        *string  `json:"name" validate:"min=1"`
+	Description *string  `json:"description"`
+	Latitude    *float64 `json:"latitude" validate:"min=-90,max=90"`
+	Longitude   *float64 `json:"longitude" validate:"min=-180,max=180"`
+}
+
+type hoopMergeRequest struct {
+	hoopRequest
+	Into int64 `json:"into" validate:"required"`
+}
+
+func (req *hoopMergeRequest) validate(errs fieldErrors) {
+	if req.Into == req.HoopID {
+		errs.add("into", ErrInvalidValue)
+	}
+}
+
+type nearbyHoopsRequest struct {
+	Latitude  float64 `json:"latitude" validate:"required,min=-90,max=90"`
+	Longitude float64 `json:"longitude" validate:"required,min=-180,max=180"`
+	Radius    float64 `json:"radius" validate:"min=0"`
+}
+
+// boxRequest is the area of the map in view.
+type boxRequest struct {
+	South float64 `json:"south" validate:"required,min=-90,max=90"`
+	West  float64 `json:"west" validate:"required,min=-180,max=180"`
+	North float64 `json:"north" validate:"required,min=-90,max=90"`
+	East  float64 `json:"east" validate:"required,min=-180,max=180"`
+}
+
+func (req *boxRequest) validate(errs fieldErrors) {
+	if req.North < req.South {
+		errs.add("north", ErrInvalidValue)
+	}
+	if req.East < req.West {
+		errs.add("east", ErrInvalidValue)
+	}
+}
+
+func (req *boxRequest) box() Box {
+	return Box{South: req.South, West: req.West, North: req.North, East: req.East}
+}
+
+type hoopClustersRequest struct {
+	boxRequest
+	Zoom int `json:"zoom" validate:"required,min=0,max=22"`
+}
+
+// tileRequest names a map tile. The format defaults to geojson.
+type tileRequest struct {
+	Z      int    `json:"z" validate:"required,min=0,max=22"` // TileMaxZoom
+	X      int    `json:"x" validate:"required,min=0"`
+	Y      int    `json:"y" validate:"required,min=0"`
+	Format string `json:"format" validate:"oneof=geojson mvt"`
+}
+
+// validate checks that the tile is on the map at its zoom level.
+func (req *tileRequest) validate(errs fieldErrors) {
+	n := 1 << uint(req.Z)
+	if req.X >= n {
+		errs.add("x", ErrInvalidValue)
+	}
+	if req.Y >= n {
+		errs.add("y", ErrInvalidValue)
+	}
+}
+
+type searchRequest struct {
+	Query string `json:"q" alias:"query" validate:"required,max=200"`
+	Types string `json:"types"`
+}
+
+// validate checks the types, which are listed separated by commas.
+func (req *searchRequest) validate(errs fieldErrors) {
+	for _, typ := range req.types() {
+		if !contains(searchTypes, typ) {
+			errs.add("types", ErrInvalidValue)
+			return
+		}
+	}
+}
+
+// types returns the types of results wanted, which are all of them unless
+// listed.
+func (req *searchRequest) types() []string {
+	if req.Types == "" {
+		return searchTypes
+	}
+	return strings.Split(req.Types, ",")
+}
+
+type storyRequest struct {
+	StoryID int64 `json:"story_id" alias:"storyID,story-id" validate:"required"`
+}
+
+type storiesRequest struct {
+	hoopRequest
+	Order string `json:"order" validate:"oneof=latest most_commented most_liked most_viewed"`
+}
+
+// storyOrders maps the order parameter to the orderings of GetStories.
+var storyOrders = map[string]int{
+	"":               STORY_ORDER_DEFAULT,
+	"latest":         STORY_ORDER_LATEST,
+	"most_commented": STORY_ORDER_MOST_COMMENTED,
+	"most_liked":     STORY_ORDER_MOST_LIKED,
+	"most_viewed":    STORY_ORDER_MOST_VIEWED,
+}
+
+type storyCreateRequest struct {
+	hoopRequest
+	Name        string `json:"name" validate:"required,min=1"`
+	Description string `json:"description"`
+	ImageURL    string `json:"image_url"`
+}
+
+type storyUpdateRequest struct {
+	storyRequest
+	Name        *string `json:"name" validate:"min=1"`
+	Description *string `json:"description"`
+	ImageURL    string  `json:"image_url"`
+}
+
+type activitiesRequest struct {
+	Scope string `json:"scope" validate:"oneof=everyone following"`
+}
+
+type streamRequest struct {
+	Scope    string  `json:"scope" validate:"oneof=everyone following none"`
+	HoopIDs  []int64 `json:"hoop_id" alias:"hoopID"`
+	StoryIDs []int64 `json:"story_id" alias:"storyID"`
+}
+
+// commentText is the text of a new or edited comment.
+type commentText struct {
+	Text string `json:"text" validate:"required,min=2"`
+}
+
+type hoopCommentRequest struct {
+	hoopRequest
+	commentText
+	ParentID *int64 `json:"parent_id" alias:"parent-id"`
+}
+
+type storyCommentRequest struct {
+	storyRequest
+	commentText
+	ParentID *int64 `json:"parent_id" alias:"parent-id"`
+}
+
+type commentRequest struct {
+	CommentID int64 `json:"comment_id" alias:"commentID" validate:"required"`
+}
+
+type commentUpdateRequest struct {
+	commentRequest
+	commentText
+}
+
+type notificationRequest struct {
+	NotificationID int64 `json:"notification_id" alias:"notificationID" validate:"required"`
+}
+
+type notificationPreferencesRequest struct {
+	Likes    *bool `json:"likes"`
+	Comments *bool `json:"comments"`
+	Stories  *bool `json:"stories"`
+}
+
+type deviceRequest struct {
+	deviceTokenRequest
+	Type string `json:"type" validate:"required"`
+}
+
+func (req *deviceRequest) validate(errs fieldErrors) {
+	if !contains(deviceTypes, req.Type) {
+		errs.add("type", ErrInvalidValue)
+	}
+}
+
+type deviceTokenRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type jobRequest struct {
+	JobID int64 `json:"job_id" alias:"jobID" validate:"required"`
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// searchResult is a SearchResult as clients get it.
+type searchResult struct {
+	Type      string          `json:"type"`
+	ID        int64           `json:"id"`
+	Highlight string          `json:"highlight"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (c *testClient) search(p params) []searchResult {
+	c.t.Helper()
+
+	var results []searchResult
+	c.list("/api/search", p, &results)
+	return results
+}
+
+func TestSearch(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Parañaque Court")
+	c.createStory(hoop.ID, "Sunday run")
+	c.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Best court in Paranaque <3"}, nil)
+	c.createHoop("Tondo Court")
+
+	// Accents and case do not matter, and every kind of result is found
+	results := c.search(params{"q": "PARANAQUE"})
+	types := make(map[string]searchResult)
+	for _, result := range results {
+		types[result.Type] = result
+	}
+	if len(results) != 3 || types[SEARCH_HOOP].ID != hoop.ID || types[SEARCH_COMMENT].ID == 0 {
+		t.Fatalf("results %+v", results)
+	}
+	if story := types[SEARCH_STORY]; !strings.Contains(string(story.Data), `"name":"Parañaque Court"`) {
+		t.Errorf("story result %s", story.Data)
+	}
+	if highlight := types[SEARCH_COMMENT].Highlight; highlight != "Best court in <mark>Paranaque</mark> &lt;3" {
+		t.Errorf("comment highlight %q", highlight)
+	}
+
+	// Results can be limited to some types
+	results = c.search(params{"q": "court", "types": "hoop"})
+	if len(results) != 2 {
+		t.Errorf("hoop results %+v", results)
+	}
+	for _, result := range results {
+		if result.Type != SEARCH_HOOP {
+			t.Errorf("%s result in a search for hoops", result.Type)
+		}
+	}
+
+	// Users are found by name, without their email
+	results = c.search(params{"q": "juan", "types": "user"})
+	if len(results) != 1 || strings.Contains(string(results[0].Data), "juan@example.com") {
+		t.Errorf("user results %+v", results)
+	}
+
+	if err := c.fails("GET", "/api/search", params{"q": "court", "types": "hoop,team"}, http.StatusBadRequest); err.Fields["types"].Code == "" {
+		t.Errorf("search for an unknown type: %+v", err)
+	}
+	c.fails("GET", "/api/search", nil, http.StatusBadRequest)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"time"
+)
+
+// Hoop orderings understood by HoopStore.GetHoops
+const (
+	HOOP_ORDER_DEFAULT = iota
+	HOOP_ORDER_POPULAR
+	HOOP_ORDER_LATEST
+)
+
+// Story orderings understood by StoryStore.GetStories
+const (
+	STORY_ORDER_DEFAULT = iota
+	STORY_ORDER_LATEST
+	STORY_ORDER_MOST_COMMENTED
+	STORY_ORDER_MOST_LIKED
+	STORY_ORDER_MOST_VIEWED
+)
+
+// HoopQuery selects which hoops GetHoops returns. At most one of Name,
+// UserID, FollowerID, ExcludeUserID and Box is expected to be set.
+type HoopQuery struct {
+	Name          string
+	UserID        int64
+	FollowerID    int64
+	ExcludeUserID int64
+	Box           *Box
+	Order         int
+}
+
+// Box is an area of the map, in degrees. Boxes that cross the antimeridian
+// are not supported.
+type Box struct {
+	South, West, North, East float64
+}
+
+func (box Box) contains(latitude, longitude float64) bool {
+	return latitude >= box.South && latitude <= box.North && longitude >= box.West && longitude <= box.East
+}
+
+// SearchQuery is the text to search for and the types of results wanted.
+type SearchQuery struct {
+	Text  string
+	Types []string
+}
+
+// SearchStore finds hoops, stories, comments and users by their text, best
+// matches first.
+type SearchStore interface {
+	Search(q SearchQuery, page Page) ([]SearchResult, *Cursor, error)
+}
+
+type UserStore interface {
+	UserExists(user *User, fetch bool) (bool, *User)
+	GetUser(userID int64) (User, error)
+	InsertUser(user *User) (int64, error)
+	UpdateUser(user *User) error
+	UpdateUserImage(userID int64, images Images) error
+	UpdateUserSocialID(userID int64, provider, socialID string) error
+	LastActivityCheckTime(userID int64) (time.Time, error)
+	UpdateLastActivityCheckTime(userID, secs int64) error
+}
+
+type HoopStore interface {
+	HoopExists(hoop *Hoop, fetch bool) (bool, *Hoop)
+	GetHoop(hoopID int64) (Hoop, error)
+	GetHoops(query HoopQuery, page Page) ([]Hoop, *Cursor, error)
+	GetNearbyHoops(latitude, longitude, radius float64, page Page) ([]Hoop, *Cursor, error)
+	GetHoopClusters(box Box, zoom int) ([]HoopCluster, error)
+	InsertHoop(userID int64, name, description string, images Images, latitude, longitude float64) error
+	UpdateHoop(hoop *Hoop) error
+	DeleteHoop(hoopID int64) error
+	MergeHoops(duplicateID, canonicalID int64) error
+	HoopRedirect(hoopID int64) (int64, error)
+	ViewHoop(hoopID int64) error
+
+	// HoopsVersion returns a number that changes whenever a hoop is added,
+	// updated, merged or deleted
+	HoopsVersion() (int64, error)
+}
+
+type StoryStore interface {
+	StoryExists(story *Story, fetch bool) (bool, *Story)
+	GetStory(storyID int64) (Story, error)
+	GetFeaturedStory(hoopID int64) (Story, error)
+	GetStories(hoopID int64, order int, page Page) ([]Story, *Cursor, error)
+	InsertStory(hoopID, userID int64, name, description string, images Images) error
+	UpdateStory(story *Story) error
+	DeleteStory(storyID int64) error
+	ViewStory(storyID int64) error
+}
+
+type CommentStore interface {
+	GetHoopComments(hoopID int64, page Page) ([]Comment, *Cursor, error)
+	GetStoryComments(storyID int64, page Page) ([]Comment, *Cursor, error)
+	GetComment(commentID int64) (Comment, error)
+	GetReplies(rootID int64, page Page) ([]Comment, *Cursor, error)
+	InsertHoopComment(userID, hoopID int64, parent *Comment, text string) error
+	InsertStoryComment(userID, storyID int64, parent *Comment, text string) error
+	UpdateComment(commentID int64, text string) error
+	DeleteComment(commentID int64) error
+}
+
+type LikeStore interface {
+	ToggleLike(userID, otherID int64, typ string) error
+	CountHoopLikes(hoopID int64) (int64, error)
+	CountStoryLikes(storyID int64) (int64, error)
+}
+
+type ActivityStore interface {
+	GetActivities(userID int64, page Page) ([]Activity, *Cursor, error)
+	GetFollowingActivities(userID int64, page Page) ([]Activity, *Cursor, error)
+}
+
+// FollowStore keeps the users and hoops that each user follows.
+type FollowStore interface {
+	Follow(followerID, userID int64) error
+	Unfollow(followerID, userID int64) error
+	IsFollowing(followerID, userID int64) (bool, error)
+	CountFollows(userID int64) (followers, following int64, err error)
+	GetFollowers(userID int64, page Page) ([]User, *Cursor, error)
+	GetFollowing(userID int64, page Page) ([]User, *Cursor, error)
+	IsFollowingHoop(userID, hoopID int64) (bool, error)
+	CountFollowedHoops(userID int64) (int64, error)
+	FollowHoop(userID, hoopID int64) error
+	UnfollowHoop(userID, hoopID int64) error
+}
+
+// NotificationStore keeps the notification inbox of each user.
+// Notifications are written by the stores that record the activity they are
+// about.
+type NotificationStore interface {
+	GetNotifications(userID int64, page Page) ([]Notification, *Cursor, error)
+	CountUnreadNotifications(userID int64) (int64, error)
+	ReadNotification(userID, notificationID int64) error
+	ReadAllNotifications(userID int64) error
+	DeleteReadNotifications(before time.Time) (int64, error)
+}
+
+// DeviceStore keeps the devices that notifications are pushed to and which
+// notifications each user wants pushed.
+type DeviceStore interface {
+	RegisterDevice(userID int64, typ, token string) error
+	UnregisterDevice(userID int64, token string) error
+	DeleteDevice(token string) error
+	GetDevices(userID int64) ([]Device, error)
+	GetNotificationPreferences(userID int64) (NotificationPreferences, error)
+	UpdateNotificationPreferences(userID int64, prefs NotificationPreferences) error
+}
+
+// JobStore queues the side effects of writes. Jobs are queued by the stores
+// that make the writes.
+type JobStore interface {
+	ClaimJob(lease time.Duration) (Job, error)
+	CompleteJob(jobID int64) error
+	RetryJob(jobID int64, delay time.Duration, lastError string) error
+	FailJob(jobID int64, lastError string) error
+	GetDeadJobs(page Page) ([]DeadJob, *Cursor, error)
+	RequeueDeadJob(jobID int64) error
+}
+
+type TokenStore interface {
+	InsertRefreshToken(userID int64, tokenHash string, expiresAt time.Time) error
+	GetRefreshToken(tokenHash string) (RefreshToken, error)
+	RevokeRefreshToken(tokenHash string) (bool, error)
+}
+
+// UploadStore tracks uploaded blobs and how many users and stories refer to
+// them. References are counted by the stores that save Images.
+type UploadStore interface {
+	ClaimUpload(key, url string) error
+	OrphanedUploads(before time.Time, limit int) ([]string, error)
+	DeleteOrphanedUpload(key string, before time.Time, deleteBlob func() error) (bool, error)
+}
+
+// Store groups the stores used by the API handlers.
+type Store struct {
+	Search        SearchStore
+	Users         UserStore
+	Hoops         HoopStore
+	Stories       StoryStore
+	Comments      CommentStore
+	Likes         LikeStore
+	Activities    ActivityStore
+	Follows       FollowStore
+	Notifications NotificationStore
+	Devices       DeviceStore
+	Jobs          JobStore
+	Tokens        TokenStore
+	Uploads       UploadStore
+}
+
+// storeBackend is implemented by backends that provide every store.
+type storeBackend interface {
+	SearchStore
+	UserStore
+	HoopStore
+	StoryStore
+	CommentStore
+	LikeStore
+	ActivityStore
+	FollowStore
+	NotificationStore
+	DeviceStore
+	JobStore
+	TokenStore
+	UploadStore
+}
+
+func newStore(backend storeBackend) Store {
+	return Store{
+		Search:        backend,
+		Users:         backend,
+		Hoops:         backend,
+		Stories:       backend,
+		Comments:      backend,
+		Likes:         backend,
+		Activities:    backend,
+		Follows:       backend,
+		Notifications: backend,
+		Devices:       backend,
+		Jobs:          backend,
+		Tokens:        backend,
+		Uploads:       backend,
+	}
+}
@@ -0,0 +1,1766 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memoryStore implements every store in memory. It is meant for handler
+// tests and local development; nothing survives a restart.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	lastID         int64
+	hoopsVersion   int64
+	users          map[int64]User
+	hoops          map[int64]Hoop
+	stories        map[int64]Story
+	featured       map[int64]int64
+	hoopRedirects  map[int64]int64
+	comments       []Comment
+	activities     []Activity
+	views          map[string]int64
+	lastCheckTimes map[int64]int64
+	refreshTokens  map[string]RefreshToken
+	uploads        map[string]memoryUpload
+
+	// follows maps followers to the users they follow, and hoopFollows
+	// users to the hoops they follow, with the time they followed
+	follows     map[int64]map[int64]time.Time
+	hoopFollows map[int64]map[int64]time.Time
+
+	notifications []Notification
+
+	// devices maps device tokens to devices
+	devices     map[string]Device
+	preferences map[int64]NotificationPreferences
+
+	jobs     []memoryJob
+	deadJobs []DeadJob
+}
+
+type memoryJob struct {
+	Job
+	runAt       time.Time
+	lockedUntil time.Time
+	lastError   string
+}
+
+type memoryUpload struct {
+	url       string
+	refCount  int
+	updatedAt time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:          make(map[int64]User),
+		hoops:          make(map[int64]Hoop),
+		stories:        make(map[int64]Story),
+		featured:       make(map[int64]int64),
+		hoopRedirects:  make(map[int64]int64),
+		views:          make(map[string]int64),
+		lastCheckTimes: make(map[int64]int64),
+		refreshTokens:  make(map[string]RefreshToken),
+		uploads:        make(map[string]memoryUpload),
+		devices:        make(map[string]Device),
+		preferences:    make(map[int64]NotificationPreferences),
+		follows:        make(map[int64]map[int64]time.Time),
+		hoopFollows:    make(map[int64]map[int64]time.Time),
+	}
+}
+
+func (m *memoryStore) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+// User
+
+func (m *memoryStore) UserExists(user *User, fetch bool) (bool, *User) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found, ok := m.findUser(user)
+	if !ok {
+		return false, nil
+	}
+
+	if fetch {
+		*user = m.user(found.ID)
+		return true, user
+	}
+	return true, nil
+}
+
+func (m *memoryStore) findUser(user *User) (User, bool) {
+	if u, ok := m.users[user.ID]; ok {
+		return u, true
+	}
+
+	for _, u := range m.users {
+		if (user.Email != "" && u.Email == user.Email) ||
+			(user.FacebookID != "" && u.FacebookID == user.FacebookID) ||
+			(user.InstagramID != "" && u.InstagramID == user.InstagramID) ||
+			(user.TwitterID != "" && u.TwitterID == user.TwitterID) {
+			return u, true
+		}
+	}
+
+	return User{}, false
+}
+
+func (m *memoryStore) user(userID int64) User {
+	user := m.users[userID]
+	if secs, ok := m.lastCheckTimes[userID]; ok {
+		user.LatestActivityCheckTime = time.Unix(secs, 0)
+	}
+	return user
+}
+
+func (m *memoryStore) GetUser(userID int64) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return m.user(userID), nil
+}
+
+func (m *memoryStore) InsertUser(user *User) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == user.Email && u.FacebookID == user.FacebookID && u.InstagramID == user.InstagramID && u.TwitterID == user.TwitterID {
+			return 0, nil
+		}
+	}
+
+	newUser := *user
+	newUser.ID = m.nextID()
+	newUser.CreatedAt = time.Now()
+	newUser.UpdatedAt = newUser.CreatedAt
+	m.users[newUser.ID] = newUser
+	m.referenceUploads(newUser.Images, 1)
+
+	return newUser.ID, nil
+}
+
+func (m *memoryStore) UpdateUser(user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[user.ID]; ok {
+		u.Firstname = user.Firstname
+		u.Lastname = user.Lastname
+		u.Gender = user.Gender
+		u.Birthdate = user.Birthdate
+		u.UpdatedAt = time.Now()
+		m.users[u.ID] = u
+	}
+	return nil
+}
+
+func (m *memoryStore) UpdateUserImage(userID int64, images Images) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		m.referenceUploads(images, 1)
+		m.referenceUploads(u.Images, -1)
+		u.Images = images
+		m.users[u.ID] = u
+	}
+	return nil
+}
+
+func (m *memoryStore) UpdateUserSocialID(userID int64, provider, socialID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+
+	switch provider {
+	case "facebook":
+		u.FacebookID = socialID
+	case "instagram":
+		u.InstagramID = socialID
+	case "twitter":
+		u.TwitterID = socialID
+	default:
+		return ErrUnknownProvider
+	}
+
+	m.users[u.ID] = u
+	return nil
+}
+
+func (m *memoryStore) LastActivityCheckTime(userID int64) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if secs, ok := m.lastCheckTimes[userID]; ok {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, nil
+}
+
+func (m *memoryStore) UpdateLastActivityCheckTime(userID, secs int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastCheckTimes[userID] = secs
+	return nil
+}
+
+// Hoop
+
+func (m *memoryStore) HoopExists(hoop *Hoop, fetch bool) (bool, *Hoop) {
+	if !fetch {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		_, ok := m.hoops[hoop.ID]
+		return ok, nil
+	}
+
+	newHoop, err := m.GetHoop(hoop.ID)
+	if err != nil {
+		return false, nil
+	}
+
+	*hoop = newHoop
+	return true, hoop
+}
+
+func (m *memoryStore) GetHoop(hoopID int64) (Hoop, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.hoops[hoopID]; !ok {
+		return Hoop{}, sql.ErrNoRows
+	}
+	return m.hoop(hoopID), nil
+}
+
+func (m *memoryStore) hoop(hoopID int64) Hoop {
+	hoop := m.hoops[hoopID]
+	hoop.User = m.user(hoop.UserID)
+	hoop.Data = map[string]interface{}{}
+	if story, ok := m.stories[m.featured[hoopID]]; ok {
+		story.User = m.user(story.UserID)
+		hoop.Data["featured_story"] = story
+	}
+	return hoop
+}
+
+func (m *memoryStore) GetHoops(q HoopQuery, page Page) ([]Hoop, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[int64]int)
+	if q.Order == HOOP_ORDER_POPULAR {
+		for _, story := range m.stories {
+			counts[story.HoopID]++
+		}
+	}
+
+	var keys []Cursor
+	for _, hoop := range m.hoops {
+		switch {
+		case q.Name != "" && !strings.Contains(string(searchFold(hoop.Name)), string(searchFold(q.Name))):
+			continue
+		case q.UserID != 0 && hoop.UserID != q.UserID:
+			continue
+		case q.FollowerID != 0 && !m.followsHoop(q.FollowerID, hoop.ID):
+			continue
+		case q.ExcludeUserID != 0 && hoop.UserID == q.ExcludeUserID:
+			continue
+		case q.Box != nil && !q.Box.contains(hoop.Latitude, hoop.Longitude):
+			continue
+		}
+		keys = append(keys, Cursor{Score: float64(counts[hoop.ID]), CreatedAt: hoop.CreatedAt, ID: hoop.ID})
+	}
+
+	sortCursors(keys, descending)
+	start, end, next := page.window(len(keys), func(i int) Cursor { return keys[i] }, descending)
+
+	var hoops []Hoop
+	for _, key := range keys[start:end] {
+		hoops = append(hoops, m.hoop(key.ID))
+	}
+
+	return hoops, next, nil
+}
+
+func (m *memoryStore) GetNearbyHoops(latitude, longitude, radius float64, page Page) ([]Hoop, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []Cursor
+	for _, hoop := range m.hoops {
+		if distance := greatCircleDistance(latitude, longitude, hoop.Latitude, hoop.Longitude); distance < radius {
+			keys = append(keys, Cursor{Score: distance, ID: hoop.ID})
+		}
+	}
+
+	sortCursors(keys, ascending)
+	start, end, next := page.window(len(keys), func(i int) Cursor { return keys[i] }, ascending)
+
+	var hoops []Hoop
+	for _, key := range keys[start:end] {
+		hoop := m.hoop(key.ID)
+		distance := key.Score
+		hoop.Distance = &distance
+		hoops = append(hoops, hoop)
+	}
+
+	return hoops, next, nil
+}
+
+func (m *memoryStore) GetHoopClusters(box Box, zoom int) ([]HoopCluster, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type cell struct{ x, y float64 }
+	size := hoopClusterCellSize(zoom)
+
+	// The clusters hold the sums of the locations, and the first hoop of
+	// each, until all hoops are counted
+	cells := make(map[cell]*HoopCluster)
+	for _, hoop := range m.hoops {
+		if !box.contains(hoop.Latitude, hoop.Longitude) {
+			continue
+		}
+
+		c := cell{math.Floor(hoop.Longitude / size), math.Floor(hoop.Latitude / size)}
+		cluster, ok := cells[c]
+		if !ok {
+			cluster = &HoopCluster{HoopID: hoop.ID}
+			cells[c] = cluster
+		} else if hoop.ID < cluster.HoopID {
+			cluster.HoopID = hoop.ID
+		}
+
+		cluster.Count++
+		cluster.Latitude += hoop.Latitude
+		cluster.Longitude += hoop.Longitude
+	}
+
+	var clusters []HoopCluster
+	for _, cluster := range cells {
+		cluster.Latitude /= float64(cluster.Count)
+		cluster.Longitude /= float64(cluster.Count)
+		clusters = append(clusters, *cluster)
+	}
+
+	// In order of the first hoop of each, as in Postgres
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].HoopID < clusters[j].HoopID
+	})
+
+	for i := range clusters {
+		if clusters[i].Count > 1 {
+			clusters[i].HoopID = 0
+		}
+	}
+
+	return clusters, nil
+}
+
+func (m *memoryStore) Search(q SearchQuery, page Page) ([]SearchResult, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	words := strings.Fields(string(searchFold(q.Text)))
+	wanted := make(map[string]bool)
+	for _, typ := range q.Types {
+		wanted[typ] = true
+	}
+
+	// IDs are unique across types here, so results are keyed by ID alone
+	found := make(map[int64]SearchResult)
+	var keys []Cursor
+	match := func(typ string, id int64, createdAt time.Time, data interface{}, title, body string) {
+		if !wanted[typ] || len(words) == 0 {
+			return
+		}
+		if rank, highlight := searchMatch(words, title, body); rank > 0 {
+			found[id] = SearchResult{Type: typ, ID: id, Rank: rank, Highlight: searchHighlight(highlight), Data: data}
+			keys = append(keys, Cursor{Score: rank, CreatedAt: createdAt, ID: id})
+		}
+	}
+
+	for _, hoop := range m.hoops {
+		match(SEARCH_HOOP, hoop.ID, hoop.CreatedAt, m.hoop(hoop.ID), hoop.Name, hoop.Description)
+	}
+	for _, story := range m.stories {
+		match(SEARCH_STORY, story.ID, story.CreatedAt, story, story.Name, story.Description)
+	}
+	for _, comment := range m.comments {
+		if !comment.Deleted {
+			comment.User = m.user(comment.UserID)
+			match(SEARCH_COMMENT, comment.ID, comment.CreatedAt, comment, "", comment.Text)
+		}
+	}
+	for _, user := range m.users {
+		user = m.user(user.ID)
+		user.Email = ""
+		match(SEARCH_USER, user.ID, user.CreatedAt, user, strings.TrimSpace(user.Firstname+" "+user.Lastname), "")
+	}
+
+	sortCursors(keys, descending)
+	start, end, next := page.window(len(keys), func(i int) Cursor { return keys[i] }, descending)
+
+	var results []SearchResult
+	for _, key := range keys[start:end] {
+		results = append(results, found[key.ID])
+	}
+
+	return results, next, nil
+}
+
+func (m *memoryStore) InsertHoop(userID int64, name, description string, images Images, latitude, longitude float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	hoop := Hoop{
+		ID:          m.nextID(),
+		UserID:      userID,
+		Name:        name,
+		Description: description,
+		Latitude:    latitude,
+		Longitude:   longitude,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	m.hoops[hoop.ID] = hoop
+
+	story := Story{
+		ID:          m.nextID(),
+		HoopID:      hoop.ID,
+		UserID:      userID,
+		Name:        name,
+		Description: description,
+		Images:      images,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	m.stories[story.ID] = story
+	m.referenceUploads(images, 1)
+	m.featured[hoop.ID] = story.ID
+
+	m.addActivity(Activity{ID: m.nextID(), UserID: userID, Type: ACTIVITY_POST_HOOP, HoopID: hoop.ID, CreatedAt: now})
+	m.hoopsVersion++
+
+	return nil
+}
+
+func (m *memoryStore) UpdateHoop(hoop *Hoop) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.hoops[hoop.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	existing.Name = hoop.Name
+	existing.Description = hoop.Description
+	existing.Latitude = hoop.Latitude
+	existing.Longitude = hoop.Longitude
+	existing.UpdatedAt = time.Now()
+	m.hoops[hoop.ID] = existing
+	m.hoopsVersion++
+
+	return nil
+}
+
+func (m *memoryStore) DeleteHoop(hoopID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.hoops[hoopID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	storyIDs := make(map[int64]bool)
+	for _, story := range m.stories {
+		if story.HoopID == hoopID {
+			storyIDs[story.ID] = true
+			m.referenceUploads(story.Images, -1)
+			delete(m.stories, story.ID)
+			delete(m.views, fmt.Sprintf("story:%d", story.ID))
+		}
+	}
+
+	comments := m.comments[:0]
+	for _, comment := range m.comments {
+		if comment.HoopID != hoopID && !storyIDs[comment.StoryID] {
+			comments = append(comments, comment)
+		}
+	}
+	m.comments = comments
+
+	activities := m.activities[:0]
+	for _, activity := range m.activities {
+		if activity.HoopID != hoopID && !storyIDs[activity.StoryID] {
+			activities = append(activities, activity)
+		}
+	}
+	m.activities = activities
+
+	for from, to := range m.hoopRedirects {
+		if to == hoopID {
+			delete(m.hoopRedirects, from)
+		}
+	}
+
+	for _, hoops := range m.hoopFollows {
+		delete(hoops, hoopID)
+	}
+
+	m.removeNotifications(func(n Notification) bool { return n.HoopID == hoopID || storyIDs[n.StoryID] })
+
+	delete(m.hoops, hoopID)
+	delete(m.featured, hoopID)
+	delete(m.views, fmt.Sprintf("hoop:%d", hoopID))
+	m.hoopsVersion++
+
+	return nil
+}
+
+func (m *memoryStore) MergeHoops(duplicateID, canonicalID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok1 := m.hoops[duplicateID]
+	_, ok2 := m.hoops[canonicalID]
+	if !ok1 || !ok2 {
+		return sql.ErrNoRows
+	}
+
+	for id, story := range m.stories {
+		if story.HoopID == duplicateID {
+			story.HoopID = canonicalID
+			m.stories[id] = story
+		}
+	}
+
+	for i := range m.comments {
+		if m.comments[i].HoopID == duplicateID {
+			m.comments[i].HoopID = canonicalID
+		}
+	}
+
+	liked := make(map[int64]bool)
+	for _, activity := range m.activities {
+		if activity.HoopID == canonicalID && activity.Type == ACTIVITY_POST_LIKE_HOOP {
+			liked[activity.UserID] = true
+		}
+	}
+
+	activities := m.activities[:0]
+	for _, activity := range m.activities {
+		if activity.HoopID == duplicateID {
+			if activity.Type == ACTIVITY_POST_LIKE_HOOP && liked[activity.UserID] {
+				continue
+			}
+			activity.HoopID = canonicalID
+		}
+		activities = append(activities, activity)
+	}
+	m.activities = activities
+
+	for from, to := range m.hoopRedirects {
+		if to == duplicateID {
+			m.hoopRedirects[from] = canonicalID
+		}
+	}
+	m.hoopRedirects[duplicateID] = canonicalID
+
+	for _, hoops := range m.hoopFollows {
+		if followedAt, ok := hoops[duplicateID]; ok {
+			if _, ok := hoops[canonicalID]; !ok {
+				hoops[canonicalID] = followedAt
+			}
+			delete(hoops, duplicateID)
+		}
+	}
+
+	for i := range m.notifications {
+		if m.notifications[i].HoopID == duplicateID {
+			m.notifications[i].HoopID = canonicalID
+		}
+	}
+
+	if _, ok := m.stories[m.featured[canonicalID]]; !ok {
+		if storyID, ok := m.featured[duplicateID]; ok {
+			m.featured[canonicalID] = storyID
+		}
+	}
+
+	m.views[fmt.Sprintf("hoop:%d", canonicalID)] += m.views[fmt.Sprintf("hoop:%d", duplicateID)]
+	delete(m.views, fmt.Sprintf("hoop:%d", duplicateID))
+	delete(m.featured, duplicateID)
+	delete(m.hoops, duplicateID)
+	m.hoopsVersion++
+
+	return nil
+}
+
+func (m *memoryStore) HoopsVersion() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.hoopsVersion, nil
+}
+
+func (m *memoryStore) HoopRedirect(hoopID int64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	targetID, ok := m.hoopRedirects[hoopID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return targetID, nil
+}
+
+func (m *memoryStore) ViewHoop(hoopID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.views[fmt.Sprintf("hoop:%d", hoopID)]++
+	return nil
+}
+
+// Story
+
+func (m *memoryStore) StoryExists(story *Story, fetch bool) (bool, *Story) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found, ok := m.stories[story.ID]
+	if !ok {
+		return false, nil
+	}
+
+	if fetch {
+		*story = found
+		return true, story
+	}
+	return true, nil
+}
+
+func (m *memoryStore) GetStory(storyID int64) (Story, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	story, ok := m.stories[storyID]
+	if !ok {
+		return Story{}, sql.ErrNoRows
+	}
+
+	story.Hoop = m.hoop(story.HoopID)
+	story.User = m.user(story.UserID)
+	return story, nil
+}
+
+func (m *memoryStore) GetFeaturedStory(hoopID int64) (Story, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	story, ok := m.stories[m.featured[hoopID]]
+	if !ok {
+		return Story{}, sql.ErrNoRows
+	}
+
+	story.User = m.user(story.UserID)
+	return story, nil
+}
+
+func (m *memoryStore) GetStories(hoopID int64, order int, page Page) ([]Story, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var counts map[int64]int
+	switch order {
+	case STORY_ORDER_MOST_COMMENTED:
+		counts = m.countStoryActivities(ACTIVITY_POST_COMMENT_STORY)
+	case STORY_ORDER_MOST_LIKED:
+		counts = m.countStoryActivities(ACTIVITY_POST_LIKE_STORY)
+	}
+
+	var stories []Story
+	for _, story := range m.stories {
+		if story.HoopID == hoopID {
+			story.viewCount = m.views[fmt.Sprintf("story:%d", story.ID)]
+			stories = append(stories, story)
+		}
+	}
+
+	key := func(i int) Cursor {
+		if order == STORY_ORDER_MOST_VIEWED {
+			return stories[i].viewCursor()
+		}
+		return Cursor{Score: float64(counts[stories[i].ID]), CreatedAt: stories[i].CreatedAt, ID: stories[i].ID}
+	}
+
+	sort.SliceStable(stories, func(i, j int) bool {
+		return descending(key(i), key(j))
+	})
+	start, end, next := page.window(len(stories), key, descending)
+
+	return stories[start:end], next, nil
+}
+
+func (m *memoryStore) countStoryActivities(typ int64) map[int64]int {
+	counts := make(map[int64]int)
+	for _, activity := range m.activities {
+		if activity.Type == typ {
+			counts[activity.StoryID]++
+		}
+	}
+	return counts
+}
+
+func (m *memoryStore) InsertStory(hoopID, userID int64, name, description string, images Images) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	story := Story{
+		ID:          m.nextID(),
+		HoopID:      hoopID,
+		UserID:      userID,
+		Name:        name,
+		Description: description,
+		Images:      images,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	m.stories[story.ID] = story
+	m.referenceUploads(images, 1)
+
+	m.addActivity(Activity{ID: m.nextID(), UserID: userID, Type: ACTIVITY_POST_STORY, StoryID: story.ID, CreatedAt: now})
+	m.notifyHoop(userID, ACTIVITY_POST_STORY, hoopID, story.ID)
+
+	return nil
+}
+
+func (m *memoryStore) UpdateStory(story *Story) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.stories[story.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	m.referenceUploads(story.Images, 1)
+	m.referenceUploads(existing.Images, -1)
+
+	existing.Name = story.Name
+	existing.Description = story.Description
+	existing.Images = story.Images
+	existing.UpdatedAt = time.Now()
+	m.stories[story.ID] = existing
+
+	return nil
+}
+
+func (m *memoryStore) DeleteStory(storyID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	story, ok := m.stories[storyID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	comments := m.comments[:0]
+	for _, comment := range m.comments {
+		if comment.StoryID != storyID {
+			comments = append(comments, comment)
+		}
+	}
+	m.comments = comments
+
+	activities := m.activities[:0]
+	for _, activity := range m.activities {
+		if activity.StoryID != storyID {
+			activities = append(activities, activity)
+		}
+	}
+	m.activities = activities
+
+	m.removeNotifications(func(n Notification) bool { return n.StoryID == storyID })
+
+	delete(m.stories, storyID)
+	delete(m.views, fmt.Sprintf("story:%d", storyID))
+	m.referenceUploads(story.Images, -1)
+
+	if m.featured[story.HoopID] == storyID {
+		delete(m.featured, story.HoopID)
+
+		var latest *Story
+		for _, other := range m.stories {
+			if other.HoopID != story.HoopID {
+				continue
+			}
+			if latest == nil || descending(Cursor{CreatedAt: other.CreatedAt, ID: other.ID}, Cursor{CreatedAt: latest.CreatedAt, ID: latest.ID}) {
+				other := other
+				latest = &other
+			}
+		}
+		if latest != nil {
+			m.featured[story.HoopID] = latest.ID
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryStore) ViewStory(storyID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.views[fmt.Sprintf("story:%d", storyID)]++
+	return nil
+}
+
+// Comment
+
+func (m *memoryStore) GetHoopComments(hoopID int64, page Page) ([]Comment, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	comments, next := m.getComments(func(comment Comment) bool { return comment.HoopID == hoopID }, page)
+	eachComment(comments, func(comment *Comment) error {
+		if !comment.Deleted {
+			comment.Data = map[string]interface{}{"user": m.user(comment.UserID)}
+		}
+		return nil
+	})
+	return comments, next, nil
+}
+
+func (m *memoryStore) GetStoryComments(storyID int64, page Page) ([]Comment, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	comments, next := m.getComments(func(comment Comment) bool { return comment.StoryID == storyID }, page)
+	eachComment(comments, func(comment *Comment) error {
+		if !comment.Deleted {
+			comment.User = m.user(comment.UserID)
+		}
+		return nil
+	})
+	return comments, next, nil
+}
+
+// getComments returns a page of the matching top-level comments with their
+// replies.
+func (m *memoryStore) getComments(match func(Comment) bool, page Page) ([]Comment, *Cursor) {
+	var comments []Comment
+	for i := len(m.comments) - 1; i >= 0; i-- {
+		if m.comments[i].ParentID == 0 && match(m.comments[i]) {
+			comments = append(comments, m.comments[i])
+		}
+	}
+
+	start, end, next := page.window(len(comments), func(i int) Cursor {
+		return Cursor{CreatedAt: comments[i].CreatedAt, ID: comments[i].ID}
+	}, descending)
+	comments = comments[start:end]
+
+	roots := map[int64]bool{}
+	for _, comment := range comments {
+		roots[comment.ID] = true
+	}
+
+	var replies []Comment
+	for _, comment := range m.comments {
+		if roots[comment.RootID] {
+			replies = append(replies, comment)
+		}
+	}
+	threadComments(comments, replies)
+
+	eachComment(comments, func(comment *Comment) error {
+		comment.redact()
+		return nil
+	})
+
+	return comments, next
+}
+
+func (m *memoryStore) GetComment(commentID int64) (Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.commentIndex(commentID)
+	if i < 0 {
+		return Comment{}, sql.ErrNoRows
+	}
+
+	comment := m.comments[i]
+	comment.redact()
+	return comment, nil
+}
+
+func (m *memoryStore) GetReplies(rootID int64, page Page) ([]Comment, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var replies []Comment
+	for _, comment := range m.comments {
+		if comment.RootID == rootID {
+			replies = append(replies, comment)
+		}
+	}
+
+	start, end, next := page.window(len(replies), func(i int) Cursor {
+		return Cursor{CreatedAt: replies[i].CreatedAt, ID: replies[i].ID}
+	}, chronological)
+	replies = replies[start:end]
+
+	for i := range replies {
+		replies[i].redact()
+		if replies[i].Deleted {
+			continue
+		}
+		if replies[i].HoopID != 0 {
+			replies[i].Data = map[string]interface{}{"user": m.user(replies[i].UserID)}
+		} else {
+			replies[i].User = m.user(replies[i].UserID)
+		}
+	}
+	return replies, next, nil
+}
+
+func (m *memoryStore) InsertHoopComment(userID, hoopID int64, parent *Comment, text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	comment := newReply(Comment{ID: m.nextID(), UserID: userID, HoopID: hoopID, Text: text, CreatedAt: now, UpdatedAt: now}, parent)
+	m.comments = append(m.comments, comment)
+	m.enqueueJob(JOB_STREAM_COMMENT, comment)
+	m.addActivity(Activity{ID: m.nextID(), UserID: userID, Type: ACTIVITY_POST_COMMENT_HOOP, HoopID: hoopID, CreatedAt: now})
+	m.notifyHoop(userID, ACTIVITY_POST_COMMENT_HOOP, hoopID, 0)
+	return nil
+}
+
+func (m *memoryStore) InsertStoryComment(userID, storyID int64, parent *Comment, text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	comment := newReply(Comment{ID: m.nextID(), UserID: userID, StoryID: storyID, Text: text, CreatedAt: now, UpdatedAt: now}, parent)
+	m.comments = append(m.comments, comment)
+	m.enqueueJob(JOB_STREAM_COMMENT, comment)
+	m.addActivity(Activity{ID: m.nextID(), UserID: userID, Type: ACTIVITY_POST_COMMENT_STORY, StoryID: storyID, CreatedAt: now})
+	m.notifyStoryOwner(userID, ACTIVITY_POST_COMMENT_STORY, storyID)
+	return nil
+}
+
+// addActivity records a new activity and streams it. It assumes the lock is
+// held.
+func (m *memoryStore) addActivity(activity Activity) {
+	m.activities = append(m.activities, activity)
+	m.enqueueJob(JOB_STREAM_ACTIVITY, activity)
+}
+
+func newReply(comment Comment, parent *Comment) Comment {
+	parentID, rootID, depth := parent.reply()
+	comment.ParentID, comment.RootID, comment.Depth = parentID.Int64, rootID.Int64, depth
+	return comment
+}
+
+func (m *memoryStore) UpdateComment(commentID int64, text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.commentIndex(commentID)
+	if i < 0 || m.comments[i].Deleted {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	m.comments[i].Text = text
+	m.comments[i].EditedAt = &now
+	m.comments[i].UpdatedAt = now
+	return nil
+}
+
+func (m *memoryStore) DeleteComment(commentID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.commentIndex(commentID)
+	if i < 0 || m.comments[i].Deleted {
+		return sql.ErrNoRows
+	}
+
+	m.comments[i].Text = ""
+	m.comments[i].Deleted = true
+	m.comments[i].UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *memoryStore) commentIndex(commentID int64) int {
+	for i := range m.comments {
+		if m.comments[i].ID == commentID {
+			return i
+		}
+	}
+	return -1
+}
+
+// Like
+
+func (m *memoryStore) ToggleLike(userID, otherID int64, typ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	activity := Activity{ID: m.nextID(), UserID: userID, CreatedAt: time.Now()}
+	switch typ {
+	case "hoop":
+		activity.Type = ACTIVITY_POST_LIKE_HOOP
+		activity.HoopID = otherID
+	case "story":
+		activity.Type = ACTIVITY_POST_LIKE_STORY
+		activity.StoryID = otherID
+	}
+
+	for i, a := range m.activities {
+		if a.UserID == activity.UserID && a.Type == activity.Type && a.HoopID == activity.HoopID && a.StoryID == activity.StoryID {
+			m.activities = append(m.activities[:i], m.activities[i+1:]...)
+			m.removeNotifications(func(n Notification) bool {
+				if activity.StoryID != 0 {
+					return n.ActorID == userID && n.Type == activity.Type && n.StoryID == activity.StoryID
+				}
+				return n.ActorID == userID && n.Type == activity.Type && n.HoopID == activity.HoopID && n.StoryID == 0
+			})
+			return nil
+		}
+	}
+
+	m.addActivity(activity)
+	switch typ {
+	case "hoop":
+		m.notifyHoop(userID, activity.Type, otherID, 0)
+	case "story":
+		m.notifyStoryOwner(userID, activity.Type, otherID)
+	}
+	return nil
+}
+
+func (m *memoryStore) CountHoopLikes(hoopID int64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var count int64
+	for _, activity := range m.activities {
+		if activity.Type == ACTIVITY_POST_LIKE_HOOP && activity.HoopID == hoopID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryStore) CountStoryLikes(storyID int64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(m.countStoryActivities(ACTIVITY_POST_LIKE_STORY)[storyID]), nil
+}
+
+// Activity
+
+func (m *memoryStore) GetActivities(userID int64, page Page) ([]Activity, *Cursor, error) {
+	return m.getActivities(userID, page, func(Activity) bool { return true })
+}
+
+func (m *memoryStore) GetFollowingActivities(userID int64, page Page) ([]Activity, *Cursor, error) {
+	return m.getActivities(userID, page, func(activity Activity) bool {
+		if _, ok := m.follows[userID][activity.UserID]; ok {
+			return true
+		}
+
+		hoopID := activity.HoopID
+		switch activity.Type {
+		case ACTIVITY_POST_STORY, ACTIVITY_POST_COMMENT_STORY, ACTIVITY_POST_LIKE_STORY:
+			hoopID = m.stories[activity.StoryID].HoopID
+		}
+		_, ok := m.hoopFollows[userID][hoopID]
+		return ok
+	})
+}
+
+// getActivities returns a page of the activities of other users that match.
+// match is called with the read lock held.
+func (m *memoryStore) getActivities(userID int64, page Page, match func(Activity) bool) ([]Activity, *Cursor, error) {
+	m.mu.RLock()
+	var activities []Activity
+	for i := len(m.activities) - 1; i >= 0; i-- {
+		if activity := m.activities[i]; activity.UserID != userID && match(activity) {
+			activities = append(activities, activity)
+		}
+	}
+	m.mu.RUnlock()
+
+	start, end, next := page.window(len(activities), func(i int) Cursor {
+		return Cursor{CreatedAt: activities[i].CreatedAt, ID: activities[i].ID}
+	}, descending)
+	activities = activities[start:end]
+
+	for i := range activities {
+		activities[i].fetchData(m, m, m)
+	}
+	return activities, next, nil
+}
+
+// Follow
+
+func (m *memoryStore) Follow(followerID, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	follow(m.follows, followerID, userID)
+	return nil
+}
+
+func (m *memoryStore) Unfollow(followerID, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.follows[followerID], userID)
+	return nil
+}
+
+func (m *memoryStore) IsFollowing(followerID, userID int64) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.follows[followerID][userID]
+	return ok, nil
+}
+
+func (m *memoryStore) CountFollows(userID int64) (followers, following int64, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, users := range m.follows {
+		if _, ok := users[userID]; ok {
+			followers++
+		}
+	}
+	return followers, int64(len(m.follows[userID])), nil
+}
+
+func (m *memoryStore) GetFollowers(userID int64, page Page) ([]User, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	followers := make(map[int64]time.Time)
+	for followerID, users := range m.follows {
+		if followedAt, ok := users[userID]; ok {
+			followers[followerID] = followedAt
+		}
+	}
+	users, next := m.getFollows(followers, page)
+	return users, next, nil
+}
+
+func (m *memoryStore) GetFollowing(userID int64, page Page) ([]User, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users, next := m.getFollows(m.follows[userID], page)
+	return users, next, nil
+}
+
+// getFollows returns a page of the users, latest followed first.
+func (m *memoryStore) getFollows(followedAt map[int64]time.Time, page Page) ([]User, *Cursor) {
+	var cursors []Cursor
+	for id, createdAt := range followedAt {
+		cursors = append(cursors, Cursor{CreatedAt: createdAt, ID: id})
+	}
+	sortCursors(cursors, descending)
+
+	start, end, next := page.window(len(cursors), func(i int) Cursor { return cursors[i] }, descending)
+
+	var users []User
+	for _, cursor := range cursors[start:end] {
+		users = append(users, m.user(cursor.ID))
+	}
+	return users, next
+}
+
+func (m *memoryStore) IsFollowingHoop(userID, hoopID int64) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.followsHoop(userID, hoopID), nil
+}
+
+func (m *memoryStore) CountFollowedHoops(userID int64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(len(m.hoopFollows[userID])), nil
+}
+
+func (m *memoryStore) FollowHoop(userID, hoopID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	follow(m.hoopFollows, userID, hoopID)
+	return nil
+}
+
+func (m *memoryStore) UnfollowHoop(userID, hoopID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.hoopFollows[userID], hoopID)
+	return nil
+}
+
+func (m *memoryStore) followsHoop(userID, hoopID int64) bool {
+	_, ok := m.hoopFollows[userID][hoopID]
+	return ok
+}
+
+// follow records that id follows otherID, keeping the time of an existing
+// follow.
+func follow(follows map[int64]map[int64]time.Time, id, otherID int64) {
+	if follows[id] == nil {
+		follows[id] = make(map[int64]time.Time)
+	}
+	if _, ok := follows[id][otherID]; !ok {
+		follows[id][otherID] = time.Now()
+	}
+}
+
+// Notification
+
+func (m *memoryStore) GetNotifications(userID int64, page Page) ([]Notification, *Cursor, error) {
+	m.mu.RLock()
+	var notifications []Notification
+	for i := len(m.notifications) - 1; i >= 0; i-- {
+		if m.notifications[i].UserID == userID {
+			notifications = append(notifications, m.notifications[i])
+		}
+	}
+	m.mu.RUnlock()
+
+	start, end, next := page.window(len(notifications), func(i int) Cursor {
+		return Cursor{CreatedAt: notifications[i].CreatedAt, ID: notifications[i].ID}
+	}, descending)
+	notifications = notifications[start:end]
+
+	for i := range notifications {
+		notifications[i].fetchData(m, m, m)
+	}
+	return notifications, next, nil
+}
+
+func (m *memoryStore) CountUnreadNotifications(userID int64) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var count int64
+	for _, notification := range m.notifications {
+		if notification.UserID == userID && notification.ReadAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryStore) ReadNotification(userID, notificationID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.notifications {
+		if n := &m.notifications[i]; n.ID == notificationID && n.UserID == userID {
+			if n.ReadAt == nil {
+				now := time.Now()
+				n.ReadAt = &now
+			}
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryStore) ReadAllNotifications(userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i := range m.notifications {
+		if n := &m.notifications[i]; n.UserID == userID && n.ReadAt == nil {
+			n.ReadAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteReadNotifications(before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := len(m.notifications)
+	m.removeNotifications(func(n Notification) bool { return n.ReadAt != nil && n.ReadAt.Before(before) })
+	return int64(count - len(m.notifications)), nil
+}
+
+// notifyHoop notifies the owner and followers of the hoop other than the
+// actor. It assumes the lock is held.
+func (m *memoryStore) notifyHoop(actorID int64, typ int64, hoopID, storyID int64) {
+	recipients := map[int64]bool{m.hoops[hoopID].UserID: true}
+	for userID, hoops := range m.hoopFollows {
+		if _, ok := hoops[hoopID]; ok {
+			recipients[userID] = true
+		}
+	}
+
+	for userID := range recipients {
+		m.notify(userID, actorID, typ, hoopID, storyID)
+	}
+}
+
+// notifyStoryOwner notifies the owner of the story unless they are the
+// actor. It assumes the lock is held.
+func (m *memoryStore) notifyStoryOwner(actorID int64, typ int64, storyID int64) {
+	if story, ok := m.stories[storyID]; ok {
+		m.notify(story.UserID, actorID, typ, story.HoopID, storyID)
+	}
+}
+
+func (m *memoryStore) notify(userID, actorID int64, typ int64, hoopID, storyID int64) {
+	if userID == 0 || userID == actorID {
+		return
+	}
+
+	notification := Notification{
+		ID:        m.nextID(),
+		UserID:    userID,
+		ActorID:   actorID,
+		Type:      typ,
+		HoopID:    hoopID,
+		StoryID:   storyID,
+		CreatedAt: time.Now(),
+	}
+	m.notifications = append(m.notifications, notification)
+	m.enqueueJob(JOB_PUSH_NOTIFICATION, notification)
+}
+
+// removeNotifications removes the matching notifications. It assumes the
+// lock is held.
+func (m *memoryStore) removeNotifications(match func(Notification) bool) {
+	notifications := m.notifications[:0]
+	for _, notification := range m.notifications {
+		if !match(notification) {
+			notifications = append(notifications, notification)
+		}
+	}
+	m.notifications = notifications
+}
+
+// Device
+
+func (m *memoryStore) RegisterDevice(userID int64, typ, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	device, ok := m.devices[token]
+	if !ok {
+		device = Device{ID: m.nextID(), Token: token, CreatedAt: now}
+	}
+	device.UserID, device.Type, device.UpdatedAt = userID, typ, now
+	m.devices[token] = device
+	return nil
+}
+
+func (m *memoryStore) UnregisterDevice(userID int64, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if device, ok := m.devices[token]; !ok || device.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(m.devices, token)
+	return nil
+}
+
+func (m *memoryStore) DeleteDevice(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.devices, token)
+	return nil
+}
+
+func (m *memoryStore) GetDevices(userID int64) ([]Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var devices []Device
+	for _, device := range m.devices {
+		if device.UserID == userID {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+func (m *memoryStore) GetNotificationPreferences(userID int64) (NotificationPreferences, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if prefs, ok := m.preferences[userID]; ok {
+		return prefs, nil
+	}
+	return defaultNotificationPreferences(), nil
+}
+
+func (m *memoryStore) UpdateNotificationPreferences(userID int64, prefs NotificationPreferences) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.preferences[userID] = prefs
+	return nil
+}
+
+// Job
+
+// enqueueJob queues a job. It assumes the lock is held.
+func (m *memoryStore) enqueueJob(typ string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("jobs:", err)
+		return
+	}
+
+	now := time.Now()
+	m.jobs = append(m.jobs, memoryJob{Job: Job{ID: m.nextID(), Type: typ, Payload: data, CreatedAt: now}, runAt: now})
+	wakeJobWorkers()
+}
+
+func (m *memoryStore) ClaimJob(lease time.Duration) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	next := -1
+	for i, job := range m.jobs {
+		if job.runAt.After(now) || job.lockedUntil.After(now) {
+			continue
+		}
+		if next < 0 || job.runAt.Before(m.jobs[next].runAt) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return Job{}, sql.ErrNoRows
+	}
+
+	m.jobs[next].Attempts++
+	m.jobs[next].lockedUntil = now.Add(lease)
+	return m.jobs[next].Job, nil
+}
+
+func (m *memoryStore) CompleteJob(jobID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.jobIndex(jobID); i >= 0 {
+		m.jobs = append(m.jobs[:i], m.jobs[i+1:]...)
+	}
+	return nil
+}
+
+func (m *memoryStore) RetryJob(jobID int64, delay time.Duration, lastError string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.jobIndex(jobID); i >= 0 {
+		m.jobs[i].runAt = time.Now().Add(delay)
+		m.jobs[i].lockedUntil = time.Time{}
+		m.jobs[i].lastError = lastError
+	}
+	return nil
+}
+
+func (m *memoryStore) FailJob(jobID int64, lastError string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.jobIndex(jobID); i >= 0 {
+		m.deadJobs = append(m.deadJobs, DeadJob{Job: m.jobs[i].Job, LastError: lastError, FailedAt: time.Now()})
+		m.jobs = append(m.jobs[:i], m.jobs[i+1:]...)
+	}
+	return nil
+}
+
+func (m *memoryStore) GetDeadJobs(page Page) ([]DeadJob, *Cursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var jobs []DeadJob
+	for i := len(m.deadJobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, m.deadJobs[i])
+	}
+
+	start, end, next := page.window(len(jobs), func(i int) Cursor {
+		return Cursor{CreatedAt: jobs[i].FailedAt, ID: jobs[i].ID}
+	}, descending)
+	return jobs[start:end], next, nil
+}
+
+func (m *memoryStore) RequeueDeadJob(jobID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, dead := range m.deadJobs {
+		if dead.ID == jobID {
+			m.deadJobs = append(m.deadJobs[:i], m.deadJobs[i+1:]...)
+			job := dead.Job
+			job.ID, job.Attempts = m.nextID(), 0
+			m.jobs = append(m.jobs, memoryJob{Job: job, runAt: time.Now()})
+			wakeJobWorkers()
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryStore) jobIndex(jobID int64) int {
+	for i := range m.jobs {
+		if m.jobs[i].ID == jobID {
+			return i
+		}
+	}
+	return -1
+}
+
+// Token
+
+func (m *memoryStore) InsertRefreshToken(userID int64, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refreshTokens[tokenHash] = RefreshToken{UserID: userID, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (m *memoryStore) GetRefreshToken(tokenHash string) (RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, ok := m.refreshTokens[tokenHash]
+	if !ok {
+		return RefreshToken{}, sql.ErrNoRows
+	}
+	return token, nil
+}
+
+func (m *memoryStore) RevokeRefreshToken(tokenHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.refreshTokens[tokenHash]
+	if !ok || !token.RevokedAt.IsZero() {
+		return false, nil
+	}
+
+	token.RevokedAt = time.Now()
+	m.refreshTokens[tokenHash] = token
+	return true, nil
+}
+
+// Upload
+
+func (m *memoryStore) ClaimUpload(key, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.uploads[key]
+	if !ok {
+		upload.url = url
+	}
+	upload.updatedAt = time.Now()
+	m.uploads[key] = upload
+
+	return nil
+}
+
+func (m *memoryStore) OrphanedUploads(before time.Time, limit int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []string
+	for key, upload := range m.uploads {
+		if upload.refCount == 0 && upload.updatedAt.Before(before) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return m.uploads[keys[i]].updatedAt.Before(m.uploads[keys[j]].updatedAt)
+	})
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (m *memoryStore) DeleteOrphanedUpload(key string, before time.Time, deleteBlob func() error) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.uploads[key]
+	if !ok || upload.refCount > 0 || !upload.updatedAt.Before(before) {
+		return false, nil
+	}
+
+	if err := deleteBlob(); err != nil {
+		return false, err
+	}
+
+	delete(m.uploads, key)
+	return true, nil
+}
+
+// referenceUploads adds delta to the reference counts of the uploads the
+// images point to. The caller must hold m.mu.
+func (m *memoryStore) referenceUploads(images Images, delta int) {
+	urls := images.urls()
+
+	for key, upload := range m.uploads {
+		if contains(urls, upload.url) && upload.refCount+delta >= 0 {
+			upload.refCount += delta
+			upload.updatedAt = time.Now()
+			m.uploads[key] = upload
+		}
+	}
+}
+
+func sortCursors(keys []Cursor, less func(a, b Cursor) bool) {
+	sort.Slice(keys, func(i, j int) bool {
+		return less(keys[i], keys[j])
+	})
+}
+
+// unaccentedRunes maps the accented letters of Filipino and Spanish names to
+// their letters without accents.
+var unaccentedRunes = map[rune]rune{
+	'á': 'a', 'à': 'a', 'â': 'a', 'ä': 'a', 'ã': 'a',
+	'é': 'e', 'è': 'e', 'ê': 'e', 'ë': 'e',
+	'í': 'i', 'ì': 'i', 'î': 'i', 'ï': 'i',
+	'ó': 'o', 'ò': 'o', 'ô': 'o', 'ö': 'o', 'õ': 'o',
+	'ú': 'u', 'ù': 'u', 'û': 'u', 'ü': 'u',
+	'ñ': 'n', 'ç': 'c',
+}
+
+// searchFold returns s in lower case without accents, as the unaccented
+// function of Postgres does, with a rune for each rune of s.
+func searchFold(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		r = unicode.ToLower(r)
+		if base, ok := unaccentedRunes[r]; ok {
+			r = base
+		}
+		runes[i] = r
+	}
+	return runes
+}
+
+// searchMatch ranks a title and body by the words of a search, all of which
+// must appear in them, ranking words in the title higher as Postgres does.
+// It returns 0 if they do not match, and otherwise the rank and the text with
+// the words marked.
+func searchMatch(words []string, title, body string) (float64, string) {
+	text := title
+	if title != "" && body != "" {
+		text += " "
+	}
+	text += body
+	folded := searchFold(text)
+	titleLen := len([]rune(title))
+
+	marked := make([]bool, len(folded))
+	rank := 0.0
+	for _, word := range words {
+		w := []rune(word)
+		inTitle, found := false, false
+		for i := 0; i+len(w) <= len(folded); i++ {
+			if string(folded[i:i+len(w)]) != word {
+				continue
+			}
+			found = true
+			inTitle = inTitle || i < titleLen
+			for j := i; j < i+len(w); j++ {
+				marked[j] = true
+			}
+		}
+
+		switch {
+		case !found:
+			return 0, ""
+		case inTitle:
+			rank += 1
+		default:
+			rank += 0.4
+		}
+	}
+
+	var highlight strings.Builder
+	for i, r := range []rune(text) {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			highlight.WriteString(searchMarkStart)
+		}
+		highlight.WriteRune(r)
+		if marked[i] && (i == len(marked)-1 || !marked[i+1]) {
+			highlight.WriteString(searchMarkStop)
+		}
+	}
+
+	return rank / float64(len(words)), highlight.String()
+}
+
+// greatCircleDistance returns the distance in metres between two coordinates.
+func greatCircleDistance(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadius = 6371 * 1000
+
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLng := (lng2 - lng1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
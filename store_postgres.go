@@ -0,0 +1,15 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// pgStore implements every store on top of Postgres, with view counts and
+// activity check times kept in Redis.
+type pgStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(db *sql.DB) *pgStore {
+	return &pgStore{db: db}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Broker channels for new activities and comments
+const activitiesChannel = "activities"
+
+func hoopCommentsChannel(hoopID int64) string {
+	return fmt.Sprintf("hoop:%d:comments", hoopID)
+}
+
+func storyCommentsChannel(storyID int64) string {
+	return fmt.Sprintf("story:%d:comments", storyID)
+}
+
+// Streams send a comment line this often so that proxies keep idle
+// connections open.
+const StreamHeartbeatInterval = 30 * time.Second
+
+// streamActivity publishes a new activity to streams.
+func streamActivity(payload []byte) error {
+	var activity Activity
+	if err := json.Unmarshal(payload, &activity); err != nil {
+		return err
+	}
+
+	activity.fetchData(store.Users, store.Hoops, store.Stories)
+
+	data, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	return broker.Publish(activitiesChannel, data)
+}
+
+// streamComment publishes a new comment to the streams of its hoop or story.
+// Comments look the same as in the comment lists.
+func streamComment(payload []byte) error {
+	var comment Comment
+	if err := json.Unmarshal(payload, &comment); err != nil {
+		return err
+	}
+
+	user, err := store.Users.GetUser(comment.UserID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var channel string
+	if comment.StoryID != 0 {
+		comment.User = user
+		channel = storyCommentsChannel(comment.StoryID)
+	} else {
+		comment.Data = map[string]interface{}{"user": user}
+		channel = hoopCommentsChannel(comment.HoopID)
+	}
+
+	data, err := json.Marshal(comment)
+	if err != nil {
+		return err
+	}
+
+	return broker.Publish(channel, data)
+}
+
+// streamedActivity holds the fields of a published activity that decide
+// whose feed it belongs to.
+type streamedActivity struct {
+	UserID int64 `json:"user_id"`
+	HoopID int64 `json:"hoop_id"`
+	Data   struct {
+		Story struct {
+			HoopID int64 `json:"hoop_id"`
+		} `json:"story"`
+	} `json:"data"`
+}
+
+// inFeed reports whether a published activity belongs in the user's
+// activity feed of the given scope, as GetActivities and
+// GetFollowingActivities would list it.
+func inFeed(user *User, scope string, data []byte) (bool, error) {
+	var activity streamedActivity
+	if err := json.Unmarshal(data, &activity); err != nil {
+		return false, err
+	}
+
+	if activity.UserID == user.ID {
+		return false, nil
+	} else if scope != "following" {
+		return true, nil
+	}
+
+	if following, err := store.Follows.IsFollowing(user.ID, activity.UserID); err != nil || following {
+		return following, err
+	}
+
+	hoopID := activity.HoopID
+	if hoopID == 0 {
+		hoopID = activity.Data.Story.HoopID
+	}
+	return store.Follows.IsFollowingHoop(user.ID, hoopID)
+}
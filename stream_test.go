@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type streamEvent struct {
+	name string
+	data string
+}
+
+// stream opens an event stream and returns its events until the test ends.
+func (c *testClient) stream(p params) <-chan streamEvent {
+	c.t.Helper()
+
+	query := url.Values{}
+	for name, value := range p {
+		query.Set(name, value.(string))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.server.URL+"/api/stream?"+query.Encode(), nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	} else if res.StatusCode != http.StatusOK {
+		c.t.Fatalf("GET /api/stream: %d", res.StatusCode)
+	} else if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		c.t.Fatalf("stream of %s", ct)
+	}
+
+	events := make(chan streamEvent, 16)
+	go func() {
+		defer res.Body.Close()
+
+		var event streamEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			switch line := scanner.Text(); {
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event.name != "":
+				events <- event
+				event = streamEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent returns the next event of the stream.
+func nextEvent(t *testing.T, events <-chan streamEvent) streamEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event streamed")
+		return streamEvent{}
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := newTestServer(t)
+	juan := newTestClient(t, server)
+	juanUser := juan.signup("Juan")
+	pedro := newTestClient(t, server)
+	pedroUser := pedro.signup("Pedro")
+	hoop := juan.createHoop("Tondo Court")
+
+	newTestClient(t, server).fails("GET", "/api/stream", nil, http.StatusForbidden)
+	juan.fails("GET", "/api/stream", params{"scope": "friends"}, http.StatusBadRequest)
+	juan.fails("GET", "/api/stream", params{"scope": "none"}, http.StatusBadRequest)
+	juan.fails("GET", "/api/stream", params{"hoop_id": "first"}, http.StatusBadRequest)
+
+	events := juan.stream(params{"hoop_id": itoa(hoop.ID)})
+
+	// The user's own activities stay out of their stream, but comments on
+	// the hoop are streamed whoever posts them
+	juan.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Nice court"}, nil)
+	pedro.ok("POST", "/api/comment/hoop", params{"hoop_id": hoop.ID, "text": "Agreed"}, nil)
+	runJobs(t)
+
+	for _, want := range []struct{ name, text string }{{"comment", "Nice court"}, {"comment", "Agreed"}, {"activity", ""}} {
+		event := nextEvent(t, events)
+		if event.name != want.name {
+			t.Fatalf("%s event, want %s: %s", event.name, want.name, event.data)
+		}
+
+		if event.name == "comment" {
+			var comment Comment
+			if err := json.Unmarshal([]byte(event.data), &comment); err != nil {
+				t.Fatal(err)
+			}
+			if comment.Text != want.text || comment.HoopID != hoop.ID || comment.Data["user"] == nil {
+				t.Errorf("comment %s", event.data)
+			}
+		} else {
+			var activity Activity
+			if err := json.Unmarshal([]byte(event.data), &activity); err != nil {
+				t.Fatal(err)
+			}
+			if activity.UserID != pedroUser.ID || activity.Type != ACTIVITY_POST_COMMENT_HOOP {
+				t.Errorf("activity %s", event.data)
+			}
+		}
+	}
+
+	// A following stream only has the activities of the following feed
+	maria := newTestClient(t, server)
+	maria.signup("Maria")
+	maria.ok("POST", "/api/follow", params{"user_id": juanUser.ID}, nil)
+	following := maria.stream(params{"scope": "following"})
+
+	pedro.createStory(hoop.ID, "Pedro's game")
+	juan.createStory(hoop.ID, "Juan's game")
+	runJobs(t)
+
+	var activity Activity
+	if err := json.Unmarshal([]byte(nextEvent(t, following).data), &activity); err != nil {
+		t.Fatal(err)
+	}
+	if activity.UserID != juanUser.ID || activity.Type != ACTIVITY_POST_STORY {
+		t.Errorf("following stream got %+v", activity)
+	}
+
+	// Story comments are streamed by story
+	third := juan.createStory(hoop.ID, "Third game")
+	stories := pedro.stream(params{"scope": "none", "story_id": itoa(third.ID)})
+	juan.ok("PATCH", "/api/comment/story", params{"story_id": third.ID, "text": "Good game"}, nil)
+	runJobs(t)
+	if event := nextEvent(t, stories); event.name != "comment" || !strings.Contains(event.data, "Good game") {
+		t.Errorf("story stream got %s %s", event.name, event.data)
+	}
+}
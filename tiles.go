@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Map tiles are numbered as in web maps, from 0/0/0 for the whole world down
+// to TileMaxZoom. Vector tiles place their markers in TileExtent units from
+// the top left of the tile.
+const (
+	TileMaxZoom = 22
+	TileExtent  = 4096
+)
+
+// Media types of tiles
+const (
+	GeoJSONContentType = "application/geo+json"
+	MVTContentType     = "application/vnd.mapbox-vector-tile"
+)
+
+type tile struct {
+	z, x, y int
+}
+
+// box returns the area of the map the tile covers.
+func (t tile) box() Box {
+	n := float64(int64(1) << uint(t.z))
+	latitude := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+
+	return Box{
+		South: latitude(t.y + 1),
+		West:  float64(t.x)/n*360 - 180,
+		North: latitude(t.y),
+		East:  float64(t.x+1)/n*360 - 180,
+	}
+}
+
+// point returns the position of the location in the tile.
+func (t tile) point(latitude, longitude float64) (x, y int64) {
+	n := float64(int64(1) << uint(t.z))
+	phi := latitude * math.Pi / 180
+
+	worldX := (longitude + 180) / 360 * n
+	worldY := (1 - math.Log(math.Tan(phi)+1/math.Cos(phi))/math.Pi) / 2 * n
+
+	return int64(math.Round((worldX - float64(t.x)) * TileExtent)), int64(math.Round((worldY - float64(t.y)) * TileExtent))
+}
+
+// tileHandler serves the hoops of a map tile as markers: the clusters of
+// GetHoopClusters at the zoom level of the tile. Tiles may be cached, but are
+// revalidated on every use with their ETag, which is the version of the hoops
+// and so changes whenever any hoop does. A tile that is still current is
+// answered without querying its hoops. The version being global means that
+// any hoop write invalidates every tile; see CREATE_HOOPS_VERSION_TABLE_SQL.
+func tileHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		req := tileRequest{Format: "geojson"}
+		if err := bind(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		version, err := store.Hoops.HoopsVersion()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%d-%s"`, version, req.Format)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, no-cache")
+
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		t := tile{z: req.Z, x: req.X, y: req.Y}
+		clusters, err := store.Hoops.GetHoopClusters(t.box(), t.z)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var data []byte
+		var contentType string
+		switch req.Format {
+		case "mvt":
+			data, contentType = encodeMVT(t, clusters), MVTContentType
+		default:
+			if data, err = encodeGeoJSON(clusters); err != nil {
+				writeError(w, err)
+				return
+			}
+			contentType = GeoJSONContentType
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+	default:
+		writeError(w, ErrMethodNotAllowed)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	ID       int64  `json:"id,omitempty"`
+	Geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// encodeGeoJSON encodes the clusters as a feature collection of points, with
+// the count of each and the ID of a single hoop.
+func encodeGeoJSON(clusters []HoopCluster) ([]byte, error) {
+	features := make([]geoJSONFeature, len(clusters))
+	for i, cluster := range clusters {
+		feature := &features[i]
+		feature.Type = "Feature"
+		feature.ID = cluster.HoopID
+		feature.Geometry.Type = "Point"
+		feature.Geometry.Coordinates = [2]float64{cluster.Longitude, cluster.Latitude}
+		feature.Properties = map[string]interface{}{"count": cluster.Count}
+		if cluster.HoopID != 0 {
+			feature.Properties["hoop_id"] = cluster.HoopID
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	})
+}
+
+// encodeMVT encodes the clusters as a Mapbox vector tile with a layer of
+// points named hoops, with the same properties as encodeGeoJSON.
+func encodeMVT(t tile, clusters []HoopCluster) []byte {
+	const (
+		countKey = iota
+		hoopIDKey
+	)
+
+	// Values are listed once, and features refer to them by index
+	var values []int64
+	index := make(map[int64]uint32)
+	value := func(v int64) uint32 {
+		i, ok := index[v]
+		if !ok {
+			i = uint32(len(values))
+			index[v] = i
+			values = append(values, v)
+		}
+		return i
+	}
+
+	var layer protobuf
+	layer.uintField(15, 2) // version
+	layer.stringField(1, "hoops")
+
+	for _, cluster := range clusters {
+		var feature protobuf
+		tags := []uint32{countKey, value(cluster.Count)}
+		if cluster.HoopID != 0 {
+			feature.uintField(1, uint64(cluster.HoopID))
+			tags = append(tags, hoopIDKey, value(cluster.HoopID))
+		}
+		feature.packedField(2, tags)
+		feature.uintField(3, 1) // point
+
+		// A single move to the point, from the origin of the tile
+		x, y := t.point(cluster.Latitude, cluster.Longitude)
+		feature.packedField(4, []uint32{1<<3 | 1, zigzag(x), zigzag(y)})
+
+		layer.bytesField(2, feature)
+	}
+
+	layer.stringField(3, "count")
+	layer.stringField(3, "hoop_id")
+	for _, v := range values {
+		var encoded protobuf
+		encoded.uintField(5, uint64(v))
+		layer.bytesField(4, encoded)
+	}
+	layer.uintField(5, TileExtent)
+
+	var message protobuf
+	message.bytesField(3, layer)
+	return message
+}
+
+// protobuf is a message in the protocol buffer encoding. Its field methods
+// add fields with the given numbers.
+type protobuf []byte
+
+func (p *protobuf) varint(v uint64) {
+	for v >= 0x80 {
+		*p = append(*p, byte(v)|0x80)
+		v >>= 7
+	}
+	*p = append(*p, byte(v))
+}
+
+func (p *protobuf) uintField(field int, v uint64) {
+	p.varint(uint64(field)<<3 | 0)
+	p.varint(v)
+}
+
+func (p *protobuf) bytesField(field int, b []byte) {
+	p.varint(uint64(field)<<3 | 2)
+	p.varint(uint64(len(b)))
+	*p = append(*p, b...)
+}
+
+func (p *protobuf) stringField(field int, s string) {
+	p.bytesField(field, []byte(s))
+}
+
+func (p *protobuf) packedField(field int, vs []uint32) {
+	var values protobuf
+	for _, v := range vs {
+		values.varint(uint64(v))
+	}
+	p.bytesField(field, values)
+}
+
+// zigzag encodes a signed coordinate as vector tiles expect.
+func zigzag(n int64) uint32 {
+	return uint32((n << 1) ^ (n >> 63))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// clusterCountingHoops counts the queries for the hoops of tiles.
+type clusterCountingHoops struct {
+	HoopStore
+	queries int
+}
+
+func (h *clusterCountingHoops) GetHoopClusters(box Box, zoom int) ([]HoopCluster, error) {
+	h.queries++
+	return h.HoopStore.GetHoopClusters(box, zoom)
+}
+
+func TestTileETag(t *testing.T) {
+	server := newTestServer(t)
+	hoops := &clusterCountingHoops{HoopStore: store.Hoops}
+	store.Hoops = hoops
+
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	get := func(path, etag string) (int, string) {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if cacheControl := res.Header.Get("Cache-Control"); cacheControl != "public, no-cache" {
+			t.Errorf("Cache-Control %q", cacheControl)
+		}
+		return res.StatusCode, res.Header.Get("ETag")
+	}
+
+	// The whole world, on which every hoop is
+	status, etag := get("/api/v2/tiles/0/0/0.geojson", "")
+	if status != http.StatusOK || etag == "" {
+		t.Fatalf("got %d with ETag %q", status, etag)
+	}
+
+	// Tiles that have not changed are not queried again
+	queries := hoops.queries
+	if status, _ := get("/api/v2/tiles/0/0/0.geojson", etag); status != http.StatusNotModified {
+		t.Errorf("unchanged tile: %d", status)
+	}
+	if status, _ := get("/api/tile?z=1&x=1&y=0", etag); status != http.StatusNotModified {
+		t.Errorf("unchanged tile of the original API: %d", status)
+	}
+	if hoops.queries != queries {
+		t.Errorf("%d queries for unchanged tiles", hoops.queries-queries)
+	}
+
+	// Nor is a vector tile the same as GeoJSON
+	if _, mvt := get("/api/v2/tiles/0/0/0.mvt", ""); mvt == etag {
+		t.Errorf("vector tile has the GeoJSON ETag %s", etag)
+	}
+
+	// Every change to hoops changes the ETag
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"adding", func() {
+			c.createHoop("Quiapo Court")
+		}},
+		{"updating", func() {
+			c.ok("PATCH", "/api/hoop", params{"hoop_id": hoop.ID, "latitude": 10.3157}, nil)
+		}},
+		{"merging", func() {
+			duplicate := c.createHoop("Tondo Court 2")
+			status, etag = get("/api/v2/tiles/0/0/0.geojson", "")
+			if err := store.Hoops.MergeHoops(duplicate.ID, hoop.ID); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"deleting", func() {
+			c.ok("DELETE", "/api/hoop", params{"hoop_id": hoop.ID}, nil)
+		}},
+	}
+	for _, change := range changes {
+		change.change()
+
+		status, changed := get("/api/v2/tiles/0/0/0.geojson", etag)
+		if status != http.StatusOK || changed == etag {
+			t.Errorf("%s a hoop: got %d with ETag %s", change.name, status, changed)
+		}
+		etag = changed
+	}
+}
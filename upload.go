@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// Uploads that nothing refers to are deleted once they have not been used
+// for UploadGracePeriod. The grace period leaves time for an upload to be
+// saved with its story or user after it is stored.
+const (
+	UploadGracePeriod   = time.Hour
+	UploadSweepInterval = 10 * time.Minute
+	uploadSweepBatch    = 100
+)
+
+// storeUpload stores data under a name derived from its content, so that
+// identical uploads share one blob, and returns its URL.
+//
+// The upload is claimed first, which keeps the sweeper from deleting its
+// blob for the grace period. The blob is then put even if it already
+// exists: the content is the same, so putting it again is harmless, and the
+// URL is only returned once this upload's own put has succeeded. An
+// identical upload still being put, or one whose put failed or never
+// happened, cannot leave it pointing at a missing blob.
+func storeUpload(data []byte, ext, contentType string) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:]) + ext
+	url := blobs.URL(key)
+
+	if err := store.Uploads.ClaimUpload(key, url); err != nil {
+		return "", err
+	}
+
+	if err := blobs.Put(key, bytes.NewReader(data), contentType); err != nil {
+		return "", err
+	}
+
+	return url, nil
+}
+
+// sweepUploads deletes orphaned uploads every interval until the process
+// exits.
+func sweepUploads(interval time.Duration) {
+	for {
+		if n, err := sweepOrphanedUploads(time.Now().Add(-UploadGracePeriod)); err != nil {
+			log.Println("sweep uploads:", err)
+		} else if n > 0 {
+			log.Printf("Swept %d orphaned uploads", n)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func sweepOrphanedUploads(before time.Time) (int, error) {
+	swept := 0
+
+	for {
+		keys, err := store.Uploads.OrphanedUploads(before, uploadSweepBatch)
+		if err != nil {
+			return swept, err
+		}
+
+		for _, key := range keys {
+			deleted, err := store.Uploads.DeleteOrphanedUpload(key, before, func() error {
+				return blobs.Delete(key)
+			})
+			if err != nil {
+				return swept, err
+			} else if deleted {
+				swept++
+			}
+		}
+
+		if len(keys) < uploadSweepBatch {
+			return swept, nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingBlobStore fails every put while failing is set.
+type failingBlobStore struct {
+	BlobStore
+	failing bool
+}
+
+var errTestPut = errors.New("put failed")
+
+func (s *failingBlobStore) Put(key string, r io.Reader, contentType string) error {
+	if s.failing {
+		return errTestPut
+	}
+	return s.BlobStore.Put(key, r, contentType)
+}
+
+// blobExists reports whether the blob at the URL is stored.
+func blobExists(t *testing.T, url string) bool {
+	r, err := blobs.Get(strings.TrimPrefix(url, ContentPath+"/"))
+	if err == ErrBlobNotFound {
+		return false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	return true
+}
+
+func TestUploadDeduplicated(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	image := testJPEG(t, 1000, 500, 0)
+	first := c.uploadStory(hoop.ID, image)
+	second := c.uploadStory(hoop.ID, image)
+	if first != second {
+		t.Errorf("identical uploads stored as %+v and %+v", first, second)
+	}
+
+	// Names are the content's hash, which URLs need not escape
+	name := regexp.MustCompile("^" + ContentPath + "/[0-9a-f]{64}\\.jpg$")
+	for _, url := range first.urls() {
+		if !name.MatchString(url) {
+			t.Errorf("uploaded to %s", url)
+		}
+	}
+
+	files, err := ioutil.ReadDir(config.ContentDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != len(imageVariants) {
+		t.Errorf("%d files stored for two identical uploads", len(files))
+	}
+}
+
+func TestUploadFailedPut(t *testing.T) {
+	newTestServer(t)
+	failing := &failingBlobStore{BlobStore: blobs, failing: true}
+	blobs = failing
+
+	data := []byte("an image")
+	if _, err := storeUpload(data, ".jpg", "image/jpeg"); err != errTestPut {
+		t.Fatalf("upload with a failing put: %v", err)
+	}
+
+	// The identical upload that follows is stored, whatever became of the
+	// first one
+	failing.failing = false
+	url, err := storeUpload(data, ".jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists(t, url) {
+		t.Error("blob is missing after the second upload")
+	}
+
+	// As is one claimed by a server that stopped before putting the blob
+	crashed := []byte("another image")
+	sum := sha256.Sum256(crashed)
+	key := hex.EncodeToString(sum[:]) + ".jpg"
+	if err := store.Uploads.ClaimUpload(key, blobs.URL(key)); err != nil {
+		t.Fatal(err)
+	}
+	if url, err := storeUpload(crashed, ".jpg", "image/jpeg"); err != nil {
+		t.Fatal(err)
+	} else if url != blobs.URL(key) || !blobExists(t, url) {
+		t.Errorf("blob %s is missing after an upload that was claimed before", url)
+	}
+}
+
+func TestSweepOrphanedUploads(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.signup("Juan")
+	hoop := c.createHoop("Tondo Court")
+
+	used := c.uploadStory(hoop.ID, testJPEG(t, 100, 50, 0))
+	orphan, err := storeUpload([]byte("an image nothing uses"), ".jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads are kept for the grace period, and while anything uses them
+	if n, err := sweepOrphanedUploads(time.Now().Add(-UploadGracePeriod)); err != nil || n != 0 {
+		t.Fatalf("swept %d uploads within the grace period: %v", n, err)
+	}
+	if n, err := sweepOrphanedUploads(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("swept %d uploads, want 1: %v", n, err)
+	}
+
+	if blobExists(t, orphan) {
+		t.Error("orphaned blob was not deleted")
+	}
+	for _, url := range used.urls() {
+		if !blobExists(t, url) {
+			t.Errorf("blob %s of a story was deleted", url)
+		}
+	}
+}